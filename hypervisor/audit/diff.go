@@ -0,0 +1,110 @@
+package audit
+
+import (
+	"encoding/json"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const redacted = "[redacted]"
+
+// Fields whose values never reach the log, matched on the last segment of the path
+var sensitiveFields = []string{"secret", "password", "token"}
+
+// Change is a field of a manifest or body, Old or New is nil when the field is added or removed
+type Change struct {
+	Field string `json:"field"`
+	Old   any    `json:"old"`
+	New   any    `json:"new"`
+}
+
+// flatten maps every leaf of a json document to its dotted path, e.g. "hypervisor_config.cpus.boot_vcpus"
+func flatten(prefix string, value any, out map[string]any) {
+	switch typed := value.(type) {
+	case map[string]any:
+		for key, child := range typed {
+			flatten(join(prefix, key), child, out)
+		}
+	case []any:
+		for i, child := range typed {
+			flatten(join(prefix, strconv.Itoa(i)), child, out)
+		}
+	default:
+		if prefix != "" {
+			out[prefix] = value
+		}
+	}
+}
+
+func join(prefix string, key string) string {
+	if prefix == "" {
+		return key
+	}
+	return prefix + "." + key
+}
+
+func decode(document []byte) (map[string]any, error) {
+	var fields map[string]any = make(map[string]any)
+	if len(strings.TrimSpace(string(document))) == 0 {
+		return fields, nil
+	}
+	var value any
+	err := json.Unmarshal(document, &value)
+	if err != nil {
+		return nil, err
+	}
+	flatten("", value, fields)
+	return fields, nil
+}
+
+func sensitive(field string) bool {
+	var last string = strings.ToLower(field[strings.LastIndex(field, ".")+1:])
+	for _, name := range sensitiveFields {
+		if strings.Contains(last, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Diff lists the fields that differ between two json documents sorted by path,
+// an empty document stands for a resource that does not exist
+func Diff(before []byte, after []byte) ([]Change, error) {
+	old, err := decode(before)
+	if err != nil {
+		return nil, err
+	}
+	current, err := decode(after)
+	if err != nil {
+		return nil, err
+	}
+	var fields []string = make([]string, 0, len(old)+len(current))
+	for field := range old {
+		fields = append(fields, field)
+	}
+	for field := range current {
+		if _, ok := old[field]; !ok {
+			fields = append(fields, field)
+		}
+	}
+	sort.Strings(fields)
+	var changes []Change = make([]Change, 0)
+	for _, field := range fields {
+		var change Change = Change{Field: field, Old: old[field], New: current[field]}
+		if reflect.DeepEqual(change.Old, change.New) {
+			continue
+		}
+		if sensitive(field) {
+			if change.Old != nil {
+				change.Old = redacted
+			}
+			if change.New != nil {
+				change.New = redacted
+			}
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
@@ -0,0 +1,29 @@
+package audit
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Diff(t *testing.T) {
+	changes, err := Diff(
+		[]byte(`{"name":"web","cpus":{"boot_vcpus":2},"labels":{"env":"dev"},"api_token":"a"}`),
+		[]byte(`{"name":"web","cpus":{"boot_vcpus":4},"labels":{"team":"ops"},"api_token":"b"}`),
+	)
+	assert.Nil(t, err)
+	assert.Equal(t, []Change{
+		{Field: "api_token", Old: redacted, New: redacted},
+		{Field: "cpus.boot_vcpus", Old: float64(2), New: float64(4)},
+		{Field: "labels.env", Old: "dev", New: nil},
+		{Field: "labels.team", Old: nil, New: "ops"},
+	}, changes)
+
+	// A new resource has every field added
+	changes, err = Diff(nil, []byte(`{"tenant":"t","disks":["a"]}`))
+	assert.Nil(t, err)
+	assert.Equal(t, []Change{{Field: "disks.0", New: "a"}, {Field: "tenant", New: "t"}}, changes)
+
+	_, err = Diff([]byte(`{`), nil)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,372 @@
+package audit
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	RESULT_SUCCESS = "success"
+	RESULT_DENIED  = "denied"
+	RESULT_FAILURE = "failure"
+)
+
+// Previous hash of the first record
+var genesisHash = strings.Repeat("0", sha256.Size*2)
+
+// Lines longer than this are not audit records
+const maxRecordSize = 4 * 1024 * 1024
+
+// Record is one api request. Hash covers the line up to the hash field,
+// which includes PrevHash, so a record cannot change without breaking the chain after it
+type Record struct {
+	Seq        uint64    `json:"seq"`
+	Time       time.Time `json:"time"`
+	Principal  string    `json:"principal,omitempty"`
+	AuthMethod string    `json:"auth_method,omitempty"`
+	TokenId    string    `json:"token_id,omitempty"`
+	Tenant     string    `json:"tenant,omitempty"`
+	Method     string    `json:"method"`
+	Route      string    `json:"route"`
+	Path       string    `json:"path"`
+	Target     string    `json:"target,omitempty"`
+	Diff       []Change  `json:"diff,omitempty"`
+	Status     int       `json:"status"`
+	Result     string    `json:"result"`
+	Error      string    `json:"error,omitempty"`
+	LatencyMs  float64   `json:"latency_ms"`
+	PrevHash   string    `json:"prev_hash"`
+	Hash       string    `json:"hash,omitempty"`
+}
+
+// head is the last record written, kept apart from the log so a truncated log is detected
+type head struct {
+	Seq  uint64 `json:"seq"`
+	Hash string `json:"hash"`
+}
+
+func chainHash(prevHash string, body []byte) string {
+	hash := sha256.New()
+	hash.Write([]byte(prevHash))
+	hash.Write([]byte{'\n'})
+	hash.Write(body)
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// encodeRecord returns the line of the record, the hash is appended as the last field
+func encodeRecord(record *Record) ([]byte, error) {
+	record.Hash = ""
+	body, err := json.Marshal(record)
+	if err != nil {
+		return nil, err
+	}
+	record.Hash = chainHash(record.PrevHash, body)
+	var line []byte = append(body[:len(body)-1:len(body)-1], []byte(fmt.Sprintf(",\"hash\":%q}\n", record.Hash))...)
+	return line, nil
+}
+
+// recordBody strips the hash field appended by encodeRecord
+func recordBody(line []byte) ([]byte, bool) {
+	index := bytes.LastIndex(line, []byte(",\"hash\":\""))
+	if index < 0 {
+		return nil, false
+	}
+	return append(line[:index:index], '}'), true
+}
+
+type Log struct {
+	path     string
+	headPath string
+	file     *os.File
+	size     int64
+	seq      uint64
+	hash     string
+	mu       sync.Mutex
+}
+
+// OpenLog continues the chain of an existing log. A partial last line left by a crash is dropped
+func OpenLog(path string) (*Log, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	var log *Log = &Log{
+		path:     path,
+		headPath: path + ".head",
+		file:     file,
+		hash:     genesisHash,
+	}
+	line, end, err := lastLine(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	err = file.Truncate(end)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	log.size = end
+	if line != nil {
+		var record Record
+		err = json.Unmarshal(line, &record)
+		if err != nil {
+			file.Close()
+			return nil, fmt.Errorf("unable to read last audit record: %w", err)
+		}
+		log.seq, log.hash = record.Seq, record.Hash
+	}
+	_, err = file.Seek(0, io.SeekEnd)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return log, nil
+}
+
+// lastLine returns the last complete line without its newline and the offset after it
+func lastLine(file *os.File) ([]byte, int64, error) {
+	stat, err := file.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	var size int64 = stat.Size()
+	var block int64 = 64 * 1024
+	var tail []byte
+	for offset := size; offset > 0; {
+		var start int64 = max(offset-block, 0)
+		var buffer []byte = make([]byte, offset-start)
+		_, err = file.ReadAt(buffer, start)
+		if err != nil {
+			return nil, 0, err
+		}
+		tail = append(buffer, tail...)
+		offset = start
+		// The end is the last newline, the line starts after the newline before it
+		end := bytes.LastIndexByte(tail, '\n')
+		if end < 0 {
+			if offset == 0 {
+				return nil, 0, nil
+			}
+			continue
+		}
+		begin := bytes.LastIndexByte(tail[:end], '\n')
+		if begin < 0 && offset > 0 && int64(len(tail)) < maxRecordSize {
+			continue
+		}
+		return tail[begin+1 : end], start + int64(end) + 1, nil
+	}
+	return nil, 0, nil
+}
+
+func (l *Log) writeHead() error {
+	content, err := json.Marshal(head{Seq: l.seq, Hash: l.hash})
+	if err != nil {
+		return err
+	}
+	var tmp string = l.headPath + ".tmp"
+	err = os.WriteFile(tmp, content, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, l.headPath)
+}
+
+// Append sets the sequence and the hashes of the record and writes it durably
+func (l *Log) Append(record *Record) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return errors.New("audit log is closed")
+	}
+	record.Seq = l.seq + 1
+	record.PrevHash = l.hash
+	line, err := encodeRecord(record)
+	if err != nil {
+		return err
+	}
+	_, err = l.file.Write(line)
+	if err == nil {
+		err = l.file.Sync()
+	}
+	if err != nil {
+		// A partial record would break the chain of the next ones
+		l.file.Truncate(l.size)
+		l.file.Seek(l.size, io.SeekStart)
+		return err
+	}
+	l.size += int64(len(line))
+	l.seq, l.hash = record.Seq, record.Hash
+	return l.writeHead()
+}
+
+// Query filter, empty fields match everything. After is the sequence of the last record already seen
+type Query struct {
+	From      time.Time
+	To        time.Time
+	Principal string
+	Tenant    string
+	Target    string
+	Result    string
+	After     uint64
+	Limit     int
+}
+
+func (q *Query) matches(record *Record) bool {
+	if record.Seq <= q.After {
+		return false
+	}
+	if !q.From.IsZero() && record.Time.Before(q.From) {
+		return false
+	}
+	if !q.To.IsZero() && !record.Time.Before(q.To) {
+		return false
+	}
+	if q.Principal != "" && record.Principal != q.Principal {
+		return false
+	}
+	if q.Tenant != "" && !strings.EqualFold(record.Tenant, q.Tenant) {
+		return false
+	}
+	if q.Target != "" && !strings.EqualFold(record.Target, q.Target) {
+		return false
+	}
+	return q.Result == "" || record.Result == q.Result
+}
+
+// Query returns matching records in log order, at most Limit of them
+func (l *Log) Query(query Query) ([]Record, error) {
+	file, err := os.Open(l.path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	var records []Record = make([]Record, 0)
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), maxRecordSize)
+	for scanner.Scan() {
+		var record Record
+		err = json.Unmarshal(scanner.Bytes(), &record)
+		if err != nil {
+			// A line being written is incomplete
+			continue
+		}
+		if !query.matches(&record) {
+			continue
+		}
+		records = append(records, record)
+		if query.Limit > 0 && len(records) >= query.Limit {
+			break
+		}
+	}
+	return records, scanner.Err()
+}
+
+func (l *Log) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
+
+type ErrChainBroken struct {
+	Seq    uint64
+	Reason string
+}
+
+func (e *ErrChainBroken) Error() string {
+	return fmt.Sprintf("audit chain broken at record %d: %s", e.Seq, e.Reason)
+}
+
+type VerifyResult struct {
+	Records  uint64
+	LastHash string
+}
+
+// readHead returns false when the log has no head yet
+func readHead(path string) (head, bool, error) {
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return head{}, false, nil
+	}
+	if err != nil {
+		return head{}, false, err
+	}
+	var last head
+	err = json.Unmarshal(content, &last)
+	if err != nil {
+		return head{}, false, fmt.Errorf("unable to read audit head: %w", err)
+	}
+	return last, true, nil
+}
+
+// Verify recomputes the chain of the log at path and checks it against its head.
+// Edits break the hash of the record, removed records break the chain or leave the head ahead of the log
+func Verify(path string) (VerifyResult, error) {
+	var result VerifyResult = VerifyResult{LastHash: genesisHash}
+	last, hasHead, err := readHead(path + ".head")
+	if err != nil {
+		return result, err
+	}
+	file, err := os.Open(path)
+	if err != nil {
+		return result, err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), maxRecordSize)
+	for scanner.Scan() {
+		var expected uint64 = result.Records + 1
+		var record Record
+		err = json.Unmarshal(scanner.Bytes(), &record)
+		if err != nil {
+			return result, &ErrChainBroken{Seq: expected, Reason: "record is not valid json"}
+		}
+		if record.Seq != expected {
+			return result, &ErrChainBroken{Seq: expected, Reason: fmt.Sprintf("found record %d", record.Seq)}
+		}
+		if record.PrevHash != result.LastHash {
+			return result, &ErrChainBroken{Seq: expected, Reason: "previous hash does not match"}
+		}
+		body, ok := recordBody(scanner.Bytes())
+		if !ok || chainHash(record.PrevHash, body) != record.Hash {
+			return result, &ErrChainBroken{Seq: expected, Reason: "record was modified"}
+		}
+		if hasHead && record.Seq == last.Seq && record.Hash != last.Hash {
+			return result, &ErrChainBroken{Seq: expected, Reason: "head hash does not match"}
+		}
+		result.Records, result.LastHash = record.Seq, record.Hash
+	}
+	if err := scanner.Err(); err != nil {
+		return result, err
+	}
+
+	if !hasHead {
+		if result.Records == 0 {
+			return result, nil
+		}
+		return result, &ErrChainBroken{Seq: result.Records, Reason: "head file is missing"}
+	}
+	if last.Seq > result.Records {
+		return result, &ErrChainBroken{Seq: result.Records + 1, Reason: fmt.Sprintf("log is truncated, head is at record %d", last.Seq)}
+	}
+	// The head is written after the record, a crash in between leaves it one record behind
+	if last.Seq+1 < result.Records {
+		return result, &ErrChainBroken{Seq: last.Seq + 1, Reason: "records were appended after the head"}
+	}
+	return result, nil
+}
@@ -0,0 +1,126 @@
+package audit
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func appendRecords(t *testing.T, path string, first int, count int) {
+	log, err := OpenLog(path)
+	assert.Nil(t, err)
+	var start time.Time = time.Unix(1700000000, 0).UTC()
+	for i := first; i < first+count; i++ {
+		err = log.Append(&Record{
+			Time:      start.Add(time.Duration(i) * time.Minute),
+			Principal: "ci",
+			Tenant:    "tenant-" + string(rune('a'+i%2)),
+			Method:    "PUT",
+			Route:     "/api/vm/:vm/boot",
+			Path:      "/api/vm/web/boot",
+			Status:    200,
+			Result:    RESULT_SUCCESS,
+		})
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, log.Close())
+}
+
+func Test_Log_Append(t *testing.T) {
+	var path string = filepath.Join(t.TempDir(), "audit.log")
+	appendRecords(t, path, 0, 3)
+	// The chain continues after a restart
+	appendRecords(t, path, 3, 2)
+
+	log, err := OpenLog(path)
+	assert.Nil(t, err)
+	defer log.Close()
+	records, err := log.Query(Query{})
+	assert.Nil(t, err)
+	assert.Len(t, records, 5)
+	for i, record := range records {
+		assert.Equal(t, uint64(i+1), record.Seq)
+		if i > 0 {
+			assert.Equal(t, records[i-1].Hash, record.PrevHash)
+		}
+	}
+	assert.Equal(t, genesisHash, records[0].PrevHash)
+
+	records, err = log.Query(Query{Tenant: "tenant-a", After: 1, Limit: 1})
+	assert.Nil(t, err)
+	assert.Len(t, records, 1)
+	assert.Equal(t, uint64(3), records[0].Seq)
+
+	records, err = log.Query(Query{From: time.Unix(1700000060, 0), To: time.Unix(1700000180, 0)})
+	assert.Nil(t, err)
+	assert.Len(t, records, 2)
+
+	result, err := Verify(path)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(5), result.Records)
+	assert.Equal(t, uint64(3), records[1].Seq)
+	assert.NotEqual(t, genesisHash, result.LastHash)
+}
+
+func Test_OpenLog_PartialLine(t *testing.T) {
+	var path string = filepath.Join(t.TempDir(), "audit.log")
+	appendRecords(t, path, 0, 2)
+	file, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0600)
+	assert.Nil(t, err)
+	file.WriteString(`{"seq":3,"time":`)
+	file.Close()
+
+	appendRecords(t, path, 2, 1)
+	result, err := Verify(path)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(3), result.Records)
+}
+
+func Test_Verify(t *testing.T) {
+	var errChain *ErrChainBroken
+	var edit = func(t *testing.T, path string, change func(lines [][]byte) [][]byte) {
+		content, err := os.ReadFile(path)
+		assert.Nil(t, err)
+		var lines [][]byte = bytes.SplitAfter(content, []byte("\n"))
+		assert.Nil(t, os.WriteFile(path, bytes.Join(change(lines[:len(lines)-1]), nil), 0600))
+	}
+
+	var path string = filepath.Join(t.TempDir(), "edited.log")
+	appendRecords(t, path, 0, 4)
+	edit(t, path, func(lines [][]byte) [][]byte {
+		lines[1] = bytes.Replace(lines[1], []byte(`"principal":"ci"`), []byte(`"principal":"me"`), 1)
+		return lines
+	})
+	_, err := Verify(path)
+	assert.True(t, errors.As(err, &errChain))
+	assert.Equal(t, uint64(2), errChain.Seq)
+
+	path = filepath.Join(t.TempDir(), "removed.log")
+	appendRecords(t, path, 0, 4)
+	edit(t, path, func(lines [][]byte) [][]byte {
+		return append(lines[:1], lines[2:]...)
+	})
+	_, err = Verify(path)
+	assert.True(t, errors.As(err, &errChain))
+	assert.Equal(t, uint64(2), errChain.Seq)
+
+	path = filepath.Join(t.TempDir(), "truncated.log")
+	appendRecords(t, path, 0, 4)
+	edit(t, path, func(lines [][]byte) [][]byte {
+		return lines[:2]
+	})
+	_, err = Verify(path)
+	assert.True(t, errors.As(err, &errChain))
+	assert.Equal(t, uint64(3), errChain.Seq)
+
+	path = filepath.Join(t.TempDir(), "headless.log")
+	appendRecords(t, path, 0, 2)
+	assert.Nil(t, os.Remove(path+".head"))
+	_, err = Verify(path)
+	assert.True(t, errors.As(err, &errChain))
+}
@@ -0,0 +1,111 @@
+package auth
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// Roles are ordered, each one includes the previous.
+// Viewers read, operators change virtual machines and upload, admins manage webhooks
+const (
+	ROLE_VIEWER   = "viewer"
+	ROLE_OPERATOR = "operator"
+	ROLE_ADMIN    = "admin"
+)
+
+var Roles = []string{ROLE_VIEWER, ROLE_OPERATOR, ROLE_ADMIN}
+
+// ALL_TENANTS binds a role on every tenant, it is required by routes not owned by a tenant
+const ALL_TENANTS = "*"
+
+// Binding grants a role on a tenant
+type Binding struct {
+	Tenant string `json:"tenant" yaml:"tenant"`
+	Role   string `json:"role" yaml:"role"`
+}
+
+func (b Binding) String() string {
+	return b.Tenant + ":" + b.Role
+}
+
+func roleRank(role string) int {
+	return slices.Index(Roles, role)
+}
+
+func (b Binding) Validate() error {
+	if roleRank(b.Role) < 0 {
+		return fmt.Errorf("unknown role %s, valid roles are %s", b.Role, strings.Join(Roles, ", "))
+	}
+	if b.Tenant == ALL_TENANTS {
+		return nil
+	}
+	if _, err := uuid.Parse(b.Tenant); err != nil {
+		return fmt.Errorf("tenant %s must be a uuid or %s", b.Tenant, ALL_TENANTS)
+	}
+	return nil
+}
+
+// ParseBindings reads comma separated tenant:role pairs, e.g. "*:viewer,<uuid>:operator"
+func ParseBindings(value string) ([]Binding, error) {
+	var bindings []Binding = make([]Binding, 0)
+	for _, pair := range strings.Split(value, ",") {
+		if pair = strings.TrimSpace(pair); pair == "" {
+			continue
+		}
+		tenant, role, ok := strings.Cut(pair, ":")
+		if !ok {
+			return nil, fmt.Errorf("binding %s must be tenant:role", pair)
+		}
+		var binding Binding = Binding{Tenant: tenant, Role: role}
+		if tenant != ALL_TENANTS {
+			id, err := uuid.Parse(tenant)
+			if err == nil {
+				binding.Tenant = id.String()
+			}
+		}
+		err := binding.Validate()
+		if err != nil {
+			return nil, err
+		}
+		bindings = append(bindings, binding)
+	}
+	return bindings, nil
+}
+
+func ValidateBindings(bindings []Binding) error {
+	for _, binding := range bindings {
+		err := binding.Validate()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Role returns the highest role of the principal on tenant, empty when it has none.
+// The admin scope is an admin of every tenant
+func (p *Principal) Role(tenant string) string {
+	if slices.Contains(p.Scopes, SCOPE_ADMIN) {
+		return ROLE_ADMIN
+	}
+	var rank int = -1
+	for _, binding := range p.Bindings {
+		if binding.Tenant != ALL_TENANTS && (tenant == ALL_TENANTS || !strings.EqualFold(binding.Tenant, tenant)) {
+			continue
+		}
+		rank = max(rank, roleRank(binding.Role))
+	}
+	if rank < 0 {
+		return ""
+	}
+	return Roles[rank]
+}
+
+// Allows tells whether the principal has at least role on tenant, ALL_TENANTS requires a binding on every tenant
+func (p *Principal) Allows(tenant string, role string) bool {
+	granted := p.Role(tenant)
+	return granted != "" && roleRank(granted) >= roleRank(role)
+}
@@ -0,0 +1,61 @@
+package auth
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	tenantA = "8e2b6a3c-5a39-4f6e-9d2a-0b7f4c1e9a01"
+	tenantB = "1f0c3d7e-2b4a-4c8d-8e6f-5a9b0c1d2e03"
+)
+
+func Test_Principal_Allows(t *testing.T) {
+	var principal *Principal = &Principal{
+		Scopes: []string{SCOPE_VM_READ, SCOPE_VM_WRITE},
+		Bindings: []Binding{
+			{Tenant: ALL_TENANTS, Role: ROLE_VIEWER},
+			{Tenant: tenantA, Role: ROLE_OPERATOR},
+		},
+	}
+	assert.Equal(t, ROLE_OPERATOR, principal.Role(tenantA))
+	assert.Equal(t, ROLE_VIEWER, principal.Role(tenantB))
+	assert.True(t, principal.Allows(tenantA, ROLE_VIEWER))
+	assert.True(t, principal.Allows(tenantA, ROLE_OPERATOR))
+	assert.False(t, principal.Allows(tenantA, ROLE_ADMIN))
+	assert.False(t, principal.Allows(tenantB, ROLE_OPERATOR))
+	// Host routes only count bindings on every tenant
+	assert.True(t, principal.Allows(ALL_TENANTS, ROLE_VIEWER))
+	assert.False(t, principal.Allows(ALL_TENANTS, ROLE_OPERATOR))
+
+	var tenantOnly *Principal = &Principal{Bindings: []Binding{{Tenant: tenantA, Role: ROLE_ADMIN}}}
+	assert.True(t, tenantOnly.Allows(tenantA, ROLE_ADMIN))
+	assert.False(t, tenantOnly.Allows(tenantB, ROLE_VIEWER))
+	assert.False(t, tenantOnly.Allows(ALL_TENANTS, ROLE_VIEWER))
+
+	var admin *Principal = &Principal{Scopes: []string{SCOPE_ADMIN}}
+	assert.True(t, admin.Allows(ALL_TENANTS, ROLE_ADMIN))
+	assert.True(t, admin.Allows(tenantB, ROLE_ADMIN))
+
+	var none *Principal = &Principal{Scopes: []string{SCOPE_VM_READ}}
+	assert.Equal(t, "", none.Role(tenantA))
+	assert.False(t, none.Allows(tenantA, ROLE_VIEWER))
+}
+
+func Test_ParseBindings(t *testing.T) {
+	bindings, err := ParseBindings("*:viewer, " + tenantA + ":operator")
+	assert.Nil(t, err)
+	assert.Equal(t, []Binding{{Tenant: ALL_TENANTS, Role: ROLE_VIEWER}, {Tenant: tenantA, Role: ROLE_OPERATOR}}, bindings)
+
+	bindings, err = ParseBindings("")
+	assert.Nil(t, err)
+	assert.Empty(t, bindings)
+
+	_, err = ParseBindings(tenantA)
+	assert.NotNil(t, err)
+	_, err = ParseBindings("tenant:viewer")
+	assert.NotNil(t, err)
+	_, err = ParseBindings(tenantA + ":owner")
+	assert.NotNil(t, err)
+}
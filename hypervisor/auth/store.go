@@ -0,0 +1,223 @@
+package auth
+
+import (
+	"encoding/gob"
+	"errors"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+type snapshot struct {
+	Tokens map[string]Token
+}
+
+// TokenStore keeps api tokens in a gob snapshot. The admin command changes the file
+// while the server runs, the server reloads it when its modification time changes
+type TokenStore struct {
+	path    string
+	tokens  map[string]Token
+	modTime time.Time
+	size    int64
+	mu      sync.Mutex
+}
+
+func OpenTokenStore(path string) (*TokenStore, error) {
+	var store *TokenStore = &TokenStore{
+		path:   path,
+		tokens: make(map[string]Token),
+	}
+	err := store.refresh()
+	if err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// Caller must hold mu. A missing file is an empty store
+func (s *TokenStore) refresh() error {
+	stat, err := os.Stat(s.path)
+	if errors.Is(err, os.ErrNotExist) {
+		s.tokens = make(map[string]Token)
+		s.modTime, s.size = time.Time{}, 0
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if stat.ModTime().Equal(s.modTime) && stat.Size() == s.size {
+		return nil
+	}
+	fd, err := os.Open(s.path)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	var db snapshot
+	err = gob.NewDecoder(fd).Decode(&db)
+	if err != nil {
+		return err
+	}
+	if db.Tokens == nil {
+		db.Tokens = make(map[string]Token)
+	}
+	s.tokens = db.Tokens
+	s.modTime, s.size = stat.ModTime(), stat.Size()
+	return nil
+}
+
+// Caller must hold mu. The snapshot is replaced by rename, a concurrent reader sees the old or the new file
+func (s *TokenStore) write() error {
+	var tmp string = s.path + ".tmp"
+	fd, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(fd).Encode(snapshot{Tokens: s.tokens})
+	if err == nil {
+		err = fd.Sync()
+	}
+	if closeErr := fd.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, s.path)
+}
+
+// update applies change to the latest content of the file, holding a lock
+// so two admin commands running at the same time do not lose a change
+func (s *TokenStore) update(change func() error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	lock, err := os.OpenFile(s.path+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return err
+	}
+	defer lock.Close()
+	err = unix.Flock(int(lock.Fd()), unix.LOCK_EX)
+	if err != nil {
+		return err
+	}
+	defer unix.Flock(int(lock.Fd()), unix.LOCK_UN)
+	// The lock makes the file stable, the cached modification time can be stale within the same second
+	s.modTime = time.Time{}
+	err = s.refresh()
+	if err != nil {
+		return err
+	}
+	err = change()
+	if err != nil {
+		return err
+	}
+	err = s.write()
+	if err != nil {
+		return err
+	}
+	s.modTime = time.Time{}
+	return s.refresh()
+}
+
+// CreateToken returns the stored token and the raw token, the raw one cannot be recovered later.
+// A zero ttl never expires
+func (s *TokenStore) CreateToken(name string, scopes []string, bindings []Binding, ttl time.Duration, now time.Time) (Token, string, error) {
+	err := ValidateScopes(scopes)
+	if err != nil {
+		return Token{}, "", err
+	}
+	err = ValidateBindings(bindings)
+	if err != nil {
+		return Token{}, "", err
+	}
+	id, err := randomHex(tokenIdBytes)
+	if err != nil {
+		return Token{}, "", err
+	}
+	secret, err := randomHex(tokenSecretBytes)
+	if err != nil {
+		return Token{}, "", err
+	}
+	var token Token = Token{
+		Id:        id,
+		Name:      name,
+		Hash:      hashSecret(secret),
+		Scopes:    append([]string(nil), scopes...),
+		Bindings:  append([]Binding(nil), bindings...),
+		CreatedAt: now.UTC(),
+	}
+	if ttl > 0 {
+		token.ExpiresAt = now.Add(ttl).UTC()
+	}
+	err = s.update(func() error {
+		s.tokens[id] = token
+		return nil
+	})
+	if err != nil {
+		return Token{}, "", err
+	}
+	return token, tokenPrefix + "_" + id + "_" + secret, nil
+}
+
+func (s *TokenStore) RevokeToken(id string) error {
+	return s.update(func() error {
+		if _, ok := s.tokens[id]; !ok {
+			return &ErrTokenNotFound{Id: id}
+		}
+		delete(s.tokens, id)
+		return nil
+	})
+}
+
+// ListTokens returns tokens sorted by creation time
+func (s *TokenStore) ListTokens() ([]Token, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.refresh()
+	if err != nil {
+		return nil, err
+	}
+	var tokens []Token = make([]Token, 0, len(s.tokens))
+	for _, token := range s.tokens {
+		tokens = append(tokens, token)
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		if !tokens[i].CreatedAt.Equal(tokens[j].CreatedAt) {
+			return tokens[i].CreatedAt.Before(tokens[j].CreatedAt)
+		}
+		return tokens[i].Id < tokens[j].Id
+	})
+	return tokens, nil
+}
+
+// Authenticate resolves a raw bearer token to its principal
+func (s *TokenStore) Authenticate(raw string, now time.Time) (*Principal, error) {
+	id, secret, err := parseToken(raw)
+	if err != nil {
+		return nil, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err = s.refresh()
+	if err != nil {
+		return nil, err
+	}
+	token, ok := s.tokens[id]
+	if !ok || !token.Matches(secret) {
+		return nil, &ErrInvalidToken{}
+	}
+	if token.Expired(now) {
+		return nil, &ErrTokenExpired{Id: id}
+	}
+	return &Principal{
+		Name:     token.Name,
+		Method:   METHOD_TOKEN,
+		TokenId:  token.Id,
+		Scopes:   append([]string(nil), token.Scopes...),
+		Bindings: append([]Binding(nil), token.Bindings...),
+	}, nil
+}
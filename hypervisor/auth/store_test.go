@@ -0,0 +1,83 @@
+package auth
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_TokenStore_Authenticate(t *testing.T) {
+	var path string = filepath.Join(t.TempDir(), "tokens.snapshot")
+	store, err := OpenTokenStore(path)
+	assert.Nil(t, err)
+	var now time.Time = time.Now()
+
+	token, raw, err := store.CreateToken("ci", []string{SCOPE_VM_READ, SCOPE_UPLOAD}, []Binding{{Tenant: ALL_TENANTS, Role: ROLE_VIEWER}}, time.Hour, now)
+	assert.Nil(t, err)
+	assert.NotContains(t, string(token.Hash), raw)
+
+	principal, err := store.Authenticate(raw, now)
+	assert.Nil(t, err)
+	assert.Equal(t, "ci", principal.Name)
+	assert.Equal(t, token.Id, principal.TokenId)
+	assert.True(t, principal.HasScope(SCOPE_UPLOAD))
+	assert.False(t, principal.HasScope(SCOPE_VM_WRITE))
+	assert.True(t, principal.Allows(ALL_TENANTS, ROLE_VIEWER))
+
+	var errInvalid *ErrInvalidToken
+	_, err = store.Authenticate(raw+"0", now)
+	assert.True(t, errors.As(err, &errInvalid))
+	_, err = store.Authenticate("chm_"+token.Id, now)
+	assert.True(t, errors.As(err, &errInvalid))
+	_, err = store.Authenticate("", now)
+	assert.True(t, errors.As(err, &errInvalid))
+
+	var errExpired *ErrTokenExpired
+	_, err = store.Authenticate(raw, now.Add(time.Hour))
+	assert.True(t, errors.As(err, &errExpired))
+}
+
+func Test_TokenStore_SharedFile(t *testing.T) {
+	var path string = filepath.Join(t.TempDir(), "tokens.snapshot")
+	server, err := OpenTokenStore(path)
+	assert.Nil(t, err)
+	admin, err := OpenTokenStore(path)
+	assert.Nil(t, err)
+	var now time.Time = time.Now()
+
+	// Tokens created by the admin command are seen by the running server
+	token, raw, err := admin.CreateToken("operator", []string{SCOPE_ADMIN}, nil, 0, now)
+	assert.Nil(t, err)
+	principal, err := server.Authenticate(raw, now.Add(100*365*24*time.Hour))
+	assert.Nil(t, err)
+	assert.True(t, principal.HasScope(SCOPE_WEBHOOKS))
+
+	_, _, err = server.CreateToken("other", []string{SCOPE_EVENTS}, nil, 0, now)
+	assert.Nil(t, err)
+	tokens, err := admin.ListTokens()
+	assert.Nil(t, err)
+	assert.Len(t, tokens, 2)
+
+	assert.Nil(t, admin.RevokeToken(token.Id))
+	var errInvalid *ErrInvalidToken
+	_, err = server.Authenticate(raw, now)
+	assert.True(t, errors.As(err, &errInvalid))
+
+	var errNotFound *ErrTokenNotFound
+	assert.True(t, errors.As(admin.RevokeToken(token.Id), &errNotFound))
+
+	stat, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), stat.Mode().Perm())
+}
+
+func Test_ValidateScopes(t *testing.T) {
+	assert.Nil(t, ValidateScopes([]string{SCOPE_VM_READ, SCOPE_ADMIN}))
+	assert.NotNil(t, ValidateScopes(nil))
+	assert.NotNil(t, ValidateScopes([]string{""}))
+	assert.NotNil(t, ValidateScopes([]string{"vm:everything"}))
+}
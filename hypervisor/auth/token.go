@@ -0,0 +1,134 @@
+package auth
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Scopes granted to tokens, ADMIN grants every scope
+const (
+	SCOPE_VM_READ  = "vm:read"
+	SCOPE_VM_WRITE = "vm:write"
+	SCOPE_UPLOAD   = "upload"
+	SCOPE_EVENTS   = "events"
+	SCOPE_WEBHOOKS = "webhooks"
+	SCOPE_METRICS  = "metrics"
+	SCOPE_AUDIT    = "audit"
+	SCOPE_ADMIN    = "admin"
+)
+
+var Scopes = []string{SCOPE_VM_READ, SCOPE_VM_WRITE, SCOPE_UPLOAD, SCOPE_EVENTS, SCOPE_WEBHOOKS, SCOPE_METRICS, SCOPE_AUDIT, SCOPE_ADMIN}
+
+// Tokens are "chm_<id>_<secret>", the id selects the stored hash without revealing the secret
+const tokenPrefix = "chm"
+
+const (
+	tokenIdBytes     = 8
+	tokenSecretBytes = 32
+)
+
+// Token is the stored form of an api token, only the hash of the secret is kept.
+// A zero ExpiresAt never expires
+type Token struct {
+	Id        string    `json:"id" yaml:"id"`
+	Name      string    `json:"name" yaml:"name"`
+	Hash      []byte    `json:"-" yaml:"-"`
+	Scopes    []string  `json:"scopes" yaml:"scopes"`
+	Bindings  []Binding `json:"bindings" yaml:"bindings"`
+	ExpiresAt time.Time `json:"expires_at" yaml:"expires_at"`
+	CreatedAt time.Time `json:"created_at" yaml:"created_at"`
+}
+
+func (t *Token) Expired(now time.Time) bool {
+	return !t.ExpiresAt.IsZero() && !now.Before(t.ExpiresAt)
+}
+
+func (t *Token) Matches(secret string) bool {
+	hash := hashSecret(secret)
+	return subtle.ConstantTimeCompare(hash, t.Hash) == 1
+}
+
+// Secrets carry 256 bits of entropy, a plain hash is enough to make a leaked store useless
+func hashSecret(secret string) []byte {
+	sum := sha256.Sum256([]byte(secret))
+	return sum[:]
+}
+
+func randomHex(size int) (string, error) {
+	var buffer []byte = make([]byte, size)
+	_, err := rand.Read(buffer)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buffer), nil
+}
+
+// parseToken splits a raw token into its id and secret
+func parseToken(raw string) (string, string, error) {
+	parts := strings.Split(raw, "_")
+	if len(parts) != 3 || parts[0] != tokenPrefix || len(parts[1]) != tokenIdBytes*2 || parts[2] == "" {
+		return "", "", &ErrInvalidToken{}
+	}
+	return parts[1], parts[2], nil
+}
+
+func ValidateScopes(scopes []string) error {
+	if len(scopes) == 0 {
+		return fmt.Errorf("at least one scope is required, valid scopes are %s", strings.Join(Scopes, ", "))
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(Scopes, scope) {
+			return fmt.Errorf("unknown scope %s, valid scopes are %s", scope, strings.Join(Scopes, ", "))
+		}
+	}
+	return nil
+}
+
+const (
+	METHOD_TOKEN       = "token"
+	METHOD_CERTIFICATE = "certificate"
+	// Callers on the local unix socket identified by their uid and gid
+	METHOD_PEER = "peer"
+)
+
+// Principal is the authenticated caller of a request
+type Principal struct {
+	Name   string
+	Method string
+	// Id of the token, empty for certificates
+	TokenId  string
+	Scopes   []string
+	Bindings []Binding
+}
+
+func (p *Principal) HasScope(scope string) bool {
+	return slices.Contains(p.Scopes, scope) || slices.Contains(p.Scopes, SCOPE_ADMIN)
+}
+
+type ErrInvalidToken struct{}
+
+func (e *ErrInvalidToken) Error() string {
+	return "invalid api token"
+}
+
+type ErrTokenExpired struct {
+	Id string
+}
+
+func (e *ErrTokenExpired) Error() string {
+	return fmt.Sprintf("api token %s is expired", e.Id)
+}
+
+type ErrTokenNotFound struct {
+	Id string
+}
+
+func (e *ErrTokenNotFound) Error() string {
+	return fmt.Sprintf("api token %s not found", e.Id)
+}
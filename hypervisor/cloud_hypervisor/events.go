@@ -0,0 +1,76 @@
+package cloudhypervisor
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"time"
+)
+
+const (
+	EVENT_SOURCE_VMM           = "vmm"
+	EVENT_SOURCE_VM            = "vm"
+	EVENT_SOURCE_GUEST         = "guest"
+	EVENT_SOURCE_VIRTIO_DEVICE = "virtio-device"
+)
+
+const (
+	EVENT_STARTING       = "starting"
+	EVENT_BOOTING        = "booting"
+	EVENT_BOOTED         = "booted"
+	EVENT_PAUSING        = "pausing"
+	EVENT_PAUSED         = "paused"
+	EVENT_RESUMING       = "resuming"
+	EVENT_RESUMED        = "resumed"
+	EVENT_SHUTDOWN       = "shutdown"
+	EVENT_DELETED        = "deleted"
+	EVENT_REBOOTING      = "rebooting"
+	EVENT_REBOOTED       = "rebooted"
+	EVENT_POWER_BUTTON   = "power-button"
+	EVENT_PANIC          = "panic"
+	EVENT_DEVICE_ADDED   = "device-added"
+	EVENT_DEVICE_REMOVED = "device-removed"
+	EVENT_ACTIVATED      = "activated"
+	EVENT_RESET          = "reset"
+)
+
+const eventBuffer = 256
+
+// Time elapsed since the process started
+type EventTimestamp struct {
+	Secs  int64 `json:"secs" yaml:"secs"`
+	Nanos int64 `json:"nanos" yaml:"nanos"`
+}
+
+func (ts EventTimestamp) Duration() time.Duration {
+	return time.Duration(ts.Secs)*time.Second + time.Duration(ts.Nanos)
+}
+
+// Event written by --event-monitor
+type Event struct {
+	Timestamp  EventTimestamp    `json:"timestamp" yaml:"timestamp"`
+	Source     string            `json:"source" yaml:"source"`
+	Event      string            `json:"event" yaml:"event"`
+	Properties map[string]string `json:"properties,omitempty" yaml:"properties,omitempty"`
+}
+
+func (event *Event) Is(source string, name string) bool {
+	return event.Source == source && event.Event == name
+}
+
+// readEvents decodes the stream of pretty printed json objects written by cloud-hypervisor.
+// Returns nil on EOF, malformed objects are not recoverable since the stream has no framing
+func readEvents(r io.Reader, events chan<- Event) error {
+	decoder := json.NewDecoder(r)
+	for {
+		var event Event
+		err := decoder.Decode(&event)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		events <- event
+	}
+}
@@ -14,6 +14,12 @@ const (
 	BOOT
 	SHUTDOWN
 	INFO
+	PAUSE
+	RESUME
+	VMM_SHUTDOWN
+	RESIZE
+	POWER_BUTTON
+	COUNTERS
 )
 
 type HypervisorRestServer struct {
@@ -39,6 +45,18 @@ func (hb *HypervisorRestServer) GetUri(action VirtualMachineAction) (string, err
 		return utils.JoinUri(hb.remoteUri, "/vm.shutdown"), nil
 	case INFO:
 		return utils.JoinUri(hb.remoteUri, "/vm.info"), nil
+	case PAUSE:
+		return utils.JoinUri(hb.remoteUri, "/vm.pause"), nil
+	case RESUME:
+		return utils.JoinUri(hb.remoteUri, "/vm.resume"), nil
+	case RESIZE:
+		return utils.JoinUri(hb.remoteUri, "/vm.resize"), nil
+	case POWER_BUTTON:
+		return utils.JoinUri(hb.remoteUri, "/vm.power-button"), nil
+	case COUNTERS:
+		return utils.JoinUri(hb.remoteUri, "/vm.counters"), nil
+	case VMM_SHUTDOWN:
+		return utils.JoinUri(hb.remoteUri, "/vmm.shutdown"), nil
 	default:
 		return "", errors.New("unknow action")
 	}
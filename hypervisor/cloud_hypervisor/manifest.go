@@ -1,20 +1,25 @@
 package cloudhypervisor
 
 type Manifest struct {
-	Cpus     VmCpus   `json:"cpus" yaml:"cpus"`
-	Payload  Payload  `json:"payload" yaml:"payload"`
-	Disks    []Disk   `json:"disks" yaml:"disks"`
-	Rng      Rng      `json:"rng" yaml:"rng"`
-	Net      []Net    `json:"net" yaml:"net"`
-	Serial   Serial   `json:"serial" yaml:"serial"`
-	Console  Console  `json:"console" yaml:"console"`
-	Platform Platform `json:"platform" yaml:"platform"`
+	Cpus     VmCpus    `json:"cpus" yaml:"cpus"`
+	Memory   *VmMemory `json:"memory,omitempty" yaml:"memory,omitempty"`
+	Payload  Payload   `json:"payload" yaml:"payload"`
+	Disks    []Disk    `json:"disks" yaml:"disks"`
+	Rng      Rng       `json:"rng" yaml:"rng"`
+	Net      []Net     `json:"net" yaml:"net"`
+	Serial   Serial    `json:"serial" yaml:"serial"`
+	Console  Console   `json:"console" yaml:"console"`
+	Platform Platform  `json:"platform" yaml:"platform"`
 }
 
 type Platform struct {
 	Uuid string `json:"uuid" yaml:"uuid"`
 }
 
+type VmMemory struct {
+	Size int64 `json:"size" yaml:"size"`
+}
+
 type VmCpus struct {
 	Boot_vcpus int `json:"boot_vcpus" yaml:"boot_vcpus"`
 	Max_vcpus  int `json:"max_vcpus" yaml:"max_vcpus"`
@@ -46,3 +51,23 @@ type Serial struct {
 type Console struct {
 	Mode string `json:"mode" yaml:"mode"`
 }
+
+const (
+	VM_STATE_CREATED  = "Created"
+	VM_STATE_RUNNING  = "Running"
+	VM_STATE_SHUTDOWN = "Shutdown"
+	VM_STATE_PAUSED   = "Paused"
+)
+
+// Response body of /vm.info
+type VmInfo struct {
+	Config           Manifest `json:"config" yaml:"config"`
+	State            string   `json:"state" yaml:"state"`
+	MemoryActualSize int64    `json:"memory_actual_size" yaml:"memory_actual_size"`
+}
+
+// Request body of /vm.resize, zero values are left unchanged by cloud-hypervisor
+type VmResize struct {
+	DesiredVcpus int   `json:"desired_vcpus,omitempty" yaml:"desired_vcpus,omitempty"`
+	DesiredRam   int64 `json:"desired_ram,omitempty" yaml:"desired_ram,omitempty"`
+}
@@ -0,0 +1,158 @@
+package cloudhypervisor
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"vmm/utils"
+)
+
+const (
+	LOG_HYPERVISOR = "hypervisor"
+	LOG_SERIAL     = "serial"
+)
+
+const MaxVerbosity = 3
+
+type LogRotation struct {
+	MaxSize  int64
+	MaxFiles int
+}
+
+type LaunchOptions struct {
+	BinaryPath string
+	RemoteUri  string
+	Rotation   LogRotation
+	// Set by the virtual machine, empty paths discard the output
+	HypervisorLogPath string
+	SerialLogPath     string
+	Verbosity         int
+}
+
+// processOutput routes stdout, stderr, --log-file and the serial port of a child
+// to rotating files. The log and the serial port are pipes inherited by the child,
+// so their output is lost when the monitor restarts while the guest keeps running
+type processOutput struct {
+	stdout     io.Writer
+	stderr     io.Writer
+	extraFiles []*os.File
+	readers    []*os.File
+	serialPath string
+	events     chan Event
+	args       []string
+	wg         sync.WaitGroup
+	flushers   []*utils.LineWriter
+	closers    []io.Closer
+}
+
+// The child sees ExtraFiles starting from fd 3
+func childFd(index int) string {
+	return "/dev/fd/" + strconv.Itoa(3+index)
+}
+
+func newProcessOutput(opts LaunchOptions) (*processOutput, error) {
+	var output *processOutput = &processOutput{
+		stdout: io.Discard,
+		stderr: io.Discard,
+		args:   make([]string, 0),
+	}
+	var verbosity int = min(max(opts.Verbosity, 0), MaxVerbosity)
+	for range verbosity {
+		output.args = append(output.args, "-v")
+	}
+	if opts.HypervisorLogPath != "" {
+		hypervisorLog, err := utils.NewRotatingWriter(opts.HypervisorLogPath, opts.Rotation.MaxSize, opts.Rotation.MaxFiles)
+		if err != nil {
+			output.close()
+			return nil, err
+		}
+		output.closers = append(output.closers, hypervisorLog)
+		output.stdout = output.lineWriter(hypervisorLog)
+		output.stderr = output.lineWriter(hypervisorLog)
+		path, err := output.pipe(output.lineWriter(hypervisorLog))
+		if err != nil {
+			output.close()
+			return nil, err
+		}
+		output.args = append(output.args, "--log-file", path)
+	}
+	// The channel is closed once the child closes its end of the pipe
+	output.events = make(chan Event, eventBuffer)
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		output.close()
+		return nil, fmt.Errorf("unable to create event pipe: %w", err)
+	}
+	output.args = append(output.args, "--event-monitor", "fd="+strconv.Itoa(3+len(output.extraFiles)))
+	output.extraFiles = append(output.extraFiles, writer)
+	output.readers = append(output.readers, reader)
+	go func() {
+		defer close(output.events)
+		defer reader.Close()
+		err := readEvents(reader, output.events)
+		if err != nil {
+			// Keep draining so the child never blocks on a full pipe
+			io.Copy(io.Discard, reader)
+		}
+	}()
+	if opts.SerialLogPath != "" {
+		serialLog, err := utils.NewRotatingWriter(opts.SerialLogPath, opts.Rotation.MaxSize, opts.Rotation.MaxFiles)
+		if err != nil {
+			output.close()
+			return nil, err
+		}
+		output.closers = append(output.closers, serialLog)
+		path, err := output.pipe(serialLog)
+		if err != nil {
+			output.close()
+			return nil, err
+		}
+		output.serialPath = path
+	}
+	return output, nil
+}
+
+func (output *processOutput) lineWriter(dst io.Writer) *utils.LineWriter {
+	lw := utils.NewLineWriter(dst)
+	output.flushers = append(output.flushers, lw)
+	return lw
+}
+
+// pipe returns the path the child opens to write into dst
+func (output *processOutput) pipe(dst io.Writer) (string, error) {
+	reader, writer, err := os.Pipe()
+	if err != nil {
+		return "", fmt.Errorf("unable to create output pipe: %w", err)
+	}
+	var path string = childFd(len(output.extraFiles))
+	output.extraFiles = append(output.extraFiles, writer)
+	output.readers = append(output.readers, reader)
+	output.wg.Add(1)
+	go func() {
+		defer output.wg.Done()
+		io.Copy(dst, reader)
+		reader.Close()
+	}()
+	return path, nil
+}
+
+// started closes the write ends owned by the parent, readers get EOF once the child exits
+func (output *processOutput) started() {
+	for _, file := range output.extraFiles {
+		file.Close()
+	}
+}
+
+// close is called after the child exited or failed to start
+func (output *processOutput) close() {
+	output.started()
+	output.wg.Wait()
+	for _, lw := range output.flushers {
+		lw.Flush()
+	}
+	for _, closer := range output.closers {
+		closer.Close()
+	}
+}
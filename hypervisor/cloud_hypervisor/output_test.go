@@ -0,0 +1,77 @@
+package cloudhypervisor
+
+import (
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ProcessOutput_Capture(t *testing.T) {
+	var folder string = t.TempDir()
+	output, err := newProcessOutput(LaunchOptions{
+		HypervisorLogPath: filepath.Join(folder, "hypervisor.log"),
+		SerialLogPath:     filepath.Join(folder, "serial.log"),
+		Rotation:          LogRotation{MaxSize: 1024, MaxFiles: 1},
+		Verbosity:         5,
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"-v", "-v", "-v", "--log-file", "/dev/fd/3", "--event-monitor", "fd=4"}, output.args, "Verbosity must be capped")
+	assert.Equal(t, "/dev/fd/5", output.serialPath)
+
+	var script string = `echo out; echo err >&2; echo log > /dev/fd/3; echo login: > /dev/fd/5
+printf '{\n  "timestamp": {"secs": 1, "nanos": 5},\n  "source": "vm",\n  "event": "booted",\n  "properties": null\n}\n\n' >&4`
+	ch, err := startSupervised(exec.Command("sh", "-c", script), output)
+	assert.Nil(t, err)
+	waitDone(t, ch)
+	var received []Event
+	for event := range ch.Events() {
+		received = append(received, event)
+	}
+	assert.Len(t, received, 1)
+	assert.True(t, received[0].Is(EVENT_SOURCE_VM, EVENT_BOOTED))
+	assert.Equal(t, time.Second+5, received[0].Timestamp.Duration())
+
+	hypervisorLog, _ := os.ReadFile(filepath.Join(folder, "hypervisor.log"))
+	assert.Contains(t, string(hypervisorLog), "out\n")
+	assert.Contains(t, string(hypervisorLog), "err\n")
+	assert.Contains(t, string(hypervisorLog), "log\n")
+	serialLog, _ := os.ReadFile(filepath.Join(folder, "serial.log"))
+	assert.Equal(t, "login:\n", string(serialLog))
+	assert.Equal(t, []string{"err"}, ch.GetExitStatus().Stderr)
+}
+
+func Test_ReadEvents(t *testing.T) {
+	var stream string = `{
+  "timestamp": {"secs": 0, "nanos": 29228800},
+  "source": "vmm",
+  "event": "starting",
+  "properties": null
+}
+
+{
+  "timestamp": {"secs": 2, "nanos": 0},
+  "source": "virtio-device",
+  "event": "activated",
+  "properties": {
+    "id": "_disk0"
+  }
+}
+
+`
+	var events chan Event = make(chan Event, 10)
+	assert.Nil(t, readEvents(strings.NewReader(stream), events))
+	close(events)
+	first := <-events
+	assert.True(t, first.Is(EVENT_SOURCE_VMM, EVENT_STARTING))
+	assert.Nil(t, first.Properties)
+	second := <-events
+	assert.True(t, second.Is(EVENT_SOURCE_VIRTIO_DEVICE, EVENT_ACTIVATED))
+	assert.Equal(t, "_disk0", second.Properties["id"])
+
+	assert.NotNil(t, readEvents(strings.NewReader("{\"source\": 3}"), make(chan Event, 1)))
+}
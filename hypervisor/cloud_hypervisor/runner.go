@@ -2,12 +2,18 @@ package cloudhypervisor
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
 	"os"
 	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"syscall"
 	"time"
 
@@ -16,15 +22,28 @@ import (
 
 type CloudHypervisor struct {
 	pid        int
+	pidfd      int
+	socketPath string
+	serialPath string
+	events     <-chan Event
+	done       chan struct{}
+	exit       *ExitStatus
+	exitMu     sync.Mutex
+	stderr     *TailBuffer
+	startedAt  time.Time
 	HttpClient *http.Client
 	RestServer *HypervisorRestServer
 }
 
-func waitSocketFileCreation(socket string) error {
+func (ch *CloudHypervisor) waitSocketFileCreation(socket string) error {
 	for range 50 {
 		_, err := os.Stat(socket)
 		if err != nil && os.IsNotExist(err) {
-			time.Sleep(time.Millisecond * 100)
+			select {
+			case <-ch.Done():
+				return fmt.Errorf("cloud-hypervisor exited before creating its socket: %s: %s", ch.GetExitStatus(), strings.Join(ch.GetExitStatus().Stderr, "\n"))
+			case <-time.After(time.Millisecond * 100):
+			}
 			continue
 		}
 		if err != nil {
@@ -49,7 +68,7 @@ func CreateTransportSocket(socket string) *http.Client {
 	return client
 }
 
-func NewCloudHypervisor(binaryPath string, remoteUri string) (*CloudHypervisor, error) {
+func NewCloudHypervisor(opts LaunchOptions) (*CloudHypervisor, error) {
 	var err error
 	socketUuid, err := uuid.NewUUID()
 	if err != nil {
@@ -57,54 +76,190 @@ func NewCloudHypervisor(binaryPath string, remoteUri string) (*CloudHypervisor,
 	}
 	var socketPath string = fmt.Sprintf("/tmp/vm-net-%s.sock", socketUuid)
 
-	cmd := exec.Command(binaryPath, "--api-socket", fmt.Sprintf("path=%s", socketPath))
+	output, err := newProcessOutput(opts)
+	if err != nil {
+		return nil, err
+	}
+	var args []string = append([]string{"--api-socket", fmt.Sprintf("path=%s", socketPath)}, output.args...)
+	cmd := exec.Command(opts.BinaryPath, args...)
 	cmd.SysProcAttr = &syscall.SysProcAttr{
 		Setsid: true,
 	}
 
-	if err := cmd.Start(); err != nil {
+	cloudHypervisor, err := startSupervised(cmd, output)
+	if err != nil {
 		return nil, err
 	}
+	cloudHypervisor.socketPath = socketPath
+	cloudHypervisor.serialPath = output.serialPath
+	cloudHypervisor.HttpClient = CreateTransportSocket(socketPath)
+	cloudHypervisor.RestServer = NewHypervisorRestServer(opts.RemoteUri)
 
-	err = waitSocketFileCreation(socketPath)
+	err = cloudHypervisor.waitSocketFileCreation(socketPath)
 	if err != nil {
+		cloudHypervisor.Signal(syscall.SIGKILL)
 		return nil, err
 	}
 
+	return cloudHypervisor, nil
+}
+
+func (ch *CloudHypervisor) Kill() error {
+	err := ch.Signal(syscall.SIGKILL)
+	if err != nil {
+		return fmt.Errorf("there was an error killing running process: %w", err)
+	}
+	return nil
+}
+
+// LoadRunningInstance wraps a process started by a previous run of the monitor,
+// every instance talks to its own api socket. startedAt is zero when unknown
+func LoadRunningInstance(pid int, socketPath string, remoteUri string, startedAt time.Time) *CloudHypervisor {
 	var cloudHypervisor *CloudHypervisor = &CloudHypervisor{
-		pid:        cmd.Process.Pid,
+		pid:        pid,
+		pidfd:      -1,
+		socketPath: socketPath,
+		startedAt:  startedAt,
 		HttpClient: CreateTransportSocket(socketPath),
 		RestServer: NewHypervisorRestServer(remoteUri),
 	}
+	return cloudHypervisor
+}
 
-	return cloudHypervisor, nil
+func (ch *CloudHypervisor) IsRunning() bool {
+	return ch.pid > 0
 }
 
-func (ch *CloudHypervisor) Kill() error {
+func (ch *CloudHypervisor) GetPid() int {
+	return ch.pid
+}
+
+// GetStartedAt returns when the process was started, zero when unknown
+func (ch *CloudHypervisor) GetStartedAt() time.Time {
+	return ch.startedAt
+}
+
+func (ch *CloudHypervisor) GetSocketPath() string {
+	return ch.socketPath
+}
 
-	// TODO:
-	// 1. Terminate current cloud-hypervisor instance
-	// 2. Drop all tap interfaces connected to the instance
+// Events is closed when the process exits, it is nil for processes not started by this monitor
+func (ch *CloudHypervisor) Events() <-chan Event {
+	return ch.events
+}
 
-	proc, err := os.FindProcess(ch.pid)
+// GetSerialPath is the file the guest serial port must be written to, as seen by the process.
+// It is empty when the serial output is not captured
+func (ch *CloudHypervisor) GetSerialPath() string {
+	return ch.serialPath
+}
+
+// IsAlive checks that the process still exists and is not a zombie
+func (ch *CloudHypervisor) IsAlive() bool {
+	if ch.pid <= 0 {
+		return false
+	}
+	if done := ch.Done(); done != nil {
+		select {
+		case <-done:
+			return false
+		default:
+			return true
+		}
+	}
+	content, err := os.ReadFile(filepath.Join("/proc", strconv.Itoa(ch.pid), "stat"))
 	if err != nil {
-		return errors.New("there was an error searching process by pid")
+		return false
+	}
+	// Format is "pid (comm) state ...", comm can contain spaces
+	var stat string = string(content)
+	var index int = strings.LastIndex(stat, ")")
+	if index < 0 || index+2 >= len(stat) {
+		return false
 	}
-	err = proc.Signal(syscall.SIGKILL)
+	return stat[index+2] != 'Z' && stat[index+2] != 'X'
+}
+
+// Put sends an action to the api socket, body can be nil
+func (ch *CloudHypervisor) Put(action VirtualMachineAction, body io.Reader) error {
+	if ch.RestServer == nil {
+		return errors.New("rest server is not configured")
+	}
+	uri, err := ch.RestServer.GetUri(action)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPut, uri, body)
 	if err != nil {
-		return errors.New("there was an error killing running process")
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	res, err := ch.HttpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		content, err := io.ReadAll(res.Body)
+		if err != nil {
+			return err
+		}
+		return errors.New(string(content))
 	}
 	return nil
 }
 
-func LoadRunningInstance(pid int, socketPath string) *CloudHypervisor {
-	var cloudHypervisor *CloudHypervisor = &CloudHypervisor{
-		pid:        pid,
-		HttpClient: CreateTransportSocket(socketPath),
+// get reads the body of a GET request on the api socket
+func (ch *CloudHypervisor) get(action VirtualMachineAction) ([]byte, error) {
+	if ch.RestServer == nil {
+		return nil, errors.New("rest server is not configured")
 	}
-	return cloudHypervisor
+	uri, err := ch.RestServer.GetUri(action)
+	if err != nil {
+		return nil, err
+	}
+	res, err := ch.HttpClient.Get(uri)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return nil, errors.New(string(body))
+	}
+	return body, nil
 }
 
-func (ch *CloudHypervisor) IsRunning() bool {
-	return ch.pid > 0
+func (ch *CloudHypervisor) GetInfo() (*VmInfo, error) {
+	body, err := ch.get(INFO)
+	if err != nil {
+		return nil, err
+	}
+	var info *VmInfo = &VmInfo{}
+	err = json.Unmarshal(body, info)
+	if err != nil {
+		return nil, err
+	}
+	return info, nil
+}
+
+// Counters are grouped by device id, e.g. {"_disk0": {"read_bytes": 512}}
+type Counters map[string]map[string]uint64
+
+func (ch *CloudHypervisor) GetCounters() (Counters, error) {
+	body, err := ch.get(COUNTERS)
+	if err != nil {
+		return nil, err
+	}
+	var counters Counters = make(Counters)
+	err = json.Unmarshal(body, &counters)
+	if err != nil {
+		return nil, err
+	}
+	return counters, nil
 }
@@ -0,0 +1,317 @@
+package cloudhypervisor
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const stderrTailLines = 20
+
+const exitPollInterval = 100 * time.Millisecond
+
+const defaultKillTimeout = 5 * time.Second
+
+// ExitStatus of a cloud-hypervisor process. Code and Signal are unknown
+// for adopted processes, only the parent can collect them
+type ExitStatus struct {
+	Code     *int      `json:"code,omitempty" yaml:"code,omitempty"`
+	Signal   string    `json:"signal,omitempty" yaml:"signal,omitempty"`
+	ExitedAt time.Time `json:"exited_at" yaml:"exited_at"`
+	Stderr   []string  `json:"stderr,omitempty" yaml:"stderr,omitempty"`
+}
+
+// Clean is true when the process exited by itself with code 0, as it does when the guest powers off
+func (status *ExitStatus) Clean() bool {
+	return status != nil && status.Code != nil && *status.Code == 0
+}
+
+func (status *ExitStatus) String() string {
+	if status.Code != nil {
+		return fmt.Sprintf("exit code %d", *status.Code)
+	}
+	if status.Signal != "" {
+		return fmt.Sprintf("killed by %s", status.Signal)
+	}
+	return "unknown exit status"
+}
+
+func newExitStatus(state *os.ProcessState) *ExitStatus {
+	var status *ExitStatus = &ExitStatus{ExitedAt: time.Now().UTC()}
+	if state == nil {
+		return status
+	}
+	waitStatus, ok := state.Sys().(syscall.WaitStatus)
+	if ok && waitStatus.Signaled() {
+		status.Signal = unix.SignalName(waitStatus.Signal())
+		return status
+	}
+	var code int = state.ExitCode()
+	status.Code = &code
+	return status
+}
+
+// TailBuffer keeps the last lines written to it
+type TailBuffer struct {
+	mu      sync.Mutex
+	lines   []string
+	partial []byte
+	max     int
+}
+
+func NewTailBuffer(max int) *TailBuffer {
+	return &TailBuffer{
+		lines: make([]string, 0, max),
+		max:   max,
+	}
+}
+
+func (tb *TailBuffer) Write(p []byte) (int, error) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.partial = append(tb.partial, p...)
+	for {
+		index := bytes.IndexByte(tb.partial, '\n')
+		if index < 0 {
+			break
+		}
+		tb.push(string(tb.partial[:index]))
+		tb.partial = tb.partial[index+1:]
+	}
+	// A process writing without newlines must not grow the buffer forever
+	if len(tb.partial) > 4096 {
+		tb.push(string(tb.partial))
+		tb.partial = nil
+	}
+	return len(p), nil
+}
+
+func (tb *TailBuffer) push(line string) {
+	if len(tb.lines) == tb.max {
+		copy(tb.lines, tb.lines[1:])
+		tb.lines = tb.lines[:tb.max-1]
+	}
+	tb.lines = append(tb.lines, strings.TrimRight(line, "\r"))
+}
+
+func (tb *TailBuffer) Lines() []string {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	var res []string = make([]string, 0, len(tb.lines)+1)
+	res = append(res, tb.lines...)
+	if len(tb.partial) > 0 {
+		res = append(res, string(tb.partial))
+	}
+	if len(res) > tb.max {
+		res = res[len(res)-tb.max:]
+	}
+	return res
+}
+
+// startSupervised starts a child and collects its exit status as soon as it exits
+// output can be nil, stderr is always kept in memory for the exit status
+func startSupervised(cmd *exec.Cmd, output *processOutput) (*CloudHypervisor, error) {
+	var pidfd int = -1
+	if cmd.SysProcAttr == nil {
+		cmd.SysProcAttr = &syscall.SysProcAttr{}
+	}
+	cmd.SysProcAttr.PidFD = &pidfd
+	var stderr *TailBuffer = NewTailBuffer(stderrTailLines)
+	cmd.Stderr = stderr
+	if output != nil {
+		cmd.Stdout = output.stdout
+		cmd.Stderr = io.MultiWriter(stderr, output.stderr)
+		cmd.ExtraFiles = output.extraFiles
+	}
+	err := cmd.Start()
+	if output != nil {
+		output.started()
+	}
+	if err != nil {
+		if output != nil {
+			output.close()
+		}
+		return nil, err
+	}
+	var ch *CloudHypervisor = &CloudHypervisor{
+		pid:       cmd.Process.Pid,
+		pidfd:     pidfd,
+		done:      make(chan struct{}),
+		stderr:    stderr,
+		startedAt: time.Now().UTC(),
+	}
+	if output != nil {
+		ch.events = output.events
+	}
+	go func() {
+		cmd.Wait()
+		if output != nil {
+			output.close()
+		}
+		status := newExitStatus(cmd.ProcessState)
+		status.Stderr = stderr.Lines()
+		ch.setExited(status)
+	}()
+	return ch, nil
+}
+
+// Supervise watches a process started by someone else through a pidfd.
+// Temporary handles, e.g. to query or kill an orphan, are not supervised
+func (ch *CloudHypervisor) Supervise() {
+	ch.exitMu.Lock()
+	defer ch.exitMu.Unlock()
+	if ch.done != nil {
+		return
+	}
+	ch.done = make(chan struct{})
+	pidfd, err := unix.PidfdOpen(ch.pid, 0)
+	if err != nil {
+		ch.exit = &ExitStatus{ExitedAt: time.Now().UTC()}
+		close(ch.done)
+		return
+	}
+	ch.pidfd = pidfd
+	go func() {
+		var fds []unix.PollFd = []unix.PollFd{{Fd: int32(pidfd), Events: unix.POLLIN}}
+		for {
+			_, err := unix.Poll(fds, -1)
+			if !errors.Is(err, unix.EINTR) {
+				break
+			}
+		}
+		ch.setExited(&ExitStatus{ExitedAt: time.Now().UTC()})
+	}()
+}
+
+func (ch *CloudHypervisor) setExited(status *ExitStatus) {
+	ch.exitMu.Lock()
+	defer ch.exitMu.Unlock()
+	ch.exit = status
+	if ch.pidfd >= 0 {
+		unix.Close(ch.pidfd)
+		ch.pidfd = -1
+	}
+	close(ch.done)
+}
+
+// Done is closed when the process exits, it is nil for unsupervised handles
+func (ch *CloudHypervisor) Done() <-chan struct{} {
+	ch.exitMu.Lock()
+	defer ch.exitMu.Unlock()
+	return ch.done
+}
+
+// GetExitStatus is nil while the process is running
+func (ch *CloudHypervisor) GetExitStatus() *ExitStatus {
+	ch.exitMu.Lock()
+	defer ch.exitMu.Unlock()
+	return ch.exit
+}
+
+// Signal goes through the pidfd when supervised, so a reused pid is never signaled
+func (ch *CloudHypervisor) Signal(sig unix.Signal) error {
+	ch.exitMu.Lock()
+	defer ch.exitMu.Unlock()
+	if ch.exit != nil {
+		return nil
+	}
+	if ch.pidfd >= 0 {
+		return unix.PidfdSendSignal(ch.pidfd, sig, nil, 0)
+	}
+	if ch.pid <= 0 {
+		return errors.New("process has no pid")
+	}
+	return unix.Kill(ch.pid, sig)
+}
+
+// A zero timeout skips the step, except for the final SIGKILL
+type StopTimeouts struct {
+	PowerButton time.Duration
+	Shutdown    time.Duration
+	Terminate   time.Duration
+	Kill        time.Duration
+}
+
+const (
+	STOP_POWER_BUTTON = "power_button"
+	STOP_SHUTDOWN     = "shutdown"
+	STOP_TERMINATE    = "terminate"
+	STOP_KILL         = "kill"
+)
+
+// waitExit returns true when the process exited within the timeout.
+// With guestShutdown it also returns when the guest reports it is shut down
+func (ch *CloudHypervisor) waitExit(timeout time.Duration, guestShutdown bool) bool {
+	var deadline time.Time = time.Now().Add(timeout)
+	var done <-chan struct{} = ch.Done()
+	ticker := time.NewTicker(exitPollInterval)
+	defer ticker.Stop()
+	for {
+		if done == nil && !ch.IsAlive() {
+			return true
+		}
+		if guestShutdown {
+			info, err := ch.GetInfo()
+			if err == nil && info.State == VM_STATE_SHUTDOWN {
+				return false
+			}
+		}
+		var remaining time.Duration = time.Until(deadline)
+		if remaining <= 0 {
+			return false
+		}
+		select {
+		case <-done:
+			return true
+		case <-ticker.C:
+		case <-time.After(remaining):
+		}
+	}
+}
+
+// Stop escalates from the acpi power button to a vmm shutdown, SIGTERM and SIGKILL,
+// waiting for the process to exit after every step. Returns the step that stopped it
+func (ch *CloudHypervisor) Stop(timeouts StopTimeouts) (string, error) {
+	if !ch.IsAlive() {
+		return "", nil
+	}
+	if timeouts.PowerButton > 0 {
+		err := ch.Put(POWER_BUTTON, nil)
+		if err == nil && ch.waitExit(timeouts.PowerButton, true) {
+			return STOP_POWER_BUTTON, nil
+		}
+	}
+	if timeouts.Shutdown > 0 {
+		ch.Put(SHUTDOWN, nil)
+		err := ch.Put(VMM_SHUTDOWN, nil)
+		if err == nil && ch.waitExit(timeouts.Shutdown, false) {
+			return STOP_SHUTDOWN, nil
+		}
+	}
+	if timeouts.Terminate > 0 {
+		err := ch.Signal(unix.SIGTERM)
+		if err == nil && ch.waitExit(timeouts.Terminate, false) {
+			return STOP_TERMINATE, nil
+		}
+	}
+	err := ch.Signal(unix.SIGKILL)
+	if err != nil {
+		return "", err
+	}
+	if timeouts.Kill <= 0 {
+		timeouts.Kill = defaultKillTimeout
+	}
+	if ch.waitExit(timeouts.Kill, false) {
+		return STOP_KILL, nil
+	}
+	return "", fmt.Errorf("process %d did not exit after SIGKILL", ch.pid)
+}
@@ -0,0 +1,68 @@
+package cloudhypervisor
+
+import (
+	"os/exec"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func waitDone(t *testing.T, ch *CloudHypervisor) {
+	select {
+	case <-ch.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("process exit was not noticed")
+	}
+}
+
+func Test_TailBuffer_Write(t *testing.T) {
+	var tb *TailBuffer = NewTailBuffer(2)
+	tb.Write([]byte("first\nsecond\nthi"))
+	tb.Write([]byte("rd\r\nfourth"))
+	assert.Equal(t, []string{"third", "fourth"}, tb.Lines(), "Only the last lines must be kept")
+}
+
+func Test_CloudHypervisor_ExitStatus(t *testing.T) {
+	ch, err := startSupervised(exec.Command("sh", "-c", "echo boom >&2; exit 3"), nil)
+	assert.Nil(t, err)
+	waitDone(t, ch)
+	exit := ch.GetExitStatus()
+	assert.NotNil(t, exit.Code)
+	assert.Equal(t, 3, *exit.Code)
+	assert.Equal(t, []string{"boom"}, exit.Stderr)
+	assert.False(t, exit.Clean())
+	assert.False(t, ch.IsAlive())
+}
+
+func Test_CloudHypervisor_Stop(t *testing.T) {
+	ch, err := startSupervised(exec.Command("sleep", "30"), nil)
+	assert.Nil(t, err)
+	// Without an api socket the escalation goes straight to the signals
+	step, err := ch.Stop(StopTimeouts{PowerButton: time.Second, Shutdown: time.Second, Terminate: 2 * time.Second})
+	assert.Nil(t, err)
+	assert.Equal(t, STOP_TERMINATE, step)
+	assert.Equal(t, "SIGTERM", ch.GetExitStatus().Signal)
+
+	ch, err = startSupervised(exec.Command("sh", "-c", "trap '' TERM; while true; do sleep 0.05; done"), nil)
+	assert.Nil(t, err)
+	time.Sleep(100 * time.Millisecond)
+	step, err = ch.Stop(StopTimeouts{Terminate: 200 * time.Millisecond})
+	assert.Nil(t, err)
+	assert.Equal(t, STOP_KILL, step, "A process ignoring SIGTERM must be killed")
+	assert.Equal(t, "SIGKILL", ch.GetExitStatus().Signal)
+}
+
+func Test_CloudHypervisor_Supervise(t *testing.T) {
+	cmd := exec.Command("sleep", "30")
+	assert.Nil(t, cmd.Start())
+	go cmd.Wait()
+	var ch *CloudHypervisor = LoadRunningInstance(cmd.Process.Pid, "/nonexistent.sock", "http://localhost/api/v1", time.Time{})
+	assert.Nil(t, ch.Done(), "Handles are not supervised until asked")
+	ch.Supervise()
+	assert.True(t, ch.IsAlive())
+	assert.Nil(t, ch.Kill())
+	waitDone(t, ch)
+	assert.Nil(t, ch.GetExitStatus().Code, "Exit code of adopted processes is unknown")
+	assert.False(t, ch.IsAlive())
+}
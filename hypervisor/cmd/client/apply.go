@@ -0,0 +1,147 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"vmm/audit"
+	vmmanager "vmm/vmm"
+)
+
+func applyCommand() *command {
+	return &command{
+		name:    "apply",
+		summary: "Create, update and prune virtual machines and vpc networks declared in a yaml file",
+		nargs:   0,
+		setup:   applyRun,
+	}
+}
+
+// formatChange shows a field of an update as old -> new, values are printed as json
+func formatChange(change audit.Change) string {
+	value := func(v any) string {
+		if v == nil {
+			return "-"
+		}
+		encoded, err := json.Marshal(v)
+		if err != nil {
+			return fmt.Sprint(v)
+		}
+		return string(encoded)
+	}
+	return fmt.Sprintf("%s: %s -> %s", change.Field, value(change.Old), value(change.New))
+}
+
+func applyRun(flags *flag.FlagSet) runFunc {
+	var file, tenant, applySet string
+	var dryRun, prune bool
+	flags.StringVar(&file, "f", "", "Yaml of VirtualMachine and VpcNetwork documents separated by ---, - reads stdin")
+	flags.StringVar(&tenant, "tenant", "", "Tenant of the documents without one, defaults to the tenant of the context")
+	flags.StringVar(&applySet, "apply-set", "", "Name under which the resources of the file are recorded, required by -prune")
+	flags.BoolVar(&dryRun, "dry-run", false, "Print the plan without changing anything")
+	flags.BoolVar(&prune, "prune", false, "Delete the resources of the apply set dropped from the file")
+	return func(s *session, args []string) error {
+		if file == "" {
+			return &ErrUsage{Message: "the apply file is required, use -f"}
+		}
+		if prune && applySet == "" {
+			return &ErrUsage{Message: "-prune requires -apply-set"}
+		}
+		var content []byte
+		var err error
+		if file == "-" {
+			content, err = io.ReadAll(os.Stdin)
+		} else {
+			content, err = os.ReadFile(file)
+		}
+		if err != nil {
+			return err
+		}
+		client, err := s.Client()
+		if err != nil {
+			return err
+		}
+		query := url.Values{}
+		setQuery(query, "tenant", s.tenant(tenant))
+		setQuery(query, "apply_set", applySet)
+		if dryRun {
+			query.Set("dry_run", "true")
+		}
+		if prune {
+			query.Set("prune", "true")
+		}
+		req, err := client.NewRequest(s.ctx, http.MethodPost, "/api/apply?"+query.Encode(), bytes.NewReader(content))
+		if err != nil {
+			return err
+		}
+		req.Header.Set("Content-Type", "application/yaml")
+		resp, err := client.Do(req)
+		if err != nil {
+			return err
+		}
+		defer resp.Body.Close()
+		var plan vmmanager.ApplyPlan
+		err = json.NewDecoder(resp.Body).Decode(&plan)
+		if err != nil {
+			return fmt.Errorf("unexpected answer of the monitor: %w", err)
+		}
+		err = printPlan(s, plan)
+		if err != nil {
+			return err
+		}
+		if plan.Failed() {
+			return errors.New("the apply is incomplete, run it again once the failed actions are fixed")
+		}
+		return nil
+	}
+}
+
+// printPlan lists the actions and the fields they change, the summary follows the table
+func printPlan(s *session, plan vmmanager.ApplyPlan) error {
+	if s.globals.output == OUTPUT_TABLE && len(plan.Actions) == 0 {
+		return s.message(plan, "No changes, %d resources are up to date", plan.Unchanged)
+	}
+	err := s.print(plan, func() table {
+		t := table{header: []string{"ACTION", "KIND", "TENANT", "NAME", "DETAILS"}}
+		for _, action := range plan.Actions {
+			var details []string = make([]string, 0, len(action.Changes)+1)
+			if action.Error != "" {
+				details = append(details, "failed: "+action.Error)
+			}
+			for _, change := range action.Changes {
+				details = append(details, formatChange(change))
+			}
+			var name string = action.Name
+			if name == "" {
+				name = action.Id
+			}
+			t.rows = append(t.rows, []string{action.Action, action.Kind, action.Tenant, name, orDash(strings.Join(details, "; "))})
+		}
+		return t
+	})
+	if err != nil || s.globals.output != OUTPUT_TABLE {
+		return err
+	}
+	var done map[string]int = make(map[string]int)
+	var failed int = 0
+	for _, action := range plan.Actions {
+		if action.Error != "" {
+			failed++
+			continue
+		}
+		done[action.Action]++
+	}
+	if plan.DryRun {
+		_, err = fmt.Fprintf(s.stdout, "\nPlan: %d to create, %d to update, %d to delete, %d unchanged\n", done[vmmanager.APPLY_CREATE], done[vmmanager.APPLY_UPDATE], done[vmmanager.APPLY_DELETE], plan.Unchanged)
+		return err
+	}
+	_, err = fmt.Fprintf(s.stdout, "\nApplied: %d created, %d updated, %d deleted, %d unchanged, %d failed\n", done[vmmanager.APPLY_CREATE], done[vmmanager.APPLY_UPDATE], done[vmmanager.APPLY_DELETE], plan.Unchanged, failed)
+	return err
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"slices"
+	"strings"
+	"text/tabwriter"
+)
+
+const (
+	OUTPUT_TABLE = "table"
+	OUTPUT_JSON  = "json"
+	OUTPUT_YAML  = "yaml"
+)
+
+type runFunc func(s *session, args []string) error
+
+// command is a node of the cli, leaves have a setup registering their flags and returning what to run
+type command struct {
+	name    string
+	args    string
+	summary string
+	// Number of positional arguments, -1 for any
+	nargs    int
+	setup    func(flags *flag.FlagSet) runFunc
+	children []*command
+}
+
+// globals are accepted by every command, before or after its name
+type globals struct {
+	context string
+	host    string
+	token   string
+	output  string
+}
+
+func (g *globals) register(flags *flag.FlagSet) {
+	flags.StringVar(&g.context, "context", os.Getenv("CHMON_CONTEXT"), "Context to use instead of the current one")
+	flags.StringVar(&g.host, "host", os.Getenv("CHMON_HOST"), "Monitor to reach, http(s)://host:port or unix:///path/to/socket, overrides the context")
+	flags.StringVar(&g.token, "token", os.Getenv("CHMON_TOKEN"), "Api token, overrides the context")
+	flags.StringVar(&g.output, "o", OUTPUT_TABLE, "Output format, table, json or yaml")
+}
+
+// session is what a running command needs, the client is built on first use
+type session struct {
+	ctx     context.Context
+	globals *globals
+	stdout  io.Writer
+	stderr  io.Writer
+	config  *Config
+	client  *Client
+}
+
+func (s *session) hostContext() (HostContext, error) {
+	context, err := s.config.Resolve(s.globals.context)
+	if err != nil {
+		return HostContext{}, err
+	}
+	if s.globals.host != "" {
+		context.Host = s.globals.host
+	}
+	if s.globals.token != "" {
+		context.Token = s.globals.token
+	}
+	return context, nil
+}
+
+func (s *session) Client() (*Client, error) {
+	if s.client != nil {
+		return s.client, nil
+	}
+	context, err := s.hostContext()
+	if err != nil {
+		return nil, err
+	}
+	s.client, err = NewClient(ClientOptions{
+		Host:     context.Host,
+		Token:    context.Token,
+		CaFile:   context.CaFile,
+		CertFile: context.CertFile,
+		KeyFile:  context.KeyFile,
+	})
+	return s.client, err
+}
+
+// tenant returns value, or the tenant of the context when value is empty
+func (s *session) tenant(value string) string {
+	if value != "" {
+		return value
+	}
+	context, err := s.hostContext()
+	if err != nil {
+		return ""
+	}
+	return context.Tenant
+}
+
+// table is the table output of a result
+type table struct {
+	header []string
+	rows   [][]string
+}
+
+// print writes value in the output format, rows builds the table output
+func (s *session) print(value any, rows func() table) error {
+	switch s.globals.output {
+	case OUTPUT_JSON:
+		return writeJson(s.stdout, value)
+	case OUTPUT_YAML:
+		return writeYaml(s.stdout, value)
+	default:
+		t := rows()
+		writer := tabwriter.NewWriter(s.stdout, 0, 4, 3, ' ', 0)
+		if len(t.header) > 0 {
+			fmt.Fprintln(writer, strings.Join(t.header, "\t"))
+		}
+		for _, row := range t.rows {
+			fmt.Fprintln(writer, strings.Join(row, "\t"))
+		}
+		return writer.Flush()
+	}
+}
+
+// message prints a confirmation in table output, json and yaml get value
+func (s *session) message(value any, format string, args ...any) error {
+	if s.globals.output == OUTPUT_TABLE {
+		_, err := fmt.Fprintf(s.stdout, format+"\n", args...)
+		return err
+	}
+	return s.print(value, nil)
+}
+
+// parseInterspersed accepts flags between positional arguments, e.g. vm info web -o json
+func parseInterspersed(flags *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string = make([]string, 0)
+	for {
+		err := flags.Parse(args)
+		if err != nil {
+			return nil, err
+		}
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		if args[0] == "--" {
+			return append(positional, args[1:]...), nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
+
+func (cmd *command) child(name string) *command {
+	index := slices.IndexFunc(cmd.children, func(child *command) bool {
+		return child.name == name
+	})
+	if index < 0 {
+		return nil
+	}
+	return cmd.children[index]
+}
+
+func (cmd *command) usage(w io.Writer, path []string) {
+	var name string = strings.Join(path, " ")
+	if len(cmd.children) > 0 {
+		fmt.Fprintf(w, "Usage: %s <command> [flags]\n\n", name)
+		if cmd.summary != "" {
+			fmt.Fprintf(w, "%s\n\n", cmd.summary)
+		}
+		fmt.Fprintln(w, "Commands:")
+		writer := tabwriter.NewWriter(w, 0, 4, 3, ' ', 0)
+		for _, child := range cmd.children {
+			fmt.Fprintf(writer, "  %s\t%s\n", strings.TrimSpace(child.name+" "+child.args), child.summary)
+		}
+		writer.Flush()
+		fmt.Fprintf(w, "\nRun '%s <command> -h' for the flags of a command\n", name)
+		return
+	}
+	fmt.Fprintf(w, "Usage: %s [flags]\n\n%s\n\nFlags:\n", strings.TrimSpace(name+" "+cmd.args), cmd.summary)
+}
+
+// execute finds the command named by args and runs it
+func execute(ctx context.Context, root *command, args []string, stdout io.Writer, stderr io.Writer) error {
+	var g *globals = &globals{}
+	rootFlags := flag.NewFlagSet(root.name, flag.ContinueOnError)
+	rootFlags.SetOutput(stderr)
+	g.register(rootFlags)
+	rootFlags.Usage = func() {
+		root.usage(stderr, []string{root.name})
+		fmt.Fprintln(stderr, "\nGlobal flags:")
+		rootFlags.PrintDefaults()
+	}
+	err := rootFlags.Parse(args)
+	if err != nil {
+		return usageError(err)
+	}
+	args = rootFlags.Args()
+
+	var cmd *command = root
+	var path []string = []string{root.name}
+	for len(cmd.children) > 0 {
+		if len(args) == 0 || args[0] == "-h" || args[0] == "--help" || args[0] == "help" {
+			cmd.usage(stderr, path)
+			return flag.ErrHelp
+		}
+		next := cmd.child(args[0])
+		if next == nil {
+			cmd.usage(stderr, path)
+			return &ErrUsage{Message: fmt.Sprintf("unknown command %q", strings.Join(append(path[1:], args[0]), " "))}
+		}
+		cmd, path, args = next, append(path, next.name), args[1:]
+	}
+
+	flags := flag.NewFlagSet(strings.Join(path, " "), flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	// Global flags given before the command name count as given to the command
+	var given map[string]string = make(map[string]string)
+	rootFlags.Visit(func(f *flag.Flag) {
+		given[f.Name] = f.Value.String()
+	})
+	g.register(flags)
+	for name, value := range given {
+		flags.Set(name, value)
+	}
+	run := cmd.setup(flags)
+	flags.Usage = func() {
+		cmd.usage(stderr, path)
+		flags.PrintDefaults()
+	}
+	positional, err := parseInterspersed(flags, args)
+	if err != nil {
+		return usageError(err)
+	}
+	if cmd.nargs >= 0 && len(positional) != cmd.nargs {
+		flags.Usage()
+		return &ErrUsage{Message: fmt.Sprintf("%s expects %d arguments, found %d", strings.Join(path, " "), cmd.nargs, len(positional))}
+	}
+	switch g.output {
+	case OUTPUT_TABLE, OUTPUT_JSON, OUTPUT_YAML:
+	default:
+		return &ErrUsage{Message: fmt.Sprintf("output must be table, json or yaml, found %q", g.output)}
+	}
+	config, err := LoadConfig()
+	if err != nil {
+		return err
+	}
+	return run(&session{
+		ctx:     ctx,
+		globals: g,
+		stdout:  stdout,
+		stderr:  stderr,
+		config:  config,
+	}, positional)
+}
+
+// ErrUsage is a command line that does not match the command, the process exits with 2
+type ErrUsage struct {
+	Message string
+}
+
+func (err *ErrUsage) Error() string {
+	return err.Message
+}
+
+// usageError wraps the errors of flag parsing, the flag package already printed them with the usage
+func usageError(err error) error {
+	if errors.Is(err, flag.ErrHelp) {
+		return err
+	}
+	return &ErrUsage{Message: err.Error()}
+}
+
+// vmPath is the api path of a virtual machine given by id or tenant/name
+func vmPath(ref string, suffix string) string {
+	var segments []string = make([]string, 0, 2)
+	for _, segment := range strings.SplitN(ref, "/", 2) {
+		segments = append(segments, url.PathEscape(segment))
+	}
+	return composeUri("/api/vm", strings.Join(segments, "/"), suffix)
+}
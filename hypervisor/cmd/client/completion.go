@@ -0,0 +1,192 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"maps"
+	"slices"
+	"strings"
+)
+
+// Values completed for flags taking one of a few words, -context completes the configured contexts
+var completedFlagValues = map[string]string{
+	"o":      "table json yaml",
+	"source": "hypervisor serial",
+	"sort":   "created_at id name tenant state cpus memory",
+}
+
+func completionCommand(root *command) *command {
+	return &command{
+		name:    "completion",
+		args:    "<bash|zsh|fish>",
+		summary: "Print the shell completion script, e.g. source <(chmon completion bash)",
+		nargs:   1,
+		setup: func(flags *flag.FlagSet) runFunc {
+			return func(s *session, args []string) error {
+				switch args[0] {
+				case "bash":
+					return writeBashCompletion(s.stdout, root)
+				case "zsh":
+					fmt.Fprintln(s.stdout, "autoload -U +X bashcompinit && bashcompinit")
+					return writeBashCompletion(s.stdout, root)
+				case "fish":
+					return writeFishCompletion(s.stdout, root)
+				default:
+					return &ErrUsage{Message: fmt.Sprintf("unknown shell %q, expected bash, zsh or fish", args[0])}
+				}
+			}
+		},
+	}
+}
+
+// completionNode is a command with its path and, for leaves, its flags
+type completionNode struct {
+	path     string
+	commands []string
+	flags    []*flag.Flag
+}
+
+func completionNodes(cmd *command, path string) []completionNode {
+	node := completionNode{path: path}
+	var nodes []completionNode
+	if len(cmd.children) == 0 {
+		flags := flag.NewFlagSet(path, flag.ContinueOnError)
+		new(globals).register(flags)
+		cmd.setup(flags)
+		flags.VisitAll(func(f *flag.Flag) {
+			node.flags = append(node.flags, f)
+		})
+		return []completionNode{node}
+	}
+	for _, child := range cmd.children {
+		node.commands = append(node.commands, child.name)
+		nodes = append(nodes, completionNodes(child, strings.TrimSpace(path+" "+child.name))...)
+	}
+	return append([]completionNode{node}, nodes...)
+}
+
+func isBoolFlag(f *flag.Flag) bool {
+	boolFlag, ok := f.Value.(interface{ IsBoolFlag() bool })
+	return ok && boolFlag.IsBoolFlag()
+}
+
+func writeBashCompletion(w io.Writer, root *command) error {
+	var commands, flags strings.Builder
+	for _, node := range completionNodes(root, "") {
+		if len(node.commands) > 0 {
+			fmt.Fprintf(&commands, "        %q) echo %q ;;\n", node.path, strings.Join(node.commands, " "))
+			continue
+		}
+		var names []string = make([]string, 0, len(node.flags))
+		for _, f := range node.flags {
+			names = append(names, "-"+f.Name)
+		}
+		fmt.Fprintf(&flags, "        %q) echo %q ;;\n", node.path, strings.Join(names, " "))
+	}
+	var values strings.Builder
+	for _, name := range slices.Sorted(maps.Keys(completedFlagValues)) {
+		fmt.Fprintf(&values, "        -%s) echo %q ;;\n", name, completedFlagValues[name])
+	}
+	_, err := fmt.Fprintf(w, `# bash completion for chmon
+_chmon_commands() {
+    case "$1" in
+%s    esac
+}
+
+_chmon_flags() {
+    case "$1" in
+%s    esac
+}
+
+_chmon_values() {
+    case "$1" in
+%s        -context) chmon context list -q 2>/dev/null ;;
+    esac
+}
+
+_chmon() {
+    local cur="${COMP_WORDS[COMP_CWORD]}"
+    local prev="${COMP_WORDS[COMP_CWORD-1]}"
+    local values path word
+    values="$(_chmon_values "$prev")"
+    if [[ -n "$values" ]]; then
+        COMPREPLY=($(compgen -W "$values" -- "$cur"))
+        return
+    fi
+    path=""
+    for word in "${COMP_WORDS[@]:1:COMP_CWORD-1}"; do
+        if [[ " $(_chmon_commands "$path") " == *" $word "* ]]; then
+            path="${path:+$path }$word"
+        fi
+    done
+    if [[ -n "$(_chmon_commands "$path")" ]]; then
+        COMPREPLY=($(compgen -W "$(_chmon_commands "$path")" -- "$cur"))
+    elif [[ "$cur" == -* ]]; then
+        COMPREPLY=($(compgen -W "$(_chmon_flags "$path")" -- "$cur"))
+    elif [[ "$path" == "context use" || "$path" == "context delete" || "$path" == "context set" ]]; then
+        COMPREPLY=($(compgen -W "$(chmon context list -q 2>/dev/null)" -- "$cur"))
+    elif [[ "$path" == "completion" ]]; then
+        COMPREPLY=($(compgen -W "bash zsh fish" -- "$cur"))
+    fi
+}
+
+complete -o default -F _chmon chmon
+`, commands.String(), flags.String(), values.String())
+	return err
+}
+
+func fishQuote(value string) string {
+	return "'" + strings.ReplaceAll(strings.ReplaceAll(value, `\`, `\\`), "'", `\'`) + "'"
+}
+
+func writeFishCompletion(w io.Writer, root *command) error {
+	var commands strings.Builder
+	var completions strings.Builder
+	for _, node := range completionNodes(root, "") {
+		condition := fmt.Sprintf(`'__chmon_at "%s"'`, node.path)
+		if len(node.commands) > 0 {
+			fmt.Fprintf(&commands, "        case %s\n            printf '%%s\\n' %s\n", fishQuote(node.path), strings.Join(node.commands, " "))
+			fmt.Fprintf(&completions, "complete -c chmon -f -n %s -a %s\n", condition, fishQuote(strings.Join(node.commands, " ")))
+			continue
+		}
+		for _, f := range node.flags {
+			var line string = fmt.Sprintf("complete -c chmon -n %s -o %s -d %s", condition, f.Name, fishQuote(f.Usage))
+			if words, ok := completedFlagValues[f.Name]; ok {
+				line += " -x -a " + fishQuote(words)
+			} else if f.Name == "context" {
+				line += " -x -a '(chmon context list -q 2>/dev/null)'"
+			} else if !isBoolFlag(f) {
+				line += " -r"
+			}
+			fmt.Fprintln(&completions, line)
+		}
+	}
+	_, err := fmt.Fprintf(w, `# fish completion for chmon
+function __chmon_commands
+    switch "$argv[1]"
+%s    end
+end
+
+function __chmon_path
+    set -l tokens (commandline -opc)
+    set -e tokens[1]
+    set -l path
+    for token in $tokens
+        if contains -- $token (__chmon_commands "$path")
+            set path (string trim "$path $token")
+        end
+    end
+    echo $path
+end
+
+function __chmon_at
+    set -l path (__chmon_path)
+    test "$path" = "$argv[1]"
+end
+
+complete -c chmon -n '__chmon_at "context use"; or __chmon_at "context delete"; or __chmon_at "context set"' -f -a '(chmon context list -q 2>/dev/null)'
+complete -c chmon -n '__chmon_at "completion"' -f -a 'bash zsh fish'
+%s`, commands.String(), completions.String())
+	return err
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Monitor reached when no context is configured, the default address of the server
+const defaultHost = "http://127.0.0.1:8080"
+
+// HostContext is a monitor and the credentials used to reach it
+type HostContext struct {
+	Name     string `json:"name" yaml:"name"`
+	Host     string `json:"host" yaml:"host"`
+	Token    string `json:"token,omitempty" yaml:"token,omitempty"`
+	CaFile   string `json:"ca_file,omitempty" yaml:"ca_file,omitempty"`
+	CertFile string `json:"cert_file,omitempty" yaml:"cert_file,omitempty"`
+	KeyFile  string `json:"key_file,omitempty" yaml:"key_file,omitempty"`
+	// Tenant used by commands taking a tenant when none is given
+	Tenant string `json:"tenant,omitempty" yaml:"tenant,omitempty"`
+}
+
+// Config is stored in $CHMON_CONFIG, by default chmon/config.yaml in the user config folder.
+// It holds tokens, so it is only readable by its owner
+type Config struct {
+	CurrentContext string        `json:"current_context" yaml:"current_context"`
+	Contexts       []HostContext `json:"contexts" yaml:"contexts"`
+	path           string
+}
+
+func configPath() (string, error) {
+	if path := os.Getenv("CHMON_CONFIG"); path != "" {
+		return path, nil
+	}
+	folder, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(folder, "chmon", "config.yaml"), nil
+}
+
+// LoadConfig returns an empty config when the file does not exist yet
+func LoadConfig() (*Config, error) {
+	path, err := configPath()
+	if err != nil {
+		return nil, err
+	}
+	config := &Config{path: path}
+	content, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return config, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = yaml.Unmarshal(content, config)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %w", path, err)
+	}
+	return config, nil
+}
+
+func (config *Config) Save() error {
+	content, err := yaml.Marshal(config)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(config.path), 0700)
+	if err != nil {
+		return err
+	}
+	var tmpPath string = config.path + ".tmp"
+	err = os.WriteFile(tmpPath, content, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, config.path)
+}
+
+func (config *Config) Get(name string) (*HostContext, bool) {
+	index := slices.IndexFunc(config.Contexts, func(context HostContext) bool {
+		return context.Name == name
+	})
+	if index < 0 {
+		return nil, false
+	}
+	return &config.Contexts[index], true
+}
+
+// Set adds the context or replaces the one with the same name
+func (config *Config) Set(context HostContext) {
+	if current, ok := config.Get(context.Name); ok {
+		*current = context
+		return
+	}
+	config.Contexts = append(config.Contexts, context)
+}
+
+func (config *Config) Delete(name string) bool {
+	var before int = len(config.Contexts)
+	config.Contexts = slices.DeleteFunc(config.Contexts, func(context HostContext) bool {
+		return context.Name == name
+	})
+	if config.CurrentContext == name {
+		config.CurrentContext = ""
+	}
+	return len(config.Contexts) < before
+}
+
+// Resolve picks the context named by name, or the current one. Without any context
+// the monitor listening on the default address is used
+func (config *Config) Resolve(name string) (HostContext, error) {
+	if name == "" {
+		name = config.CurrentContext
+	}
+	if name == "" {
+		return HostContext{Host: defaultHost}, nil
+	}
+	context, ok := config.Get(name)
+	if !ok {
+		return HostContext{}, fmt.Errorf("context %s is not found in %s", name, config.path)
+	}
+	return *context, nil
+}
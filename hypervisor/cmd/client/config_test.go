@@ -0,0 +1,53 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Config_Save(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "chmon", "config.yaml")
+	t.Setenv("CHMON_CONFIG", path)
+	config, err := LoadConfig()
+	assert.Nil(t, err, "A missing config is empty")
+	assert.Empty(t, config.Contexts)
+
+	config.Set(HostContext{Name: "lab", Host: "https://lab:8443", Token: "secret"})
+	config.Set(HostContext{Name: "local", Host: "unix:///run/chmon.sock"})
+	config.Set(HostContext{Name: "lab", Host: "https://lab:9443", Tenant: "11111111-2222-3333-4444-555555555555"})
+	config.CurrentContext = "lab"
+	assert.Nil(t, config.Save())
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), "Tokens are only readable by the owner")
+
+	loaded, err := LoadConfig()
+	assert.Nil(t, err)
+	assert.Len(t, loaded.Contexts, 2, "A context with the same name is replaced")
+	context, err := loaded.Resolve("")
+	assert.Nil(t, err)
+	assert.Equal(t, HostContext{Name: "lab", Host: "https://lab:9443", Tenant: "11111111-2222-3333-4444-555555555555"}, context)
+	context, err = loaded.Resolve("local")
+	assert.Nil(t, err)
+	assert.Equal(t, "unix:///run/chmon.sock", context.Host)
+	_, err = loaded.Resolve("missing")
+	assert.NotNil(t, err)
+
+	assert.True(t, loaded.Delete("lab"))
+	assert.False(t, loaded.Delete("lab"))
+	assert.Empty(t, loaded.CurrentContext, "Deleting the current context unsets it")
+	context, err = loaded.Resolve("")
+	assert.Nil(t, err)
+	assert.Equal(t, defaultHost, context.Host, "Without current context the default monitor is used")
+}
+
+func Test_Config_LoadInvalid(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	t.Setenv("CHMON_CONFIG", path)
+	assert.Nil(t, os.WriteFile(path, []byte("contexts: {"), 0600))
+	_, err := LoadConfig()
+	assert.NotNil(t, err)
+}
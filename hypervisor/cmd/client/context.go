@@ -0,0 +1,152 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+func contextCommand() *command {
+	return &command{
+		name:    "context",
+		summary: "Manage the monitors reached by chmon and their credentials",
+		children: []*command{
+			{name: "list", summary: "List contexts, the current one is marked with *", nargs: 0, setup: contextList},
+			{name: "current", summary: "Print the current context", nargs: 0, setup: contextCurrent},
+			{name: "use", args: "<name>", summary: "Make a context the current one", nargs: 1, setup: contextUse},
+			{name: "set", args: "<name>", summary: "Create or update a context, -host and -token set its monitor and token", nargs: 1, setup: contextSet},
+			{name: "delete", args: "<name>", summary: "Delete a context", nargs: 1, setup: contextDelete},
+		},
+	}
+}
+
+// Tokens are never printed, only whether the context has one
+func redacted(context HostContext) HostContext {
+	if context.Token != "" {
+		context.Token = "<redacted>"
+	}
+	return context
+}
+
+func contextList(flags *flag.FlagSet) runFunc {
+	var quiet bool
+	flags.BoolVar(&quiet, "q", false, "Only print the names")
+	return func(s *session, args []string) error {
+		if quiet {
+			for _, context := range s.config.Contexts {
+				fmt.Fprintln(s.stdout, context.Name)
+			}
+			return nil
+		}
+		var contexts []HostContext = make([]HostContext, 0, len(s.config.Contexts))
+		for _, context := range s.config.Contexts {
+			contexts = append(contexts, redacted(context))
+		}
+		return s.print(contexts, func() table {
+			t := table{header: []string{"CURRENT", "NAME", "HOST", "TENANT", "AUTH"}}
+			for _, context := range s.config.Contexts {
+				var current string = ""
+				if context.Name == s.config.CurrentContext {
+					current = "*"
+				}
+				var auth string = "-"
+				switch {
+				case context.Token != "":
+					auth = "token"
+				case context.CertFile != "":
+					auth = "certificate"
+				}
+				t.rows = append(t.rows, []string{current, context.Name, context.Host, orDash(context.Tenant), auth})
+			}
+			return t
+		})
+	}
+}
+
+func contextCurrent(flags *flag.FlagSet) runFunc {
+	return func(s *session, args []string) error {
+		if s.config.CurrentContext == "" {
+			return fmt.Errorf("no current context, chmon reaches %s", defaultHost)
+		}
+		context, err := s.config.Resolve("")
+		if err != nil {
+			return err
+		}
+		return s.message(redacted(context), "%s", context.Name)
+	}
+}
+
+func contextUse(flags *flag.FlagSet) runFunc {
+	return func(s *session, args []string) error {
+		if _, ok := s.config.Get(args[0]); !ok {
+			return fmt.Errorf("context %s is not found", args[0])
+		}
+		s.config.CurrentContext = args[0]
+		err := s.config.Save()
+		if err != nil {
+			return err
+		}
+		return s.message(map[string]string{"current_context": args[0]}, "Switched to context %s", args[0])
+	}
+}
+
+func contextSet(flags *flag.FlagSet) runFunc {
+	var caFile, certFile, keyFile, tenant string
+	var use bool
+	flags.StringVar(&caFile, "ca-file", "", "Certificate authority of the monitor")
+	flags.StringVar(&certFile, "cert-file", "", "Client certificate")
+	flags.StringVar(&keyFile, "key-file", "", "Key of the client certificate")
+	flags.StringVar(&tenant, "tenant", "", "Default tenant of the commands")
+	flags.BoolVar(&use, "use", false, "Make the context the current one")
+	return func(s *session, args []string) error {
+		context := HostContext{Name: args[0]}
+		if existing, ok := s.config.Get(args[0]); ok {
+			context = *existing
+		}
+		// Only the flags given on the command line change an existing context
+		flags.Visit(func(f *flag.Flag) {
+			switch f.Name {
+			case "host":
+				context.Host = s.globals.host
+			case "token":
+				context.Token = s.globals.token
+			case "ca-file":
+				context.CaFile = caFile
+			case "cert-file":
+				context.CertFile = certFile
+			case "key-file":
+				context.KeyFile = keyFile
+			case "tenant":
+				context.Tenant = tenant
+			}
+		})
+		if context.Host == "" {
+			return &ErrUsage{Message: "a new context needs a monitor, use -host"}
+		}
+		_, err := NewClient(ClientOptions{Host: context.Host, CaFile: context.CaFile, CertFile: context.CertFile, KeyFile: context.KeyFile})
+		if err != nil {
+			return err
+		}
+		s.config.Set(context)
+		if use || len(s.config.Contexts) == 1 {
+			s.config.CurrentContext = context.Name
+		}
+		err = s.config.Save()
+		if err != nil {
+			return err
+		}
+		return s.message(redacted(context), "Context %s saved", context.Name)
+	}
+}
+
+func contextDelete(flags *flag.FlagSet) runFunc {
+	return func(s *session, args []string) error {
+		if !s.config.Delete(args[0]) {
+			return fmt.Errorf("context %s is not found", args[0])
+		}
+		err := s.config.Save()
+		if err != nil {
+			return err
+		}
+		return s.message(map[string]string{"deleted": args[0]}, "Context %s deleted", args[0])
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// run executes a chmon command line and returns its standard output
+func run(t *testing.T, args ...string) (string, error) {
+	var stdout, stderr bytes.Buffer
+	err := execute(context.Background(), rootCommand(), args, &stdout, &stderr)
+	return stdout.String(), err
+}
+
+func Test_contextSet(t *testing.T) {
+	t.Setenv("CHMON_CONFIG", filepath.Join(t.TempDir(), "config.yaml"))
+	t.Setenv("CHMON_CONTEXT", "")
+	t.Setenv("CHMON_HOST", "")
+	t.Setenv("CHMON_TOKEN", "")
+
+	_, err := run(t, "context", "set", "lab")
+	var errUsage *ErrUsage
+	assert.ErrorAs(t, err, &errUsage, "A new context needs a monitor")
+	_, err = run(t, "context", "set", "lab", "-host", "ftp://lab")
+	assert.NotNil(t, err, "The monitor must be reachable by the client")
+
+	_, err = run(t, "context", "set", "lab", "-host", "https://lab:8443", "-token", "secret")
+	assert.Nil(t, err)
+	_, err = run(t, "context", "set", "local", "-host", "unix:///run/chmon.sock")
+	assert.Nil(t, err)
+	out, err := run(t, "context", "current")
+	assert.Nil(t, err)
+	assert.Equal(t, "lab\n", out, "The first context becomes the current one")
+
+	_, err = run(t, "context", "set", "lab", "-tenant", "11111111-2222-3333-4444-555555555555")
+	assert.Nil(t, err)
+	out, err = run(t, "context", "list", "-o", "json")
+	assert.Nil(t, err)
+	var contexts []HostContext
+	assert.Nil(t, json.Unmarshal([]byte(out), &contexts))
+	assert.Equal(t, []HostContext{
+		{Name: "lab", Host: "https://lab:8443", Token: "<redacted>", Tenant: "11111111-2222-3333-4444-555555555555"},
+		{Name: "local", Host: "unix:///run/chmon.sock"},
+	}, contexts, "Only the flags given change a context and tokens are never printed")
+
+	_, err = run(t, "context", "use", "local")
+	assert.Nil(t, err)
+	out, err = run(t, "context", "current")
+	assert.Nil(t, err)
+	assert.Equal(t, "local\n", out)
+	_, err = run(t, "context", "use", "missing")
+	assert.NotNil(t, err)
+	_, err = run(t, "context", "delete", "local")
+	assert.Nil(t, err)
+	_, err = run(t, "context", "current")
+	assert.NotNil(t, err, "Deleting the current context unsets it")
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"time"
+	virtualmachine "vmm/virtual_machine"
+)
+
+func diskCommand() *command {
+	return &command{
+		name:    "disk",
+		summary: "Upload, list and resize the disks of virtual machines",
+		children: []*command{
+			{name: "upload", args: "<vm> <file>", summary: "Upload a disk image to a virtual machine", nargs: 2, setup: uploadFile(UPLOAD_DISK)},
+			{name: "list", args: "<vm>", summary: "List the disks of a virtual machine", nargs: 1, setup: diskList},
+			{name: "resize", args: "<vm> <disk>", summary: "Grow a disk of a stopped virtual machine", nargs: 2, setup: diskResize},
+		},
+	}
+}
+
+func kernelCommand() *command {
+	return &command{
+		name:    "kernel",
+		summary: "Upload kernels of virtual machines",
+		children: []*command{
+			{name: "upload", args: "<vm> <file>", summary: "Upload a kernel to a virtual machine", nargs: 2, setup: uploadFile(UPLOAD_KERNEL)},
+		},
+	}
+}
+
+func uploadFile(kind string) func(flags *flag.FlagSet) runFunc {
+	return func(flags *flag.FlagSet) runFunc {
+		var name, chunkSize string
+		var opts uploadOptions
+		flags.StringVar(&name, "name", "", "Name of the file on the monitor, defaults to the local file name")
+		flags.IntVar(&opts.concurrency, "concurrency", defaultConcurrency, "Chunks sent in parallel")
+		flags.StringVar(&chunkSize, "chunk-size", formatBytes(defaultChunkSize), "Size of the chunks, e.g. 8M")
+		flags.IntVar(&opts.retries, "retries", defaultRetries, "Attempts of a failed chunk after the first one")
+		flags.BoolVar(&opts.resume, "resume", true, "Continue a pending upload of the same file, disks only")
+		return func(s *session, args []string) error {
+			var err error
+			opts.chunkSize, err = parseSize(chunkSize)
+			if err != nil || opts.chunkSize <= 0 {
+				return &ErrUsage{Message: fmt.Sprintf("invalid chunk size %q", chunkSize)}
+			}
+			if opts.concurrency < 1 || opts.retries < 0 {
+				return &ErrUsage{Message: "-concurrency must be positive and -retries not negative"}
+			}
+			client, err := s.Client()
+			if err != nil {
+				return err
+			}
+			if name == "" {
+				name = filepath.Base(args[1])
+			}
+			u := &upload{kind: kind, virtualMachine: args[0], path: args[1], name: name}
+			var started time.Time = time.Now()
+			err = runUpload(s, client, u, opts)
+			if errors.Is(err, context.Canceled) && kind == UPLOAD_DISK {
+				return errors.New("upload interrupted, run the same command to resume it")
+			}
+			if err != nil {
+				return err
+			}
+			var elapsed time.Duration = time.Since(started)
+			return s.message(map[string]any{"vm": args[0], "name": name, "size": u.size, "sha256": u.sha256, "resumed": u.resumed},
+				"%s uploaded to %s, %s in %s, sha256 %s", name, args[0], formatBytes(u.size), elapsed.Round(time.Millisecond), u.sha256)
+		}
+	}
+}
+
+func diskList(flags *flag.FlagSet) runFunc {
+	return func(s *session, args []string) error {
+		client, err := s.Client()
+		if err != nil {
+			return err
+		}
+		var disks []virtualmachine.DiskFile
+		err = client.Call(s.ctx, http.MethodGet, vmPath(args[0], "disks"), nil, nil, &disks)
+		if err != nil {
+			return err
+		}
+		return s.print(disks, func() table {
+			t := table{header: []string{"NAME", "SIZE", "ATTACHED"}}
+			for _, disk := range disks {
+				t.rows = append(t.rows, []string{disk.Name, formatBytes(disk.Size), strconv.FormatBool(disk.Attached)})
+			}
+			return t
+		})
+	}
+}
+
+func diskResize(flags *flag.FlagSet) runFunc {
+	var size string
+	flags.StringVar(&size, "size", "", "New size, e.g. 20G, disks only grow")
+	return func(s *session, args []string) error {
+		bytes, err := parseSize(size)
+		if err != nil || bytes == 0 {
+			return &ErrUsage{Message: "a size is required, e.g. -size 20G"}
+		}
+		client, err := s.Client()
+		if err != nil {
+			return err
+		}
+		var disk virtualmachine.DiskFile
+		err = client.Call(s.ctx, http.MethodPut, vmPath(args[0], composeUri("disks", url.PathEscape(args[1]), "resize")), nil, map[string]int64{"size": bytes}, &disk)
+		if err != nil {
+			return err
+		}
+		return s.message(disk, "%s of %s resized to %s", disk.Name, args[0], formatBytes(disk.Size))
+	}
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+	"vmm/events"
+)
+
+// Delay before reconnecting to the events stream of the monitor
+const eventsReconnectDelay = 2 * time.Second
+
+func eventsCommand() *command {
+	return &command{
+		name:    "events",
+		summary: "Follow the events of the monitor",
+		nargs:   0,
+		setup:   eventsFollow,
+	}
+}
+
+// readEvents decodes a server sent events stream. lastId is updated with every event
+// carrying an id, so a reconnection resumes after it
+func readEvents(body io.Reader, lastId *uint64, handle func(events.Event) error) error {
+	scanner := bufio.NewScanner(body)
+	scanner.Buffer(make([]byte, 64*1024), 4*1024*1024)
+	var data strings.Builder
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case line == "":
+			if data.Len() == 0 {
+				continue
+			}
+			var event events.Event
+			err := json.Unmarshal([]byte(data.String()), &event)
+			data.Reset()
+			if err != nil {
+				return fmt.Errorf("unexpected event from the monitor: %w", err)
+			}
+			if event.Id != 0 {
+				*lastId = event.Id
+			}
+			err = handle(event)
+			if err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, "data:"):
+			data.WriteString(strings.TrimPrefix(strings.TrimPrefix(line, "data:"), " "))
+		}
+	}
+	return scanner.Err()
+}
+
+// streamEvents follows /api/events until ctx ends, the stream is reopened when the connection drops
+func streamEvents(ctx context.Context, client *Client, query url.Values, lastId uint64, handle func(events.Event) error) error {
+	for {
+		header := http.Header{}
+		if lastId != 0 {
+			header.Set("Last-Event-ID", strconv.FormatUint(lastId, 10))
+		}
+		body, err := client.Stream(ctx, "/api/events", query, header)
+		if err == nil {
+			err = readEvents(body, &lastId, handle)
+			body.Close()
+		}
+		if ctx.Err() != nil {
+			return nil
+		}
+		var errApi *ErrApi
+		if errors.As(err, &errApi) && errApi.Status < 500 {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(eventsReconnectDelay):
+		}
+	}
+}
+
+func eventsFollow(flags *flag.FlagSet) runFunc {
+	var types, vm, tenant string
+	var since uint64
+	flags.StringVar(&types, "type", "", "Comma separated event types, a trailing dot or star matches a prefix, e.g. vm.*,upload.")
+	flags.StringVar(&vm, "vm", "", "Only the events of this virtual machine")
+	flags.StringVar(&tenant, "tenant", "", "Only the events of this tenant, defaults to the tenant of the context")
+	flags.Uint64Var(&since, "since", 0, "Replay the journal after this event id")
+	return func(s *session, args []string) error {
+		client, err := s.Client()
+		if err != nil {
+			return err
+		}
+		query := url.Values{}
+		for _, eventType := range strings.Split(types, ",") {
+			if eventType = strings.TrimSpace(eventType); eventType != "" {
+				query.Add("type", eventType)
+			}
+		}
+		setQuery(query, "vm", vm)
+		setQuery(query, "tenant", s.tenant(tenant))
+		var encoder *json.Encoder = json.NewEncoder(s.stdout)
+		return streamEvents(s.ctx, client, query, since, func(event events.Event) error {
+			switch s.globals.output {
+			case OUTPUT_JSON:
+				return encoder.Encode(event)
+			case OUTPUT_YAML:
+				fmt.Fprintln(s.stdout, "---")
+				return writeYaml(s.stdout, event)
+			default:
+				data, _ := json.Marshal(event.Data)
+				if event.Data == nil {
+					data = nil
+				}
+				_, err := fmt.Fprintf(s.stdout, "%s  %-22s %-36s %s\n", event.Time.Local().Format(time.DateTime), event.Type, orDash(event.VirtualMachine), data)
+				return err
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+func writeJson(w io.Writer, value any) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	encoder.SetEscapeHTML(false)
+	return encoder.Encode(value)
+}
+
+// writeYaml goes through json so fields are named as in the api, in the same order
+func writeYaml(w io.Writer, value any) error {
+	content, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	var document yaml.Node
+	err = yaml.Unmarshal(content, &document)
+	if err != nil {
+		return err
+	}
+	blockStyle(&document)
+	encoder := yaml.NewEncoder(w)
+	encoder.SetIndent(2)
+	err = encoder.Encode(&document)
+	if err != nil {
+		return err
+	}
+	return encoder.Close()
+}
+
+// blockStyle drops the flow style and quotes of json, the encoder quotes strings when needed
+func blockStyle(node *yaml.Node) {
+	node.Style = 0
+	for _, child := range node.Content {
+		blockStyle(child)
+	}
+}
+
+var sizeUnits = []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB"}
+
+func formatBytes(size int64) string {
+	var value float64 = float64(size)
+	var unit int = 0
+	for value >= 1024 && unit < len(sizeUnits)-1 {
+		value /= 1024
+		unit++
+	}
+	if unit == 0 {
+		return fmt.Sprintf("%d B", size)
+	}
+	return fmt.Sprintf("%.1f %s", value, sizeUnits[unit])
+}
+
+// parseSize accepts bytes or a number with a binary unit, e.g. 512M, 20G or 1.5TiB
+func parseSize(value string) (int64, error) {
+	var raw string = strings.TrimSuffix(strings.TrimSuffix(strings.ToUpper(strings.TrimSpace(value)), "B"), "I")
+	var multiplier float64 = 1
+	if raw != "" {
+		if index := strings.IndexByte("KMGTP", raw[len(raw)-1]); index >= 0 {
+			multiplier = float64(int64(1) << (10 * (index + 1)))
+			raw = raw[:len(raw)-1]
+		}
+	}
+	number, err := strconv.ParseFloat(strings.TrimSpace(raw), 64)
+	if err != nil || number < 0 {
+		return 0, fmt.Errorf("invalid size %q, expected bytes or a number followed by K, M, G, T or P", value)
+	}
+	return int64(number * multiplier), nil
+}
+
+// formatAge is the time elapsed since t, rounded to its two largest units
+func formatAge(t time.Time) string {
+	if t.IsZero() {
+		return "-"
+	}
+	var elapsed time.Duration = time.Since(t)
+	switch {
+	case elapsed < time.Minute:
+		return fmt.Sprintf("%ds", int(elapsed.Seconds()))
+	case elapsed < time.Hour:
+		return fmt.Sprintf("%dm%ds", int(elapsed.Minutes()), int(elapsed.Seconds())%60)
+	case elapsed < 24*time.Hour:
+		return fmt.Sprintf("%dh%dm", int(elapsed.Hours()), int(elapsed.Minutes())%60)
+	default:
+		return fmt.Sprintf("%dd%dh", int(elapsed.Hours())/24, int(elapsed.Hours())%24)
+	}
+}
+
+func orDash(value string) string {
+	if value == "" {
+		return "-"
+	}
+	return value
+}
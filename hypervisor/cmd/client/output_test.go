@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type outputItem struct {
+	Name   string            `json:"name"`
+	Size   int64             `json:"size"`
+	Labels map[string]string `json:"labels,omitempty"`
+}
+
+func Test_session_print(t *testing.T) {
+	value := []outputItem{{Name: "root.raw", Size: 512, Labels: map[string]string{"tier": "front"}}, {Name: "data: raw", Size: 1024}}
+	rows := func() table {
+		t := table{header: []string{"NAME", "SIZE"}}
+		for _, item := range value {
+			t.rows = append(t.rows, []string{item.Name, formatBytes(item.Size)})
+		}
+		return t
+	}
+	tests := []struct {
+		output   string
+		expected string
+	}{
+		{output: OUTPUT_TABLE, expected: "NAME        SIZE\nroot.raw    512 B\ndata: raw   1.0 KiB\n"},
+		{output: OUTPUT_JSON, expected: "[\n  {\n    \"name\": \"root.raw\",\n    \"size\": 512,\n    \"labels\": {\n      \"tier\": \"front\"\n    }\n  },\n  {\n    \"name\": \"data: raw\",\n    \"size\": 1024\n  }\n]\n"},
+		{output: OUTPUT_YAML, expected: "- name: root.raw\n  size: 512\n  labels:\n    tier: front\n- name: 'data: raw'\n  size: 1024\n"},
+	}
+	for _, test := range tests {
+		var stdout bytes.Buffer
+		s := &session{globals: &globals{output: test.output}, stdout: &stdout}
+		assert.Nil(t, s.print(value, rows))
+		assert.Equal(t, test.expected, stdout.String(), test.output)
+	}
+}
+
+func Test_session_message(t *testing.T) {
+	var stdout bytes.Buffer
+	s := &session{globals: &globals{output: OUTPUT_TABLE}, stdout: &stdout}
+	assert.Nil(t, s.message(map[string]string{"deleted": "web"}, "Virtual machine %s deleted", "web"))
+	assert.Equal(t, "Virtual machine web deleted\n", stdout.String())
+	stdout.Reset()
+	s.globals.output = OUTPUT_JSON
+	assert.Nil(t, s.message(map[string]string{"deleted": "web"}, "Virtual machine %s deleted", "web"))
+	assert.Equal(t, "{\n  \"deleted\": \"web\"\n}\n", stdout.String(), "Json and yaml get the value instead of the message")
+}
+
+func Test_execute_output(t *testing.T) {
+	_, err := run(t, "context", "list", "-o", "xml")
+	var errUsage *ErrUsage
+	assert.ErrorAs(t, err, &errUsage, "Unknown output formats are rejected")
+}
+
+func Test_parseSize(t *testing.T) {
+	for value, expected := range map[string]int64{"512": 512, "4K": 4096, "512M": 512 << 20, "20G": 20 << 30, "1.5TiB": 3 << 39, "2gb": 2 << 30} {
+		size, err := parseSize(value)
+		assert.Nil(t, err, value)
+		assert.Equal(t, expected, size, value)
+	}
+	for _, value := range []string{"", "-1", "12X", "G"} {
+		_, err := parseSize(value)
+		assert.NotNil(t, err, value)
+	}
+}
+
+func Test_formatAge(t *testing.T) {
+	assert.Equal(t, "-", formatAge(time.Time{}))
+	assert.Equal(t, "1h30m", formatAge(time.Now().Add(-90*time.Minute)))
+	assert.Equal(t, "2d3h", formatAge(time.Now().Add(-51*time.Hour)))
+}
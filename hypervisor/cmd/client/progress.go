@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/x/term"
+)
+
+const (
+	progressRefresh = 250 * time.Millisecond
+	// Throughput is averaged over this window so the ETA follows the current speed
+	throughputWindow = 5 * time.Second
+	progressBarWidth = 40
+)
+
+// isTerminal tells whether w is attached to a terminal, the progress view is only drawn there
+func isTerminal(w io.Writer) bool {
+	file, ok := w.(*os.File)
+	return ok && term.IsTerminal(file.Fd())
+}
+
+type tickMsg time.Time
+
+func tick() tea.Cmd {
+	return tea.Tick(progressRefresh, func(t time.Time) tea.Msg {
+		return tickMsg(t)
+	})
+}
+
+type rateSample struct {
+	at   time.Time
+	done int64
+}
+
+// uploadModel is the progress view of an upload, fed with the messages reported by upload.run
+type uploadModel struct {
+	title     string
+	phase     string
+	total     int64
+	done      int64
+	resumed   int64
+	samples   []rateSample
+	retries   int
+	lastRetry string
+	width     int
+	cancel    context.CancelFunc
+	canceled  bool
+	finished  bool
+}
+
+func (m *uploadModel) Init() tea.Cmd {
+	return tick()
+}
+
+func (m *uploadModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.KeyMsg:
+		if msg.String() == "ctrl+c" {
+			m.canceled = true
+			m.cancel()
+		}
+	case tea.WindowSizeMsg:
+		m.width = msg.Width
+	case phaseMsg:
+		m.phase = msg.phase
+		m.total = msg.total
+		m.resumed = msg.resumed
+		m.done = msg.resumed
+		m.samples = []rateSample{{at: time.Now(), done: m.done}}
+	case progressMsg:
+		m.done += msg.bytes
+	case retryMsg:
+		m.retries++
+		m.lastRetry = fmt.Sprintf("bytes at %d, attempt %d: %s", msg.offset, msg.attempt, msg.err.Error())
+	case tickMsg:
+		var now time.Time = time.Time(msg)
+		m.samples = append(m.samples, rateSample{at: now, done: m.done})
+		for len(m.samples) > 2 && now.Sub(m.samples[0].at) > throughputWindow {
+			m.samples = m.samples[1:]
+		}
+		return m, tick()
+	case doneMsg:
+		m.finished = true
+		return m, tea.Quit
+	}
+	return m, nil
+}
+
+// throughput is in bytes per second over the samples of the window
+func (m *uploadModel) throughput() float64 {
+	if len(m.samples) < 2 {
+		return 0
+	}
+	first, last := m.samples[0], m.samples[len(m.samples)-1]
+	var elapsed float64 = last.at.Sub(first.at).Seconds()
+	if elapsed <= 0 {
+		return 0
+	}
+	return float64(last.done-first.done) / elapsed
+}
+
+func formatEta(d time.Duration) string {
+	d = d.Round(time.Second)
+	switch {
+	case d < time.Minute:
+		return fmt.Sprintf("%ds", int(d.Seconds()))
+	case d < time.Hour:
+		return fmt.Sprintf("%dm%02ds", int(d.Minutes()), int(d.Seconds())%60)
+	default:
+		return fmt.Sprintf("%dh%02dm", int(d.Hours()), int(d.Minutes())%60)
+	}
+}
+
+func (m *uploadModel) bar(ratio float64) string {
+	var width int = progressBarWidth
+	if m.width > 0 {
+		width = max(10, min(width, m.width-60))
+	}
+	var filled int = int(ratio * float64(width))
+	return "[" + strings.Repeat("█", filled) + strings.Repeat("░", width-filled) + "]"
+}
+
+func (m *uploadModel) View() string {
+	if m.finished {
+		return ""
+	}
+	var view strings.Builder
+	fmt.Fprintf(&view, "%s, %s\n", m.title, m.phase)
+	var ratio float64 = 0
+	if m.total > 0 {
+		ratio = min(float64(m.done)/float64(m.total), 1)
+	}
+	var rate float64 = m.throughput()
+	var eta string = "-"
+	if rate > 0 {
+		eta = formatEta(time.Duration(float64(m.total-m.done) / rate * float64(time.Second)))
+	}
+	fmt.Fprintf(&view, "%s %3.0f%%  %s / %s  %s/s  ETA %s\n", m.bar(ratio), ratio*100, formatBytes(m.done), formatBytes(m.total), formatBytes(int64(rate)), eta)
+	if m.resumed > 0 && m.phase == PHASE_UPLOADING {
+		fmt.Fprintf(&view, "Resumed, %s were already on the monitor\n", formatBytes(m.resumed))
+	}
+	if m.retries > 0 {
+		fmt.Fprintf(&view, "%d retries, last %s\n", m.retries, m.lastRetry)
+	}
+	if m.canceled {
+		view.WriteString("Stopping...\n")
+	}
+	return view.String()
+}
+
+// runUpload runs u with the progress view when stderr is a terminal, otherwise retries are logged on stderr
+func runUpload(s *session, client *Client, u *upload, opts uploadOptions) error {
+	if s.globals.output != OUTPUT_TABLE || !isTerminal(s.stderr) {
+		u.report = func(msg any) {
+			if retry, ok := msg.(retryMsg); ok {
+				fmt.Fprintf(s.stderr, "Retrying bytes at %d, attempt %d: %s\n", retry.offset, retry.attempt, retry.err.Error())
+			}
+		}
+		return u.run(s.ctx, client, opts)
+	}
+	ctx, cancel := context.WithCancel(s.ctx)
+	defer cancel()
+	model := &uploadModel{
+		title:  fmt.Sprintf("Uploading %s %s to %s", u.kind, u.name, u.virtualMachine),
+		phase:  PHASE_HASHING,
+		cancel: cancel,
+	}
+	var options []tea.ProgramOption = []tea.ProgramOption{tea.WithOutput(s.stderr)}
+	if !term.IsTerminal(os.Stdin.Fd()) {
+		options = append(options, tea.WithInput(nil))
+	}
+	program := tea.NewProgram(model, options...)
+	u.report = func(msg any) {
+		program.Send(msg)
+	}
+	var result chan error = make(chan error, 1)
+	go func() {
+		err := u.run(ctx, client, opts)
+		result <- err
+		program.Send(doneMsg{err: err})
+	}()
+	_, err := program.Run()
+	if err != nil {
+		cancel()
+	}
+	var uploadErr error = <-result
+	if uploadErr != nil {
+		return uploadErr
+	}
+	return err
+}
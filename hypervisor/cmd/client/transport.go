@@ -0,0 +1,217 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// Requests sent over a unix socket still need a host in the url, the dialer ignores it
+const unixSocketBaseUrl = "http://unix"
+
+// ClientOptions describe how to reach a monitor, Host is http(s)://host:port or unix:///path/to/socket
+type ClientOptions struct {
+	Host  string
+	Token string
+	// Certificate authority of the monitor, the system pool is used when empty
+	CaFile string
+	// Client certificate, for monitors authenticating certificates
+	CertFile string
+	KeyFile  string
+}
+
+// Client sends api requests to a monitor reached over tcp or over its unix socket
+type Client struct {
+	baseUrl    string
+	token      string
+	httpClient *http.Client
+}
+
+// ErrApi is an answer of the monitor outside of 2xx, Message is the body
+type ErrApi struct {
+	Status  int
+	Message string
+}
+
+func (err *ErrApi) Error() string {
+	if err.Message == "" {
+		return http.StatusText(err.Status)
+	}
+	return fmt.Sprintf("%s (%d)", err.Message, err.Status)
+}
+
+// NewClient builds a client without timeout, requests are bounded by their context.
+// The token is optional on the unix socket, where the monitor authenticates the process by its credentials
+func NewClient(opts ClientOptions) (*Client, error) {
+	parsed, err := url.Parse(opts.Host)
+	if err != nil {
+		return nil, fmt.Errorf("invalid host %s: %w", opts.Host, err)
+	}
+	transport := &http.Transport{
+		Proxy:               http.ProxyFromEnvironment,
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: 10,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	var baseUrl string
+	switch parsed.Scheme {
+	case "unix":
+		var socket string = parsed.Path
+		if socket == "" {
+			return nil, fmt.Errorf("invalid host %s: the socket path is missing", opts.Host)
+		}
+		var dialer net.Dialer
+		transport.Proxy = nil
+		transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return dialer.DialContext(ctx, "unix", socket)
+		}
+		baseUrl = unixSocketBaseUrl
+	case "http", "https":
+		baseUrl = strings.TrimRight(opts.Host, "/")
+		transport.TLSClientConfig, err = clientTlsConfig(opts)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("invalid host %s: the scheme must be http, https or unix", opts.Host)
+	}
+	return &Client{
+		baseUrl: baseUrl,
+		token:   opts.Token,
+		httpClient: &http.Client{
+			Transport: transport,
+		},
+	}, nil
+}
+
+func clientTlsConfig(opts ClientOptions) (*tls.Config, error) {
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if opts.CaFile != "" {
+		content, err := os.ReadFile(opts.CaFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(content) {
+			return nil, fmt.Errorf("no certificate found in %s", opts.CaFile)
+		}
+	}
+	if opts.CertFile != "" || opts.KeyFile != "" {
+		certificate, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+	return config, nil
+}
+
+// NewRequest builds a request to path, relative to the root of the monitor
+func (client *Client) NewRequest(ctx context.Context, method string, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, composeUri(client.baseUrl, path), body)
+	if err != nil {
+		return nil, err
+	}
+	if client.token != "" {
+		req.Header.Set("Authorization", "Bearer "+client.token)
+	}
+	return req, nil
+}
+
+// Do sends the request, answers outside of 2xx are returned as ErrApi with the body closed
+func (client *Client) Do(req *http.Request) (*http.Response, error) {
+	resp, err := client.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 64*1024))
+		return nil, &ErrApi{Status: resp.StatusCode, Message: strings.TrimSpace(string(body))}
+	}
+	return resp, nil
+}
+
+// Call sends body as json and decodes the answer in out. A nil out discards the answer,
+// a *string out receives the raw body
+func (client *Client) Call(ctx context.Context, method string, path string, query url.Values, body any, out any) error {
+	var reader io.Reader
+	if body != nil {
+		encoded, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(encoded)
+	}
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	req, err := client.NewRequest(ctx, method, path, reader)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	switch out := out.(type) {
+	case nil:
+		_, err = io.Copy(io.Discard, resp.Body)
+		return err
+	case *string:
+		content, err := io.ReadAll(resp.Body)
+		*out = string(content)
+		return err
+	default:
+		err = json.NewDecoder(resp.Body).Decode(out)
+		if err != nil {
+			return fmt.Errorf("unexpected answer from the monitor: %w", err)
+		}
+		return nil
+	}
+}
+
+// Stream returns the body of a long lived answer, e.g. followed logs or events
+func (client *Client) Stream(ctx context.Context, path string, query url.Values, header http.Header) (io.ReadCloser, error) {
+	if len(query) > 0 {
+		path += "?" + query.Encode()
+	}
+	req, err := client.NewRequest(ctx, http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func composeUri(parts ...string) string {
+	var res string = ""
+	for _, part := range parts {
+		if res == "" {
+			res = strings.Trim(part, "/")
+			continue
+		}
+		res += "/" + strings.Trim(part, "/")
+	}
+	return res
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"encoding/pem"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_NewClient(t *testing.T) {
+	for _, host := range []string{"ftp://monitor", "unix://", "monitor:8080", "://monitor"} {
+		_, err := NewClient(ClientOptions{Host: host})
+		assert.NotNil(t, err, host)
+	}
+	_, err := NewClient(ClientOptions{Host: "https://monitor", CaFile: filepath.Join(t.TempDir(), "missing.pem")})
+	assert.NotNil(t, err, "A missing certificate authority is reported")
+}
+
+func Test_Client_Unix(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "chmon.sock")
+	listener, err := net.Listen("unix", socket)
+	assert.Nil(t, err)
+	var authorization string
+	server := &httptest.Server{
+		Listener: listener,
+		Config: &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			authorization = r.Header.Get("Authorization")
+			if r.URL.Path != "/api/vm/web" {
+				http.Error(w, "Virtual Machine is not found", http.StatusNotFound)
+				return
+			}
+			w.Write([]byte(`{"name":"web"}`))
+		})},
+	}
+	server.Start()
+	defer server.Close()
+
+	client, err := NewClient(ClientOptions{Host: "unix://" + socket})
+	assert.Nil(t, err)
+	var vm struct {
+		Name string `json:"name"`
+	}
+	assert.Nil(t, client.Call(context.Background(), http.MethodGet, vmPath("web", ""), nil, nil, &vm))
+	assert.Equal(t, "web", vm.Name)
+	assert.Empty(t, authorization, "The unix socket authenticates the process, no token is sent")
+
+	err = client.Call(context.Background(), http.MethodGet, vmPath("db", ""), nil, nil, nil)
+	var errApi *ErrApi
+	assert.ErrorAs(t, err, &errApi)
+	assert.Equal(t, http.StatusNotFound, errApi.Status)
+	assert.Equal(t, "Virtual Machine is not found (404)", errApi.Error())
+}
+
+func Test_Client_Https(t *testing.T) {
+	var authorization string
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		w.Write([]byte("ok"))
+	}))
+	defer server.Close()
+
+	client, err := NewClient(ClientOptions{Host: server.URL, Token: "secret"})
+	assert.Nil(t, err)
+	assert.NotNil(t, client.Call(context.Background(), http.MethodGet, "/api/vm", nil, nil, nil), "The certificate of the monitor is verified")
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	assert.Nil(t, os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw}), 0600))
+	client, err = NewClient(ClientOptions{Host: server.URL + "/", Token: "secret", CaFile: caFile})
+	assert.Nil(t, err)
+	var body string
+	assert.Nil(t, client.Call(context.Background(), http.MethodGet, "/api/vm", nil, nil, &body))
+	assert.Equal(t, "ok", body)
+	assert.Equal(t, "Bearer secret", authorization)
+
+	assert.Nil(t, os.WriteFile(caFile, []byte("not a certificate"), 0600))
+	_, err = NewClient(ClientOptions{Host: server.URL, CaFile: caFile})
+	assert.NotNil(t, err)
+}
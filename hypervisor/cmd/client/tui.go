@@ -0,0 +1,494 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+	"vmm/events"
+	"vmm/timeseries"
+	virtualmachine "vmm/virtual_machine"
+	vmmanager "vmm/vmm"
+
+	tea "github.com/charmbracelet/bubbletea"
+	"github.com/charmbracelet/x/ansi"
+)
+
+const (
+	defaultTuiRefresh = 5 * time.Second
+	// Lines of serial output kept in the console pane
+	consoleScrollback = 500
+	// Window of the metrics api read for the current usage of a guest
+	usageWindow = 2 * time.Minute
+)
+
+type tuiTab int
+
+const (
+	TAB_VIRTUAL_MACHINES tuiTab = iota
+	TAB_VPC_NETWORKS
+	TAB_CAPACITY
+)
+
+var tuiTabNames = []string{"Virtual machines", "VPC networks", "Capacity"}
+
+func tuiCommand() *command {
+	return &command{
+		name:    "tui",
+		summary: "Interactive dashboard of virtual machines, vpc networks and host capacity",
+		nargs:   0,
+		setup:   tuiRun,
+	}
+}
+
+// Messages of the dashboard, answers of the monitor carry their error
+type (
+	vmsMsg struct {
+		items []vmmanager.VirtualMachineSummary
+		err   error
+	}
+	usageMsg    map[string]timeseries.Sample
+	networksMsg struct {
+		networks []vmmanager.VpcNetwork
+		err      error
+	}
+	capacityMsg struct {
+		report vmmanager.CapacityReport
+		err    error
+	}
+	tuiEventMsg events.Event
+	actionMsg   struct {
+		action string
+		name   string
+		err    error
+	}
+	consoleLineMsg struct {
+		vm   string
+		line string
+	}
+	consoleEndMsg struct {
+		vm  string
+		err error
+	}
+	eventsEndMsg struct{ err error }
+	refreshMsg   time.Time
+)
+
+// pendingAction waits for a confirmation before reaching the monitor
+type pendingAction struct {
+	action string
+	vm     vmmanager.VirtualMachineSummary
+}
+
+// consolePane follows the serial output of one virtual machine
+type consolePane struct {
+	vm     string
+	name   string
+	lines  []string
+	cancel context.CancelFunc
+	err    error
+}
+
+type tuiModel struct {
+	ctx      context.Context
+	client   *Client
+	host     string
+	tenant   string
+	refresh  time.Duration
+	send     func(tea.Msg)
+	tab      tuiTab
+	vms      []vmmanager.VirtualMachineSummary
+	usage    map[string]timeseries.Sample
+	networks []vmmanager.VpcNetwork
+	capacity *vmmanager.CapacityReport
+	// Errors of the last fetch of each tab, shown instead of the data
+	vmsErr      error
+	networksErr error
+	capacityErr error
+	lastEvent   time.Time
+	cursor      int
+	confirm     *pendingAction
+	status      string
+	statusErr   bool
+	console     *consolePane
+	width       int
+	height      int
+}
+
+func tuiRun(flags *flag.FlagSet) runFunc {
+	var tenant string
+	var refresh time.Duration
+	flags.StringVar(&tenant, "tenant", "", "Only show this tenant, defaults to the tenant of the context")
+	flags.DurationVar(&refresh, "refresh", defaultTuiRefresh, "Interval between two reads of usage and capacity")
+	return func(s *session, args []string) error {
+		if !isTerminal(s.stdout) {
+			return errors.New("chmon tui needs a terminal")
+		}
+		if refresh < time.Second {
+			return &ErrUsage{Message: "-refresh must be at least 1s"}
+		}
+		client, err := s.Client()
+		if err != nil {
+			return err
+		}
+		hostContext, err := s.hostContext()
+		if err != nil {
+			return err
+		}
+		ctx, cancel := context.WithCancel(s.ctx)
+		defer cancel()
+		model := &tuiModel{
+			ctx:     ctx,
+			client:  client,
+			host:    hostContext.Host,
+			tenant:  s.tenant(tenant),
+			refresh: refresh,
+			usage:   make(map[string]timeseries.Sample),
+		}
+		program := tea.NewProgram(model, tea.WithAltScreen(), tea.WithOutput(s.stdout), tea.WithContext(ctx))
+		model.send = program.Send
+		go model.followEvents()
+		_, err = program.Run()
+		model.closeConsole()
+		if errors.Is(err, tea.ErrProgramKilled) {
+			return nil
+		}
+		return err
+	}
+}
+
+// followEvents feeds the dashboard with the lifecycle events of virtual machines and networks
+func (m *tuiModel) followEvents() {
+	query := url.Values{}
+	query.Add("type", "vm.")
+	query.Add("type", "vpc.")
+	query.Add("type", events.STREAM_GAP)
+	setQuery(query, "tenant", m.tenant)
+	err := streamEvents(m.ctx, m.client, query, 0, func(event events.Event) error {
+		m.send(tuiEventMsg(event))
+		return nil
+	})
+	if err != nil {
+		m.send(eventsEndMsg{err: err})
+	}
+}
+
+func (m *tuiModel) fetchVms() tea.Cmd {
+	return func() tea.Msg {
+		query := url.Values{}
+		setQuery(query, "tenant", m.tenant)
+		var items []vmmanager.VirtualMachineSummary
+		for {
+			var page vmmanager.ListPage
+			err := m.client.Call(m.ctx, http.MethodGet, "/api/vm", query, nil, &page)
+			if err != nil {
+				return vmsMsg{err: err}
+			}
+			items = append(items, page.Items...)
+			if page.NextCursor == "" {
+				break
+			}
+			query.Set("cursor", page.NextCursor)
+		}
+		slices.SortFunc(items, func(a vmmanager.VirtualMachineSummary, b vmmanager.VirtualMachineSummary) int {
+			return strings.Compare(a.Tenant+"/"+a.Name+"/"+a.Id, b.Tenant+"/"+b.Name+"/"+b.Id)
+		})
+		return vmsMsg{items: items}
+	}
+}
+
+// fetchUsage reads the last sample of every guest holding resources, the others use nothing
+func (m *tuiModel) fetchUsage() tea.Cmd {
+	var ids []string
+	for _, vm := range m.vms {
+		if vm.Status.State.IsActive() {
+			ids = append(ids, vm.Id)
+		}
+	}
+	return func() tea.Msg {
+		var usage usageMsg = make(usageMsg)
+		query := url.Values{}
+		query.Set("from", strconv.FormatInt(time.Now().Add(-usageWindow).Unix(), 10))
+		for _, id := range ids {
+			var series timeseries.Series
+			err := m.client.Call(m.ctx, http.MethodGet, vmPath(id, "metrics"), query, nil, &series)
+			if err == nil && len(series.Points) > 0 {
+				usage[id] = series.Points[len(series.Points)-1]
+			}
+		}
+		return usage
+	}
+}
+
+func (m *tuiModel) fetchNetworks() tea.Cmd {
+	return func() tea.Msg {
+		query := url.Values{}
+		setQuery(query, "tenant", m.tenant)
+		var networks []vmmanager.VpcNetwork
+		err := m.client.Call(m.ctx, http.MethodGet, "/api/vpc", query, nil, &networks)
+		return networksMsg{networks: networks, err: err}
+	}
+}
+
+func (m *tuiModel) fetchCapacity() tea.Cmd {
+	return func() tea.Msg {
+		var report vmmanager.CapacityReport
+		err := m.client.Call(m.ctx, http.MethodGet, "/api/vmm/capacity", nil, nil, &report)
+		return capacityMsg{report: report, err: err}
+	}
+}
+
+func (m *tuiModel) tickRefresh() tea.Cmd {
+	return tea.Tick(m.refresh, func(t time.Time) tea.Msg {
+		return refreshMsg(t)
+	})
+}
+
+func (m *tuiModel) runAction(action pendingAction) tea.Cmd {
+	return func() tea.Msg {
+		err := m.client.Call(m.ctx, http.MethodPut, vmPath(action.vm.Id, action.action), nil, nil, nil)
+		return actionMsg{action: action.action, name: displayName(action.vm), err: err}
+	}
+}
+
+// openConsole follows the serial log of a virtual machine, lines are stripped of terminal sequences
+func (m *tuiModel) openConsole(vm vmmanager.VirtualMachineSummary) {
+	m.closeConsole()
+	ctx, cancel := context.WithCancel(m.ctx)
+	m.console = &consolePane{vm: vm.Id, name: displayName(vm), cancel: cancel}
+	go func() {
+		query := url.Values{}
+		query.Set("source", "serial")
+		query.Set("tail", "100")
+		query.Set("follow", "true")
+		body, err := m.client.Stream(ctx, vmPath(vm.Id, "logs"), query, nil)
+		if err != nil {
+			m.send(consoleEndMsg{vm: vm.Id, err: err})
+			return
+		}
+		defer body.Close()
+		scanner := bufio.NewScanner(body)
+		scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+		for scanner.Scan() {
+			m.send(consoleLineMsg{vm: vm.Id, line: strings.TrimRight(ansi.Strip(scanner.Text()), "\r")})
+		}
+		if ctx.Err() == nil {
+			m.send(consoleEndMsg{vm: vm.Id, err: scanner.Err()})
+		}
+	}()
+}
+
+func (m *tuiModel) closeConsole() {
+	if m.console != nil {
+		m.console.cancel()
+		m.console = nil
+	}
+}
+
+func (m *tuiModel) selected() (vmmanager.VirtualMachineSummary, bool) {
+	if m.tab != TAB_VIRTUAL_MACHINES || m.cursor < 0 || m.cursor >= len(m.vms) {
+		return vmmanager.VirtualMachineSummary{}, false
+	}
+	return m.vms[m.cursor], true
+}
+
+func (m *tuiModel) rows() int {
+	switch m.tab {
+	case TAB_VPC_NETWORKS:
+		return len(m.networks)
+	case TAB_CAPACITY:
+		if m.capacity == nil {
+			return 0
+		}
+		return len(m.capacity.Tenants)
+	default:
+		return len(m.vms)
+	}
+}
+
+func (m *tuiModel) moveCursor(delta int) {
+	m.cursor = max(0, min(m.cursor+delta, m.rows()-1))
+}
+
+func (m *tuiModel) setStatus(err error, format string, args ...any) {
+	if err != nil {
+		m.status = err.Error()
+		m.statusErr = true
+		return
+	}
+	m.status = fmt.Sprintf(format, args...)
+	m.statusErr = false
+}
+
+func (m *tuiModel) Init() tea.Cmd {
+	return tea.Batch(m.fetchVms(), m.fetchNetworks(), m.fetchCapacity(), m.tickRefresh())
+}
+
+func (m *tuiModel) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	switch msg := msg.(type) {
+	case tea.WindowSizeMsg:
+		m.width = msg.Width
+		m.height = msg.Height
+	case tea.KeyMsg:
+		return m.handleKey(msg)
+	case vmsMsg:
+		m.vmsErr = msg.err
+		if msg.err == nil {
+			m.vms = msg.items
+			m.moveCursor(0)
+			return m, m.fetchUsage()
+		}
+	case usageMsg:
+		m.usage = msg
+	case networksMsg:
+		m.networksErr = msg.err
+		if msg.err == nil {
+			m.networks = msg.networks
+		}
+	case capacityMsg:
+		m.capacityErr = msg.err
+		if msg.err == nil {
+			m.capacity = &msg.report
+		}
+	case refreshMsg:
+		return m, tea.Batch(m.fetchUsage(), m.fetchCapacity(), m.tickRefresh())
+	case tuiEventMsg:
+		return m, m.handleEvent(events.Event(msg))
+	case eventsEndMsg:
+		m.setStatus(fmt.Errorf("the events stream stopped, the dashboard is no longer live: %w", msg.err), "")
+	case actionMsg:
+		m.setStatus(msg.err, "%s %s requested", msg.action, msg.name)
+		return m, m.fetchCapacity()
+	case consoleLineMsg:
+		if m.console != nil && m.console.vm == msg.vm {
+			m.console.lines = append(m.console.lines, msg.line)
+			if len(m.console.lines) > consoleScrollback {
+				m.console.lines = m.console.lines[len(m.console.lines)-consoleScrollback:]
+			}
+		}
+	case consoleEndMsg:
+		if m.console != nil && m.console.vm == msg.vm {
+			m.console.err = msg.err
+			if msg.err == nil {
+				m.console.err = errors.New("console closed by the monitor")
+			}
+		}
+	}
+	return m, nil
+}
+
+// handleEvent applies state changes in place, creations and gaps in the stream reload the list
+func (m *tuiModel) handleEvent(event events.Event) tea.Cmd {
+	m.lastEvent = event.Time
+	switch {
+	case event.Type == events.VM_STATE:
+		to, _ := event.Data["to"].(string)
+		for i := range m.vms {
+			if m.vms[i].Id == event.VirtualMachine {
+				m.vms[i].Status.State = virtualmachine.State(to)
+				m.vms[i].Status.UpdatedAt = event.Time
+				m.vms[i].Status.StartedAt = eventStartedAt(event)
+			}
+		}
+		return tea.Batch(m.fetchUsage(), m.fetchCapacity())
+	case event.Type == events.VM_DELETED:
+		m.vms = slices.DeleteFunc(m.vms, func(vm vmmanager.VirtualMachineSummary) bool {
+			return vm.Id == event.VirtualMachine
+		})
+		if m.console != nil && m.console.vm == event.VirtualMachine {
+			m.closeConsole()
+		}
+		m.moveCursor(0)
+		return tea.Batch(m.fetchNetworks(), m.fetchCapacity())
+	case strings.HasPrefix(event.Type, "vm."):
+		return m.fetchVms()
+	case strings.HasPrefix(event.Type, "vpc."):
+		return m.fetchNetworks()
+	case event.Type == events.STREAM_GAP:
+		return tea.Batch(m.fetchVms(), m.fetchNetworks(), m.fetchCapacity())
+	}
+	return nil
+}
+
+func (m *tuiModel) handleKey(msg tea.KeyMsg) (tea.Model, tea.Cmd) {
+	if m.confirm != nil {
+		var action pendingAction = *m.confirm
+		m.confirm = nil
+		if msg.String() == "y" || msg.String() == "Y" {
+			m.setStatus(nil, "%s %s...", action.action, displayName(action.vm))
+			return m, m.runAction(action)
+		}
+		m.setStatus(nil, "%s of %s canceled", action.action, displayName(action.vm))
+		return m, nil
+	}
+	switch msg.String() {
+	case "ctrl+c", "q":
+		return m, tea.Quit
+	case "tab":
+		m.tab = (m.tab + 1) % tuiTab(len(tuiTabNames))
+		m.cursor = 0
+	case "shift+tab":
+		m.tab = (m.tab + tuiTab(len(tuiTabNames)) - 1) % tuiTab(len(tuiTabNames))
+		m.cursor = 0
+	case "1", "2", "3":
+		m.tab = tuiTab(msg.String()[0] - '1')
+		m.cursor = 0
+	case "up", "k":
+		m.moveCursor(-1)
+	case "down", "j":
+		m.moveCursor(1)
+	case "pgup":
+		m.moveCursor(-10)
+	case "pgdown":
+		m.moveCursor(10)
+	case "home", "g":
+		m.cursor = 0
+	case "end", "G":
+		m.moveCursor(m.rows())
+	case "r":
+		m.setStatus(nil, "Refreshing")
+		return m, tea.Batch(m.fetchVms(), m.fetchNetworks(), m.fetchCapacity())
+	case "b", "s", "d":
+		vm, ok := m.selected()
+		if ok {
+			m.confirm = &pendingAction{action: map[string]string{"b": "boot", "s": "shutdown", "d": "delete"}[msg.String()], vm: vm}
+		}
+	case "c", "enter":
+		vm, ok := m.selected()
+		if ok && m.console != nil && m.console.vm == vm.Id {
+			m.closeConsole()
+		} else if ok {
+			m.openConsole(vm)
+		}
+	case "esc":
+		m.closeConsole()
+	}
+	return m, nil
+}
+
+func displayName(vm vmmanager.VirtualMachineSummary) string {
+	if vm.Name != "" {
+		return vm.Name
+	}
+	return vm.Id
+}
+
+// eventStartedAt returns the start time of the process carried by a state event, nil without a process
+func eventStartedAt(event events.Event) *time.Time {
+	value, ok := event.Data["started_at"].(string)
+	if !ok {
+		return nil
+	}
+	startedAt, err := time.Parse(time.RFC3339Nano, value)
+	if err != nil {
+		return nil
+	}
+	return &startedAt
+}
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	virtualmachine "vmm/virtual_machine"
+	vmmanager "vmm/vmm"
+
+	"github.com/charmbracelet/lipgloss"
+	"github.com/charmbracelet/x/ansi"
+)
+
+var (
+	tuiTitleStyle     = lipgloss.NewStyle().Bold(true)
+	tuiActiveTabStyle = lipgloss.NewStyle().Bold(true).Reverse(true).Padding(0, 1)
+	tuiTabStyle       = lipgloss.NewStyle().Faint(true).Padding(0, 1)
+	tuiHeaderStyle    = lipgloss.NewStyle().Bold(true)
+	tuiSelectedStyle  = lipgloss.NewStyle().Reverse(true)
+	tuiFaintStyle     = lipgloss.NewStyle().Faint(true)
+	tuiErrorStyle     = lipgloss.NewStyle().Foreground(lipgloss.Color("1"))
+	tuiConfirmStyle   = lipgloss.NewStyle().Bold(true).Foreground(lipgloss.Color("3"))
+	tuiStateStyles    = map[virtualmachine.State]lipgloss.Style{
+		virtualmachine.RUNNING:  lipgloss.NewStyle().Foreground(lipgloss.Color("2")),
+		virtualmachine.STARTING: lipgloss.NewStyle().Foreground(lipgloss.Color("3")),
+		virtualmachine.PAUSED:   lipgloss.NewStyle().Foreground(lipgloss.Color("3")),
+		virtualmachine.STOPPING: lipgloss.NewStyle().Foreground(lipgloss.Color("3")),
+		virtualmachine.CRASHED:  lipgloss.NewStyle().Foreground(lipgloss.Color("1")),
+		virtualmachine.DELETING: lipgloss.NewStyle().Foreground(lipgloss.Color("5")),
+		virtualmachine.STOPPED:  tuiFaintStyle,
+		virtualmachine.CREATED:  tuiFaintStyle,
+	}
+)
+
+const tuiHelp = "↑/↓ select  tab view  b boot  s shutdown  d delete  c console  r refresh  q quit"
+
+// tuiTable is a table of the dashboard, style may color a cell of rows that are not selected
+type tuiTable struct {
+	header []string
+	rows   [][]string
+	style  func(row int, col int) (lipgloss.Style, bool)
+}
+
+// render draws at most height lines, scrolled so the row under cursor is visible
+func (t tuiTable) render(cursor int, height int, width int) []string {
+	var widths []int = make([]int, len(t.header))
+	for col, cell := range t.header {
+		widths[col] = ansi.StringWidth(cell)
+	}
+	for _, row := range t.rows {
+		for col, cell := range row {
+			widths[col] = max(widths[col], ansi.StringWidth(cell))
+		}
+	}
+	pad := func(cell string, col int) string {
+		return cell + strings.Repeat(" ", widths[col]-ansi.StringWidth(cell)+2)
+	}
+	var header strings.Builder
+	for col, cell := range t.header {
+		header.WriteString(pad(cell, col))
+	}
+	var lines []string = []string{tuiHeaderStyle.Render(ansi.Truncate(header.String(), width, ""))}
+	var visible int = max(height-1, 1)
+	var offset int = max(0, cursor-visible+1)
+	for index := offset; index < len(t.rows) && index < offset+visible; index++ {
+		var line strings.Builder
+		for col, cell := range t.rows[index] {
+			var padded string = pad(cell, col)
+			if style, ok := t.styleOf(index, col); ok && index != cursor {
+				padded = style.Render(cell) + strings.Repeat(" ", widths[col]-ansi.StringWidth(cell)+2)
+			}
+			line.WriteString(padded)
+		}
+		var rendered string = ansi.Truncate(line.String(), width, "")
+		if index == cursor {
+			rendered = tuiSelectedStyle.Render(ansi.Truncate(ansi.Strip(line.String())+strings.Repeat(" ", width), width, ""))
+		}
+		lines = append(lines, rendered)
+	}
+	return lines
+}
+
+func (t tuiTable) styleOf(row int, col int) (lipgloss.Style, bool) {
+	if t.style == nil {
+		return lipgloss.Style{}, false
+	}
+	return t.style(row, col)
+}
+
+func shortId(id string) string {
+	if len(id) > 8 {
+		return id[:8]
+	}
+	return id
+}
+
+func (m *tuiModel) vmTable() tuiTable {
+	t := tuiTable{header: []string{"NAME", "ID", "TENANT", "STATE", "CPU", "MEMORY", "UPTIME"}}
+	for _, vm := range m.vms {
+		var cpu string = fmt.Sprintf("- / %d", vm.Cpus)
+		var memory string = fmt.Sprintf("- / %s", formatBytes(vm.Memory))
+		if sample, ok := m.usage[vm.Id]; ok {
+			cpu = fmt.Sprintf("%.2f / %d", sample.Cpus, vm.Cpus)
+			memory = fmt.Sprintf("%s / %s", formatBytes(int64(sample.MemoryBytes)), formatBytes(vm.Memory))
+		}
+		var uptime string = "-"
+		if vm.Status.State == virtualmachine.RUNNING && vm.Status.StartedAt != nil {
+			uptime = formatAge(*vm.Status.StartedAt)
+		}
+		t.rows = append(t.rows, []string{orDash(vm.Name), shortId(vm.Id), shortId(vm.Tenant), string(vm.Status.State), cpu, memory, uptime})
+	}
+	t.style = func(row int, col int) (lipgloss.Style, bool) {
+		if col != 3 {
+			return lipgloss.Style{}, false
+		}
+		style, ok := tuiStateStyles[m.vms[row].Status.State]
+		return style, ok
+	}
+	return t
+}
+
+func (m *tuiModel) networkTable() tuiTable {
+	var names map[string]string = make(map[string]string, len(m.vms))
+	for _, vm := range m.vms {
+		names[vm.Id] = displayName(vm)
+	}
+	t := tuiTable{header: []string{"TENANT", "NETWORK", "BRIDGE", "VIRTUAL MACHINES"}}
+	for _, network := range m.networks {
+		var attached []string = make([]string, 0, len(network.VirtualMachines))
+		for _, id := range network.VirtualMachines {
+			if name, ok := names[id]; ok {
+				attached = append(attached, name)
+			} else {
+				attached = append(attached, shortId(id))
+			}
+		}
+		t.rows = append(t.rows, []string{shortId(network.Tenant), network.Network, network.Bridge, orDash(strings.Join(attached, ", "))})
+	}
+	return t
+}
+
+// usageBar shows used over total as a bar of width cells followed by the percentage
+func usageBar(used int64, total int64, width int) string {
+	var ratio float64 = 0
+	if total > 0 {
+		ratio = max(0, min(float64(used)/float64(total), 1))
+	}
+	var filled int = int(ratio * float64(width))
+	return "[" + strings.Repeat("█", filled) + strings.Repeat("░", width-filled) + "] " + fmt.Sprintf("%3.0f%%", ratio*100)
+}
+
+func (m *tuiModel) capacitySummary() []string {
+	report := m.capacity
+	line := func(label string, r vmmanager.Resources) string {
+		return fmt.Sprintf("%-12s %4d cpus  %10s", label, r.Cpus, formatBytes(r.Memory))
+	}
+	return []string{
+		line("Host", report.Host),
+		line("Allocatable", report.Allocatable),
+		line("Allocated", report.Allocated) + "  cpus " + usageBar(report.Allocated.Cpus, report.Allocatable.Cpus, 20) + "  memory " + usageBar(report.Allocated.Memory, report.Allocatable.Memory, 20),
+		line("Reserved", report.Reserved),
+		line("Free", report.Free),
+		"",
+	}
+}
+
+func (m *tuiModel) tenantTable() tuiTable {
+	t := tuiTable{header: []string{"TENANT", "VMS", "ALLOCATED CPUS", "ALLOCATED MEMORY", "RESERVED CPUS", "RESERVED MEMORY"}}
+	for _, tenant := range slices.Sorted(maps.Keys(m.capacity.Tenants)) {
+		usage := m.capacity.Tenants[tenant]
+		t.rows = append(t.rows, []string{
+			tenant,
+			strconv.Itoa(usage.VirtualMachines),
+			strconv.FormatInt(usage.Allocated.Cpus, 10),
+			formatBytes(usage.Allocated.Memory),
+			strconv.FormatInt(usage.Reserved.Cpus, 10),
+			formatBytes(usage.Reserved.Memory),
+		})
+	}
+	return t
+}
+
+// body renders the current tab in height lines at most
+func (m *tuiModel) body(height int) []string {
+	var empty string
+	var err error
+	var lines []string
+	var t tuiTable
+	switch m.tab {
+	case TAB_VPC_NETWORKS:
+		t, err, empty = m.networkTable(), m.networksErr, "No vpc networks"
+	case TAB_CAPACITY:
+		err, empty = m.capacityErr, "No tenants"
+		if m.capacity == nil && err == nil {
+			return []string{tuiFaintStyle.Render("Loading capacity...")}
+		}
+		if m.capacity != nil {
+			lines, t = m.capacitySummary(), m.tenantTable()
+		}
+	default:
+		t, err, empty = m.vmTable(), m.vmsErr, "No virtual machines"
+	}
+	if err != nil {
+		return []string{tuiErrorStyle.Render(ansi.Truncate(err.Error(), m.width, ""))}
+	}
+	if len(t.rows) == 0 {
+		return append(lines, tuiFaintStyle.Render(empty))
+	}
+	return append(lines, t.render(m.cursor, height-len(lines), m.width)...)
+}
+
+func (m *tuiModel) consoleView(height int) []string {
+	var title string = fmt.Sprintf("Serial console of %s, c or esc closes it", m.console.name)
+	var lines []string = []string{tuiTitleStyle.Render(ansi.Truncate(title, m.width, ""))}
+	var output []string = m.console.lines
+	var room int = height - 1
+	if m.console.err != nil {
+		room--
+	}
+	if len(output) > room {
+		output = output[len(output)-room:]
+	}
+	for _, line := range output {
+		lines = append(lines, ansi.Truncate(line, m.width, ""))
+	}
+	if m.console.err != nil {
+		lines = append(lines, tuiErrorStyle.Render(ansi.Truncate(m.console.err.Error(), m.width, "")))
+	}
+	for len(lines) < height {
+		lines = append(lines, "")
+	}
+	return lines
+}
+
+func (m *tuiModel) footer() string {
+	if m.confirm != nil {
+		return tuiConfirmStyle.Render(fmt.Sprintf("%s %s (%s)? y/N", strings.ToUpper(m.confirm.action[:1])+m.confirm.action[1:], displayName(m.confirm.vm), shortId(m.confirm.vm.Id)))
+	}
+	if m.statusErr {
+		return tuiErrorStyle.Render(ansi.Truncate(m.status, m.width, ""))
+	}
+	return ansi.Truncate(m.status, m.width, "")
+}
+
+func (m *tuiModel) View() string {
+	if m.width == 0 {
+		return "Connecting..."
+	}
+	var tenant string = m.tenant
+	if tenant == "" {
+		tenant = "all tenants"
+	}
+	var live string = "waiting for events"
+	if !m.lastEvent.IsZero() {
+		live = "last event " + m.lastEvent.Local().Format("15:04:05")
+	}
+	var header string = tuiTitleStyle.Render("chmon") + " " + ansi.Truncate(fmt.Sprintf("%s, %s, %s", m.host, tenant, live), m.width-6, "")
+	var tabs []string = make([]string, 0, len(tuiTabNames))
+	for index, name := range tuiTabNames {
+		var label string = fmt.Sprintf("%d %s", index+1, name)
+		if tuiTab(index) == m.tab {
+			tabs = append(tabs, tuiActiveTabStyle.Render(label))
+		} else {
+			tabs = append(tabs, tuiTabStyle.Render(label))
+		}
+	}
+	var consoleHeight int = 0
+	if m.console != nil {
+		consoleHeight = max(5, m.height*2/5)
+	}
+	var bodyHeight int = max(m.height-4-consoleHeight, 2)
+	var lines []string = []string{header, strings.Join(tabs, " ")}
+	var body []string = m.body(bodyHeight)
+	lines = append(lines, body...)
+	for range bodyHeight - len(body) {
+		lines = append(lines, "")
+	}
+	if m.console != nil {
+		lines = append(lines, m.consoleView(consoleHeight)...)
+	}
+	lines = append(lines, m.footer(), tuiFaintStyle.Render(ansi.Truncate(tuiHelp, m.width, "")))
+	return strings.Join(lines, "\n")
+}
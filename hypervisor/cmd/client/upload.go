@@ -0,0 +1,351 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	vmmanager "vmm/vmm"
+)
+
+const (
+	UPLOAD_DISK   = "disk"
+	UPLOAD_KERNEL = "kernel"
+)
+
+const (
+	PHASE_HASHING    = "hashing"
+	PHASE_UPLOADING  = "uploading"
+	PHASE_COMMITTING = "committing"
+)
+
+const (
+	defaultChunkSize   = 4 * 1024 * 1024
+	defaultConcurrency = 4
+	defaultRetries     = 5
+	// Delay before the first retry of a chunk, doubled on every attempt up to retryMaxDelay
+	retryBaseDelay = 500 * time.Millisecond
+	retryMaxDelay  = 15 * time.Second
+)
+
+type BeginBody struct {
+	VirtualMachine string `json:"virtual_machine"`
+	Size           int64  `json:"size"`
+	Sha256         string `json:"sha256,omitempty"`
+}
+
+type CommitBody struct {
+	VirtualMachine string `json:"virtual_machine"`
+	TmpFileName    string `json:"tmp_file_name"`
+	Sha256         string `json:"sha256,omitempty"`
+}
+
+type uploadOptions struct {
+	concurrency int
+	chunkSize   int64
+	retries     int
+	// Continue a pending upload session of the same file instead of beginning a new one
+	resume bool
+}
+
+// Messages reported while uploading, they feed the progress view
+type (
+	phaseMsg struct {
+		phase string
+		total int64
+		// Bytes already on the monitor when resuming
+		resumed int64
+	}
+	progressMsg struct{ bytes int64 }
+	retryMsg    struct {
+		offset  int64
+		attempt int
+		err     error
+	}
+	doneMsg struct{ err error }
+)
+
+// upload is a file sent to the storage of a virtual machine
+type upload struct {
+	kind           string
+	virtualMachine string
+	path           string
+	// Name of the file on the monitor
+	name        string
+	size        int64
+	sha256      string
+	tmpFileName string
+	resumed     bool
+	report      func(msg any)
+}
+
+func (u *upload) route(parts ...string) string {
+	return composeUri(append([]string{"/api", u.kind, "upload"}, parts...)...)
+}
+
+// hash computes the sha256 of the file, it is declared at begin and checked by the monitor at commit
+func (u *upload) hash(ctx context.Context, file *os.File) error {
+	u.report(phaseMsg{phase: PHASE_HASHING, total: u.size})
+	hash := sha256.New()
+	var buffer []byte = make([]byte, 1024*1024)
+	for {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		n, err := file.Read(buffer)
+		hash.Write(buffer[:n])
+		u.report(progressMsg{bytes: int64(n)})
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return err
+		}
+	}
+	u.sha256 = hex.EncodeToString(hash.Sum(nil))
+	return nil
+}
+
+// pendingSession finds an upload of the same file left by an interrupted run, the newest one wins
+func (u *upload) pendingSession(ctx context.Context, client *Client) (*vmmanager.UploadSession, error) {
+	req, err := client.NewRequest(ctx, http.MethodGet, u.route(), nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-VirtualMachine", u.virtualMachine)
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	var sessions []vmmanager.UploadSession
+	err = json.NewDecoder(resp.Body).Decode(&sessions)
+	if err != nil {
+		return nil, fmt.Errorf("unexpected answer of the monitor: %w", err)
+	}
+	var found *vmmanager.UploadSession
+	for i, session := range sessions {
+		if session.FileName == u.name && session.Size == u.size && session.Sha256 == u.sha256 {
+			found = &sessions[i]
+		}
+	}
+	return found, nil
+}
+
+// begin creates the temporary file on the monitor
+func (u *upload) begin(ctx context.Context, client *Client) error {
+	var tmpFileName string
+	err := client.Call(ctx, http.MethodPost, u.route(u.name, "begin"), nil, BeginBody{
+		VirtualMachine: u.virtualMachine,
+		Size:           u.size,
+		Sha256:         u.sha256,
+	}, &tmpFileName)
+	u.tmpFileName = strings.TrimSpace(tmpFileName)
+	return err
+}
+
+func (u *upload) sendChunk(ctx context.Context, client *Client, chunk []byte, offset int64) error {
+	req, err := client.NewRequest(ctx, http.MethodPut, u.route(u.tmpFileName, "chunk"), bytes.NewReader(chunk))
+	if err != nil {
+		return err
+	}
+	req.ContentLength = int64(len(chunk))
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("X-VirtualMachine", u.virtualMachine)
+	req.Header.Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+int64(len(chunk))-1, u.size))
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// retryable tells whether sending a chunk again may succeed, the monitor refusing it is final
+func retryable(err error) bool {
+	var errApi *ErrApi
+	if errors.As(err, &errApi) {
+		return errApi.Status >= 500 || errApi.Status == http.StatusTooManyRequests || errApi.Status == http.StatusRequestTimeout
+	}
+	return !errors.Is(err, context.Canceled)
+}
+
+// retryDelay doubles from retryBaseDelay with a random jitter so workers do not retry in lockstep
+func retryDelay(attempt int) time.Duration {
+	var delay time.Duration = min(retryBaseDelay<<attempt, retryMaxDelay)
+	return delay/2 + rand.N(delay/2+1)
+}
+
+func (u *upload) sendChunkWithRetry(ctx context.Context, client *Client, chunk []byte, offset int64, retries int) error {
+	for attempt := 0; ; attempt++ {
+		err := u.sendChunk(ctx, client, chunk, offset)
+		if err == nil || ctx.Err() != nil || !retryable(err) || attempt >= retries {
+			return err
+		}
+		u.report(retryMsg{offset: offset, attempt: attempt + 1, err: err})
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(retryDelay(attempt)):
+		}
+	}
+}
+
+// missingChunks returns the offsets of the chunks not fully covered by the received ranges.
+// Ranges are sorted, a chunk may be covered by adjacent or overlapping ones
+func missingChunks(size int64, chunkSize int64, received []vmmanager.ByteRange) []int64 {
+	var offsets []int64
+	var next int = 0
+	for offset := int64(0); offset < size; offset += chunkSize {
+		var end int64 = min(offset+chunkSize, size) - 1
+		for next < len(received) && received[next].End < offset {
+			next++
+		}
+		var covered int64 = offset
+		for i := next; i < len(received) && received[i].Start <= covered && covered <= end; i++ {
+			covered = max(covered, received[i].End+1)
+		}
+		if covered > end {
+			continue
+		}
+		offsets = append(offsets, offset)
+	}
+	return offsets
+}
+
+func (u *upload) chunkLength(offset int64, chunkSize int64) int64 {
+	return min(offset+chunkSize, u.size) - offset
+}
+
+// sendChunks uploads the chunks at offsets with a pool of workers, the first error stops the others
+func (u *upload) sendChunks(ctx context.Context, client *Client, file *os.File, offsets []int64, opts uploadOptions) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var jobs chan int64 = make(chan int64)
+	var wg sync.WaitGroup
+	var once sync.Once
+	var firstErr error
+	fail := func(err error) {
+		once.Do(func() {
+			firstErr = err
+			cancel()
+		})
+	}
+	for range max(opts.concurrency, 1) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			var buffer []byte = make([]byte, opts.chunkSize)
+			for offset := range jobs {
+				chunk := buffer[:u.chunkLength(offset, opts.chunkSize)]
+				_, err := file.ReadAt(chunk, offset)
+				if err != nil && err != io.EOF {
+					fail(err)
+					continue
+				}
+				err = u.sendChunkWithRetry(ctx, client, chunk, offset, opts.retries)
+				if err != nil {
+					fail(fmt.Errorf("unable to upload bytes %d-%d: %w", offset, offset+int64(len(chunk))-1, err))
+					continue
+				}
+				u.report(progressMsg{bytes: int64(len(chunk))})
+			}
+		}()
+	}
+	for _, offset := range offsets {
+		select {
+		case jobs <- offset:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	close(jobs)
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
+
+func (u *upload) commit(ctx context.Context, client *Client) error {
+	return client.Call(ctx, http.MethodPost, u.route(u.name, "commit"), nil, CommitBody{
+		VirtualMachine: u.virtualMachine,
+		TmpFileName:    u.tmpFileName,
+		Sha256:         u.sha256,
+	}, nil)
+}
+
+// run hashes the file, sends the chunks missing on the monitor and moves the file in place.
+// Disk uploads resume a pending session of the same file, kernels have no session on the monitor
+func (u *upload) run(ctx context.Context, client *Client, opts uploadOptions) error {
+	if u.report == nil {
+		u.report = func(any) {}
+	}
+	file, err := os.Open(u.path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	u.size = stat.Size()
+	if u.size == 0 {
+		return fmt.Errorf("%s is empty", u.path)
+	}
+	err = u.hash(ctx, file)
+	if err != nil {
+		return err
+	}
+	var received []vmmanager.ByteRange
+	if u.kind == UPLOAD_DISK && opts.resume {
+		session, err := u.pendingSession(ctx, client)
+		if err != nil {
+			return fmt.Errorf("unable to look for a pending upload: %w", err)
+		}
+		if session != nil {
+			u.tmpFileName = session.TmpFileName
+			u.resumed = true
+			received = session.Ranges
+		}
+	}
+	if u.tmpFileName == "" {
+		err = u.begin(ctx, client)
+		if err != nil {
+			return fmt.Errorf("unable to begin the upload: %w", err)
+		}
+	}
+	var offsets []int64 = missingChunks(u.size, opts.chunkSize, received)
+	var missing int64 = 0
+	for _, offset := range offsets {
+		missing += u.chunkLength(offset, opts.chunkSize)
+	}
+	u.report(phaseMsg{phase: PHASE_UPLOADING, total: u.size, resumed: u.size - missing})
+	err = u.sendChunks(ctx, client, file, offsets, opts)
+	if err != nil {
+		return err
+	}
+	u.report(phaseMsg{phase: PHASE_COMMITTING, total: u.size, resumed: u.size})
+	err = u.commit(ctx, client)
+	if err != nil {
+		var errApi *ErrApi
+		if u.resumed && errors.As(err, &errApi) && errApi.Status == http.StatusUnprocessableEntity {
+			return fmt.Errorf("unable to commit the resumed upload, run again with -resume=false: %w", err)
+		}
+		return fmt.Errorf("unable to commit the upload: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	vmmanager "vmm/vmm"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_missingChunks(t *testing.T) {
+	tests := []struct {
+		name     string
+		size     int64
+		received []vmmanager.ByteRange
+		expected []int64
+	}{
+		{name: "nothing received", size: 10, received: nil, expected: []int64{0, 4, 8}},
+		{name: "everything received", size: 10, received: []vmmanager.ByteRange{{Start: 0, End: 9}}, expected: nil},
+		{name: "partial chunks are sent again", size: 10, received: []vmmanager.ByteRange{{Start: 0, End: 2}, {Start: 5, End: 9}}, expected: []int64{0, 4}},
+		{name: "adjacent ranges cover a chunk", size: 10, received: []vmmanager.ByteRange{{Start: 0, End: 1}, {Start: 2, End: 3}, {Start: 4, End: 5}}, expected: []int64{4, 8}},
+		{name: "overlapping ranges cover a chunk", size: 12, received: []vmmanager.ByteRange{{Start: 0, End: 5}, {Start: 3, End: 7}}, expected: []int64{8}},
+		{name: "merged range over several chunks", size: 12, received: []vmmanager.ByteRange{{Start: 4, End: 11}}, expected: []int64{0}},
+		{name: "short last chunk", size: 10, received: []vmmanager.ByteRange{{Start: 8, End: 9}}, expected: []int64{0, 4}},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.expected, missingChunks(test.size, 4, test.received), test.name)
+	}
+}
+
+func Test_retryable(t *testing.T) {
+	tests := []struct {
+		err       error
+		retryable bool
+	}{
+		{err: &ErrApi{Status: http.StatusBadRequest}, retryable: false},
+		{err: &ErrApi{Status: http.StatusForbidden}, retryable: false},
+		{err: &ErrApi{Status: http.StatusNotFound}, retryable: false},
+		{err: &ErrApi{Status: http.StatusUnprocessableEntity}, retryable: false},
+		{err: &ErrApi{Status: http.StatusRequestTimeout}, retryable: true},
+		{err: &ErrApi{Status: http.StatusTooManyRequests}, retryable: true},
+		{err: &ErrApi{Status: http.StatusInternalServerError}, retryable: true},
+		{err: &ErrApi{Status: http.StatusServiceUnavailable}, retryable: true},
+		{err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, retryable: true},
+		{err: io.ErrUnexpectedEOF, retryable: true},
+		{err: fmt.Errorf("request: %w", context.Canceled), retryable: false},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.retryable, retryable(test.err), test.err.Error())
+	}
+}
+
+func Test_retryDelay(t *testing.T) {
+	for attempt := range 10 {
+		delay := retryDelay(attempt)
+		assert.GreaterOrEqual(t, delay, min(retryBaseDelay<<attempt, retryMaxDelay)/2)
+		assert.LessOrEqual(t, delay, retryMaxDelay)
+	}
+}
+
+// fakeUploadMonitor keeps the chunks of one pending disk upload
+type fakeUploadMonitor struct {
+	mu       sync.Mutex
+	session  vmmanager.UploadSession
+	content  []byte
+	chunks   []string
+	failures map[string]int
+	begun    bool
+	commit   CommitBody
+}
+
+func (m *fakeUploadMonitor) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	switch {
+	case r.Method == http.MethodGet && r.URL.Path == "/api/disk/upload":
+		json.NewEncoder(w).Encode([]vmmanager.UploadSession{m.session})
+	case r.Method == http.MethodPost && r.URL.Path == "/api/disk/upload/root.raw/begin":
+		m.begun = true
+		http.Error(w, "unexpected begin", http.StatusConflict)
+	case r.Method == http.MethodPut && r.URL.Path == "/api/disk/upload/"+m.session.TmpFileName+"/chunk":
+		var start, end, size int64
+		fmt.Sscanf(r.Header.Get("Content-Range"), "bytes %d-%d/%d", &start, &end, &size)
+		var chunkRange string = fmt.Sprintf("%d-%d", start, end)
+		if m.failures[chunkRange] > 0 {
+			m.failures[chunkRange]--
+			http.Error(w, "busy", http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := io.ReadAll(r.Body)
+		copy(m.content[start:], body)
+		m.chunks = append(m.chunks, chunkRange)
+	case r.Method == http.MethodPost && r.URL.Path == "/api/disk/upload/root.raw/commit":
+		json.NewDecoder(r.Body).Decode(&m.commit)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func Test_upload_run(t *testing.T) {
+	var content []byte = []byte("0123456789")
+	path := filepath.Join(t.TempDir(), "root.raw")
+	assert.Nil(t, os.WriteFile(path, content, 0600))
+	sum := sha256.Sum256(content)
+
+	monitor := &fakeUploadMonitor{
+		session: vmmanager.UploadSession{
+			FileName:    "root.raw",
+			TmpFileName: "abc_root.raw.tmp",
+			Size:        int64(len(content)),
+			Sha256:      hex.EncodeToString(sum[:]),
+			Ranges:      []vmmanager.ByteRange{{Start: 0, End: 3}},
+		},
+		content:  append([]byte("0123"), make([]byte, len(content)-4)...),
+		failures: map[string]int{"8-9": 1},
+	}
+	server := httptest.NewServer(monitor)
+	defer server.Close()
+	client, err := NewClient(ClientOptions{Host: server.URL})
+	assert.Nil(t, err)
+
+	var retries int = 0
+	u := &upload{kind: UPLOAD_DISK, virtualMachine: "web", path: path, name: "root.raw", report: func(msg any) {
+		if _, ok := msg.(retryMsg); ok {
+			retries++
+		}
+	}}
+	err = u.run(context.Background(), client, uploadOptions{concurrency: 1, chunkSize: 4, retries: 2, resume: true})
+	assert.Nil(t, err)
+	assert.False(t, monitor.begun, "The pending session is resumed")
+	assert.True(t, u.resumed)
+	assert.Equal(t, []string{"4-7", "8-9"}, monitor.chunks, "Only the missing chunks are sent")
+	assert.Equal(t, 1, retries, "A chunk refused with 503 is sent again")
+	assert.Equal(t, content, monitor.content)
+	assert.Equal(t, CommitBody{VirtualMachine: "web", TmpFileName: "abc_root.raw.tmp", Sha256: monitor.session.Sha256}, monitor.commit)
+}
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	virtualmachine "vmm/virtual_machine"
+	vmmanager "vmm/vmm"
+
+	"gopkg.in/yaml.v3"
+)
+
+// VirtualMachineInfo is the answer of /api/vm/:vm/info
+type VirtualMachineInfo struct {
+	Manifest *virtualmachine.Manifest `json:"manifest"`
+	Status   virtualmachine.Status    `json:"status"`
+}
+
+func vmCommand() *command {
+	return &command{
+		name:    "vm",
+		summary: "Create, inspect and operate virtual machines",
+		children: []*command{
+			{name: "list", summary: "List virtual machines", nargs: 0, setup: vmList},
+			{name: "info", args: "<vm>", summary: "Show the manifest and status of a virtual machine", nargs: 1, setup: vmInfo},
+			{name: "create", summary: "Create a virtual machine from a json or yaml manifest", nargs: 0, setup: vmCreate},
+			{name: "boot", args: "<vm>", summary: "Boot a virtual machine", nargs: 1, setup: vmAction("boot", "booted")},
+			{name: "shutdown", args: "<vm>", summary: "Shut a virtual machine down", nargs: 1, setup: vmAction("shutdown", "stopped")},
+			{name: "pause", args: "<vm>", summary: "Pause a running virtual machine", nargs: 1, setup: vmAction("pause", "paused")},
+			{name: "resume", args: "<vm>", summary: "Resume a paused virtual machine", nargs: 1, setup: vmAction("resume", "resumed")},
+			{name: "delete", args: "<vm>", summary: "Stop a virtual machine and remove its files", nargs: 1, setup: vmAction("delete", "deleted")},
+			{name: "console", args: "<vm>", summary: "Follow the serial console of a virtual machine, read only", nargs: 1, setup: vmConsole},
+			{name: "logs", args: "<vm>", summary: "Print the logs of a virtual machine", nargs: 1, setup: vmLogs},
+		},
+	}
+}
+
+func vmList(flags *flag.FlagSet) runFunc {
+	var tenant, selector, state, sortBy string
+	var descending, all bool
+	var limit int
+	flags.StringVar(&tenant, "tenant", "", "Only list the virtual machines of this tenant, defaults to the tenant of the context")
+	flags.StringVar(&selector, "l", "", "Label selector, e.g. env=prod,tier!=db")
+	flags.StringVar(&state, "state", "", "Comma separated states, e.g. running,paused")
+	flags.StringVar(&sortBy, "sort", "", "Sort by created_at, id, name, tenant, state, cpus or memory")
+	flags.BoolVar(&descending, "desc", false, "Sort in descending order")
+	flags.IntVar(&limit, "limit", 0, "Number of virtual machines per page")
+	flags.BoolVar(&all, "all", false, "Follow the cursor until the last page")
+	return func(s *session, args []string) error {
+		client, err := s.Client()
+		if err != nil {
+			return err
+		}
+		query := url.Values{}
+		setQuery(query, "tenant", s.tenant(tenant))
+		setQuery(query, "selector", selector)
+		setQuery(query, "state", state)
+		setQuery(query, "sort", sortBy)
+		if descending {
+			query.Set("order", "desc")
+		}
+		if limit > 0 {
+			query.Set("limit", strconv.Itoa(limit))
+		}
+		var result vmmanager.ListPage
+		for {
+			var page vmmanager.ListPage
+			err = client.Call(s.ctx, http.MethodGet, "/api/vm", query, nil, &page)
+			if err != nil {
+				return err
+			}
+			result.Items = append(result.Items, page.Items...)
+			result.NextCursor = page.NextCursor
+			if !all || page.NextCursor == "" {
+				break
+			}
+			query.Set("cursor", page.NextCursor)
+		}
+		return s.print(result, func() table {
+			t := table{header: []string{"ID", "NAME", "TENANT", "STATE", "CPUS", "MEMORY", "AGE"}}
+			for _, item := range result.Items {
+				t.rows = append(t.rows, []string{
+					item.Id,
+					orDash(item.Name),
+					item.Tenant,
+					string(item.Status.State),
+					strconv.Itoa(item.Cpus),
+					formatBytes(item.Memory),
+					formatAge(item.CreatedAt),
+				})
+			}
+			if result.NextCursor != "" {
+				fmt.Fprintf(s.stderr, "More virtual machines are available, use -all or -limit\n")
+			}
+			return t
+		})
+	}
+}
+
+func setQuery(query url.Values, name string, value string) {
+	if value != "" {
+		query.Set(name, value)
+	}
+}
+
+func vmInfo(flags *flag.FlagSet) runFunc {
+	return func(s *session, args []string) error {
+		client, err := s.Client()
+		if err != nil {
+			return err
+		}
+		var info VirtualMachineInfo
+		err = client.Call(s.ctx, http.MethodGet, vmPath(args[0], "info"), nil, nil, &info)
+		if err != nil {
+			return err
+		}
+		return s.print(info, func() table {
+			manifest := info.Manifest
+			var disks []string = make([]string, 0)
+			for _, disk := range manifest.Config.Disks {
+				disks = append(disks, disk.Name)
+			}
+			var labels []string = make([]string, 0)
+			for key, value := range manifest.Labels {
+				labels = append(labels, key+"="+value)
+			}
+			sort.Strings(labels)
+			var started string = "-"
+			if info.Status.StartedAt != nil {
+				started = formatAge(*info.Status.StartedAt)
+			}
+			return table{rows: [][]string{
+				{"ID:", manifest.GuestIdentifier.String()},
+				{"Name:", orDash(manifest.Name)},
+				{"Tenant:", manifest.Tenant.String()},
+				{"State:", string(info.Status.State)},
+				{"Since:", formatAge(info.Status.UpdatedAt)},
+				{"Started:", started},
+				{"Cpus:", strconv.Itoa(manifest.Config.Cpus)},
+				{"Memory:", formatBytes(manifest.Config.Memory)},
+				{"Disks:", orDash(strings.Join(disks, ", "))},
+				{"Kernel:", orDash(manifest.Config.Kernel)},
+				{"Labels:", orDash(strings.Join(labels, ", "))},
+				{"Created:", formatAge(manifest.CreatedAt)},
+			}}
+		})
+	}
+}
+
+// readDocument reads a json or yaml file, - is stdin. Yaml is converted to json for the api
+func readDocument(path string) (json.RawMessage, error) {
+	var content []byte
+	var err error
+	if path == "-" {
+		content, err = io.ReadAll(os.Stdin)
+	} else {
+		content, err = os.ReadFile(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if ext := strings.ToLower(filepath.Ext(path)); ext == ".json" || bytes.HasPrefix(bytes.TrimSpace(content), []byte("{")) {
+		if !json.Valid(content) {
+			return nil, fmt.Errorf("%s is not valid json", path)
+		}
+		return content, nil
+	}
+	var document any
+	err = yaml.Unmarshal(content, &document)
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %w", path, err)
+	}
+	return json.Marshal(document)
+}
+
+func vmCreate(flags *flag.FlagSet) runFunc {
+	var file string
+	flags.StringVar(&file, "f", "", "Manifest of the virtual machine, json or yaml, - reads stdin")
+	return func(s *session, args []string) error {
+		if file == "" {
+			return &ErrUsage{Message: "the manifest is required, use -f"}
+		}
+		manifest, err := readDocument(file)
+		if err != nil {
+			return err
+		}
+		client, err := s.Client()
+		if err != nil {
+			return err
+		}
+		var id string
+		err = client.Call(s.ctx, http.MethodPost, "/api/vmm/metadata", nil, manifest, &id)
+		if err != nil {
+			return err
+		}
+		return s.message(map[string]string{"id": id}, "%s created", id)
+	}
+}
+
+func vmAction(action string, done string) func(flags *flag.FlagSet) runFunc {
+	return func(flags *flag.FlagSet) runFunc {
+		return func(s *session, args []string) error {
+			client, err := s.Client()
+			if err != nil {
+				return err
+			}
+			err = client.Call(s.ctx, http.MethodPut, vmPath(args[0], action), nil, nil, nil)
+			if err != nil {
+				return err
+			}
+			return s.message(map[string]string{"vm": args[0], "action": action}, "%s %s", args[0], done)
+		}
+	}
+}
+
+// followLogs copies a log source of a virtual machine to stdout until the context ends
+func followLogs(s *session, ref string, source string, tail int, follow bool) error {
+	client, err := s.Client()
+	if err != nil {
+		return err
+	}
+	query := url.Values{}
+	query.Set("source", source)
+	query.Set("tail", strconv.Itoa(tail))
+	query.Set("follow", strconv.FormatBool(follow))
+	body, err := client.Stream(s.ctx, vmPath(ref, "logs"), query, nil)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	_, err = io.Copy(s.stdout, body)
+	if err != nil && s.ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+func vmConsole(flags *flag.FlagSet) runFunc {
+	var tail int
+	flags.IntVar(&tail, "tail", 50, "Lines of serial output printed before following")
+	return func(s *session, args []string) error {
+		fmt.Fprintf(s.stderr, "Following the serial console of %s, press Ctrl-C to detach\n", args[0])
+		return followLogs(s, args[0], "serial", tail, true)
+	}
+}
+
+func vmLogs(flags *flag.FlagSet) runFunc {
+	var source string
+	var tail int
+	var follow bool
+	flags.StringVar(&source, "source", "hypervisor", "Log source, hypervisor or serial")
+	flags.IntVar(&tail, "tail", 200, "Number of lines printed")
+	flags.BoolVar(&follow, "f", false, "Keep printing new lines")
+	return func(s *session, args []string) error {
+		err := followLogs(s, args[0], source, tail, follow)
+		var errApi *ErrApi
+		if errors.As(err, &errApi) && errApi.Status == http.StatusBadRequest {
+			return &ErrUsage{Message: errApi.Message}
+		}
+		return err
+	}
+}
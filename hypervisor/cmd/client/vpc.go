@@ -0,0 +1,91 @@
+package main
+
+import (
+	"flag"
+	"net/http"
+	"net/url"
+	"strconv"
+	vmmanager "vmm/vmm"
+)
+
+func vpcCommand() *command {
+	return &command{
+		name:    "vpc",
+		summary: "Manage the private networks of tenants",
+		children: []*command{
+			{name: "list", summary: "List vpc networks and the virtual machines attached", nargs: 0, setup: vpcList},
+			{name: "create", args: "<cidr>", summary: "Reserve a vpc network for a tenant", nargs: 1, setup: vpcCreate},
+			{name: "delete", args: "<cidr>", summary: "Release a vpc network no virtual machine uses", nargs: 1, setup: vpcDelete},
+		},
+	}
+}
+
+func vpcList(flags *flag.FlagSet) runFunc {
+	var tenant string
+	flags.StringVar(&tenant, "tenant", "", "Only list the networks of this tenant, defaults to the tenant of the context")
+	return func(s *session, args []string) error {
+		client, err := s.Client()
+		if err != nil {
+			return err
+		}
+		query := url.Values{}
+		setQuery(query, "tenant", s.tenant(tenant))
+		var networks []vmmanager.VpcNetwork
+		err = client.Call(s.ctx, http.MethodGet, "/api/vpc", query, nil, &networks)
+		if err != nil {
+			return err
+		}
+		return s.print(networks, func() table {
+			t := table{header: []string{"TENANT", "NETWORK", "BRIDGE", "VMS"}}
+			for _, network := range networks {
+				t.rows = append(t.rows, []string{network.Tenant, network.Network, network.Bridge, strconv.Itoa(len(network.VirtualMachines))})
+			}
+			return t
+		})
+	}
+}
+
+func tenantFlag(flags *flag.FlagSet, tenant *string) {
+	flags.StringVar(tenant, "tenant", "", "Tenant owning the network, defaults to the tenant of the context")
+}
+
+func vpcCreate(flags *flag.FlagSet) runFunc {
+	var tenant string
+	tenantFlag(flags, &tenant)
+	return func(s *session, args []string) error {
+		if s.tenant(tenant) == "" {
+			return &ErrUsage{Message: "a tenant is required, use -tenant or set one in the context"}
+		}
+		client, err := s.Client()
+		if err != nil {
+			return err
+		}
+		var network vmmanager.VpcNetwork
+		err = client.Call(s.ctx, http.MethodPost, composeUri("/api/vpc", s.tenant(tenant)), nil, map[string]string{"network": args[0]}, &network)
+		if err != nil {
+			return err
+		}
+		return s.message(network, "%s created on bridge %s", network.Network, network.Bridge)
+	}
+}
+
+func vpcDelete(flags *flag.FlagSet) runFunc {
+	var tenant string
+	tenantFlag(flags, &tenant)
+	return func(s *session, args []string) error {
+		if s.tenant(tenant) == "" {
+			return &ErrUsage{Message: "a tenant is required, use -tenant or set one in the context"}
+		}
+		client, err := s.Client()
+		if err != nil {
+			return err
+		}
+		query := url.Values{}
+		query.Set("network", args[0])
+		err = client.Call(s.ctx, http.MethodDelete, composeUri("/api/vpc", s.tenant(tenant)), query, nil, nil)
+		if err != nil {
+			return err
+		}
+		return s.message(map[string]string{"tenant": s.tenant(tenant), "network": args[0]}, "%s deleted", args[0])
+	}
+}
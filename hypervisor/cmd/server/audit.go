@@ -0,0 +1,53 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"vmm/audit"
+	vmmanager "vmm/vmm"
+)
+
+const auditUsage = `Usage: server audit verify [-manifest_path <path>] [-file <path>]
+
+Recomputes the hash chain of the audit log, exits with 1 when a record
+was modified, removed or the log was truncated
+`
+
+func runAuditCommand(args []string) int {
+	if len(args) == 0 || args[0] != "verify" {
+		fmt.Fprint(os.Stderr, auditUsage)
+		return 2
+	}
+	var flags *flag.FlagSet = flag.NewFlagSet("audit verify", flag.ContinueOnError)
+	var manifestPath string
+	var path string
+	flags.StringVar(&manifestPath, "manifest_path", "/etc/vmm/manifest.json", "Path to host manifest")
+	flags.StringVar(&path, "file", "", "Path to the audit log, defaults to the one in the config folder")
+	err := flags.Parse(args[1:])
+	if err != nil {
+		return 2
+	}
+	if path == "" {
+		manifest, err := vmmanager.LoadManifest(manifestPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to read manifest: %s\n", err.Error())
+			return 1
+		}
+		path = manifest.AuditLogFilePath()
+	}
+	result, err := audit.Verify(path)
+	if err != nil {
+		var errChain *audit.ErrChainBroken
+		if errors.As(err, &errChain) {
+			fmt.Fprintf(os.Stderr, "Audit log is not valid, %s\n", err.Error())
+			fmt.Fprintf(os.Stderr, "Records verified before the break: %d\n", result.Records)
+			return 1
+		}
+		fmt.Fprintf(os.Stderr, "Unable to verify audit log: %s\n", err.Error())
+		return 1
+	}
+	fmt.Printf("Audit log is valid\nRecords: %d\nLast hash: %s\n", result.Records, result.LastHash)
+	return 0
+}
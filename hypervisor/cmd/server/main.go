@@ -1,8 +1,14 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"net/http"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 	vmmanager "vmm/vmm"
 	"vmm/webserver"
 
@@ -10,17 +16,39 @@ import (
 )
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "token" {
+		os.Exit(runTokenCommand(os.Args[2:]))
+	}
+	if len(os.Args) > 1 && os.Args[1] == "audit" {
+		os.Exit(runAuditCommand(os.Args[2:]))
+	}
 	var err error
 	var hostManifestPath string
 	var serverAddress string
-	logger, _ := zap.NewProduction()
+	var shutdownTimeout time.Duration
+	var stopGuests bool
+	// The level follows the host manifest and its reloads
+	var logLevel zap.AtomicLevel = zap.NewAtomicLevel()
+	var loggerConfig zap.Config = zap.NewProductionConfig()
+	loggerConfig.Level = logLevel
+	logger, _ := loggerConfig.Build()
 	defer logger.Sync()
 
 	flag.StringVar(&hostManifestPath, "manifest_path", "/etc/vmm/manifest.json", "Path to host manifest")
-	flag.StringVar(&serverAddress, "server_address", "0.0.0.0:8080", "Address to bind")
+	flag.StringVar(&serverAddress, "server_address", "0.0.0.0:8080", "Tcp address to bind, empty to serve only on the unix socket of the manifest")
+	flag.DurationVar(&shutdownTimeout, "shutdown_timeout", 30*time.Second, "Time given to requests in flight when the monitor stops")
+	flag.BoolVar(&stopGuests, "stop_guests", false, "Stop every guest when the monitor stops, by default they keep running and the next start adopts them")
 	flag.Parse()
 
-	hypervisorMonitor, err := vmmanager.NewHypervisorMonitor(logger, hostManifestPath)
+	hypervisorMonitor, err := vmmanager.NewHypervisorMonitor(logger, logLevel, hostManifestPath)
+	var errInvalid *vmmanager.ErrInvalidManifest
+	if errors.As(err, &errInvalid) {
+		for _, problem := range errInvalid.Problems {
+			logger.Error("Invalid host manifest", zap.String("path", hostManifestPath), zap.String("problem", problem))
+		}
+		logger.Sync()
+		os.Exit(1)
+	}
 	if err != nil {
 		logger.Fatal("unable to initialize vmm", zap.String("error", err.Error()))
 	}
@@ -30,8 +58,31 @@ func main() {
 		logger.Fatal("Unable to init vmm", zap.String("error", err.Error()))
 	}
 
-	// Run webserver and start listening for incoming requests
-	webserver.Run(hypervisorMonitor, serverAddress)
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			_, err := hypervisorMonitor.Reload()
+			if err != nil {
+				logger.Error("Unable to reload host manifest", zap.String("path", hostManifestPath), zap.String("error", err.Error()))
+			}
+		}
+	}()
 
-	os.Exit(0)
+	// Run webserver and start listening for incoming requests until SIGTERM or SIGINT
+	ctx, stop := signal.NotifyContext(context.Background(), syscall.SIGTERM, syscall.SIGINT)
+	defer stop()
+	var exitCode int = 0
+	err = webserver.Run(ctx, hypervisorMonitor, serverAddress, shutdownTimeout)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		logger.Error("Api server stopped", zap.String("error", err.Error()))
+		exitCode = 1
+	}
+	err = hypervisorMonitor.Shutdown(stopGuests)
+	if err != nil {
+		logger.Error("Unable to stop vmm cleanly", zap.String("error", err.Error()))
+		exitCode = 1
+	}
+	logger.Sync()
+	os.Exit(exitCode)
 }
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+	"vmm/auth"
+	vmmanager "vmm/vmm"
+)
+
+const tokenUsage = `Usage: server token <command> [flags]
+
+Commands:
+  create -name <name> -scopes <scope,...> [-tenants <tenant:role,...>] [-ttl <duration>]
+  list
+  revoke <id>
+
+Scopes: %s
+Roles: %s, the tenant * binds every tenant
+`
+
+// runTokenCommand manages api tokens directly in the config folder,
+// a running server picks up the change on the next request
+func runTokenCommand(args []string) int {
+	if len(args) == 0 {
+		fmt.Fprintf(os.Stderr, tokenUsage, strings.Join(auth.Scopes, ", "), strings.Join(auth.Roles, ", "))
+		return 2
+	}
+	var flags *flag.FlagSet = flag.NewFlagSet("token "+args[0], flag.ContinueOnError)
+	var manifestPath string
+	var name string
+	var scopes string
+	var tenants string
+	var ttl time.Duration
+	flags.StringVar(&manifestPath, "manifest_path", "/etc/vmm/manifest.json", "Path to host manifest")
+	if args[0] == "create" {
+		flags.StringVar(&name, "name", "", "Name of the token, e.g. the system using it")
+		flags.StringVar(&scopes, "scopes", "", "Comma separated scopes")
+		flags.StringVar(&tenants, "tenants", "", "Comma separated tenant:role bindings")
+		flags.DurationVar(&ttl, "ttl", 0, "Lifetime of the token, zero never expires")
+	}
+	err := flags.Parse(args[1:])
+	if err != nil {
+		return 2
+	}
+	manifest, err := vmmanager.LoadManifest(manifestPath)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to read manifest: %s\n", err.Error())
+		return 1
+	}
+	store, err := auth.OpenTokenStore(manifest.TokensFilePath())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Unable to open token store: %s\n", err.Error())
+		return 1
+	}
+
+	switch args[0] {
+	case "create":
+		if name == "" {
+			fmt.Fprintln(os.Stderr, "Name is required")
+			return 2
+		}
+		bindings, err := auth.ParseBindings(tenants)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Invalid tenants: %s\n", err.Error())
+			return 2
+		}
+		token, raw, err := store.CreateToken(name, strings.Split(scopes, ","), bindings, ttl, time.Now())
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to create token: %s\n", err.Error())
+			return 1
+		}
+		fmt.Fprintf(os.Stderr, "Token %s created, it is not shown again\n", token.Id)
+		fmt.Println(raw)
+	case "list":
+		tokens, err := store.ListTokens()
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to list tokens: %s\n", err.Error())
+			return 1
+		}
+		writer := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(writer, "ID\tNAME\tSCOPES\tTENANTS\tCREATED\tEXPIRES")
+		for _, token := range tokens {
+			var expires string = "never"
+			if !token.ExpiresAt.IsZero() {
+				expires = token.ExpiresAt.Format(time.RFC3339)
+				if token.Expired(time.Now()) {
+					expires += " (expired)"
+				}
+			}
+			var bindings []string = make([]string, 0, len(token.Bindings))
+			for _, binding := range token.Bindings {
+				bindings = append(bindings, binding.String())
+			}
+			fmt.Fprintf(writer, "%s\t%s\t%s\t%s\t%s\t%s\n", token.Id, token.Name, strings.Join(token.Scopes, ","), strings.Join(bindings, ","), token.CreatedAt.Format(time.RFC3339), expires)
+		}
+		writer.Flush()
+	case "revoke":
+		if flags.NArg() != 1 {
+			fmt.Fprintln(os.Stderr, "Token id is required")
+			return 2
+		}
+		err = store.RevokeToken(flags.Arg(0))
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to revoke token: %s\n", err.Error())
+			return 1
+		}
+		fmt.Printf("Token %s revoked\n", flags.Arg(0))
+	default:
+		fmt.Fprintf(os.Stderr, tokenUsage, strings.Join(auth.Scopes, ", "), strings.Join(auth.Roles, ", "))
+		return 2
+	}
+	return 0
+}
@@ -0,0 +1,180 @@
+package events
+
+import (
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	VM_CREATED          = "vm.created"
+	VM_DELETED          = "vm.deleted"
+	VM_STATE            = "vm.state"
+	VM_RESTART          = "vm.restart"
+	VM_RESTART_LIMIT    = "vm.restart_limit"
+	UPLOAD_PROGRESS     = "upload.progress"
+	UPLOAD_COMMITTED    = "upload.committed"
+	VPC_NETWORK_ADDED   = "vpc.network_added"
+	VPC_NETWORK_REMOVED = "vpc.network_removed"
+	ORPHAN_DETECTED     = "orphan.detected"
+	ORPHAN_ADOPTED      = "orphan.adopted"
+	ORPHAN_KILLED       = "orphan.killed"
+	QUOTA_EXCEEDED      = "quota.exceeded"
+	AUTH_DENIED         = "auth.denied"
+	MONITOR_RELOADED    = "monitor.reloaded"
+	// Events of the cloud-hypervisor event monitor are published as hypervisor.<source>.<event>
+	HYPERVISOR_PREFIX = "hypervisor."
+	// Sent to stream clients without id when events could not be delivered
+	STREAM_GAP = "stream.gap"
+)
+
+const DefaultSubscriptionBuffer = 256
+
+type Event struct {
+	Id             uint64         `json:"id" yaml:"id"`
+	Time           time.Time      `json:"time" yaml:"time"`
+	Type           string         `json:"type" yaml:"type"`
+	VirtualMachine string         `json:"virtual_machine,omitempty" yaml:"virtual_machine,omitempty"`
+	Tenant         string         `json:"tenant,omitempty" yaml:"tenant,omitempty"`
+	Data           map[string]any `json:"data,omitempty" yaml:"data,omitempty"`
+}
+
+type Publisher interface {
+	Publish(event Event) Event
+}
+
+// Filter matches events by type and owner, empty fields match everything.
+// A type ending with a dot or a star matches as a prefix, e.g. "hypervisor." or "vm.*"
+type Filter struct {
+	Types          []string
+	VirtualMachine string
+	Tenant         string
+}
+
+func matchType(pattern string, eventType string) bool {
+	if strings.HasSuffix(pattern, "*") {
+		return strings.HasPrefix(eventType, strings.TrimSuffix(pattern, "*"))
+	}
+	if strings.HasSuffix(pattern, ".") {
+		return strings.HasPrefix(eventType, pattern)
+	}
+	return pattern == eventType
+}
+
+func (f *Filter) Matches(event Event) bool {
+	if f.VirtualMachine != "" && !strings.EqualFold(f.VirtualMachine, event.VirtualMachine) {
+		return false
+	}
+	if f.Tenant != "" && !strings.EqualFold(f.Tenant, event.Tenant) {
+		return false
+	}
+	if len(f.Types) == 0 {
+		return true
+	}
+	for _, pattern := range f.Types {
+		if matchType(pattern, event.Type) {
+			return true
+		}
+	}
+	return false
+}
+
+// Subscription never blocks the bus, events are dropped when its buffer is full
+type Subscription struct {
+	C       <-chan Event
+	ch      chan Event
+	filter  Filter
+	dropped atomic.Uint64
+	bus     *Bus
+}
+
+func (s *Subscription) Dropped() uint64 {
+	return s.dropped.Load()
+}
+
+func (s *Subscription) Close() {
+	s.bus.unsubscribe(s)
+}
+
+// Bus fans out events to subscribers in publish order. Hooks run synchronously
+// before the fan out, so an event is persisted before anyone sees it
+type Bus struct {
+	mu          sync.Mutex
+	lastId      uint64
+	subscribers map[*Subscription]struct{}
+	hooks       []func(Event)
+}
+
+func NewBus() *Bus {
+	return &Bus{
+		subscribers: make(map[*Subscription]struct{}),
+	}
+}
+
+// SetLastId makes the next event id start after lastId, used when ids are persisted
+func (b *Bus) SetLastId(lastId uint64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if lastId > b.lastId {
+		b.lastId = lastId
+	}
+}
+
+func (b *Bus) AddHook(hook func(Event)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.hooks = append(b.hooks, hook)
+}
+
+// Publish assigns id and time and returns the published event
+func (b *Bus) Publish(event Event) Event {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.lastId++
+	event.Id = b.lastId
+	if event.Time.IsZero() {
+		event.Time = time.Now().UTC()
+	}
+	for _, hook := range b.hooks {
+		hook(event)
+	}
+	for subscription := range b.subscribers {
+		if !subscription.filter.Matches(event) {
+			continue
+		}
+		select {
+		case subscription.ch <- event:
+		default:
+			subscription.dropped.Add(1)
+		}
+	}
+	return event
+}
+
+func (b *Bus) Subscribe(filter Filter, buffer int) *Subscription {
+	if buffer <= 0 {
+		buffer = DefaultSubscriptionBuffer
+	}
+	ch := make(chan Event, buffer)
+	var subscription *Subscription = &Subscription{
+		C:      ch,
+		ch:     ch,
+		filter: filter,
+		bus:    b,
+	}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subscribers[subscription] = struct{}{}
+	return subscription
+}
+
+func (b *Bus) unsubscribe(subscription *Subscription) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.subscribers[subscription]; !ok {
+		return
+	}
+	delete(b.subscribers, subscription)
+	close(subscription.ch)
+}
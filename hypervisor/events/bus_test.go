@@ -0,0 +1,46 @@
+package events
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Filter_Matches(t *testing.T) {
+	var event Event = Event{Type: "hypervisor.vm.booted", VirtualMachine: "vm-a", Tenant: "tenant-a"}
+	assert.True(t, (&Filter{}).Matches(event))
+	assert.True(t, (&Filter{Types: []string{"hypervisor."}}).Matches(event))
+	assert.True(t, (&Filter{Types: []string{"vm.state", "hypervisor.vm.*"}}).Matches(event))
+	assert.False(t, (&Filter{Types: []string{"hypervisor.vm"}}).Matches(event), "Types without wildcard match exactly")
+	assert.False(t, (&Filter{VirtualMachine: "vm-b"}).Matches(event))
+	assert.True(t, (&Filter{Tenant: "TENANT-A"}).Matches(event))
+}
+
+func Test_Bus_Publish(t *testing.T) {
+	var bus *Bus = NewBus()
+	bus.SetLastId(41)
+	var hooked []uint64
+	bus.AddHook(func(event Event) {
+		hooked = append(hooked, event.Id)
+	})
+	all := bus.Subscribe(Filter{}, 1)
+	states := bus.Subscribe(Filter{Types: []string{VM_STATE}}, 10)
+
+	first := bus.Publish(Event{Type: VM_STATE})
+	bus.Publish(Event{Type: VM_CREATED})
+	assert.Equal(t, uint64(42), first.Id)
+	assert.False(t, first.Time.IsZero())
+	assert.Equal(t, []uint64{42, 43}, hooked)
+
+	assert.Equal(t, uint64(42), (<-all.C).Id)
+	assert.Equal(t, uint64(1), all.Dropped(), "A full subscription must drop instead of blocking")
+	assert.Equal(t, VM_STATE, (<-states.C).Type)
+	assert.Len(t, states.C, 0)
+
+	all.Close()
+	_, ok := <-all.C
+	assert.False(t, ok)
+	all.Close()
+	bus.Publish(Event{Type: VM_STATE})
+	assert.Len(t, states.C, 1)
+}
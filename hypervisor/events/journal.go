@@ -0,0 +1,208 @@
+package events
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"sync"
+)
+
+const DefaultJournalSize = 10000
+
+// Journal persists published events as json lines, so clients can resume a stream.
+// It is bounded by two segments: when the current one holds maxEvents events it
+// replaces the previous one, so between maxEvents and 2*maxEvents events are kept
+type Journal struct {
+	path      string
+	maxEvents int
+	file      *os.File
+	count     int
+	lastId    uint64
+	mu        sync.Mutex
+}
+
+func OpenJournal(path string, maxEvents int) (*Journal, error) {
+	if maxEvents <= 0 {
+		maxEvents = DefaultJournalSize
+	}
+	var journal *Journal = &Journal{
+		path:      path,
+		maxEvents: maxEvents,
+	}
+	previous, err := scanSegment(journal.previousPath(), false)
+	if err != nil {
+		return nil, err
+	}
+	current, err := scanSegment(path, true)
+	if err != nil {
+		return nil, err
+	}
+	journal.count = current.count
+	journal.lastId = max(previous.lastId, current.lastId)
+	journal.file, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return journal, nil
+}
+
+func (j *Journal) previousPath() string {
+	return j.path + ".1"
+}
+
+type segmentInfo struct {
+	count  int
+	lastId uint64
+}
+
+// scanSegment counts the events of a segment. With repair a partially
+// written last line, left by a crash during an append, is truncated
+func scanSegment(path string, repair bool) (segmentInfo, error) {
+	var info segmentInfo
+	fd, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return info, nil
+	}
+	if err != nil {
+		return info, err
+	}
+	defer fd.Close()
+	var reader *bufio.Reader = bufio.NewReader(fd)
+	var valid int64 = 0
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return info, err
+		}
+		valid += int64(len(line))
+		var event Event
+		if json.Unmarshal(bytes.TrimSpace(line), &event) != nil {
+			continue
+		}
+		info.count++
+		info.lastId = event.Id
+	}
+	if repair {
+		stat, err := fd.Stat()
+		if err != nil {
+			return info, err
+		}
+		if stat.Size() != valid {
+			err = os.Truncate(path, valid)
+			if err != nil {
+				return info, err
+			}
+		}
+	}
+	return info, nil
+}
+
+func (j *Journal) LastId() uint64 {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.lastId
+}
+
+func (j *Journal) Append(event Event) error {
+	content, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.file == nil {
+		return errors.New("journal is closed")
+	}
+	_, err = j.file.Write(append(content, '\n'))
+	if err != nil {
+		return err
+	}
+	j.count++
+	j.lastId = event.Id
+	if j.count >= j.maxEvents {
+		return j.rotateLocked()
+	}
+	return nil
+}
+
+func (j *Journal) rotateLocked() error {
+	err := j.file.Close()
+	j.file = nil
+	if err == nil {
+		err = os.Rename(j.path, j.previousPath())
+	}
+	if err != nil {
+		// Events keep going to the current segment, the rotation is retried on the next append
+		var reopenErr error
+		j.file, reopenErr = os.OpenFile(j.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+		return errors.Join(err, reopenErr)
+	}
+	j.file, err = os.OpenFile(j.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	j.count = 0
+	return nil
+}
+
+// Since returns the retained events published after afterId that match the filter.
+// The second value is false when events after afterId were already discarded
+func (j *Journal) Since(afterId uint64, filter Filter) ([]Event, bool, error) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	var res []Event = make([]Event, 0)
+	var oldest uint64 = 0
+	for _, path := range []string{j.previousPath(), j.path} {
+		err := readSegment(path, func(event Event) {
+			if oldest == 0 {
+				oldest = event.Id
+			}
+			if event.Id > afterId && filter.Matches(event) {
+				res = append(res, event)
+			}
+		})
+		if err != nil {
+			return nil, false, err
+		}
+	}
+	var complete bool = afterId >= j.lastId || (oldest != 0 && oldest <= afterId+1)
+	return res, complete, nil
+}
+
+func readSegment(path string, callback func(Event)) error {
+	fd, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	var scanner *bufio.Scanner = bufio.NewScanner(fd)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		var event Event
+		if json.Unmarshal(scanner.Bytes(), &event) != nil {
+			continue
+		}
+		callback(event)
+	}
+	return scanner.Err()
+}
+
+func (j *Journal) Close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.file == nil {
+		return nil
+	}
+	err := j.file.Close()
+	j.file = nil
+	return err
+}
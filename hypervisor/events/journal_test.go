@@ -0,0 +1,97 @@
+package events
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Journal_Since(t *testing.T) {
+	var path string = filepath.Join(t.TempDir(), "events.journal")
+	journal, err := OpenJournal(path, 100)
+	assert.Nil(t, err)
+	defer journal.Close()
+	for i := 1; i <= 4; i++ {
+		var eventType string = VM_STATE
+		if i%2 == 0 {
+			eventType = VM_CREATED
+		}
+		assert.Nil(t, journal.Append(Event{Id: uint64(i), Type: eventType}))
+	}
+	replay, complete, err := journal.Since(1, Filter{Types: []string{VM_CREATED}})
+	assert.Nil(t, err)
+	assert.True(t, complete)
+	assert.Len(t, replay, 2)
+	assert.Equal(t, uint64(2), replay[0].Id)
+	assert.Equal(t, uint64(4), replay[1].Id)
+
+	replay, complete, err = journal.Since(4, Filter{})
+	assert.Nil(t, err)
+	assert.True(t, complete)
+	assert.Len(t, replay, 0)
+}
+
+func Test_Journal_Rotation(t *testing.T) {
+	var path string = filepath.Join(t.TempDir(), "events.journal")
+	journal, err := OpenJournal(path, 3)
+	assert.Nil(t, err)
+	defer journal.Close()
+	for i := 1; i <= 10; i++ {
+		assert.Nil(t, journal.Append(Event{Id: uint64(i), Type: VM_STATE}))
+	}
+	replay, complete, err := journal.Since(0, Filter{})
+	assert.Nil(t, err)
+	assert.False(t, complete, "Events discarded by the rotation must be reported")
+	assert.Len(t, replay, 4, "Only the current and the previous segment are kept")
+	assert.Equal(t, uint64(7), replay[0].Id)
+
+	_, complete, err = journal.Since(6, Filter{})
+	assert.Nil(t, err)
+	assert.True(t, complete)
+}
+
+func Test_Journal_RotationFailure(t *testing.T) {
+	var path string = filepath.Join(t.TempDir(), "events.journal")
+	journal, err := OpenJournal(path, 2)
+	assert.Nil(t, err)
+	defer journal.Close()
+	// A non empty folder in place of the previous segment makes the rename fail
+	assert.Nil(t, os.MkdirAll(filepath.Join(path+".1", "busy"), 0700))
+	assert.Nil(t, journal.Append(Event{Id: 1, Type: VM_STATE}))
+	assert.NotNil(t, journal.Append(Event{Id: 2, Type: VM_STATE}))
+	assert.NotNil(t, journal.Append(Event{Id: 3, Type: VM_STATE}), "The rotation is retried")
+
+	assert.Nil(t, os.RemoveAll(path+".1"))
+	assert.Nil(t, journal.Append(Event{Id: 4, Type: VM_STATE}), "The journal is still open after a failed rotation")
+	assert.Nil(t, journal.Append(Event{Id: 5, Type: VM_STATE}))
+	replay, complete, err := journal.Since(0, Filter{})
+	assert.Nil(t, err)
+	assert.True(t, complete, "No event is lost")
+	assert.Len(t, replay, 5)
+	assert.Equal(t, uint64(5), journal.LastId())
+}
+
+func Test_OpenJournal(t *testing.T) {
+	var path string = filepath.Join(t.TempDir(), "events.journal")
+	journal, err := OpenJournal(path, 100)
+	assert.Nil(t, err)
+	assert.Nil(t, journal.Append(Event{Id: 7, Type: VM_STATE}))
+	assert.Nil(t, journal.Close())
+
+	fd, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	assert.Nil(t, err)
+	_, err = fd.WriteString(`{"id":8,"type":"vm.st`)
+	assert.Nil(t, err)
+	fd.Close()
+
+	journal, err = OpenJournal(path, 100)
+	assert.Nil(t, err)
+	defer journal.Close()
+	assert.Equal(t, uint64(7), journal.LastId())
+	assert.Nil(t, journal.Append(Event{Id: 8, Type: VM_STATE}))
+	replay, _, err := journal.Since(0, Filter{})
+	assert.Nil(t, err)
+	assert.Len(t, replay, 2, "A partially written event must be truncated on open")
+}
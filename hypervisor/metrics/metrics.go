@@ -0,0 +1,305 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	COUNTER   = "counter"
+	GAUGE     = "gauge"
+	HISTOGRAM = "histogram"
+	// For values whose kind is not known in advance
+	UNTYPED = "untyped"
+)
+
+const ContentType = "text/plain; version=0.0.4; charset=utf-8"
+
+// DefaultBuckets suit request latencies in seconds
+var DefaultBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type Label struct {
+	Name  string
+	Value string
+}
+
+// Sample is one line of a family, suffix is appended to the family name, e.g. "_bucket"
+type Sample struct {
+	Suffix string
+	Labels []Label
+	Value  float64
+}
+
+type Family struct {
+	Name    string
+	Help    string
+	Type    string
+	Samples []Sample
+}
+
+// Collector produces families at scrape time
+type Collector interface {
+	Collect() []Family
+}
+
+type CollectorFunc func() []Family
+
+func (f CollectorFunc) Collect() []Family {
+	return f()
+}
+
+type Registry struct {
+	mu         sync.Mutex
+	collectors []Collector
+}
+
+func NewRegistry() *Registry {
+	return &Registry{}
+}
+
+func (r *Registry) Register(collector Collector) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.collectors = append(r.collectors, collector)
+}
+
+// Write renders every family in the text exposition format, families are sorted by name
+// and samples of families with the same name are merged
+func (r *Registry) Write(w io.Writer) error {
+	r.mu.Lock()
+	collectors := append([]Collector(nil), r.collectors...)
+	r.mu.Unlock()
+	var families map[string]*Family = make(map[string]*Family)
+	for _, collector := range collectors {
+		for _, family := range collector.Collect() {
+			if existing, ok := families[family.Name]; ok {
+				existing.Samples = append(existing.Samples, family.Samples...)
+				continue
+			}
+			copied := family
+			families[family.Name] = &copied
+		}
+	}
+	var names []string = make([]string, 0, len(families))
+	for name := range families {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		err := writeFamily(w, families[name])
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeFamily(w io.Writer, family *Family) error {
+	var builder strings.Builder
+	fmt.Fprintf(&builder, "# HELP %s %s\n", family.Name, escapeHelp(family.Help))
+	fmt.Fprintf(&builder, "# TYPE %s %s\n", family.Name, family.Type)
+	for _, sample := range family.Samples {
+		builder.WriteString(family.Name)
+		builder.WriteString(sample.Suffix)
+		if len(sample.Labels) > 0 {
+			builder.WriteByte('{')
+			for i, label := range sample.Labels {
+				if i > 0 {
+					builder.WriteByte(',')
+				}
+				fmt.Fprintf(&builder, "%s=\"%s\"", label.Name, escapeLabelValue(label.Value))
+			}
+			builder.WriteByte('}')
+		}
+		builder.WriteByte(' ')
+		builder.WriteString(formatValue(sample.Value))
+		builder.WriteByte('\n')
+	}
+	_, err := io.WriteString(w, builder.String())
+	return err
+}
+
+func escapeHelp(help string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`).Replace(help)
+}
+
+func escapeLabelValue(value string) string {
+	return strings.NewReplacer(`\`, `\\`, "\n", `\n`, `"`, `\"`).Replace(value)
+}
+
+func formatValue(value float64) string {
+	switch {
+	case math.IsInf(value, 1):
+		return "+Inf"
+	case math.IsInf(value, -1):
+		return "-Inf"
+	case math.IsNaN(value):
+		return "NaN"
+	}
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
+
+func labelPairs(names []string, values []string) []Label {
+	var labels []Label = make([]Label, len(names))
+	for i := range names {
+		labels[i] = Label{Name: names[i], Value: values[i]}
+	}
+	return labels
+}
+
+func vectorKey(values []string) string {
+	return strings.Join(values, "\xff")
+}
+
+// CounterVec is a counter partitioned by label values
+type CounterVec struct {
+	name       string
+	help       string
+	labelNames []string
+	mu         sync.Mutex
+	values     map[string]*counterValue
+}
+
+type counterValue struct {
+	labels []string
+	value  float64
+}
+
+func NewCounterVec(name string, help string, labelNames ...string) *CounterVec {
+	return &CounterVec{
+		name:       name,
+		help:       help,
+		labelNames: labelNames,
+		values:     make(map[string]*counterValue),
+	}
+}
+
+// Add ignores negative deltas, counters only go up
+func (c *CounterVec) Add(delta float64, labelValues ...string) {
+	if delta < 0 || len(labelValues) != len(c.labelNames) {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := vectorKey(labelValues)
+	value, ok := c.values[key]
+	if !ok {
+		value = &counterValue{labels: append([]string(nil), labelValues...)}
+		c.values[key] = value
+	}
+	value.value += delta
+}
+
+func (c *CounterVec) Collect() []Family {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var family Family = Family{Name: c.name, Help: c.help, Type: COUNTER}
+	for _, key := range sortedKeys(c.values) {
+		value := c.values[key]
+		family.Samples = append(family.Samples, Sample{
+			Labels: labelPairs(c.labelNames, value.labels),
+			Value:  value.value,
+		})
+	}
+	return []Family{family}
+}
+
+// HistogramVec is a histogram partitioned by label values
+type HistogramVec struct {
+	name       string
+	help       string
+	labelNames []string
+	buckets    []float64
+	mu         sync.Mutex
+	values     map[string]*histogramValue
+}
+
+type histogramValue struct {
+	labels []string
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func NewHistogramVec(name string, help string, buckets []float64, labelNames ...string) *HistogramVec {
+	var sorted []float64 = append([]float64(nil), buckets...)
+	sort.Float64s(sorted)
+	return &HistogramVec{
+		name:       name,
+		help:       help,
+		labelNames: labelNames,
+		buckets:    sorted,
+		values:     make(map[string]*histogramValue),
+	}
+}
+
+func (h *HistogramVec) Observe(value float64, labelValues ...string) {
+	if len(labelValues) != len(h.labelNames) {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := vectorKey(labelValues)
+	histogram, ok := h.values[key]
+	if !ok {
+		histogram = &histogramValue{
+			labels: append([]string(nil), labelValues...),
+			counts: make([]uint64, len(h.buckets)),
+		}
+		h.values[key] = histogram
+	}
+	for i, bound := range h.buckets {
+		if value <= bound {
+			histogram.counts[i]++
+		}
+	}
+	histogram.count++
+	histogram.sum += value
+}
+
+func (h *HistogramVec) Collect() []Family {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	var family Family = Family{Name: h.name, Help: h.help, Type: HISTOGRAM}
+	for _, key := range sortedKeys(h.values) {
+		histogram := h.values[key]
+		labels := labelPairs(h.labelNames, histogram.labels)
+		for i, bound := range h.buckets {
+			family.Samples = append(family.Samples, Sample{
+				Suffix: "_bucket",
+				Labels: append(append([]Label(nil), labels...), Label{Name: "le", Value: formatValue(bound)}),
+				Value:  float64(histogram.counts[i]),
+			})
+		}
+		family.Samples = append(family.Samples,
+			Sample{Suffix: "_bucket", Labels: append(append([]Label(nil), labels...), Label{Name: "le", Value: "+Inf"}), Value: float64(histogram.count)},
+			Sample{Suffix: "_sum", Labels: labels, Value: histogram.sum},
+			Sample{Suffix: "_count", Labels: labels, Value: float64(histogram.count)},
+		)
+	}
+	return []Family{family}
+}
+
+func sortedKeys[T any](values map[string]T) []string {
+	var keys []string = make([]string, 0, len(values))
+	for key := range values {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// Gauge builds a single sample gauge family
+func Gauge(name string, help string, value float64, labels ...Label) Family {
+	return Family{
+		Name:    name,
+		Help:    help,
+		Type:    GAUGE,
+		Samples: []Sample{{Labels: labels, Value: value}},
+	}
+}
@@ -0,0 +1,55 @@
+package metrics
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_Registry_Write(t *testing.T) {
+	var registry *Registry = NewRegistry()
+	counter := NewCounterVec("test_bytes_total", "Bytes\nwritten", "kind")
+	counter.Add(10, "disk")
+	counter.Add(5, "disk")
+	counter.Add(-1, "disk")
+	counter.Add(1, "kernel", "extra")
+	registry.Register(counter)
+	registry.Register(CollectorFunc(func() []Family {
+		return []Family{Gauge("test_gauge", "A gauge", 1.5, Label{Name: "name", Value: `a "b"`})}
+	}))
+
+	var output strings.Builder
+	assert.Nil(t, registry.Write(&output))
+	assert.Equal(t, `# HELP test_bytes_total Bytes\nwritten
+# TYPE test_bytes_total counter
+test_bytes_total{kind="disk"} 15
+# HELP test_gauge A gauge
+# TYPE test_gauge gauge
+test_gauge{name="a \"b\""} 1.5
+`, output.String())
+}
+
+func Test_HistogramVec_Collect(t *testing.T) {
+	histogram := NewHistogramVec("test_seconds", "Latency", []float64{1, 0.1}, "route")
+	histogram.Observe(0.05, "/a")
+	histogram.Observe(0.5, "/a")
+	histogram.Observe(5, "/a")
+	families := histogram.Collect()
+	assert.Len(t, families, 1)
+	var values map[string]float64 = make(map[string]float64)
+	for _, sample := range families[0].Samples {
+		var key string = sample.Suffix
+		for _, label := range sample.Labels {
+			if label.Name == "le" {
+				key += label.Value
+			}
+		}
+		values[key] = sample.Value
+	}
+	assert.Equal(t, float64(1), values["_bucket0.1"])
+	assert.Equal(t, float64(2), values["_bucket1"], "Buckets are cumulative")
+	assert.Equal(t, float64(3), values["_bucket+Inf"])
+	assert.Equal(t, float64(3), values["_count"])
+	assert.InDelta(t, 5.55, values["_sum"], 0.0001)
+}
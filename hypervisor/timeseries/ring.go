@@ -0,0 +1,133 @@
+package timeseries
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"os"
+	"time"
+)
+
+const (
+	ringMagic   uint32 = 0x43485453 // "CHTS"
+	ringVersion uint32 = 1
+	headerSize         = 32
+	// Bucket start, sample count and one float64 per field
+	recordSize = 8 + 8 + FieldCount*8
+)
+
+// record is one bucket of a tier, the values are averages of count samples
+type record struct {
+	bucket int64
+	count  uint64
+	values [FieldCount]float64
+}
+
+// ringFile stores the buckets of one tier in a file of fixed size.
+// The slot of a bucket is derived from its start time, so a slot is valid
+// only when the stored bucket matches, older data is overwritten in place
+type ringFile struct {
+	file  *os.File
+	step  int64
+	slots int64
+}
+
+func openRingFile(path string, step time.Duration, retention time.Duration) (*ringFile, error) {
+	var ring *ringFile = &ringFile{
+		step:  int64(step / time.Second),
+		slots: int64(retention / step),
+	}
+	if ring.step <= 0 || ring.slots <= 0 {
+		return nil, errors.New("tier step must be at least one second and shorter than its retention")
+	}
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+	ring.file = file
+	// A file written with another layout is reset, history does not survive a change of tiers
+	if !ring.headerMatches() {
+		err = ring.reset()
+		if err != nil {
+			file.Close()
+			return nil, err
+		}
+	}
+	return ring, nil
+}
+
+func (r *ringFile) header() []byte {
+	var header []byte = make([]byte, headerSize)
+	binary.LittleEndian.PutUint32(header[0:], ringMagic)
+	binary.LittleEndian.PutUint32(header[4:], ringVersion)
+	binary.LittleEndian.PutUint64(header[8:], uint64(r.step))
+	binary.LittleEndian.PutUint64(header[16:], uint64(r.slots))
+	binary.LittleEndian.PutUint64(header[24:], FieldCount)
+	return header
+}
+
+func (r *ringFile) headerMatches() bool {
+	var header []byte = make([]byte, headerSize)
+	_, err := r.file.ReadAt(header, 0)
+	if err != nil {
+		return false
+	}
+	stat, err := r.file.Stat()
+	if err != nil || stat.Size() != headerSize+r.slots*recordSize {
+		return false
+	}
+	return string(header) == string(r.header())
+}
+
+func (r *ringFile) reset() error {
+	err := r.file.Truncate(0)
+	if err != nil {
+		return err
+	}
+	err = r.file.Truncate(headerSize + r.slots*recordSize)
+	if err != nil {
+		return err
+	}
+	_, err = r.file.WriteAt(r.header(), 0)
+	return err
+}
+
+func (r *ringFile) offset(bucket int64) int64 {
+	return headerSize + ((bucket/r.step)%r.slots)*recordSize
+}
+
+// read returns false when the slot holds another bucket or was never written
+func (r *ringFile) read(bucket int64) (record, bool, error) {
+	var buffer []byte = make([]byte, recordSize)
+	_, err := r.file.ReadAt(buffer, r.offset(bucket))
+	if err != nil && err != io.EOF {
+		return record{}, false, err
+	}
+	var rec record = record{
+		bucket: int64(binary.LittleEndian.Uint64(buffer[0:])),
+		count:  binary.LittleEndian.Uint64(buffer[8:]),
+	}
+	if rec.bucket != bucket || rec.count == 0 {
+		return record{}, false, nil
+	}
+	for i := range rec.values {
+		rec.values[i] = math.Float64frombits(binary.LittleEndian.Uint64(buffer[16+i*8:]))
+	}
+	return rec, true, nil
+}
+
+func (r *ringFile) write(rec record) error {
+	var buffer []byte = make([]byte, recordSize)
+	binary.LittleEndian.PutUint64(buffer[0:], uint64(rec.bucket))
+	binary.LittleEndian.PutUint64(buffer[8:], rec.count)
+	for i, value := range rec.values {
+		binary.LittleEndian.PutUint64(buffer[16+i*8:], math.Float64bits(value))
+	}
+	_, err := r.file.WriteAt(buffer, r.offset(rec.bucket))
+	return err
+}
+
+func (r *ringFile) close() error {
+	return r.file.Close()
+}
@@ -0,0 +1,215 @@
+package timeseries
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+const FieldCount = 6
+
+var errStoreClosed = errors.New("time series store is closed")
+
+// A query returns at most this many points, the step is raised to fit
+const MaxQueryPoints = 2000
+
+// Sample holds resource usage rates of a guest, counters are turned into rates by the sampler
+type Sample struct {
+	Time                    time.Time `json:"time" yaml:"time"`
+	Cpus                    float64   `json:"cpus" yaml:"cpus"`
+	MemoryBytes             float64   `json:"memory_bytes" yaml:"memory_bytes"`
+	DiskReadBytesPerSecond  float64   `json:"disk_read_bytes_per_second" yaml:"disk_read_bytes_per_second"`
+	DiskWriteBytesPerSecond float64   `json:"disk_write_bytes_per_second" yaml:"disk_write_bytes_per_second"`
+	NetRxBytesPerSecond     float64   `json:"net_rx_bytes_per_second" yaml:"net_rx_bytes_per_second"`
+	NetTxBytesPerSecond     float64   `json:"net_tx_bytes_per_second" yaml:"net_tx_bytes_per_second"`
+}
+
+func (s *Sample) values() [FieldCount]float64 {
+	return [FieldCount]float64{s.Cpus, s.MemoryBytes, s.DiskReadBytesPerSecond, s.DiskWriteBytesPerSecond, s.NetRxBytesPerSecond, s.NetTxBytesPerSecond}
+}
+
+func sampleFromValues(t time.Time, values [FieldCount]float64) Sample {
+	return Sample{
+		Time:                    t,
+		Cpus:                    values[0],
+		MemoryBytes:             values[1],
+		DiskReadBytesPerSecond:  values[2],
+		DiskWriteBytesPerSecond: values[3],
+		NetRxBytesPerSecond:     values[4],
+		NetTxBytesPerSecond:     values[5],
+	}
+}
+
+// Tier keeps averages over Step for Retention
+type Tier struct {
+	Step      time.Duration
+	Retention time.Duration
+}
+
+var DefaultTiers = []Tier{
+	{Step: time.Minute, Retention: 24 * time.Hour},
+	{Step: 15 * time.Minute, Retention: 30 * 24 * time.Hour},
+}
+
+type Series struct {
+	Step   int64    `json:"step" yaml:"step"`
+	Points []Sample `json:"points" yaml:"points"`
+}
+
+// Store is the history of one guest, one ring file per tier
+type Store struct {
+	tiers   []Tier
+	rings   []*ringFile
+	current []record
+	mu      sync.Mutex
+}
+
+// OpenStore creates folder when missing, its parent must exist
+func OpenStore(folder string, tiers []Tier) (*Store, error) {
+	if len(tiers) == 0 {
+		return nil, errors.New("at least one retention tier is required")
+	}
+	err := os.Mkdir(folder, 0700)
+	if err != nil && !errors.Is(err, os.ErrExist) {
+		return nil, err
+	}
+	var sorted []Tier = append([]Tier(nil), tiers...)
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].Step < sorted[j].Step
+	})
+	var store *Store = &Store{
+		tiers:   sorted,
+		rings:   make([]*ringFile, 0, len(sorted)),
+		current: make([]record, len(sorted)),
+	}
+	for _, tier := range sorted {
+		ring, err := openRingFile(filepath.Join(folder, fmt.Sprintf("%ds.ring", int64(tier.Step/time.Second))), tier.Step, tier.Retention)
+		if err != nil {
+			store.Close()
+			return nil, err
+		}
+		store.rings = append(store.rings, ring)
+	}
+	return store, nil
+}
+
+// Append folds the sample into the current bucket of every tier.
+// The partial bucket is written each time, so a restart continues the average
+func (s *Store) Append(sample Sample) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.rings == nil {
+		return errStoreClosed
+	}
+	var unix int64 = sample.Time.Unix()
+	var values [FieldCount]float64 = sample.values()
+	for i, ring := range s.rings {
+		var bucket int64 = unix - unix%ring.step
+		current := &s.current[i]
+		if current.bucket != bucket || current.count == 0 {
+			stored, ok, err := ring.read(bucket)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				stored = record{bucket: bucket}
+			}
+			*current = stored
+		}
+		for field := range current.values {
+			current.values[field] = (current.values[field]*float64(current.count) + values[field]) / float64(current.count+1)
+		}
+		current.count++
+		err := ring.write(*current)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Query averages the buckets between from and to over step. The finest tier still
+// retaining from is used, a zero step or a step finer than the tier uses the tier step
+func (s *Store) Query(from time.Time, to time.Time, step time.Duration, now time.Time) (Series, error) {
+	if !from.Before(to) {
+		return Series{}, errors.New("from must be before to")
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.rings == nil {
+		return Series{}, errStoreClosed
+	}
+	var index int = len(s.tiers) - 1
+	for i, tier := range s.tiers {
+		if !from.Before(now.Add(-tier.Retention)) {
+			index = i
+			break
+		}
+	}
+	var ring *ringFile = s.rings[index]
+	// Buckets out of the retention cannot hold data, skipping them bounds the scan
+	if oldest := now.Add(-s.tiers[index].Retention); from.Before(oldest) {
+		from = oldest
+	}
+	if to.After(now) {
+		to = now.Add(time.Duration(ring.step) * time.Second)
+	}
+	if !from.Before(to) {
+		return Series{Step: ring.step, Points: make([]Sample, 0)}, nil
+	}
+	var stepSeconds int64 = max(int64(step/time.Second), ring.step)
+	var span int64 = to.Unix() - from.Unix()
+	if span/stepSeconds > MaxQueryPoints {
+		stepSeconds = (span + MaxQueryPoints - 1) / MaxQueryPoints
+	}
+	// The output step is a multiple of the tier step, so buckets are never split
+	stepSeconds = (stepSeconds + ring.step - 1) / ring.step * ring.step
+
+	var series Series = Series{Step: stepSeconds, Points: make([]Sample, 0)}
+	var first int64 = from.Unix() - from.Unix()%ring.step
+	var current record
+	var flush = func() {
+		if current.count > 0 {
+			series.Points = append(series.Points, sampleFromValues(time.Unix(current.bucket, 0).UTC(), current.values))
+		}
+	}
+	for bucket := first; bucket < to.Unix(); bucket += ring.step {
+		rec, ok, err := ring.read(bucket)
+		if err != nil {
+			return Series{}, err
+		}
+		if !ok {
+			continue
+		}
+		var outBucket int64 = bucket - bucket%stepSeconds
+		if outBucket != current.bucket || current.count == 0 {
+			flush()
+			current = record{bucket: outBucket}
+		}
+		total := current.count + rec.count
+		for field := range current.values {
+			current.values[field] = (current.values[field]*float64(current.count) + rec.values[field]*float64(rec.count)) / float64(total)
+		}
+		current.count = total
+	}
+	flush()
+	return series, nil
+}
+
+func (s *Store) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var res error = nil
+	for _, ring := range s.rings {
+		err := ring.close()
+		if err != nil && res == nil {
+			res = err
+		}
+	}
+	s.rings = nil
+	return res
+}
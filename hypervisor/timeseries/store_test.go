@@ -0,0 +1,102 @@
+package timeseries
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+var testTiers = []Tier{
+	{Step: 10 * time.Minute, Retention: 24 * time.Hour},
+	{Step: time.Minute, Retention: time.Hour},
+}
+
+func Test_Store_Query(t *testing.T) {
+	var folder string = t.TempDir()
+	store, err := OpenStore(folder, testTiers)
+	assert.Nil(t, err)
+	defer store.Close()
+	var start time.Time = time.Unix(1_700_000_400, 0).UTC()
+	for i := 0; i < 20; i++ {
+		assert.Nil(t, store.Append(Sample{Time: start.Add(time.Duration(i) * 30 * time.Second), Cpus: float64(i), MemoryBytes: 100}))
+	}
+	var now time.Time = start.Add(10 * time.Minute)
+
+	series, err := store.Query(start, now, 0, now)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(60), series.Step, "Recent ranges use the finest tier")
+	assert.Len(t, series.Points, 10)
+	assert.Equal(t, 0.5, series.Points[0].Cpus, "Samples of a bucket are averaged")
+	assert.Equal(t, float64(100), series.Points[0].MemoryBytes)
+
+	series, err = store.Query(start, now, 5*time.Minute, now)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(300), series.Step)
+	assert.Len(t, series.Points, 2)
+	assert.Equal(t, 4.5, series.Points[0].Cpus)
+
+	series, err = store.Query(start.Add(-2*time.Hour), now, 0, now)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(600), series.Step, "Ranges beyond the retention of the finest tier use a coarser one")
+	assert.Len(t, series.Points, 1)
+	assert.Equal(t, 9.5, series.Points[0].Cpus)
+
+	_, err = store.Query(now, start, 0, now)
+	assert.NotNil(t, err)
+}
+
+func Test_Store_Reopen(t *testing.T) {
+	var folder string = t.TempDir()
+	var start time.Time = time.Unix(1_700_000_400, 0).UTC()
+	store, err := OpenStore(folder, testTiers)
+	assert.Nil(t, err)
+	assert.Nil(t, store.Append(Sample{Time: start, Cpus: 1}))
+	assert.Nil(t, store.Close())
+
+	store, err = OpenStore(folder, testTiers)
+	assert.Nil(t, err)
+	defer store.Close()
+	assert.Nil(t, store.Append(Sample{Time: start.Add(time.Second), Cpus: 3}))
+	series, err := store.Query(start, start.Add(time.Minute), 0, start)
+	assert.Nil(t, err)
+	assert.Len(t, series.Points, 1)
+	assert.Equal(t, float64(2), series.Points[0].Cpus, "A partial bucket must be continued after reopening")
+}
+
+func Test_Store_Wraparound(t *testing.T) {
+	var folder string = t.TempDir()
+	store, err := OpenStore(folder, []Tier{{Step: time.Minute, Retention: 5 * time.Minute}})
+	assert.Nil(t, err)
+	defer store.Close()
+	var start time.Time = time.Unix(1_700_000_400, 0).UTC()
+	for i := 0; i < 7; i++ {
+		assert.Nil(t, store.Append(Sample{Time: start.Add(time.Duration(i) * time.Minute), Cpus: float64(i)}))
+	}
+	stat, err := os.Stat(filepath.Join(folder, "60s.ring"))
+	assert.Nil(t, err)
+	assert.Equal(t, int64(headerSize+5*recordSize), stat.Size(), "The ring file never grows")
+	var now time.Time = start.Add(6 * time.Minute)
+	series, err := store.Query(start, now.Add(time.Minute), 0, now)
+	assert.Nil(t, err)
+	assert.Len(t, series.Points, 5)
+	assert.Equal(t, float64(2), series.Points[0].Cpus, "Overwritten buckets must not be returned")
+}
+
+func Test_OpenStore_LayoutChange(t *testing.T) {
+	var folder string = t.TempDir()
+	var start time.Time = time.Unix(1_700_000_400, 0).UTC()
+	store, err := OpenStore(folder, []Tier{{Step: time.Minute, Retention: time.Hour}})
+	assert.Nil(t, err)
+	assert.Nil(t, store.Append(Sample{Time: start, Cpus: 1}))
+	assert.Nil(t, store.Close())
+
+	store, err = OpenStore(folder, []Tier{{Step: time.Minute, Retention: 2 * time.Hour}})
+	assert.Nil(t, err)
+	defer store.Close()
+	series, err := store.Query(start, start.Add(time.Minute), 0, start)
+	assert.Nil(t, err)
+	assert.Len(t, series.Points, 0, "A ring file with another layout must be reset")
+}
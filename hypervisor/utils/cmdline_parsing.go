@@ -2,71 +2,146 @@ package utils
 
 import (
 	"errors"
+	"strconv"
 	"strings"
 
 	"github.com/google/shlex"
 )
 
+// Args holds true for flags without values, a string for flags with
+// one value and a []string for flags followed by more values (--disk a b)
 type CmdLineParsing struct {
-	Args   map[string]interface{}
-	Binary string
+	Args       map[string]interface{}
+	Positional []string
+	Binary     string
 }
 
 func NewCmdLineParsing() *CmdLineParsing {
 	return &CmdLineParsing{
-		Args:   make(map[string]interface{}),
-		Binary: "",
+		Args:       make(map[string]interface{}),
+		Positional: make([]string, 0),
+		Binary:     "",
 	}
 }
 
 func ParseCmdLine(command string) (*CmdLineParsing, error) {
-	var cmdLine *CmdLineParsing = &CmdLineParsing{
-		Binary: "",
-		Args:   make(map[string]interface{}),
-	}
 	args, err := shlex.Split(command)
 	if err != nil {
 		return nil, err
 	}
-	for i := 0; i < len(args); i++ {
-		if i == 0 {
-			cmdLine.Binary = args[0]
-			continue
+	return ParseCmdLineArgs(args)
+}
+
+// ParseCmdLineFile parses the NUL separated content of /proc/<pid>/cmdline,
+// arguments containing spaces are kept intact
+func ParseCmdLineFile(content []byte) (*CmdLineParsing, error) {
+	var args []string = strings.Split(strings.TrimRight(string(content), "\000"), "\000")
+	return ParseCmdLineArgs(args)
+}
+
+func isFlag(arg string) bool {
+	return len(arg) > 1 && arg[0] == '-'
+}
+
+func ParseCmdLineArgs(args []string) (*CmdLineParsing, error) {
+	if len(args) == 0 || args[0] == "" {
+		return nil, errors.New("empty command line")
+	}
+	var cmdLine *CmdLineParsing = NewCmdLineParsing()
+	cmdLine.Binary = args[0]
+	var current string = ""
+	for i := 1; i < len(args); i++ {
+		var arg string = args[i]
+		if arg == "--" {
+			cmdLine.Positional = append(cmdLine.Positional, args[i+1:]...)
+			break
 		}
-		if args[i][:2] == "--" && i == len(args)-1 {
-			cmdLine.Args[args[i]] = true
+		if !isFlag(arg) {
+			if current == "" {
+				cmdLine.Positional = append(cmdLine.Positional, arg)
+				continue
+			}
+			cmdLine.addValue(current, arg)
 			continue
 		}
-		if args[i][:2] != "--" {
-			return nil, errors.New("expected a flag")
-		}
-		if args[i][:2] == "--" && args[i+1][:2] == "--" {
-			cmdLine.Args[args[i]] = true
+		current = arg
+		if index := strings.Index(arg, "="); strings.HasPrefix(arg, "--") && index > 0 {
+			current = arg[:index]
+			cmdLine.addValue(current, arg[index+1:])
 			continue
 		}
-		cmdLine.Args[args[i]] = args[i+1]
-		i += 1
+		if _, ok := cmdLine.Args[current]; !ok {
+			cmdLine.Args[current] = true
+		}
 	}
 	return cmdLine, nil
 }
 
+func (cmdLine *CmdLineParsing) addValue(flag string, value string) {
+	switch current := cmdLine.Args[flag].(type) {
+	case string:
+		cmdLine.Args[flag] = []string{current, value}
+	case []string:
+		cmdLine.Args[flag] = append(current, value)
+	default:
+		cmdLine.Args[flag] = value
+	}
+}
+
+// Value returns the first value given to a flag
+func (cmdLine *CmdLineParsing) Value(flag string) (string, bool) {
+	switch current := cmdLine.Args[flag].(type) {
+	case string:
+		return current, true
+	case []string:
+		return current[0], true
+	default:
+		return "", false
+	}
+}
+
+// Fd is -1 when the socket is given by path
 type CmdSocketParsing struct {
 	Path string
+	Fd   int
 }
 
 func NewCmdSocketParsing() *CmdSocketParsing {
 	return &CmdSocketParsing{
 		Path: "",
+		Fd:   -1,
 	}
 }
 
+// Parse accepts "path=<socket>", "fd=<descriptor>" and a bare socket path
 func (current *CmdSocketParsing) Parse(pathArg string) error {
-	var parts []string = strings.Split(pathArg, "=")
-	if len(parts) != 2 || parts[0] != "path" {
-		return errors.New("unknown property")
+	if pathArg == "" {
+		return errors.New("empty api socket")
+	}
+	if !strings.Contains(pathArg, "=") {
+		current.Path = pathArg
+		return nil
+	}
+	for _, option := range strings.Split(pathArg, ",") {
+		var parts []string = strings.SplitN(option, "=", 2)
+		if len(parts) != 2 {
+			return errors.New("unknown property")
+		}
+		switch parts[0] {
+		case "path":
+			current.Path = parts[1]
+		case "fd":
+			fd, err := strconv.Atoi(parts[1])
+			if err != nil || fd < 0 {
+				return errors.New("invalid file descriptor")
+			}
+			current.Fd = fd
+		default:
+			return errors.New("unknown property")
+		}
+	}
+	if current.Path == "" && current.Fd < 0 {
+		return errors.New("api socket has neither path nor fd")
 	}
-
-	current.Path = parts[1]
-
 	return nil
 }
@@ -21,3 +21,53 @@ func Test_CmdSocketParsing_Parse(t *testing.T) {
 	assert.Nil(t, err, "No errors should be raised")
 	assert.Equal(t, cmdSocketParsing.Path, "/tmp/cloud-hypervisor/46c97539-797a-4cf6-b4b6-31f9909d9401.sock")
 }
+
+func Test_CmdLineParsing_ParseArgs(t *testing.T) {
+	var args = []string{
+		"cloud-hypervisor",
+		"-v",
+		"--api-socket=path=/run/ch/vm.sock",
+		"--disk", "path=/var/lib/vm/a.raw", "path=/var/lib/vm/b raw.img",
+		"--serial", "tty",
+		"--seccomp",
+		"--", "extra",
+	}
+	cmdLine, err := ParseCmdLineArgs(args)
+	assert.Nil(t, err, "No errors should be raised")
+	assert.Equal(t, "cloud-hypervisor", cmdLine.Binary)
+	assert.Equal(t, true, cmdLine.Args["-v"])
+	assert.Equal(t, true, cmdLine.Args["--seccomp"])
+	socket, ok := cmdLine.Value("--api-socket")
+	assert.True(t, ok)
+	assert.Equal(t, "path=/run/ch/vm.sock", socket)
+	assert.Equal(t, []string{"path=/var/lib/vm/a.raw", "path=/var/lib/vm/b raw.img"}, cmdLine.Args["--disk"])
+	assert.Equal(t, "tty", cmdLine.Args["--serial"])
+	assert.Equal(t, []string{"extra"}, cmdLine.Positional)
+	_, ok = cmdLine.Value("--seccomp")
+	assert.False(t, ok, "Flags without value have no value")
+}
+
+func Test_CmdLineParsing_ParseFile(t *testing.T) {
+	cmdLine, err := ParseCmdLineFile([]byte("/usr/bin/cloud-hypervisor\000--api-socket\000fd=3\000"))
+	assert.Nil(t, err, "No errors should be raised")
+	assert.Equal(t, "/usr/bin/cloud-hypervisor", cmdLine.Binary)
+	assert.Equal(t, "fd=3", cmdLine.Args["--api-socket"])
+
+	_, err = ParseCmdLineFile([]byte(""))
+	assert.NotNil(t, err, "Kernel threads have an empty command line")
+}
+
+func Test_CmdSocketParsing_ParseFd(t *testing.T) {
+	var cmdSocketParsing *CmdSocketParsing = NewCmdSocketParsing()
+	assert.Nil(t, cmdSocketParsing.Parse("fd=3"))
+	assert.Equal(t, 3, cmdSocketParsing.Fd)
+	assert.Equal(t, "", cmdSocketParsing.Path)
+
+	cmdSocketParsing = NewCmdSocketParsing()
+	assert.Nil(t, cmdSocketParsing.Parse("/tmp/vm.sock"))
+	assert.Equal(t, "/tmp/vm.sock", cmdSocketParsing.Path)
+	assert.Equal(t, -1, cmdSocketParsing.Fd)
+
+	assert.NotNil(t, NewCmdSocketParsing().Parse("fd=abc"))
+	assert.NotNil(t, NewCmdSocketParsing().Parse("mode=0600"))
+}
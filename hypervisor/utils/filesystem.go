@@ -31,6 +31,28 @@ func WriteGobFile[T any](path string, db T) error {
 	return encoder.Encode(db)
 }
 
+// ReplaceGobFile writes db to a temporary file and renames it over path,
+// so a crash leaves either the previous or the new content
+func ReplaceGobFile[T any](path string, db T, perm os.FileMode) error {
+	var tmp string = path + ".tmp"
+	fd, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	err = gob.NewEncoder(fd).Encode(db)
+	if err == nil {
+		err = fd.Sync()
+	}
+	if closeErr := fd.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
 func AppendOrCreateToFile(path string, row []byte) (int, error) {
 	fd, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, os.ModePerm)
 	if err != nil {
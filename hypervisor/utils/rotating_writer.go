@@ -0,0 +1,150 @@
+package utils
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// RotatingWriter appends to a file and renames it to <path>.1 once it reaches maxSize,
+// older files are shifted up to <path>.<maxFiles> and then dropped
+type RotatingWriter struct {
+	path     string
+	maxSize  int64
+	maxFiles int
+	mu       sync.Mutex
+	file     *os.File
+	size     int64
+}
+
+func NewRotatingWriter(path string, maxSize int64, maxFiles int) (*RotatingWriter, error) {
+	err := os.MkdirAll(filepath.Dir(path), os.ModePerm)
+	if err != nil {
+		return nil, err
+	}
+	var rw *RotatingWriter = &RotatingWriter{
+		path:     path,
+		maxSize:  maxSize,
+		maxFiles: maxFiles,
+	}
+	err = rw.open()
+	if err != nil {
+		return nil, err
+	}
+	return rw, nil
+}
+
+func (rw *RotatingWriter) open() error {
+	file, err := os.OpenFile(rw.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	rw.file = file
+	rw.size = info.Size()
+	return nil
+}
+
+func (rw *RotatingWriter) rotate() error {
+	err := rw.file.Close()
+	if err != nil {
+		return err
+	}
+	for i := rw.maxFiles - 1; i > 0; i-- {
+		err = os.Rename(fmt.Sprintf("%s.%d", rw.path, i), fmt.Sprintf("%s.%d", rw.path, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	if rw.maxFiles > 0 {
+		err = os.Rename(rw.path, rw.path+".1")
+	} else {
+		err = os.Remove(rw.path)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return rw.open()
+}
+
+func (rw *RotatingWriter) Write(p []byte) (int, error) {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.file == nil {
+		return 0, os.ErrClosed
+	}
+	if rw.maxSize > 0 && rw.size > 0 && rw.size+int64(len(p)) > rw.maxSize {
+		err := rw.rotate()
+		if err != nil {
+			return 0, err
+		}
+	}
+	n, err := rw.file.Write(p)
+	rw.size += int64(n)
+	return n, err
+}
+
+func (rw *RotatingWriter) Close() error {
+	rw.mu.Lock()
+	defer rw.mu.Unlock()
+	if rw.file == nil {
+		return nil
+	}
+	err := rw.file.Close()
+	rw.file = nil
+	return err
+}
+
+// LineWriter forwards only complete lines, so several writers
+// sharing the same destination do not interleave half lines
+type LineWriter struct {
+	mu      sync.Mutex
+	dst     io.Writer
+	partial []byte
+}
+
+func NewLineWriter(dst io.Writer) *LineWriter {
+	return &LineWriter{
+		dst: dst,
+	}
+}
+
+func (lw *LineWriter) Write(p []byte) (int, error) {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	lw.partial = append(lw.partial, p...)
+	index := bytes.LastIndexByte(lw.partial, '\n')
+	if index < 0 && len(lw.partial) < 64*1024 {
+		return len(p), nil
+	}
+	var end int = index + 1
+	if index < 0 {
+		end = len(lw.partial)
+	}
+	_, err := lw.dst.Write(lw.partial[:end])
+	lw.partial = append(lw.partial[:0], lw.partial[end:]...)
+	if err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Flush writes the trailing partial line, if any
+func (lw *LineWriter) Flush() error {
+	lw.mu.Lock()
+	defer lw.mu.Unlock()
+	if len(lw.partial) == 0 {
+		return nil
+	}
+	lw.partial = append(lw.partial, '\n')
+	_, err := lw.dst.Write(lw.partial)
+	lw.partial = lw.partial[:0]
+	return err
+}
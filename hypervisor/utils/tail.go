@@ -0,0 +1,129 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"time"
+)
+
+const tailChunkSize = 64 * 1024
+
+const followPollInterval = 250 * time.Millisecond
+
+// TailFile returns the last n lines of a file and the offset its content ends at.
+// A negative n returns the whole file
+func TailFile(path string, n int) ([]byte, int64, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return nil, 0, err
+	}
+	var size int64 = info.Size()
+	if n < 0 {
+		content := make([]byte, size)
+		_, err = io.ReadFull(file, content)
+		return content, size, err
+	}
+	var content []byte = make([]byte, 0)
+	var offset int64 = size
+	// One more newline than requested, the first line read can be partial
+	for offset > 0 && bytes.Count(content, []byte("\n")) <= n {
+		var chunkSize int64 = min(tailChunkSize, offset)
+		offset -= chunkSize
+		chunk := make([]byte, chunkSize)
+		_, err = file.ReadAt(chunk, offset)
+		if err != nil && err != io.EOF {
+			return nil, 0, err
+		}
+		content = append(chunk, content...)
+	}
+	var lines [][]byte = bytes.SplitAfter(content, []byte("\n"))
+	if len(lines[len(lines)-1]) == 0 {
+		lines = lines[:len(lines)-1]
+	}
+	if offset > 0 && len(lines) > 0 {
+		lines = lines[1:]
+	}
+	if len(lines) > n {
+		lines = lines[len(lines)-n:]
+	}
+	return bytes.Join(lines, nil), size, nil
+}
+
+// FollowFile copies what is appended to the file after offset until ctx is done.
+// A missing file is waited for. Rotation and truncation are detected and the new file is read from its start
+func FollowFile(ctx context.Context, path string, offset int64, w io.Writer, flush func()) error {
+	ticker := time.NewTicker(followPollInterval)
+	defer ticker.Stop()
+	file, err := os.Open(path)
+	for os.IsNotExist(err) {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		offset = 0
+		file, err = os.Open(path)
+	}
+	if err != nil {
+		return err
+	}
+	defer func() {
+		file.Close()
+	}()
+	_, err = file.Seek(offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	for {
+		written, err := io.Copy(w, file)
+		if err != nil {
+			return err
+		}
+		offset += written
+		if written > 0 && flush != nil {
+			flush()
+		}
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+		current, err := file.Stat()
+		if err != nil {
+			return err
+		}
+		latest, err := os.Stat(path)
+		if err != nil {
+			// The file is being rotated, try again on the next tick
+			continue
+		}
+		if !os.SameFile(current, latest) {
+			// Drain what was written before the rotation
+			_, err = io.Copy(w, file)
+			if err != nil {
+				return err
+			}
+			file.Close()
+			file, err = os.Open(path)
+			if err != nil {
+				return err
+			}
+			offset = 0
+			continue
+		}
+		if latest.Size() < offset {
+			_, err = file.Seek(0, io.SeekStart)
+			if err != nil {
+				return err
+			}
+			offset = 0
+		}
+	}
+}
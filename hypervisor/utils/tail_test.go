@@ -0,0 +1,109 @@
+package utils
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (sb *syncBuffer) Write(p []byte) (int, error) {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.buf.Write(p)
+}
+
+func (sb *syncBuffer) String() string {
+	sb.mu.Lock()
+	defer sb.mu.Unlock()
+	return sb.buf.String()
+}
+
+func Test_TailFile(t *testing.T) {
+	var path string = filepath.Join(t.TempDir(), "log")
+	assert.Nil(t, os.WriteFile(path, []byte("a\nb\nc\nd\n"), 0644))
+
+	content, offset, err := TailFile(path, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, "c\nd\n", string(content))
+	assert.Equal(t, int64(8), offset)
+
+	content, _, _ = TailFile(path, 10)
+	assert.Equal(t, "a\nb\nc\nd\n", string(content))
+	content, _, _ = TailFile(path, 0)
+	assert.Equal(t, "", string(content))
+	content, _, _ = TailFile(path, -1)
+	assert.Equal(t, "a\nb\nc\nd\n", string(content))
+
+	var long string = strings.Repeat(strings.Repeat("x", 1000)+"\n", 200)
+	assert.Nil(t, os.WriteFile(path, []byte(long+"last"), 0644))
+	content, _, _ = TailFile(path, 2)
+	assert.Equal(t, strings.Repeat("x", 1000)+"\nlast", string(content), "Lines must be found across chunks")
+}
+
+func Test_FollowFile(t *testing.T) {
+	var path string = filepath.Join(t.TempDir(), "log")
+	rw, err := NewRotatingWriter(path, 16, 2)
+	assert.Nil(t, err)
+	rw.Write([]byte("old\n"))
+	_, offset, err := TailFile(path, 0)
+	assert.Nil(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var out *syncBuffer = &syncBuffer{}
+	done := make(chan error)
+	go func() {
+		done <- FollowFile(ctx, path, offset, out, nil)
+	}()
+	rw.Write([]byte("first line\n"))
+	time.Sleep(2 * followPollInterval)
+	// Rotates, the follower must move to the new file
+	rw.Write([]byte("second line\n"))
+	assert.Eventually(t, func() bool {
+		return out.String() == "first line\nsecond line\n"
+	}, 3*time.Second, 50*time.Millisecond)
+	cancel()
+	assert.Nil(t, <-done)
+	rw.Close()
+}
+
+func Test_RotatingWriter_Write(t *testing.T) {
+	var path string = filepath.Join(t.TempDir(), "log")
+	rw, err := NewRotatingWriter(path, 10, 2)
+	assert.Nil(t, err)
+	for _, line := range []string{"aaaaaaaa\n", "bbbbbbbb\n", "cccccccc\n", "dddddddd\n"} {
+		_, err = rw.Write([]byte(line))
+		assert.Nil(t, err)
+	}
+	assert.Nil(t, rw.Close())
+	content, _ := os.ReadFile(path)
+	assert.Equal(t, "dddddddd\n", string(content))
+	content, _ = os.ReadFile(path + ".1")
+	assert.Equal(t, "cccccccc\n", string(content))
+	content, _ = os.ReadFile(path + ".2")
+	assert.Equal(t, "bbbbbbbb\n", string(content))
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err), "Files above maxFiles must be dropped")
+}
+
+func Test_LineWriter_Write(t *testing.T) {
+	var out bytes.Buffer
+	var lw *LineWriter = NewLineWriter(&out)
+	lw.Write([]byte("par"))
+	assert.Equal(t, "", out.String())
+	lw.Write([]byte("tial\nnext"))
+	assert.Equal(t, "partial\n", out.String())
+	assert.Nil(t, lw.Flush())
+	assert.Equal(t, "partial\nnext\n", out.String())
+}
@@ -1,6 +1,8 @@
 package virtualmachine
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -13,6 +15,9 @@ import (
 	"go.uber.org/zap"
 )
 
+// The state of a disk upload is stored next to its temporary disk, so the upload can resume after a restart
+const uploadSessionSuffix = ".session"
+
 type FileSystemWrapper struct {
 	basePath string
 	logger   *zap.Logger
@@ -22,6 +27,10 @@ func (fs *FileSystemWrapper) GetManifestPath() string {
 	return filepath.Join(fs.basePath, "manifest.json")
 }
 
+func (fs *FileSystemWrapper) GetStatusPath() string {
+	return filepath.Join(fs.basePath, "status.json")
+}
+
 func (fs *FileSystemWrapper) GetKernelPath(kernelName string) string {
 	return filepath.Join(fs.basePath, "kernel", kernelName)
 }
@@ -38,6 +47,20 @@ func (fs *FileSystemWrapper) GetDiskStoragePath() string {
 	return filepath.Join(fs.basePath, "disks")
 }
 
+// isUploadFile tells if a file of the disks folder belongs to an upload in progress
+func isUploadFile(name string) bool {
+	return strings.HasSuffix(name, ".tmp") || strings.HasSuffix(name, uploadSessionSuffix)
+}
+
+func (fs *FileSystemWrapper) GetLogPath(source string) string {
+	return filepath.Join(fs.basePath, "logs", source+".log")
+}
+
+// GetMetricsPath is the folder of the resource usage history
+func (fs *FileSystemWrapper) GetMetricsPath() string {
+	return filepath.Join(fs.basePath, "metrics")
+}
+
 func (fs *FileSystemWrapper) ReadManifest() (*Manifest, error) {
 	fileBytes, err := os.ReadFile(fs.GetManifestPath())
 	if err != nil {
@@ -67,8 +90,123 @@ func (fs *FileSystemWrapper) StoreManifest(manifest *Manifest) error {
 	return os.WriteFile(fs.GetManifestPath(), content, os.ModePerm)
 }
 
+func (fs *FileSystemWrapper) ReadStatus() (*Status, error) {
+	fileBytes, err := os.ReadFile(fs.GetStatusPath())
+	if err != nil {
+		return nil, err
+	}
+	var status *Status
+	err = json.Unmarshal(fileBytes, &status)
+	if err != nil {
+		return nil, err
+	}
+	return status, nil
+}
+
+func (fs *FileSystemWrapper) StoreStatus(status Status) error {
+	var err error = fs.createFolderRecursively(fs.basePath)
+	if err != nil {
+		return err
+	}
+	content, err := json.Marshal(status)
+	if err != nil {
+		return err
+	}
+	// Write to a temporary file first so a crash never leaves a torn status file
+	var tmpPath string = fs.GetStatusPath() + ".tmp"
+	err = os.WriteFile(tmpPath, content, os.ModePerm)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, fs.GetStatusPath())
+}
+
+// DiskUsage sums the size of committed disks, uploads in progress are not counted
+func (fs *FileSystemWrapper) DiskUsage() (int64, error) {
+	entries, err := os.ReadDir(fs.GetDiskStoragePath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	var total int64 = 0
+	for _, entry := range entries {
+		if entry.IsDir() || isUploadFile(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return 0, err
+		}
+		total += info.Size()
+	}
+	return total, nil
+}
+
+type ErrDiskNotFound struct {
+	Name string
+}
+
+func (err *ErrDiskNotFound) Error() string {
+	return fmt.Sprintf("disk %s is not found", err.Name)
+}
+
+// DiskFile is a committed disk of the virtual machine
+type DiskFile struct {
+	Name string `json:"name" yaml:"name"`
+	Size int64  `json:"size" yaml:"size"`
+	// Attached disks are listed in the config of the virtual machine
+	Attached bool `json:"attached" yaml:"attached"`
+}
+
+// ListDisks returns the committed disks sorted by name, uploads in progress are not listed
+func (fs *FileSystemWrapper) ListDisks() ([]DiskFile, error) {
+	var disks []DiskFile = make([]DiskFile, 0)
+	entries, err := os.ReadDir(fs.GetDiskStoragePath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return disks, nil
+		}
+		return nil, err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || isUploadFile(entry.Name()) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		disks = append(disks, DiskFile{Name: entry.Name(), Size: info.Size()})
+	}
+	return disks, nil
+}
+
+// ResizeDisk grows a raw disk to size bytes and returns its previous size
+func (fs *FileSystemWrapper) ResizeDisk(diskName string, size int64) (int64, error) {
+	if diskName == "" || filepath.Base(diskName) != diskName || isUploadFile(diskName) {
+		return 0, fmt.Errorf("invalid disk name %q", diskName)
+	}
+	info, err := os.Stat(fs.GetDiskPath(diskName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, &ErrDiskNotFound{Name: diskName}
+		}
+		return 0, err
+	}
+	if size < info.Size() {
+		return 0, fmt.Errorf("disk %s cannot shrink from %d to %d bytes", diskName, info.Size(), size)
+	}
+	return info.Size(), os.Truncate(fs.GetDiskPath(diskName), size)
+}
+
+func (fs *FileSystemWrapper) RemoveAll() error {
+	return os.RemoveAll(fs.basePath)
+}
+
 func (fs *FileSystemWrapper) createFile(path string) error {
-	fd, err := os.Open(path)
+	fd, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY, os.ModePerm)
 	if err != nil {
 		return err
 	}
@@ -144,3 +282,101 @@ func (fs *FileSystemWrapper) CommitDisk(tmpDiskName string, diskName string) err
 func (fs *FileSystemWrapper) CommitKernel(tmpKernelName string, kernelName string) error {
 	return fs.commitOperation(fs.GetKernelStoragePath(), tmpKernelName, kernelName)
 }
+
+// checksum is the hex sha256 of a temporary file
+func (fs *FileSystemWrapper) checksum(storagePath string, tmpFileName string) (string, error) {
+	err := validTempFileName(tmpFileName)
+	if err != nil {
+		return "", err
+	}
+	fd, err := os.Open(filepath.Join(storagePath, tmpFileName))
+	if err != nil {
+		return "", err
+	}
+	defer fd.Close()
+	hash := sha256.New()
+	_, err = io.Copy(hash, fd)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func (fs *FileSystemWrapper) DiskChecksum(tmpDiskName string) (string, error) {
+	return fs.checksum(fs.GetDiskStoragePath(), tmpDiskName)
+}
+
+func validTempFileName(tmpFileName string) error {
+	if filepath.Base(tmpFileName) != tmpFileName || !strings.HasSuffix(tmpFileName, ".tmp") {
+		return fmt.Errorf("invalid temporary file name %q", tmpFileName)
+	}
+	return nil
+}
+
+// StoreUploadSession saves the state of the upload of a temporary disk
+func (fs *FileSystemWrapper) StoreUploadSession(tmpDiskName string, content []byte) error {
+	err := validTempFileName(tmpDiskName)
+	if err != nil {
+		return err
+	}
+	var sessionPath string = fs.GetDiskPath(tmpDiskName + uploadSessionSuffix)
+	// Write to a temporary file first so a crash never leaves a torn session file
+	var tmpPath string = sessionPath + ".tmp"
+	err = os.WriteFile(tmpPath, content, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, sessionPath)
+}
+
+// ReadUploadSessions returns the stored upload sessions by temporary disk name.
+// Sessions whose temporary disk is gone are removed
+func (fs *FileSystemWrapper) ReadUploadSessions() (map[string][]byte, error) {
+	var sessions map[string][]byte = make(map[string][]byte)
+	entries, err := os.ReadDir(fs.GetDiskStoragePath())
+	if err != nil {
+		if os.IsNotExist(err) {
+			return sessions, nil
+		}
+		return nil, err
+	}
+	for _, entry := range entries {
+		tmpDiskName, ok := strings.CutSuffix(entry.Name(), uploadSessionSuffix)
+		if entry.IsDir() || !ok || validTempFileName(tmpDiskName) != nil {
+			continue
+		}
+		_, err := os.Stat(fs.GetDiskPath(tmpDiskName))
+		if os.IsNotExist(err) {
+			err = os.Remove(fs.GetDiskPath(entry.Name()))
+			if err != nil && !os.IsNotExist(err) {
+				return nil, err
+			}
+			continue
+		}
+		content, err := os.ReadFile(fs.GetDiskPath(entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+		sessions[tmpDiskName] = content
+	}
+	return sessions, nil
+}
+
+// RemoveDiskUpload removes a temporary disk and its upload session, missing files are ignored
+func (fs *FileSystemWrapper) RemoveDiskUpload(tmpDiskName string) error {
+	err := validTempFileName(tmpDiskName)
+	if err != nil {
+		return err
+	}
+	for _, path := range []string{fs.GetDiskPath(tmpDiskName), fs.GetDiskPath(tmpDiskName + uploadSessionSuffix)} {
+		err = os.Remove(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (fs *FileSystemWrapper) KernelChecksum(tmpKernelName string) (string, error) {
+	return fs.checksum(fs.GetKernelStoragePath(), tmpKernelName)
+}
@@ -0,0 +1,66 @@
+package virtualmachine
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_FileSystemWrapper_ResizeDisk(t *testing.T) {
+	fs := &FileSystemWrapper{basePath: t.TempDir()}
+	disks, err := fs.ListDisks()
+	assert.Nil(t, err)
+	assert.Empty(t, disks, "A virtual machine without disks folder has no disk")
+
+	assert.Nil(t, os.MkdirAll(fs.GetDiskStoragePath(), 0700))
+	assert.Nil(t, os.WriteFile(fs.GetDiskPath("root.raw"), make([]byte, 512), 0600))
+	_, err = fs.CreateDisk("data.raw")
+	assert.Nil(t, err)
+
+	previous, err := fs.ResizeDisk("root.raw", 4096)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(512), previous)
+	disks, err = fs.ListDisks()
+	assert.Nil(t, err)
+	assert.Equal(t, []DiskFile{{Name: "root.raw", Size: 4096}}, disks, "Uploads in progress are not listed")
+
+	_, err = fs.ResizeDisk("root.raw", 1024)
+	assert.NotNil(t, err, "Disks never shrink")
+	_, err = fs.ResizeDisk("missing.raw", 1024)
+	var errNotFound *ErrDiskNotFound
+	assert.True(t, errors.As(err, &errNotFound))
+	_, err = fs.ResizeDisk(filepath.Join("..", "manifest.json"), 1024)
+	assert.NotNil(t, err, "Disk names cannot leave the disks folder")
+}
+
+func Test_FileSystemWrapper_UploadSessions(t *testing.T) {
+	fs := &FileSystemWrapper{basePath: t.TempDir()}
+	sessions, err := fs.ReadUploadSessions()
+	assert.Nil(t, err)
+	assert.Empty(t, sessions, "A virtual machine without disks folder has no upload")
+
+	tmpDiskName, err := fs.CreateDisk("data.raw")
+	assert.Nil(t, err)
+	assert.Nil(t, fs.StoreUploadSession(tmpDiskName, []byte(`{"size":1024}`)))
+	assert.Nil(t, fs.StoreUploadSession(tmpDiskName, []byte(`{"size":2048}`)), "A session is overwritten")
+	assert.NotNil(t, fs.StoreUploadSession("data.raw", []byte(`{}`)), "Only temporary disks have a session")
+	assert.Nil(t, os.WriteFile(fs.GetDiskPath("gone_data.raw.tmp"+uploadSessionSuffix), []byte(`{}`), 0600))
+
+	sessions, err = fs.ReadUploadSessions()
+	assert.Nil(t, err)
+	assert.Equal(t, map[string][]byte{tmpDiskName: []byte(`{"size":2048}`)}, sessions)
+	_, err = os.Stat(fs.GetDiskPath("gone_data.raw.tmp" + uploadSessionSuffix))
+	assert.True(t, os.IsNotExist(err), "A session without temporary disk is removed")
+	disks, err := fs.ListDisks()
+	assert.Nil(t, err)
+	assert.Empty(t, disks, "Upload sessions are not listed as disks")
+
+	assert.Nil(t, fs.RemoveDiskUpload(tmpDiskName))
+	assert.Nil(t, fs.RemoveDiskUpload(tmpDiskName), "Removing twice is a no-op")
+	entries, err := os.ReadDir(fs.GetDiskStoragePath())
+	assert.Nil(t, err)
+	assert.Empty(t, entries, "The temporary disk and its session are removed")
+}
@@ -0,0 +1,203 @@
+package virtualmachine
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+const (
+	maxLabelNameLength       = 63
+	maxLabelPrefixLength     = 253
+	maxLabelValueLength      = 63
+	maxAnnotationsTotalBytes = 256 * 1024
+)
+
+var labelNameRegex = regexp.MustCompile(`^[A-Za-z0-9]([-A-Za-z0-9_.]*[A-Za-z0-9])?$`)
+var labelPrefixRegex = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?(\.[a-z0-9]([-a-z0-9]*[a-z0-9])?)*$`)
+
+// Keys are made of an optional dns prefix and a name, e.g. "team.example.com/owner"
+func ValidateMetadataKey(key string) error {
+	var name string = key
+	if index := strings.LastIndex(key, "/"); index >= 0 {
+		prefix := key[:index]
+		name = key[index+1:]
+		if len(prefix) == 0 || len(prefix) > maxLabelPrefixLength || !labelPrefixRegex.MatchString(prefix) {
+			return fmt.Errorf("invalid prefix in key %q: expected a lowercase dns subdomain", key)
+		}
+	}
+	if len(name) == 0 || len(name) > maxLabelNameLength {
+		return fmt.Errorf("invalid key %q: name must be 1-%d characters", key, maxLabelNameLength)
+	}
+	if !labelNameRegex.MatchString(name) {
+		return fmt.Errorf("invalid key %q: name must be alphanumeric with '-', '_' or '.' inside", key)
+	}
+	return nil
+}
+
+func ValidateLabelValue(value string) error {
+	if len(value) > maxLabelValueLength {
+		return fmt.Errorf("invalid label value %q: at most %d characters", value, maxLabelValueLength)
+	}
+	if value != "" && !labelNameRegex.MatchString(value) {
+		return fmt.Errorf("invalid label value %q: must be alphanumeric with '-', '_' or '.' inside", value)
+	}
+	return nil
+}
+
+func ValidateLabels(labels map[string]string) error {
+	for key, value := range labels {
+		if err := ValidateMetadataKey(key); err != nil {
+			return err
+		}
+		if err := ValidateLabelValue(value); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Annotation values are free text, only their total size is bounded
+func ValidateAnnotations(annotations map[string]string) error {
+	var total int = 0
+	for key, value := range annotations {
+		if err := ValidateMetadataKey(key); err != nil {
+			return err
+		}
+		total += len(key) + len(value)
+	}
+	if total > maxAnnotationsTotalBytes {
+		return fmt.Errorf("annotations exceed %d bytes", maxAnnotationsTotalBytes)
+	}
+	return nil
+}
+
+// MergeMetadata applies a patch on a copy of current. A nil value removes the key
+func MergeMetadata(current map[string]string, patch map[string]*string) map[string]string {
+	res := make(map[string]string, len(current)+len(patch))
+	for key, value := range current {
+		res[key] = value
+	}
+	for key, value := range patch {
+		if value == nil {
+			delete(res, key)
+			continue
+		}
+		res[key] = *value
+	}
+	return res
+}
+
+const (
+	SELECTOR_EQUALS = iota
+	SELECTOR_NOT_EQUALS
+	SELECTOR_EXISTS
+	SELECTOR_NOT_EXISTS
+)
+
+type Requirement struct {
+	Key      string
+	Operator int
+	Value    string
+}
+
+func (r *Requirement) Matches(labels map[string]string) bool {
+	value, ok := labels[r.Key]
+	switch r.Operator {
+	case SELECTOR_EQUALS:
+		return ok && value == r.Value
+	case SELECTOR_NOT_EQUALS:
+		return !ok || value != r.Value
+	case SELECTOR_EXISTS:
+		return ok
+	case SELECTOR_NOT_EXISTS:
+		return !ok
+	default:
+		return false
+	}
+}
+
+func (r *Requirement) String() string {
+	switch r.Operator {
+	case SELECTOR_EQUALS:
+		return r.Key + "=" + r.Value
+	case SELECTOR_NOT_EQUALS:
+		return r.Key + "!=" + r.Value
+	case SELECTOR_NOT_EXISTS:
+		return "!" + r.Key
+	default:
+		return r.Key
+	}
+}
+
+// Selector is a conjunction of requirements, e.g. "env=prod,owner!=bob,service,!legacy"
+type Selector struct {
+	Requirements []Requirement
+}
+
+func ParseSelector(selector string) (*Selector, error) {
+	res := &Selector{Requirements: []Requirement{}}
+	selector = strings.TrimSpace(selector)
+	if selector == "" {
+		return res, nil
+	}
+	for _, part := range strings.Split(selector, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			return nil, errors.New("empty requirement in selector")
+		}
+		var req Requirement
+		if index := strings.Index(part, "!="); index >= 0 {
+			req = Requirement{Key: part[:index], Operator: SELECTOR_NOT_EQUALS, Value: part[index+2:]}
+		} else if index := strings.Index(part, "="); index >= 0 {
+			value := strings.TrimPrefix(part[index+1:], "=")
+			req = Requirement{Key: part[:index], Operator: SELECTOR_EQUALS, Value: value}
+		} else if strings.HasPrefix(part, "!") {
+			req = Requirement{Key: part[1:], Operator: SELECTOR_NOT_EXISTS}
+		} else {
+			req = Requirement{Key: part, Operator: SELECTOR_EXISTS}
+		}
+		req.Key = strings.TrimSpace(req.Key)
+		req.Value = strings.TrimSpace(req.Value)
+		if err := ValidateMetadataKey(req.Key); err != nil {
+			return nil, err
+		}
+		if err := ValidateLabelValue(req.Value); err != nil {
+			return nil, err
+		}
+		res.Requirements = append(res.Requirements, req)
+	}
+	sort.SliceStable(res.Requirements, func(i, j int) bool {
+		return res.Requirements[i].Operator < res.Requirements[j].Operator
+	})
+	return res, nil
+}
+
+func (s *Selector) Empty() bool {
+	return s == nil || len(s.Requirements) == 0
+}
+
+func (s *Selector) Matches(labels map[string]string) bool {
+	if s == nil {
+		return true
+	}
+	for i := range s.Requirements {
+		if !s.Requirements[i].Matches(labels) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Selector) String() string {
+	if s == nil {
+		return ""
+	}
+	parts := make([]string, 0, len(s.Requirements))
+	for i := range s.Requirements {
+		parts = append(parts, s.Requirements[i].String())
+	}
+	return strings.Join(parts, ",")
+}
@@ -0,0 +1,44 @@
+package virtualmachine
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_ValidateLabels(t *testing.T) {
+	assert.Nil(t, ValidateLabels(map[string]string{"env": "prod", "team.example.com/owner": "alice", "service": ""}), "Expect valid labels")
+	assert.NotNil(t, ValidateLabels(map[string]string{"-env": "prod"}), "Expect key starting with dash to be rejected")
+	assert.NotNil(t, ValidateLabels(map[string]string{"Team.Example/owner": "alice"}), "Expect uppercase prefix to be rejected")
+	assert.NotNil(t, ValidateLabels(map[string]string{"env": "prod east"}), "Expect value with spaces to be rejected")
+	assert.NotNil(t, ValidateLabels(map[string]string{"env": strings.Repeat("a", 64)}), "Expect too long value to be rejected")
+}
+
+func Test_ValidateAnnotations(t *testing.T) {
+	assert.Nil(t, ValidateAnnotations(map[string]string{"description": "free text, with spaces"}), "Expect free text values")
+	assert.NotNil(t, ValidateAnnotations(map[string]string{"description": strings.Repeat("a", maxAnnotationsTotalBytes)}), "Expect oversized annotations to be rejected")
+}
+
+func Test_MergeMetadata(t *testing.T) {
+	value := "staging"
+	current := map[string]string{"env": "prod", "owner": "alice"}
+	res := MergeMetadata(current, map[string]*string{"env": &value, "owner": nil})
+	assert.Equal(t, map[string]string{"env": "staging"}, res, "Expect the patch to be applied")
+	assert.Equal(t, "prod", current["env"], "Expect the original map to be untouched")
+}
+
+func Test_ParseSelector(t *testing.T) {
+	selector, err := ParseSelector("env=prod, owner!=bob,service,!legacy")
+	assert.Nil(t, err, "No errors expected in ParseSelector")
+	assert.Equal(t, 4, len(selector.Requirements), "Expect four requirements")
+	assert.True(t, selector.Matches(map[string]string{"env": "prod", "owner": "alice", "service": "api"}), "Expect labels to match")
+	assert.False(t, selector.Matches(map[string]string{"env": "prod", "owner": "bob", "service": "api"}), "Expect not equal to exclude")
+	assert.False(t, selector.Matches(map[string]string{"env": "prod", "service": "api", "legacy": "true"}), "Expect not exists to exclude")
+	assert.False(t, selector.Matches(map[string]string{"env": "prod"}), "Expect exists to require the key")
+
+	_, err = ParseSelector("env=prod,,owner")
+	assert.NotNil(t, err, "Expect empty requirement to be rejected")
+	_, err = ParseSelector("env=prod east")
+	assert.NotNil(t, err, "Expect invalid value to be rejected")
+}
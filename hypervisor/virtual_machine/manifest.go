@@ -1,13 +1,40 @@
 package virtualmachine
 
 import (
+	"fmt"
+	"regexp"
+	"time"
+	cloudhypervisor "vmm/cloud_hypervisor"
+
 	"github.com/google/uuid"
 )
 
 type Manifest struct {
-	GuestIdentifier uuid.UUID `json:"guest_identifier" xml:"guest_identifier"`
-	Tenant          uuid.UUID `json:"tenant" xml:"tenant"`
-	Config          Config    `json:"hypervisor_config" yaml:"hypervisor_config"`
+	GuestIdentifier uuid.UUID         `json:"guest_identifier" xml:"guest_identifier"`
+	Tenant          uuid.UUID         `json:"tenant" xml:"tenant"`
+	Name            string            `json:"name,omitempty" yaml:"name,omitempty"`
+	CreatedAt       time.Time         `json:"created_at" yaml:"created_at"`
+	Labels          map[string]string `json:"labels,omitempty" yaml:"labels,omitempty"`
+	Annotations     map[string]string `json:"annotations,omitempty" yaml:"annotations,omitempty"`
+	Config          Config            `json:"hypervisor_config" yaml:"hypervisor_config"`
+}
+
+var nameRegex = regexp.MustCompile(`^[a-z0-9]([-a-z0-9]*[a-z0-9])?$`)
+
+// Names are dns labels so they can be used in urls and hostnames
+func ValidateName(name string) error {
+	if len(name) > 63 || !nameRegex.MatchString(name) {
+		return fmt.Errorf("invalid name %q: expected 1-63 lowercase alphanumeric characters or '-'", name)
+	}
+	return nil
+}
+
+func (manifest *Manifest) ValidateMetadata() error {
+	err := ValidateLabels(manifest.Labels)
+	if err != nil {
+		return err
+	}
+	return ValidateAnnotations(manifest.Annotations)
 }
 
 type Config struct {
@@ -19,6 +46,25 @@ type Config struct {
 	Vpc       []VpcNet `json:"vpc" yaml:"vpc"`
 	Rng       Rng      `json:"rng" yaml:"rng"`
 	Cpus      int      `json:"cpus" yaml:"cpus"`
+	// Guest memory in bytes
+	Memory int64 `json:"memory" yaml:"memory"`
+	// Number of -v given to cloud-hypervisor, from 0 to 3
+	Verbosity int `json:"verbosity,omitempty" yaml:"verbosity,omitempty"`
+	// One of no, on-failure, always. Empty means no
+	RestartPolicy string `json:"restart_policy,omitempty" yaml:"restart_policy,omitempty"`
+}
+
+// Validate checks the fields cloud-hypervisor does not check by itself
+func (config *Config) Validate() error {
+	switch config.RestartPolicy {
+	case "", RESTART_NO, RESTART_ON_FAILURE, RESTART_ALWAYS:
+	default:
+		return fmt.Errorf("unknown restart policy %q", config.RestartPolicy)
+	}
+	if config.Verbosity < 0 || config.Verbosity > cloudhypervisor.MaxVerbosity {
+		return fmt.Errorf("verbosity must be between 0 and %d", cloudhypervisor.MaxVerbosity)
+	}
+	return nil
 }
 
 type Rng struct {
@@ -0,0 +1,131 @@
+package virtualmachine
+
+import (
+	"time"
+	"vmm/events"
+
+	"go.uber.org/zap"
+)
+
+const (
+	RESTART_NO         = "no"
+	RESTART_ON_FAILURE = "on-failure"
+	RESTART_ALWAYS     = "always"
+)
+
+// Why the guest stopped running without being asked to
+const (
+	RESTART_REASON_SHUTDOWN = "shutdown"
+	RESTART_REASON_FAILURE  = "failure"
+	RESTART_REASON_RESET    = "reset"
+)
+
+// A guest restarting or resetting more than maxRestarts times within restartWindow is left stopped
+const (
+	maxRestarts       = 5
+	restartWindow     = 10 * time.Minute
+	maxRestartBackoff = time.Minute
+)
+
+// Observer is told what happens to a virtual machine, the monitor implements it
+type Observer interface {
+	events.Publisher
+	// Restart boots the virtual machine again after delay, unless its status changed from the given one
+	Restart(vm *VirtualMachine, reason string, delay time.Duration, from Status)
+}
+
+type noopObserver struct{}
+
+func (noopObserver) Publish(event events.Event) events.Event {
+	return event
+}
+
+func (noopObserver) Restart(vm *VirtualMachine, reason string, delay time.Duration, from Status) {}
+
+// observerOrNoop replaces a missing observer, events and restarts are then dropped
+func observerOrNoop(observer Observer) Observer {
+	if observer == nil {
+		return noopObserver{}
+	}
+	return observer
+}
+
+// shouldRestart tells if a fresh process must be started. Resets are handled
+// by cloud-hypervisor in place and only count against the restart limit
+func shouldRestart(policy string, reason string) bool {
+	switch reason {
+	case RESTART_REASON_FAILURE:
+		return policy == RESTART_ON_FAILURE || policy == RESTART_ALWAYS
+	case RESTART_REASON_SHUTDOWN:
+		return policy == RESTART_ALWAYS
+	default:
+		return false
+	}
+}
+
+// restartBackoff doubles from one second for every restart in the window
+func restartBackoff(attempt int) time.Duration {
+	var delay time.Duration = time.Second
+	for i := 1; i < attempt && delay < maxRestartBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, maxRestartBackoff)
+}
+
+type restartTracker struct {
+	restarts []time.Time
+}
+
+// record returns the number of restarts in the window including this one,
+// and false without recording when the limit is reached
+func (rt *restartTracker) record(now time.Time) (int, bool) {
+	var kept []time.Time = rt.restarts[:0]
+	for _, at := range rt.restarts {
+		if now.Sub(at) < restartWindow {
+			kept = append(kept, at)
+		}
+	}
+	rt.restarts = kept
+	if len(rt.restarts) >= maxRestarts {
+		return len(rt.restarts), false
+	}
+	rt.restarts = append(rt.restarts, now)
+	return len(rt.restarts), true
+}
+
+// Caller must hold vm.mu
+func (vm *VirtualMachine) applyRestartPolicy(reason string) {
+	if !shouldRestart(vm.GetManifest().Config.RestartPolicy, reason) {
+		return
+	}
+	attempt, ok := vm.restarts.record(time.Now())
+	if !ok {
+		vm.logger.Warn("restart limit reached", zap.String("vm_id", vm.GetManifest().GuestIdentifier.String()), zap.String("reason", reason))
+		vm.publish(events.VM_RESTART_LIMIT, map[string]any{"reason": reason, "restarts": attempt})
+		return
+	}
+	var delay time.Duration = restartBackoff(attempt)
+	vm.publish(events.VM_RESTART, map[string]any{"reason": reason, "attempt": attempt, "delay_ms": delay.Milliseconds()})
+	vm.observer.Restart(vm, reason, delay, vm.state.GetStatus())
+}
+
+// Caller must hold vm.mu. A guest resetting in a loop is stopped
+func (vm *VirtualMachine) recordReset() bool {
+	attempt, ok := vm.restarts.record(time.Now())
+	if ok {
+		return true
+	}
+	vm.logger.Warn("reset limit reached, stopping guest", zap.String("vm_id", vm.GetManifest().GuestIdentifier.String()))
+	vm.publish(events.VM_RESTART_LIMIT, map[string]any{"reason": RESTART_REASON_RESET, "restarts": attempt})
+	return false
+}
+
+func (vm *VirtualMachine) publish(eventType string, data map[string]any) {
+	manifest := vm.GetManifest()
+	vm.observer.Publish(events.Event{
+		Type:           eventType,
+		VirtualMachine: manifest.GuestIdentifier.String(),
+		Tenant:         manifest.Tenant.String(),
+		Data:           data,
+	})
+}
@@ -0,0 +1,70 @@
+package virtualmachine
+
+import (
+	"testing"
+	"time"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func Test_ShouldRestart(t *testing.T) {
+	assert.False(t, shouldRestart("", RESTART_REASON_FAILURE), "Guests are not restarted by default")
+	assert.False(t, shouldRestart(RESTART_NO, RESTART_REASON_FAILURE))
+	assert.True(t, shouldRestart(RESTART_ON_FAILURE, RESTART_REASON_FAILURE))
+	assert.False(t, shouldRestart(RESTART_ON_FAILURE, RESTART_REASON_SHUTDOWN))
+	assert.True(t, shouldRestart(RESTART_ALWAYS, RESTART_REASON_SHUTDOWN))
+	assert.False(t, shouldRestart(RESTART_ALWAYS, RESTART_REASON_RESET), "Resets are handled in place by cloud-hypervisor")
+}
+
+func Test_RestartBackoff(t *testing.T) {
+	assert.Equal(t, time.Second, restartBackoff(1))
+	assert.Equal(t, 4*time.Second, restartBackoff(3))
+	assert.Equal(t, maxRestartBackoff, restartBackoff(20))
+}
+
+func Test_RestartTracker_Record(t *testing.T) {
+	var tracker restartTracker
+	var now time.Time = time.Now()
+	for i := 1; i <= maxRestarts; i++ {
+		attempt, ok := tracker.record(now)
+		assert.True(t, ok)
+		assert.Equal(t, i, attempt)
+	}
+	_, ok := tracker.record(now)
+	assert.False(t, ok, "Restarts above the limit must be refused")
+	attempt, ok := tracker.record(now.Add(restartWindow))
+	assert.True(t, ok, "Restarts out of the window must be forgotten")
+	assert.Equal(t, 1, attempt)
+}
+
+func Test_Config_Validate(t *testing.T) {
+	assert.Nil(t, (&Config{}).Validate())
+	assert.Nil(t, (&Config{RestartPolicy: RESTART_ON_FAILURE, Verbosity: 3}).Validate())
+	assert.NotNil(t, (&Config{RestartPolicy: "sometimes"}).Validate())
+	assert.NotNil(t, (&Config{Verbosity: 4}).Validate())
+}
+
+func Test_VirtualMachine_ConcurrentManifestUpdate(t *testing.T) {
+	manifest := &Manifest{GuestIdentifier: uuid.New(), Tenant: uuid.New(), Config: Config{RestartPolicy: RESTART_ALWAYS}}
+	vm, err := NewVirtualMachine(manifest, zap.NewNop(), t.TempDir(), "lo", nil, nil)
+	assert.Nil(t, err)
+	var value string = "front"
+	var done chan struct{} = make(chan struct{})
+	go func() {
+		defer close(done)
+		for range 50 {
+			vm.UpdateMetadata(map[string]*string{"tier": &value}, nil)
+			vm.Rename("web")
+		}
+	}()
+	// Crash handling runs under vm.mu only, the race detector reports unguarded reads of the manifest
+	for range 50 {
+		vm.mu.Lock()
+		vm.applyRestartPolicy(RESTART_REASON_FAILURE)
+		vm.parseManifestToCloudHypervisor()
+		vm.mu.Unlock()
+	}
+	<-done
+}
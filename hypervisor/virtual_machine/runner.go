@@ -8,25 +8,43 @@ import (
 	"io"
 	"net/http"
 	"path/filepath"
+	"slices"
 	"sync"
+	"sync/atomic"
+	"time"
 	cloudhypervisor "vmm/cloud_hypervisor"
+	"vmm/events"
 	vmnetworking_enumerator "vmm/vm_networking/interface_enumerator"
 
 	"github.com/vishvananda/netlink"
 	"go.uber.org/zap"
 )
 
+// Used when the instance is dropped without a shutdown request, e.g. after a failed boot or on delete
+var releaseTimeouts = cloudhypervisor.StopTimeouts{
+	Shutdown:  5 * time.Second,
+	Terminate: 5 * time.Second,
+	Kill:      5 * time.Second,
+}
+
 type VirtualMachine struct {
-	manifest          *Manifest
-	hypervisor        *cloudhypervisor.CloudHypervisor
+	manifest   *Manifest
+	manifestMu sync.RWMutex
+	hypervisor *cloudhypervisor.CloudHypervisor
+	// Mirrors hypervisor for readers that must not wait for an operation holding mu
+	instance          atomic.Pointer[cloudhypervisor.CloudHypervisor]
 	storage           *FileSystemWrapper
 	logger            *zap.Logger
 	mu                sync.Mutex
 	networkEnumerator *vmnetworking_enumerator.NetworkEnumerator
 	defaultBridge     netlink.Link
+	state             *StateMachine
+	observer          Observer
+	restarts          restartTracker
 }
 
-func NewVirtualMachine(manifest *Manifest, logger *zap.Logger, storagePath string, defaultBridge string, networkEnumerator *vmnetworking_enumerator.NetworkEnumerator) (*VirtualMachine, error) {
+// observer can be nil
+func NewVirtualMachine(manifest *Manifest, logger *zap.Logger, storagePath string, defaultBridge string, networkEnumerator *vmnetworking_enumerator.NetworkEnumerator, observer Observer) (*VirtualMachine, error) {
 	bridgeLink, err := netlink.LinkByName(defaultBridge)
 	if err != nil {
 		return nil, err
@@ -41,11 +59,13 @@ func NewVirtualMachine(manifest *Manifest, logger *zap.Logger, storagePath strin
 		logger:            logger,
 		networkEnumerator: networkEnumerator,
 		defaultBridge:     bridgeLink,
+		state:             NewStateMachine(Status{State: CREATED, UpdatedAt: time.Now().UTC()}),
+		observer:          observerOrNoop(observer),
 	}, nil
 
 }
 
-func LoadVirtualMachine(vmFolder string, logger *zap.Logger, defaultBridge string, networkEnumerator *vmnetworking_enumerator.NetworkEnumerator) (*VirtualMachine, error) {
+func LoadVirtualMachine(vmFolder string, logger *zap.Logger, defaultBridge string, networkEnumerator *vmnetworking_enumerator.NetworkEnumerator, observer Observer) (*VirtualMachine, error) {
 	bridgeLink, err := netlink.LinkByName(defaultBridge)
 	if err != nil {
 		return nil, err
@@ -58,6 +78,21 @@ func LoadVirtualMachine(vmFolder string, logger *zap.Logger, defaultBridge strin
 	if err != nil {
 		return nil, errors.New("unable to read manifest")
 	}
+	status, err := storage.ReadStatus()
+	if err != nil {
+		// Virtual machines stored before status tracking have never been booted by the monitor
+		status = &Status{State: CREATED, UpdatedAt: time.Now().UTC()}
+	}
+	// The process of the previous run is only known again once it is adopted
+	status.StartedAt = nil
+	if recovered := RecoverState(status.State); recovered != status.State {
+		logger.Warn("settling state left by an interrupted request", zap.String("vm_id", manifest.GuestIdentifier.String()), zap.String("from", string(status.State)), zap.String("to", string(recovered)))
+		status = &Status{State: recovered, UpdatedAt: time.Now().UTC(), LastExit: status.LastExit}
+		err = storage.StoreStatus(*status)
+		if err != nil {
+			logger.Warn("unable to store status", zap.String("vm_id", manifest.GuestIdentifier.String()), zap.String("error", err.Error()))
+		}
+	}
 	return &VirtualMachine{
 		manifest:          manifest,
 		hypervisor:        nil,
@@ -65,19 +100,130 @@ func LoadVirtualMachine(vmFolder string, logger *zap.Logger, defaultBridge strin
 		logger:            logger,
 		networkEnumerator: networkEnumerator,
 		defaultBridge:     bridgeLink,
+		state:             NewStateMachine(*status),
+		observer:          observerOrNoop(observer),
 	}, nil
 }
 
 func (vm *VirtualMachine) StoreManifest() error {
-	vm.mu.Lock()
-	defer vm.mu.Unlock()
+	vm.manifestMu.RLock()
+	defer vm.manifestMu.RUnlock()
 	return vm.storage.StoreManifest(vm.manifest)
 }
 
+func (vm *VirtualMachine) StoreStatus() error {
+	return vm.storage.StoreStatus(vm.state.GetStatus())
+}
+
+func (vm *VirtualMachine) GetStatus() Status {
+	return vm.state.GetStatus()
+}
+
+// Caller must hold mu
+func (vm *VirtualMachine) setInstance(hypervisor *cloudhypervisor.CloudHypervisor) {
+	vm.hypervisor = hypervisor
+	vm.instance.Store(hypervisor)
+	var startedAt *time.Time = nil
+	if hypervisor != nil && !hypervisor.GetStartedAt().IsZero() {
+		var at time.Time = hypervisor.GetStartedAt()
+		startedAt = &at
+	}
+	vm.state.SetStartedAt(startedAt)
+}
+
+// GetInstance returns the attached cloud-hypervisor process without waiting
+// for the operation in progress, it is nil when the guest is not running
+func (vm *VirtualMachine) GetInstance() *cloudhypervisor.CloudHypervisor {
+	return vm.instance.Load()
+}
+
+// The returned manifest must be treated as read only,
+// updates replace the whole manifest so readers never see a partial change
 func (vm *VirtualMachine) GetManifest() *Manifest {
+	vm.manifestMu.RLock()
+	defer vm.manifestMu.RUnlock()
+	return vm.manifest
+}
+
+// UpdateMetadata patches labels and annotations and stores the manifest.
+// Returns the labels before and after the update
+func (vm *VirtualMachine) UpdateMetadata(labels map[string]*string, annotations map[string]*string) (map[string]string, map[string]string, error) {
+	vm.manifestMu.Lock()
+	defer vm.manifestMu.Unlock()
+	updated := *vm.manifest
+	updated.Labels = MergeMetadata(vm.manifest.Labels, labels)
+	updated.Annotations = MergeMetadata(vm.manifest.Annotations, annotations)
+	err := updated.ValidateMetadata()
+	if err != nil {
+		return nil, nil, err
+	}
+	err = vm.storage.StoreManifest(&updated)
+	if err != nil {
+		return nil, nil, err
+	}
+	previous := vm.manifest.Labels
+	vm.manifest = &updated
+	return previous, updated.Labels, nil
+}
+
+// UpdateConfig replaces the hypervisor config, the guest must not hold host resources
+func (vm *VirtualMachine) UpdateConfig(config Config) error {
 	vm.mu.Lock()
 	defer vm.mu.Unlock()
-	return vm.manifest
+	if state := vm.state.GetStatus().State; state.IsActive() || state == DELETING {
+		return fmt.Errorf("virtual machine must be stopped to update its config, current state is %s", state)
+	}
+	vm.manifestMu.Lock()
+	defer vm.manifestMu.Unlock()
+	updated := *vm.manifest
+	updated.Config = config
+	err := vm.storage.StoreManifest(&updated)
+	if err != nil {
+		return err
+	}
+	vm.manifest = &updated
+	return nil
+}
+
+func (vm *VirtualMachine) Rename(name string) error {
+	vm.manifestMu.Lock()
+	defer vm.manifestMu.Unlock()
+	updated := *vm.manifest
+	updated.Name = name
+	err := vm.storage.StoreManifest(&updated)
+	if err != nil {
+		return err
+	}
+	vm.manifest = &updated
+	return nil
+}
+
+func (vm *VirtualMachine) GetDiskUsage() (int64, error) {
+	return vm.storage.DiskUsage()
+}
+
+func (vm *VirtualMachine) ListDisks() ([]DiskFile, error) {
+	disks, err := vm.storage.ListDisks()
+	if err != nil {
+		return nil, err
+	}
+	for i := range disks {
+		disks[i].Attached = slices.ContainsFunc(vm.GetManifest().Config.Disks, func(disk Disk) bool {
+			return disk.Name == disks[i].Name
+		})
+	}
+	return disks, nil
+}
+
+// ResizeDisk grows a disk of a stopped guest, the guest sees the new size on its next boot.
+// Returns the previous size
+func (vm *VirtualMachine) ResizeDisk(diskName string, size int64) (int64, error) {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	if state := vm.state.GetStatus().State; state.IsActive() || state == DELETING {
+		return 0, fmt.Errorf("virtual machine must be stopped to resize a disk, current state is %s", state)
+	}
+	return vm.storage.ResizeDisk(diskName, size)
 }
 
 func (vm *VirtualMachine) CreateDisk(diskName string) (string, error) {
@@ -92,6 +238,21 @@ func (vm *VirtualMachine) CreateKernel(kernelName string) (string, error) {
 	return vm.storage.CreateKernel(kernelName)
 }
 
+// Upload sessions are written by the monitor that tracks them, so the lock is not held
+func (vm *VirtualMachine) StoreUploadSession(tmpDiskName string, content []byte) error {
+	return vm.storage.StoreUploadSession(tmpDiskName, content)
+}
+
+func (vm *VirtualMachine) ReadUploadSessions() (map[string][]byte, error) {
+	return vm.storage.ReadUploadSessions()
+}
+
+func (vm *VirtualMachine) RemoveDiskUpload(tmpDiskName string) error {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	return vm.storage.RemoveDiskUpload(tmpDiskName)
+}
+
 func (vm *VirtualMachine) WriteChunkToDisk(diskName string, byteIndex int64, chunk io.Reader) error {
 	vm.mu.Lock()
 	defer vm.mu.Unlock()
@@ -104,72 +265,385 @@ func (vm *VirtualMachine) WriteChunkToKernel(kernelName string, byteIndex int64,
 	return vm.storage.WriteKernelChunk(kernelName, byteIndex, chunk)
 }
 
+// GetLogPath returns the current log file of a source, older files carry a .N suffix
+func (vm *VirtualMachine) GetLogPath(source string) (string, error) {
+	if source != cloudhypervisor.LOG_HYPERVISOR && source != cloudhypervisor.LOG_SERIAL {
+		return "", fmt.Errorf("unknown log source %q", source)
+	}
+	return vm.storage.GetLogPath(source), nil
+}
+
+func (vm *VirtualMachine) GetMetricsPath() string {
+	return vm.storage.GetMetricsPath()
+}
+
 func (vm *VirtualMachine) CommitDisk(tempDiskName string, diskName string) error {
 	vm.mu.Lock()
 	defer vm.mu.Unlock()
 	return vm.storage.CommitDisk(tempDiskName, diskName)
 }
 
+// DiskChecksum hashes a temporary disk. The file is only written by its upload,
+// so the lock is not held while reading it
+func (vm *VirtualMachine) DiskChecksum(tmpDiskName string) (string, error) {
+	return vm.storage.DiskChecksum(tmpDiskName)
+}
+
+func (vm *VirtualMachine) KernelChecksum(tmpKernelName string) (string, error) {
+	return vm.storage.KernelChecksum(tmpKernelName)
+}
+
 func (vm *VirtualMachine) CommitKernel(tempKernelName string, kernelName string) error {
 	vm.mu.Lock()
 	defer vm.mu.Unlock()
 	return vm.storage.CommitKernel(tempKernelName, kernelName)
 }
 
-func (vm *VirtualMachine) AttachInstance(hypervisor *cloudhypervisor.CloudHypervisor) {
+// AdoptInstance attaches a cloud-hypervisor process that is already running
+// and derives the state from it. Adopting the attached process again is a no-op
+func (vm *VirtualMachine) AdoptInstance(hypervisor *cloudhypervisor.CloudHypervisor) error {
 	vm.mu.Lock()
 	defer vm.mu.Unlock()
-	vm.hypervisor = hypervisor
+	if vm.hypervisor != nil && vm.hypervisor.IsAlive() {
+		if vm.hypervisor.GetPid() == hypervisor.GetPid() {
+			return nil
+		}
+		return &ErrInstanceAttached{Pid: vm.hypervisor.GetPid()}
+	}
+	var current State = vm.state.GetStatus().State
+	if current.IsTransitional() {
+		return &ErrInvalidTransition{From: current, To: RUNNING}
+	}
+	hypervisor.Supervise()
+	vm.setInstance(hypervisor)
+	go vm.watchInstance(hypervisor)
+	vm.settleState()
+	return nil
 }
 
-func (vm *VirtualMachine) RunInstance(binaryPath string, remoteUri string) error {
+func (vm *VirtualMachine) RequestBoot(opts cloudhypervisor.LaunchOptions) error {
 	vm.mu.Lock()
 	defer vm.mu.Unlock()
-	if vm.hypervisor != nil {
-		return errors.New("an instance is already running")
+	err := vm.setState(STARTING)
+	if err != nil {
+		return err
 	}
-	cloudhypervisor, err := cloudhypervisor.NewCloudHypervisor(binaryPath, remoteUri)
+	err = vm.boot(opts)
 	if err != nil {
+		vm.releaseInstance()
+		vm.setState(STOPPED)
+		return err
+	}
+	return vm.setState(RUNNING)
+}
+
+// RequestShutdown asks the guest to power off and escalates up to SIGKILL
+// when the process does not exit within the timeouts
+func (vm *VirtualMachine) RequestShutdown(timeouts cloudhypervisor.StopTimeouts) error {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	err := vm.setState(STOPPING)
+	if err != nil {
+		return err
+	}
+	if vm.hypervisor == nil {
+		vm.settleState()
+		return errors.New("virtual machine has no running instance")
+	}
+	step, err := vm.hypervisor.Stop(timeouts)
+	if err != nil {
+		vm.settleState()
+		return err
+	}
+	vm.logger.Info("vmm process stopped", zap.String("vm_id", vm.GetManifest().GuestIdentifier.String()), zap.String("step", step))
+	vm.setInstance(nil)
+	return vm.setState(STOPPED)
+}
+
+func (vm *VirtualMachine) RequestPause() error {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	err := vm.setState(PAUSED)
+	if err != nil {
+		return err
+	}
+	err = vm.requestAction(cloudhypervisor.PAUSE)
+	if err != nil {
+		vm.settleState()
 		return err
 	}
-	vm.AttachInstance(cloudhypervisor)
 	return nil
 }
 
-func (vm *VirtualMachine) RequestBoot(binaryPath string, remoteUri string) error {
+func (vm *VirtualMachine) RequestResume() error {
 	vm.mu.Lock()
 	defer vm.mu.Unlock()
-	if vm.hypervisor != nil {
-		return errors.New("virtual machine is already running")
+	if vm.state.GetStatus().State != PAUSED {
+		return &ErrInvalidTransition{From: vm.state.GetStatus().State, To: RUNNING}
 	}
-	err := vm.setupNetworking()
+	err := vm.setState(RUNNING)
 	if err != nil {
-		return errors.New("there was an error connecting vm to network interfaces")
+		return err
 	}
-	hypervisor, err := cloudhypervisor.NewCloudHypervisor(binaryPath, remoteUri)
+	err = vm.requestAction(cloudhypervisor.RESUME)
 	if err != nil {
+		vm.settleState()
 		return err
 	}
-	vm.hypervisor = hypervisor
-	err = vm.createVirtualMachine()
+	return nil
+}
+
+// RequestResize removes cpus from a running guest through vm.resize, growing it is refused
+// as guests boot without hotplug room. For a stopped guest only the manifest is updated
+func (vm *VirtualMachine) RequestResize(cpus int, memory int64) error {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	state := vm.state.GetStatus().State
+	if state.IsTransitional() {
+		return fmt.Errorf("virtual machine cannot be resized while %s", state)
+	}
+	if state == RUNNING || state == PAUSED {
+		manifest := vm.GetManifest()
+		if cpus > manifest.Config.Cpus {
+			return &ErrHotplugUnsupported{Resource: "cpus"}
+		}
+		if memory != manifest.Config.Memory {
+			return &ErrHotplugUnsupported{Resource: "memory"}
+		}
+		err := vm.requestResize(cpus, memory)
+		if err != nil {
+			return err
+		}
+	}
+	vm.manifestMu.Lock()
+	defer vm.manifestMu.Unlock()
+	updated := *vm.manifest
+	updated.Config.Cpus = cpus
+	updated.Config.Memory = memory
+	err := vm.storage.StoreManifest(&updated)
 	if err != nil {
 		return err
 	}
-	err = vm.bootVirtualMachine()
+	vm.manifest = &updated
+	return nil
+}
+
+// RequestDelete stops the instance if needed and removes every file of the virtual machine.
+// The caller is in charge of dropping the virtual machine from the monitor
+func (vm *VirtualMachine) RequestDelete() error {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	err := vm.setState(DELETING)
 	if err != nil {
 		return err
 	}
+	vm.releaseInstance()
+	err = vm.storage.RemoveAll()
+	if err != nil {
+		vm.setState(STOPPED)
+		return err
+	}
 	return nil
 }
 
-func (vm *VirtualMachine) RequestShutdown() error {
-	err := vm.shutdownVirtualMachine()
+// RefreshState derives the state from the running instance.
+// Virtual machines busy with a request keep their current state
+func (vm *VirtualMachine) RefreshState() Status {
+	if !vm.mu.TryLock() {
+		return vm.state.GetStatus()
+	}
+	defer vm.mu.Unlock()
+	if vm.state.GetStatus().State.IsTransitional() {
+		return vm.state.GetStatus()
+	}
+	return vm.settleState()
+}
+
+// Caller must hold vm.mu
+func (vm *VirtualMachine) settleState() Status {
+	var alive bool = false
+	var info *cloudhypervisor.VmInfo = nil
+	var err error
+	if vm.hypervisor != nil && vm.hypervisor.IsAlive() {
+		alive = true
+		info, err = vm.hypervisor.GetInfo()
+		if err != nil {
+			vm.logger.Warn("unable to retrieve vm info", zap.String("vm_id", vm.GetManifest().GuestIdentifier.String()), zap.String("error", err.Error()))
+		}
+	}
+	if !alive {
+		vm.setInstance(nil)
+	}
+	var current State = vm.state.GetStatus().State
+	return vm.forceState(DeriveState(current, alive, info))
+}
+
+// Caller must hold vm.mu
+func (vm *VirtualMachine) setState(to State) error {
+	var from State = vm.state.GetStatus().State
+	status, err := vm.state.Transition(to)
 	if err != nil {
 		return err
 	}
+	vm.persistStatus(status)
+	vm.publishState(from, status)
 	return nil
 }
 
+// Caller must hold vm.mu
+func (vm *VirtualMachine) forceState(to State) Status {
+	var from State = vm.state.GetStatus().State
+	status, changed := vm.state.Force(to)
+	if changed {
+		vm.persistStatus(status)
+		vm.publishState(from, status)
+	}
+	return status
+}
+
+func (vm *VirtualMachine) publishState(from State, status Status) {
+	var data map[string]any = map[string]any{
+		"from": string(from),
+		"to":   string(status.State),
+	}
+	if status.State == CRASHED && status.LastExit != nil {
+		data["exit"] = status.LastExit.String()
+	}
+	if status.StartedAt != nil {
+		data["started_at"] = status.StartedAt.Format(time.RFC3339Nano)
+	}
+	vm.publish(events.VM_STATE, data)
+}
+
+func (vm *VirtualMachine) persistStatus(status Status) {
+	err := vm.storage.StoreStatus(status)
+	if err != nil {
+		vm.logger.Error("unable to store vm status", zap.String("vm_id", vm.GetManifest().GuestIdentifier.String()), zap.String("error", err.Error()))
+	}
+}
+
+// Caller must hold vm.mu
+func (vm *VirtualMachine) boot(opts cloudhypervisor.LaunchOptions) error {
+	if vm.hypervisor != nil {
+		// A guest that was shut down from inside leaves its vmm process behind
+		vm.releaseInstance()
+	}
+	err := vm.setupNetworking()
+	if err != nil {
+		return errors.New("there was an error connecting vm to network interfaces")
+	}
+	opts.HypervisorLogPath = vm.storage.GetLogPath(cloudhypervisor.LOG_HYPERVISOR)
+	opts.SerialLogPath = vm.storage.GetLogPath(cloudhypervisor.LOG_SERIAL)
+	opts.Verbosity = vm.GetManifest().Config.Verbosity
+	hypervisor, err := cloudhypervisor.NewCloudHypervisor(opts)
+	if err != nil {
+		return err
+	}
+	vm.setInstance(hypervisor)
+	go vm.watchInstance(hypervisor)
+	go vm.consumeEvents(hypervisor)
+	err = vm.createVirtualMachine()
+	if err != nil {
+		return err
+	}
+	return vm.bootVirtualMachine()
+}
+
+// Caller must hold vm.mu
+func (vm *VirtualMachine) releaseInstance() {
+	if vm.hypervisor == nil {
+		return
+	}
+	_, err := vm.hypervisor.Stop(releaseTimeouts)
+	if err != nil {
+		vm.logger.Error("unable to stop vmm process", zap.Int("pid", vm.hypervisor.GetPid()), zap.String("error", err.Error()))
+	}
+	vm.setInstance(nil)
+}
+
+// watchInstance records the exit of the process as soon as it happens.
+// An exit nobody asked for moves the guest to crashed, or stopped when the guest powered off
+func (vm *VirtualMachine) watchInstance(hypervisor *cloudhypervisor.CloudHypervisor) {
+	<-hypervisor.Done()
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	var exit *cloudhypervisor.ExitStatus = hypervisor.GetExitStatus()
+	vm.state.SetLastExit(exit)
+	if vm.hypervisor != hypervisor {
+		// Storage of a deleted guest is already gone
+		if vm.state.GetStatus().State != DELETING {
+			vm.persistStatus(vm.state.GetStatus())
+		}
+		return
+	}
+	vm.setInstance(nil)
+	var current State = vm.state.GetStatus().State
+	var to State = DeriveState(current, false, nil)
+	if to == CRASHED && exit.Clean() {
+		to = STOPPED
+	}
+	if to == CRASHED {
+		vm.logger.Error("vmm process exited unexpectedly", zap.String("vm_id", vm.GetManifest().GuestIdentifier.String()), zap.Int("pid", hypervisor.GetPid()), zap.String("exit", exit.String()), zap.Strings("stderr", exit.Stderr))
+	}
+	vm.forceState(to)
+	vm.persistStatus(vm.state.GetStatus())
+	if current.IsActive() && to == CRASHED {
+		vm.applyRestartPolicy(RESTART_REASON_FAILURE)
+	} else if current.IsActive() && to == STOPPED {
+		vm.applyRestartPolicy(RESTART_REASON_SHUTDOWN)
+	}
+}
+
+// consumeEvents republishes the event monitor stream and applies lifecycle events right away
+func (vm *VirtualMachine) consumeEvents(hypervisor *cloudhypervisor.CloudHypervisor) {
+	for event := range hypervisor.Events() {
+		data := map[string]any{
+			"elapsed_ms": event.Timestamp.Duration().Milliseconds(),
+		}
+		if len(event.Properties) > 0 {
+			data["properties"] = event.Properties
+		}
+		vm.publish(events.HYPERVISOR_PREFIX+event.Source+"."+event.Event, data)
+		vm.handleEvent(hypervisor, event)
+	}
+}
+
+func (vm *VirtualMachine) handleEvent(hypervisor *cloudhypervisor.CloudHypervisor, event cloudhypervisor.Event) {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	if vm.hypervisor != hypervisor {
+		return
+	}
+	var current State = vm.state.GetStatus().State
+	// Requests in progress set the state themselves
+	if current.IsTransitional() {
+		return
+	}
+	switch {
+	case event.Is(cloudhypervisor.EVENT_SOURCE_VM, cloudhypervisor.EVENT_BOOTED),
+		event.Is(cloudhypervisor.EVENT_SOURCE_VM, cloudhypervisor.EVENT_RESUMED),
+		event.Is(cloudhypervisor.EVENT_SOURCE_VM, cloudhypervisor.EVENT_REBOOTED):
+		vm.forceState(RUNNING)
+	case event.Is(cloudhypervisor.EVENT_SOURCE_VM, cloudhypervisor.EVENT_PAUSED):
+		vm.forceState(PAUSED)
+	case event.Is(cloudhypervisor.EVENT_SOURCE_VM, cloudhypervisor.EVENT_REBOOTING):
+		if !vm.recordReset() {
+			vm.releaseInstance()
+			vm.forceState(STOPPED)
+		}
+	case event.Is(cloudhypervisor.EVENT_SOURCE_VM, cloudhypervisor.EVENT_SHUTDOWN):
+		// The guest powered off, the process has nothing left to run
+		vm.releaseInstance()
+		vm.forceState(STOPPED)
+		vm.applyRestartPolicy(RESTART_REASON_SHUTDOWN)
+	case event.Is(cloudhypervisor.EVENT_SOURCE_GUEST, cloudhypervisor.EVENT_PANIC):
+		vm.logger.Error("guest panicked", zap.String("vm_id", vm.GetManifest().GuestIdentifier.String()))
+		vm.releaseInstance()
+		vm.forceState(CRASHED)
+		vm.applyRestartPolicy(RESTART_REASON_FAILURE)
+	}
+}
+
 func (vm *VirtualMachine) createVirtualMachine() error {
 	vmManifest, err := vm.parseManifestToCloudHypervisor()
 	if err != nil {
@@ -229,21 +703,31 @@ func (vm *VirtualMachine) bootVirtualMachine() error {
 	return nil
 }
 
-func (vm *VirtualMachine) shutdownVirtualMachine() error {
-	uri, _ := vm.hypervisor.RestServer.GetUri(cloudhypervisor.SHUTDOWN)
-	req, err := http.NewRequest(http.MethodPut, uri, nil)
+func (vm *VirtualMachine) requestResize(cpus int, memory int64) error {
+	if vm.hypervisor == nil {
+		return errors.New("virtual machine has no running instance")
+	}
+	var buf bytes.Buffer
+	err := json.NewEncoder(&buf).Encode(cloudhypervisor.VmResize{
+		DesiredVcpus: cpus,
+		DesiredRam:   memory,
+	})
 	if err != nil {
 		return err
 	}
-	res, err := vm.hypervisor.HttpClient.Do(req)
-	if err != nil || (res.StatusCode < 200 || res.StatusCode > 299) {
-		return errors.New("there was an error performing http request")
+	return vm.hypervisor.Put(cloudhypervisor.RESIZE, &buf)
+}
+
+func (vm *VirtualMachine) requestAction(action cloudhypervisor.VirtualMachineAction) error {
+	if vm.hypervisor == nil {
+		return errors.New("virtual machine has no running instance")
 	}
-	return nil
+	return vm.hypervisor.Put(action, nil)
 }
 
 func (vm *VirtualMachine) setupNetworking() error {
-	for i := 0; i < len(vm.manifest.Config.Vpc); i++ {
+	var manifest *Manifest = vm.GetManifest()
+	for i := 0; i < len(manifest.Config.Vpc); i++ {
 		//vpc := vm.manifest.Config.Vpc[i]
 		//bridge := vpc.Bridge
 	}
@@ -286,36 +770,47 @@ func (vm *VirtualMachine) setupNetworking() error {
 }
 
 func (vm *VirtualMachine) parseManifestToCloudHypervisor() (*cloudhypervisor.Manifest, error) {
+	var manifest *Manifest = vm.GetManifest()
 	chManifest := &cloudhypervisor.Manifest{
 		Cpus: cloudhypervisor.VmCpus{
-			Boot_vcpus: vm.manifest.Config.Cpus,
-			Max_vcpus:  vm.manifest.Config.Cpus,
+			Boot_vcpus: manifest.Config.Cpus,
+			Max_vcpus:  manifest.Config.Cpus,
 		},
 		Platform: cloudhypervisor.Platform{
-			Uuid: vm.manifest.GuestIdentifier.String(),
+			Uuid: manifest.GuestIdentifier.String(),
 		},
 		Rng: cloudhypervisor.Rng{
-			Src: vm.manifest.Config.Rng.Src,
+			Src: manifest.Config.Rng.Src,
 		},
 		Serial: cloudhypervisor.Serial{
-			Mode: "File",
-			File: fmt.Sprintf("/tmp/%s.log", vm.manifest.GuestIdentifier.String()),
+			Mode: "Null",
 		},
 		Console: cloudhypervisor.Console{
 			Mode: "Off",
 		},
 	}
+	if vm.hypervisor != nil && vm.hypervisor.GetSerialPath() != "" {
+		chManifest.Serial = cloudhypervisor.Serial{
+			Mode: "File",
+			File: vm.hypervisor.GetSerialPath(),
+		}
+	}
+	if manifest.Config.Memory > 0 {
+		chManifest.Memory = &cloudhypervisor.VmMemory{
+			Size: manifest.Config.Memory,
+		}
+	}
 	disks := []cloudhypervisor.Disk{}
-	for i := 0; i < len(vm.manifest.Config.Disks); i++ {
+	for i := 0; i < len(manifest.Config.Disks); i++ {
 		disks = append(disks, cloudhypervisor.Disk{
-			Path: vm.storage.GetDiskPath(vm.manifest.Config.Disks[i].Name),
+			Path: vm.storage.GetDiskPath(manifest.Config.Disks[i].Name),
 		})
 	}
 	chManifest.Disks = disks
-	if vm.manifest.Config.Kernel != "" && vm.manifest.Config.Init != "" {
+	if manifest.Config.Kernel != "" && manifest.Config.Init != "" {
 		chManifest.Payload = cloudhypervisor.Payload{
-			Kernel:  vm.storage.GetKernelPath(vm.manifest.Config.Kernel),
-			Cmdline: fmt.Sprintf("console=ttyS0 root=/dev/vda rw init=%s", vm.manifest.Config.Init),
+			Kernel:  vm.storage.GetKernelPath(manifest.Config.Kernel),
+			Cmdline: fmt.Sprintf("console=ttyS0 root=/dev/vda rw init=%s", manifest.Config.Init),
 		}
 	}
 	return chManifest, nil
@@ -0,0 +1,31 @@
+package virtualmachine
+
+import (
+	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func Test_VirtualMachine_RequestResize(t *testing.T) {
+	manifest := &Manifest{GuestIdentifier: uuid.New(), Tenant: uuid.New(), Config: Config{Cpus: 2, Memory: 1 << 30}}
+	vm, err := NewVirtualMachine(manifest, zap.NewNop(), t.TempDir(), "lo", nil, nil)
+	assert.Nil(t, err)
+
+	assert.Nil(t, vm.RequestResize(4, 2<<30), "A stopped guest is resized in its manifest")
+	assert.Equal(t, 4, vm.GetManifest().Config.Cpus)
+
+	vm.state = NewStateMachine(Status{State: RUNNING})
+	var errHotplug *ErrHotplugUnsupported
+	err = vm.RequestResize(8, 2<<30)
+	assert.ErrorAs(t, err, &errHotplug, "A running guest has no room for more cpus")
+	assert.Equal(t, "cpus", errHotplug.Resource)
+	err = vm.RequestResize(4, 4<<30)
+	assert.ErrorAs(t, err, &errHotplug, "A running guest has no memory hotplug area")
+	assert.Equal(t, "memory", errHotplug.Resource)
+	err = vm.RequestResize(2, 2<<30)
+	assert.NotNil(t, err)
+	assert.NotErrorAs(t, err, &errHotplug, "Removing cpus is sent to cloud-hypervisor")
+	assert.Equal(t, 4, vm.GetManifest().Config.Cpus, "A refused resize keeps the manifest")
+}
@@ -0,0 +1,201 @@
+package virtualmachine
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	cloudhypervisor "vmm/cloud_hypervisor"
+)
+
+type State string
+
+const (
+	CREATED  State = "created"
+	STARTING State = "starting"
+	RUNNING  State = "running"
+	PAUSED   State = "paused"
+	STOPPING State = "stopping"
+	STOPPED  State = "stopped"
+	CRASHED  State = "crashed"
+	DELETING State = "deleting"
+)
+
+// Transitions allowed when a change is requested through the api.
+// Observed changes (process exit, vm.info) bypass this table, see DeriveState
+var stateTransitions = map[State][]State{
+	CREATED:  {STARTING, DELETING},
+	STARTING: {RUNNING, STOPPED, CRASHED},
+	RUNNING:  {PAUSED, STOPPING, STOPPED, CRASHED},
+	PAUSED:   {RUNNING, STOPPING, STOPPED, CRASHED},
+	STOPPING: {STOPPED, CRASHED},
+	STOPPED:  {STARTING, DELETING},
+	CRASHED:  {STARTING, STOPPED, DELETING},
+	DELETING: {STOPPED},
+}
+
+func ParseState(s string) (State, error) {
+	state := State(s)
+	if _, ok := stateTransitions[state]; !ok {
+		return "", fmt.Errorf("unknown state %q", s)
+	}
+	return state, nil
+}
+
+// A transitional state is held by a request for its whole duration,
+// so no other request can start until it settles
+func (s State) IsTransitional() bool {
+	return s == STARTING || s == STOPPING || s == DELETING
+}
+
+// RecoverState settles a state saved by a monitor that stopped in the middle of a request.
+// No process is attached yet, running instances are adopted afterwards
+func RecoverState(saved State) State {
+	if !saved.IsTransitional() {
+		return saved
+	}
+	// The files of an interrupted delete are still there, so it can be requested again
+	if saved == DELETING {
+		return STOPPED
+	}
+	return DeriveState(saved, false, nil)
+}
+
+// Active guests hold host cpus and memory
+func (s State) IsActive() bool {
+	return s == STARTING || s == RUNNING || s == PAUSED || s == STOPPING
+}
+
+func (s State) CanTransition(to State) bool {
+	for _, allowed := range stateTransitions[s] {
+		if allowed == to {
+			return true
+		}
+	}
+	return false
+}
+
+type ErrInvalidTransition struct {
+	From State
+	To   State
+}
+
+func (err *ErrInvalidTransition) Error() string {
+	return fmt.Sprintf("virtual machine cannot go from %s to %s", err.From, err.To)
+}
+
+// ErrHotplugUnsupported is returned when a running guest is resized beyond what it was booted with.
+// Guests boot with max_vcpus equal to their cpus and without a memory hotplug area
+type ErrHotplugUnsupported struct {
+	Resource string
+}
+
+func (err *ErrHotplugUnsupported) Error() string {
+	return fmt.Sprintf("%s of a running virtual machine cannot grow past its boot size, stop it to resize", err.Resource)
+}
+
+type ErrInstanceAttached struct {
+	Pid int
+}
+
+func (err *ErrInstanceAttached) Error() string {
+	return fmt.Sprintf("virtual machine is already attached to cloud-hypervisor process %d", err.Pid)
+}
+
+// Status is the lifecycle state of a guest. StartedAt is when the attached
+// cloud-hypervisor process was started, nil without a process
+type Status struct {
+	State     State                       `json:"state" yaml:"state"`
+	UpdatedAt time.Time                   `json:"updated_at" yaml:"updated_at"`
+	StartedAt *time.Time                  `json:"started_at,omitempty" yaml:"started_at,omitempty"`
+	LastExit  *cloudhypervisor.ExitStatus `json:"last_exit,omitempty" yaml:"last_exit,omitempty"`
+}
+
+type StateMachine struct {
+	mu     sync.Mutex
+	status Status
+}
+
+func NewStateMachine(status Status) *StateMachine {
+	return &StateMachine{
+		status: status,
+	}
+}
+
+func (sm *StateMachine) GetStatus() Status {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	return sm.status
+}
+
+// Transition moves to the given state only if the table allows it from the current one
+func (sm *StateMachine) Transition(to State) (Status, error) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if !sm.status.State.CanTransition(to) {
+		return sm.status, &ErrInvalidTransition{From: sm.status.State, To: to}
+	}
+	sm.status = Status{State: to, UpdatedAt: time.Now().UTC(), StartedAt: sm.status.StartedAt, LastExit: sm.status.LastExit}
+	return sm.status, nil
+}
+
+// Force sets the state without checking the table.
+// Returns false when the state did not change
+func (sm *StateMachine) Force(to State) (Status, bool) {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	if sm.status.State == to {
+		return sm.status, false
+	}
+	sm.status = Status{State: to, UpdatedAt: time.Now().UTC(), StartedAt: sm.status.StartedAt, LastExit: sm.status.LastExit}
+	return sm.status, true
+}
+
+// SetLastExit records how the last cloud-hypervisor process of the guest exited
+func (sm *StateMachine) SetLastExit(exit *cloudhypervisor.ExitStatus) Status {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.status.LastExit = exit
+	return sm.status
+}
+
+// SetStartedAt records when the attached process was started, nil when it is detached
+func (sm *StateMachine) SetStartedAt(startedAt *time.Time) Status {
+	sm.mu.Lock()
+	defer sm.mu.Unlock()
+	sm.status.StartedAt = startedAt
+	return sm.status
+}
+
+// DeriveState maps process liveness and the vm.info response of cloud-hypervisor
+// to a lifecycle state. info can be nil when the api socket does not answer
+func DeriveState(current State, alive bool, info *cloudhypervisor.VmInfo) State {
+	if !alive {
+		switch current {
+		case CREATED, STOPPED, DELETING:
+			return current
+		case STOPPING:
+			return STOPPED
+		default:
+			return CRASHED
+		}
+	}
+	if info == nil {
+		return current
+	}
+	switch info.State {
+	case cloudhypervisor.VM_STATE_RUNNING:
+		return RUNNING
+	case cloudhypervisor.VM_STATE_PAUSED:
+		return PAUSED
+	case cloudhypervisor.VM_STATE_SHUTDOWN:
+		return STOPPED
+	case cloudhypervisor.VM_STATE_CREATED:
+		if current == CREATED {
+			return CREATED
+		}
+		return STOPPED
+	default:
+		return current
+	}
+}
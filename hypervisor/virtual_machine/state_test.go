@@ -0,0 +1,94 @@
+package virtualmachine
+
+import (
+	"sync"
+	"testing"
+	"time"
+	cloudhypervisor "vmm/cloud_hypervisor"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_StateMachine_Transition(t *testing.T) {
+	sm := NewStateMachine(Status{State: CREATED})
+	status, err := sm.Transition(STARTING)
+	assert.Nil(t, err, "Expect created vm to be bootable")
+	assert.Equal(t, STARTING, status.State, "Expect the new state to be returned")
+	_, err = sm.Transition(STARTING)
+	assert.NotNil(t, err, "Expect a second boot to be rejected")
+	_, err = sm.Transition(DELETING)
+	assert.IsType(t, &ErrInvalidTransition{}, err, "Expect delete while starting to be rejected")
+	_, err = sm.Transition(RUNNING)
+	assert.Nil(t, err, "Expect starting vm to become running")
+}
+
+func Test_StateMachine_ConcurrentTransition(t *testing.T) {
+	sm := NewStateMachine(Status{State: STOPPED})
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var succeeded int = 0
+	for range 20 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := sm.Transition(STARTING)
+			if err == nil {
+				mu.Lock()
+				succeeded += 1
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	assert.Equal(t, 1, succeeded, "Expect only one request to win the transition")
+}
+
+func Test_StateMachine_Force(t *testing.T) {
+	sm := NewStateMachine(Status{State: RUNNING})
+	_, changed := sm.Force(RUNNING)
+	assert.False(t, changed, "Expect no change when state is the same")
+	status, changed := sm.Force(CRASHED)
+	assert.True(t, changed, "Expect the state to change")
+	assert.Equal(t, CRASHED, status.State, "Expect crashed state")
+}
+
+func Test_StateMachine_SetStartedAt(t *testing.T) {
+	sm := NewStateMachine(Status{State: STARTING})
+	var startedAt time.Time = time.Date(2024, 5, 1, 10, 0, 0, 0, time.UTC)
+	sm.SetStartedAt(&startedAt)
+	status, err := sm.Transition(RUNNING)
+	assert.Nil(t, err)
+	assert.Equal(t, &startedAt, status.StartedAt, "Expect the process start time to survive state changes")
+	status, _ = sm.Force(PAUSED)
+	assert.Equal(t, &startedAt, status.StartedAt)
+	status = sm.SetStartedAt(nil)
+	assert.Nil(t, status.StartedAt, "Expect no start time once the process is detached")
+}
+
+func Test_DeriveState(t *testing.T) {
+	assert.Equal(t, CRASHED, DeriveState(RUNNING, false, nil), "Expect dead process of a running vm to be a crash")
+	assert.Equal(t, STOPPED, DeriveState(STOPPING, false, nil), "Expect dead process of a stopping vm to be stopped")
+	assert.Equal(t, CREATED, DeriveState(CREATED, false, nil), "Expect never booted vm to stay created")
+	assert.Equal(t, RUNNING, DeriveState(RUNNING, true, nil), "Expect state to be kept when vm.info does not answer")
+	assert.Equal(t, RUNNING, DeriveState(CREATED, true, &cloudhypervisor.VmInfo{State: cloudhypervisor.VM_STATE_RUNNING}), "Expect adopted instance to be running")
+	assert.Equal(t, PAUSED, DeriveState(RUNNING, true, &cloudhypervisor.VmInfo{State: cloudhypervisor.VM_STATE_PAUSED}), "Expect paused state from vm.info")
+	assert.Equal(t, STOPPED, DeriveState(RUNNING, true, &cloudhypervisor.VmInfo{State: cloudhypervisor.VM_STATE_SHUTDOWN}), "Expect guest shutdown to be stopped")
+}
+
+func Test_RecoverState(t *testing.T) {
+	assert.Equal(t, CRASHED, RecoverState(STARTING), "Expect an interrupted boot to be a crash")
+	assert.Equal(t, STOPPED, RecoverState(STOPPING), "Expect an interrupted shutdown to be stopped")
+	assert.Equal(t, STOPPED, RecoverState(DELETING), "Expect an interrupted delete to be requested again")
+	assert.Equal(t, RUNNING, RecoverState(RUNNING), "Expect settled states to be kept")
+	for _, state := range []State{STARTING, STOPPING, DELETING} {
+		assert.True(t, RecoverState(state).CanTransition(STARTING) || RecoverState(state).CanTransition(DELETING), "Expect %s to leave a way out", state)
+	}
+}
+
+func Test_ParseState(t *testing.T) {
+	state, err := ParseState("running")
+	assert.Nil(t, err, "No errors expected for a known state")
+	assert.Equal(t, RUNNING, state, "Expect the correct state")
+	_, err = ParseState("booting")
+	assert.NotNil(t, err, "Expect unknown state to be rejected")
+}
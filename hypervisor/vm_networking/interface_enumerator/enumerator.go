@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"os"
 	"strconv"
+	"strings"
 	"sync"
 	"vmm/utils"
 )
@@ -60,7 +61,7 @@ func NewNetworkEnumerator(snapshot_path string) (*NetworkEnumerator, error) {
 		return &NetworkEnumerator{
 			tapStorage:    make([]bool, 512),
 			tapIndex:      0,
-			bridgeStorage: make([]bool, 512),
+			bridgeStorage: freeSlots(512),
 			bridgeIndex:   0,
 			tapPrefix:     "tpvm-",
 			bridgePrefix:  "brvm-",
@@ -71,6 +72,15 @@ func NewNetworkEnumerator(snapshot_path string) (*NetworkEnumerator, error) {
 	return nil, err
 }
 
+// freeSlots is a pool of size slots, all of them available
+func freeSlots(size int) []bool {
+	slots := make([]bool, size)
+	for i := range slots {
+		slots[i] = true
+	}
+	return slots
+}
+
 func (mm *NetworkEnumerator) doSnapshot() error {
 	manifest := EnumeratorManifest{
 		TapStorage:    mm.tapStorage,
@@ -136,6 +146,10 @@ func (mm *NetworkEnumerator) GenerateBridgeName() (string, error) {
 			break
 		}
 	}
+	if index == -1 {
+		return "", errors.New("no bridge available")
+	}
+	mm.bridgeStorage[index] = false
 	bridgeName := mm.BridgeName(uint32(index))
 	/*err := mm.doSnapshot()
 	if err != nil {
@@ -143,3 +157,54 @@ func (mm *NetworkEnumerator) GenerateBridgeName() (string, error) {
 	}*/
 	return bridgeName, nil
 }
+
+// bridgeNumber is the slot of a bridge name generated by the enumerator
+func (mm *NetworkEnumerator) bridgeNumber(name string) (int, bool) {
+	if !strings.HasPrefix(name, mm.bridgePrefix) {
+		return 0, false
+	}
+	number, err := strconv.ParseUint(strings.TrimPrefix(name, mm.bridgePrefix), 10, 32)
+	if err != nil || number >= uint64(len(mm.bridgeStorage)) {
+		return 0, false
+	}
+	return int(number), true
+}
+
+// ReserveBridgeNames rebuilds the bridge pool, only the given bridges are taken
+func (mm *NetworkEnumerator) ReserveBridgeNames(names []string) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	mm.bridgeStorage = freeSlots(len(mm.bridgeStorage))
+	for _, name := range names {
+		if number, ok := mm.bridgeNumber(name); ok {
+			mm.bridgeStorage[number] = false
+		}
+	}
+}
+
+// ReleaseBridgeName gives a bridge name back to the pool, names not generated by the enumerator are ignored
+func (mm *NetworkEnumerator) ReleaseBridgeName(name string) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	if number, ok := mm.bridgeNumber(name); ok {
+		mm.bridgeStorage[number] = true
+	}
+}
+
+// PoolUsage returns the size of the tap and bridge pools and how many slots are free.
+// A slot is free when the allocator can hand it out, i.e. it is marked true
+func (mm *NetworkEnumerator) PoolUsage() (tapSize int, tapFree int, bridgeSize int, bridgeFree int) {
+	mm.mu.Lock()
+	defer mm.mu.Unlock()
+	for _, free := range mm.tapStorage {
+		if free {
+			tapFree++
+		}
+	}
+	for _, free := range mm.bridgeStorage {
+		if free {
+			bridgeFree++
+		}
+	}
+	return len(mm.tapStorage), tapFree, len(mm.bridgeStorage), bridgeFree
+}
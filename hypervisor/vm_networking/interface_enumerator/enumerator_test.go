@@ -0,0 +1,40 @@
+package interface_enumerator
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_NetworkEnumerator_GenerateBridgeName(t *testing.T) {
+	enumerator, err := NewNetworkEnumerator(filepath.Join(t.TempDir(), "enumerator.snapshot"))
+	assert.Nil(t, err)
+	first, err := enumerator.GenerateBridgeName()
+	assert.Nil(t, err)
+	assert.Equal(t, "brvm-0", first, "A fresh pool starts free")
+	second, err := enumerator.GenerateBridgeName()
+	assert.Nil(t, err)
+	assert.Equal(t, "brvm-1", second, "Generated names are taken")
+	_, _, size, free := enumerator.PoolUsage()
+	assert.Equal(t, size-2, free)
+
+	enumerator.ReleaseBridgeName(first)
+	enumerator.ReleaseBridgeName("br0")
+	_, _, _, free = enumerator.PoolUsage()
+	assert.Equal(t, size-1, free, "Names not generated by the enumerator are ignored")
+
+	enumerator.ReserveBridgeNames([]string{"brvm-3", "brvm-9999"})
+	_, _, _, free = enumerator.PoolUsage()
+	assert.Equal(t, size-1, free, "Only the reserved names in the pool are taken")
+}
+
+func Test_NetworkEnumerator_Exhausted(t *testing.T) {
+	enumerator, err := NewNetworkEnumerator(filepath.Join(t.TempDir(), "enumerator.snapshot"))
+	assert.Nil(t, err)
+	enumerator.bridgeStorage = freeSlots(1)
+	_, err = enumerator.GenerateBridgeName()
+	assert.Nil(t, err)
+	_, err = enumerator.GenerateBridgeName()
+	assert.NotNil(t, err, "A full pool must not hand out a name")
+}
@@ -1,12 +1,16 @@
 package networkvpc
 
 import (
+	"bytes"
 	"net"
 	vmnetworking "vmm/vm_networking"
 
 	"github.com/google/uuid"
 )
 
+// Longest interface name accepted by the kernel
+const bridgeNameSize = 15
+
 type AddNetwork struct {
 	action  byte
 	tenant  uuid.UUID
@@ -32,8 +36,8 @@ func (addNetwork *AddNetwork) Parse(blob []byte, index int) error {
 		return err
 	}
 	addNetwork.tenant = tenant
-	addNetwork.action = blob[0]
-	addNetwork.bridge = string(blob[index+1+16+5 : index+1+16+5+15])
+	addNetwork.action = blob[index]
+	addNetwork.bridge = string(bytes.TrimRight(blob[index+1+16+5:index+1+16+5+bridgeNameSize], "\x00"))
 	ip := net.IP(blob[index+1+16 : index+1+16+4])
 	maskSize := int(blob[index+1+16+4])
 	mask := net.CIDRMask(maskSize, 32)
@@ -51,12 +55,15 @@ func (addNetwork *AddNetwork) Row() []byte {
 	res = append(res, addNetwork.network.IP.To4()...)
 	ones, _ := addNetwork.network.Mask.Size()
 	res = append(res, byte(ones))
-	res = append(res, []byte(addNetwork.bridge)...)
+	// Names shorter than the interface name limit are padded, rows have a fixed size
+	var bridge []byte = make([]byte, bridgeNameSize)
+	copy(bridge, addNetwork.bridge)
+	res = append(res, bridge...)
 	return res
 }
 
 func (addNetwork *AddNetwork) GetRowSize() int {
-	return 1 + 16 + 5 + 15
+	return 1 + 16 + 5 + bridgeNameSize
 }
 
 func (addNetwork *AddNetwork) GetNetworkString() string {
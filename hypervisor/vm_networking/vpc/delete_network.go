@@ -22,7 +22,7 @@ func NewDeleteNetwork(tenant uuid.UUID, network net.IPNet) *DeleteNetwork {
 }
 
 func (deleteNetwork *DeleteNetwork) Parse(blob []byte, index int) error {
-	if len(blob) < deleteNetwork.GetRowSize() {
+	if len(blob) < index+deleteNetwork.GetRowSize() {
 		return &ErrNotEnoughBytes{}
 	}
 	tenant, err := uuid.FromBytes(blob[index+1 : index+1+16])
@@ -30,7 +30,7 @@ func (deleteNetwork *DeleteNetwork) Parse(blob []byte, index int) error {
 		return err
 	}
 	deleteNetwork.tenant = tenant
-	deleteNetwork.action = blob[0]
+	deleteNetwork.action = blob[index]
 	ip := net.IP(blob[index+1+16 : index+1+16+4])
 	maskSize := int(blob[index+1+16+4])
 	mask := net.CIDRMask(maskSize, 32)
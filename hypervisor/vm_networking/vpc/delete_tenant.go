@@ -17,7 +17,7 @@ func NewDeleteTenant(tenant uuid.UUID) *DeleteTenant {
 }
 
 func (deleteTenant *DeleteTenant) Parse(blob []byte, index int) error {
-	if len(blob) < deleteTenant.GetRowSize() {
+	if len(blob) < index+deleteTenant.GetRowSize() {
 		return &ErrNotEnoughBytes{}
 	}
 	tenant, err := uuid.FromBytes(blob[index+1 : index+1+16])
@@ -25,7 +25,7 @@ func (deleteTenant *DeleteTenant) Parse(blob []byte, index int) error {
 		return err
 	}
 	deleteTenant.tenant = tenant
-	deleteTenant.action = blob[0]
+	deleteTenant.action = blob[index]
 	return nil
 }
 
@@ -2,9 +2,13 @@ package networkvpc
 
 import (
 	"errors"
+	"io"
+	"maps"
 	"net"
+	"os"
 	"sync"
 	"vmm/utils"
+	vmnetworking "vmm/vm_networking"
 
 	"github.com/google/uuid"
 )
@@ -74,9 +78,12 @@ func (vpcManager *VpcManager) LoadFromStorage(storagePath string) error {
 	vpcManager.mu.Lock()
 	defer vpcManager.mu.Unlock()
 	db, err := vpcManager.storage.ReadSnapshot(vpcManager.GetSnapshotFilePath())
-	if err != nil {
+	if err != nil && !os.IsNotExist(err) {
 		return err
 	}
+	if db == nil {
+		db = make(map[string]map[string]string)
+	}
 	vpcManager.database = db
 	err = vpcManager.readChangesFile()
 	if err != nil {
@@ -110,6 +117,13 @@ func (vpcManager *VpcManager) doSnapshot() error {
 	return nil
 }
 
+// MakeSnapshot stores the networks and clears the changes file, e.g. before the monitor exits
+func (vpcManager *VpcManager) MakeSnapshot() error {
+	vpcManager.mu.Lock()
+	defer vpcManager.mu.Unlock()
+	return vpcManager.doSnapshot()
+}
+
 func (VpcManager *VpcManager) processBuffer(index int, buffer []byte) (BlobData, error) {
 	var data BlobData
 	switch buffer[index] {
@@ -129,44 +143,43 @@ func (VpcManager *VpcManager) processBuffer(index int, buffer []byte) (BlobData,
 	return data, nil
 }
 
+// readChangesFile replays the rows appended after the last snapshot,
+// a row torn by a crash during the append is dropped
 func (vpcManager *VpcManager) readChangesFile() error {
-	var index int64 = 0
-	var err error
-	var buffer []byte = make([]byte, 2048)
+	var changes []byte = make([]byte, 0)
+	var chunk []byte = make([]byte, 2048)
+	var offset int64 = 0
 	for {
-		n, err := vpcManager.storage.ReadChunk(vpcManager.changesPath, buffer, index)
-		if err != nil {
+		n, err := vpcManager.storage.ReadChunk(vpcManager.changesPath, chunk, offset)
+		changes = append(changes, chunk[:n]...)
+		offset += int64(n)
+		if errors.Is(err, io.EOF) || errors.Is(err, os.ErrNotExist) || (err == nil && n == 0) {
 			break
 		}
-		if n == 0 {
-			break
+		if err != nil {
+			return err
 		}
-		var localIndex int = 0
-		for {
-			data, err := vpcManager.processBuffer(localIndex, buffer)
-			if err != nil {
-				index += int64(localIndex)
-				break
-			}
-			localIndex += data.GetRowSize()
-			if obj, ok := data.(*AddNetwork); ok {
-				vpcManager.addNetwork(obj, false)
-				continue
-			}
-			if obj, ok := data.(*DeleteNetwork); ok {
-				vpcManager.deleteNetwork(obj, false)
-				continue
-			}
-			if obj, ok := data.(*DeleteTenant); ok {
-				vpcManager.deleteTenant(obj, false)
-				continue
-			}
+	}
+	for index := 0; index < len(changes); {
+		data, err := vpcManager.processBuffer(index, changes)
+		var errNotEnough *ErrNotEnoughBytes
+		if errors.As(err, &errNotEnough) {
+			return nil
 		}
-		if !errors.Is(err, &ErrNotEnoughBytes{}) {
-			break
+		if err != nil {
+			return err
+		}
+		index += data.GetRowSize()
+		switch obj := data.(type) {
+		case *AddNetwork:
+			vpcManager.addNetwork(obj, false)
+		case *DeleteNetwork:
+			vpcManager.deleteNetwork(obj, false)
+		case *DeleteTenant:
+			vpcManager.deleteTenant(obj, false)
 		}
 	}
-	return err
+	return nil
 }
 
 func (vpcManager *VpcManager) addNetwork(an *AddNetwork, store bool) error {
@@ -232,3 +245,36 @@ func (vpcManager *VpcManager) DeleteTenant(tenant uuid.UUID) error {
 	deleteTenant := NewDeleteTenant(tenant)
 	return vpcManager.deleteTenant(deleteTenant, true)
 }
+
+func (vpcManager *VpcManager) CountNetworks(tenant uuid.UUID) int {
+	vpcManager.mu.Lock()
+	defer vpcManager.mu.Unlock()
+	return len(vpcManager.database[tenant.String()])
+}
+
+func (vpcManager *VpcManager) HasNetwork(tenant uuid.UUID, network net.IPNet) bool {
+	vpcManager.mu.Lock()
+	defer vpcManager.mu.Unlock()
+	_, ok := vpcManager.database[tenant.String()][vmnetworking.NetworkToCIDR4(network)]
+	return ok
+}
+
+// ListNetworks returns the bridge of every network of the tenant, keyed by cidr
+func (vpcManager *VpcManager) ListNetworks(tenant uuid.UUID) map[string]string {
+	vpcManager.mu.Lock()
+	defer vpcManager.mu.Unlock()
+	return maps.Clone(vpcManager.database[tenant.String()])
+}
+
+// ListTenants returns every tenant owning at least one network
+func (vpcManager *VpcManager) ListTenants() []string {
+	vpcManager.mu.Lock()
+	defer vpcManager.mu.Unlock()
+	var tenants []string = make([]string, 0, len(vpcManager.database))
+	for tenant, networks := range vpcManager.database {
+		if len(networks) > 0 {
+			tenants = append(tenants, tenant)
+		}
+	}
+	return tenants
+}
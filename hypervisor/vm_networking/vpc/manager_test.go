@@ -1,7 +1,13 @@
 package networkvpc
 
 import (
+	"net"
+	"os"
+	"path/filepath"
 	"testing"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
 )
 
 type MockedStorageVpc struct {
@@ -28,3 +34,58 @@ func (ms *MockedStorageVpc) AppendRow(path string, row []byte) (int, error) {
 func Test_AddNetwork(t *testing.T) {
 
 }
+
+func Test_VpcManager_LoadFromStorage(t *testing.T) {
+	var folder string = t.TempDir()
+	var snapshotPath string = filepath.Join(folder, "vpc_config.snapshot")
+	var changesPath string = filepath.Join(folder, "vpc_changes.aof")
+	tenant := uuid.New()
+	_, first, _ := net.ParseCIDR("10.0.0.0/24")
+	_, second, _ := net.ParseCIDR("10.0.1.0/24")
+
+	manager := NewVpcManager(snapshotPath, changesPath)
+	assert.Nil(t, manager.LoadFromStorage(folder), "A first start has no snapshot")
+	assert.Nil(t, manager.AddNetwork(tenant, *first, "brvm-1"))
+	assert.Nil(t, manager.AddNetwork(tenant, *second, "brvm-2"))
+	assert.Nil(t, manager.DeleteNetwork(tenant, *first))
+
+	// The changes are replayed by the next start
+	manager = NewVpcManager(snapshotPath, changesPath)
+	assert.Nil(t, manager.LoadFromStorage(folder))
+	assert.Equal(t, 1, manager.CountNetworks(tenant))
+	assert.True(t, manager.HasNetwork(tenant, *second))
+
+	// A row torn by a crash is dropped
+	assert.Nil(t, manager.AddNetwork(tenant, *first, "brvm-3"))
+	row := NewAddNetwork(tenant, *first, "brvm-4").Row()
+	file, err := os.OpenFile(changesPath, os.O_APPEND|os.O_WRONLY, 0600)
+	assert.Nil(t, err)
+	file.Write(row[:10])
+	file.Close()
+	manager = NewVpcManager(snapshotPath, changesPath)
+	assert.Nil(t, manager.LoadFromStorage(folder))
+	assert.Equal(t, 2, manager.CountNetworks(tenant))
+
+	assert.Nil(t, manager.AddNetwork(tenant, *second, "brvm-2"))
+	assert.Nil(t, manager.MakeSnapshot())
+	stat, err := os.Stat(changesPath)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(0), stat.Size(), "The snapshot clears the changes file")
+}
+
+func Test_VpcManager_ListNetworks(t *testing.T) {
+	var folder string = t.TempDir()
+	manager := NewVpcManager(filepath.Join(folder, "vpc_config.snapshot"), filepath.Join(folder, "vpc_changes.aof"))
+	assert.Nil(t, manager.LoadFromStorage(folder))
+	tenant := uuid.New()
+	_, network, _ := net.ParseCIDR("10.0.0.0/24")
+	assert.Nil(t, manager.AddNetwork(tenant, *network, "brvm-1"))
+
+	assert.Equal(t, map[string]string{"10.0.0.0/24": "brvm-1"}, manager.ListNetworks(tenant))
+	assert.Equal(t, []string{tenant.String()}, manager.ListTenants())
+	manager.ListNetworks(tenant)["10.0.1.0/24"] = "brvm-2"
+	assert.Equal(t, 1, manager.CountNetworks(tenant), "The returned map is a copy")
+
+	assert.Nil(t, manager.DeleteNetwork(tenant, *network))
+	assert.Empty(t, manager.ListTenants(), "Tenants without networks are not listed")
+}
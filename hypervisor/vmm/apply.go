@@ -0,0 +1,564 @@
+package vmm
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net"
+	"slices"
+	"strings"
+	"vmm/audit"
+	"vmm/auth"
+	virtualmachine "vmm/virtual_machine"
+	vmnetwork_utility "vmm/vm_networking"
+
+	"github.com/google/uuid"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	KIND_VIRTUAL_MACHINE = "VirtualMachine"
+	KIND_VPC_NETWORK     = "VpcNetwork"
+)
+
+const (
+	APPLY_CREATE = "create"
+	APPLY_UPDATE = "update"
+	APPLY_DELETE = "delete"
+)
+
+// ErrInvalidApply lists every problem found in the documents or the options of an apply
+type ErrInvalidApply struct {
+	Problems []string
+}
+
+func (err *ErrInvalidApply) Error() string {
+	return fmt.Sprintf("invalid apply: %s", strings.Join(err.Problems, "; "))
+}
+
+// applyDocument holds the fields of every kind, the kind tells which ones may be set
+type applyDocument struct {
+	Kind        string                 `yaml:"kind"`
+	Tenant      string                 `yaml:"tenant"`
+	Name        string                 `yaml:"name"`
+	Labels      map[string]string      `yaml:"labels"`
+	Annotations map[string]string      `yaml:"annotations"`
+	Config      *virtualmachine.Config `yaml:"hypervisor_config"`
+	Network     string                 `yaml:"network"`
+}
+
+// ApplyResource is a virtual machine or a vpc network declared in an apply file
+type ApplyResource struct {
+	Kind   string
+	Tenant uuid.UUID
+	// Name of the virtual machine or cidr of the network
+	Name     string
+	Manifest *virtualmachine.Manifest
+	Network  net.IPNet
+}
+
+// key identifies the resource among the resources of the same kind
+func (resource *ApplyResource) key() string {
+	return resource.Tenant.String() + "/" + resource.Name
+}
+
+// ParseApplyDocuments reads a multi-document yaml of virtual machines and vpc networks.
+// Documents without tenant belong to tenant, a document of another tenant is rejected when it is set
+func ParseApplyDocuments(content []byte, tenant string) ([]ApplyResource, error) {
+	var problems []string = make([]string, 0)
+	var resources []ApplyResource = make([]ApplyResource, 0)
+	var declared map[string]int = make(map[string]int)
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	for index := 1; ; index++ {
+		var document *applyDocument
+		err := decoder.Decode(&document)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("document %d: %s", index, err.Error()))
+			break
+		}
+		if document == nil {
+			continue
+		}
+		resource, err := document.resource(tenant)
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("document %d: %s", index, err.Error()))
+			continue
+		}
+		var id string = resource.Kind + "/" + resource.key()
+		if previous, ok := declared[id]; ok {
+			problems = append(problems, fmt.Sprintf("document %d: %s %s is already declared in document %d", index, resource.Kind, resource.key(), previous))
+			continue
+		}
+		declared[id] = index
+		resources = append(resources, resource)
+	}
+	if len(problems) > 0 {
+		return nil, &ErrInvalidApply{Problems: problems}
+	}
+	return resources, nil
+}
+
+func (document *applyDocument) resource(tenant string) (ApplyResource, error) {
+	var owner string = document.Tenant
+	if owner == "" {
+		owner = tenant
+	}
+	if owner == "" {
+		return ApplyResource{}, errors.New("tenant is required")
+	}
+	id, err := uuid.Parse(owner)
+	if err != nil {
+		return ApplyResource{}, fmt.Errorf("tenant must be a uuid, found %q", owner)
+	}
+	if tenant != "" && id.String() != tenant {
+		return ApplyResource{}, fmt.Errorf("tenant %s is not the tenant of the apply", id.String())
+	}
+	switch document.Kind {
+	case KIND_VIRTUAL_MACHINE:
+		return document.virtualMachine(id)
+	case KIND_VPC_NETWORK:
+		if document.Name != "" || document.Labels != nil || document.Annotations != nil || document.Config != nil {
+			return ApplyResource{}, errors.New("a VpcNetwork only has tenant and network")
+		}
+		network, err := ParseVpcNetwork(document.Network)
+		if err != nil {
+			return ApplyResource{}, err
+		}
+		return ApplyResource{Kind: KIND_VPC_NETWORK, Tenant: id, Name: vmnetwork_utility.NetworkToCIDR4(network), Network: network}, nil
+	case "":
+		return ApplyResource{}, errors.New("kind is required")
+	default:
+		return ApplyResource{}, fmt.Errorf("unknown kind %q, expected %s or %s", document.Kind, KIND_VIRTUAL_MACHINE, KIND_VPC_NETWORK)
+	}
+}
+
+// Virtual machines are identified by name, so it is required
+func (document *applyDocument) virtualMachine(tenant uuid.UUID) (ApplyResource, error) {
+	if document.Network != "" {
+		return ApplyResource{}, errors.New("network is set on a VirtualMachine, vpc interfaces go in hypervisor_config.vpc")
+	}
+	if document.Name == "" {
+		return ApplyResource{}, errors.New("name is required")
+	}
+	err := virtualmachine.ValidateName(document.Name)
+	if err != nil {
+		return ApplyResource{}, err
+	}
+	if document.Config == nil {
+		return ApplyResource{}, errors.New("hypervisor_config is required")
+	}
+	manifest := &virtualmachine.Manifest{
+		Tenant:      tenant,
+		Name:        document.Name,
+		Labels:      document.Labels,
+		Annotations: document.Annotations,
+		Config:      *document.Config,
+	}
+	err = manifest.ValidateMetadata()
+	if err != nil {
+		return ApplyResource{}, err
+	}
+	err = manifest.Config.Validate()
+	if err != nil {
+		return ApplyResource{}, err
+	}
+	for _, vpc := range manifest.Config.Vpc {
+		if len(vpc.Addresses) < 1 {
+			return ApplyResource{}, errors.New("required at least one ip address for a given interface")
+		}
+		_, _, err = vmnetwork_utility.ParseCIDR4(vpc.Addresses[0], vpc.Mask)
+		if err != nil {
+			return ApplyResource{}, fmt.Errorf("vpc interface %s: %w", vpc.Addresses[0], err)
+		}
+	}
+	return ApplyResource{Kind: KIND_VIRTUAL_MACHINE, Tenant: tenant, Name: document.Name, Manifest: manifest}, nil
+}
+
+// ApplyAction is a step of a plan, Changes lists the fields modified by an update
+type ApplyAction struct {
+	Action  string         `json:"action" yaml:"action"`
+	Kind    string         `json:"kind" yaml:"kind"`
+	Tenant  string         `json:"tenant" yaml:"tenant"`
+	Name    string         `json:"name" yaml:"name"`
+	Id      string         `json:"id,omitempty" yaml:"id,omitempty"`
+	Changes []audit.Change `json:"changes,omitempty" yaml:"changes,omitempty"`
+	// Set when the action failed, the following actions are still run
+	Error    string `json:"error,omitempty" yaml:"error,omitempty"`
+	resource *ApplyResource
+}
+
+type ApplyPlan struct {
+	ApplySet string        `json:"apply_set,omitempty" yaml:"apply_set,omitempty"`
+	DryRun   bool          `json:"dry_run" yaml:"dry_run"`
+	Actions  []ApplyAction `json:"actions" yaml:"actions"`
+	// Resources of the file already matching the current state
+	Unchanged int `json:"unchanged" yaml:"unchanged"`
+}
+
+// Failed tells whether an action of an executed plan failed
+func (plan *ApplyPlan) Failed() bool {
+	for _, action := range plan.Actions {
+		if action.Error != "" {
+			return true
+		}
+	}
+	return false
+}
+
+type ApplyOptions struct {
+	// Empty spans every tenant, the documents must then name their tenant
+	Tenant string
+	// Resources are recorded in the set, only resources of the set are pruned
+	ApplySet string
+	DryRun   bool
+	// Delete the resources of the set dropped from the file
+	Prune bool
+}
+
+func (opts *ApplyOptions) Validate() error {
+	var problems []string = make([]string, 0)
+	if opts.Tenant != "" {
+		if _, err := uuid.Parse(opts.Tenant); err != nil {
+			problems = append(problems, fmt.Sprintf("tenant must be a uuid, found %q", opts.Tenant))
+		}
+	}
+	if opts.ApplySet != "" {
+		if err := virtualmachine.ValidateName(opts.ApplySet); err != nil {
+			problems = append(problems, "apply set: "+err.Error())
+		}
+	}
+	if opts.Prune && opts.ApplySet == "" {
+		problems = append(problems, "prune requires an apply set")
+	}
+	if len(problems) > 0 {
+		return &ErrInvalidApply{Problems: problems}
+	}
+	return nil
+}
+
+// applySetKey scopes the set to the tenant of the apply, so tenants cannot prune each other
+func (opts *ApplyOptions) applySetKey() string {
+	if opts.Tenant == "" {
+		return auth.ALL_TENANTS + "/" + opts.ApplySet
+	}
+	return opts.Tenant + "/" + opts.ApplySet
+}
+
+// applyState is the state of the host a plan is computed against
+type applyState struct {
+	virtualMachines []*virtualmachine.Manifest
+	vpcNetworks     []VpcNetwork
+	managed         ApplySet
+}
+
+// applySpec is the part of a manifest set by an apply file. Bridges are assigned by the monitor
+func applySpec(manifest *virtualmachine.Manifest) ([]byte, error) {
+	var config virtualmachine.Config = manifest.Config
+	config.Vpc = slices.Clone(config.Vpc)
+	for i := range config.Vpc {
+		config.Vpc[i].Bridge = ""
+	}
+	return json.Marshal(struct {
+		Labels      map[string]string     `json:"labels,omitempty"`
+		Annotations map[string]string     `json:"annotations,omitempty"`
+		Config      virtualmachine.Config `json:"hypervisor_config"`
+	}{manifest.Labels, manifest.Annotations, config})
+}
+
+// vpcNetworkOf returns the cidr of the network of a vpc interface
+func vpcNetworkOf(vpc virtualmachine.VpcNet) (string, bool) {
+	if len(vpc.Addresses) < 1 {
+		return "", false
+	}
+	_, ipNet, err := vmnetwork_utility.ParseCIDR4(vpc.Addresses[0], vpc.Mask)
+	if err != nil {
+		return "", false
+	}
+	return vmnetwork_utility.NetworkToCIDR4(*ipNet), true
+}
+
+// planApply lists the actions in the order they run: networks are created before the virtual
+// machines and deleted after them. Networks used by a virtual machine of the file are never pruned
+func planApply(resources []ApplyResource, state applyState, prune bool) ([]ApplyAction, int, error) {
+	var byName map[string]*virtualmachine.Manifest = make(map[string]*virtualmachine.Manifest)
+	var byId map[string]*virtualmachine.Manifest = make(map[string]*virtualmachine.Manifest)
+	for _, manifest := range state.virtualMachines {
+		byId[manifest.GuestIdentifier.String()] = manifest
+		if manifest.Name != "" {
+			byName[manifest.Tenant.String()+"/"+manifest.Name] = manifest
+		}
+	}
+	var networks map[string]bool = make(map[string]bool)
+	for _, network := range state.vpcNetworks {
+		networks[network.Tenant+"/"+network.Network] = true
+	}
+	var createNetworks, virtualMachines, deleteVirtualMachines, deleteNetworks []ApplyAction
+	var declared map[string]bool = make(map[string]bool)
+	var used map[string]bool = make(map[string]bool)
+	var unchanged int = 0
+	for i := range resources {
+		resource := &resources[i]
+		declared[resource.Kind+"/"+resource.key()] = true
+		action := ApplyAction{Kind: resource.Kind, Tenant: resource.Tenant.String(), Name: resource.Name, resource: resource}
+		if resource.Kind == KIND_VPC_NETWORK {
+			if networks[resource.key()] {
+				unchanged++
+				continue
+			}
+			action.Action = APPLY_CREATE
+			createNetworks = append(createNetworks, action)
+			continue
+		}
+		for _, vpc := range resource.Manifest.Config.Vpc {
+			if network, ok := vpcNetworkOf(vpc); ok {
+				used[resource.Tenant.String()+"/"+network] = true
+			}
+		}
+		current, ok := byName[resource.key()]
+		if !ok {
+			action.Action = APPLY_CREATE
+			virtualMachines = append(virtualMachines, action)
+			continue
+		}
+		before, err := applySpec(current)
+		if err != nil {
+			return nil, 0, err
+		}
+		after, err := applySpec(resource.Manifest)
+		if err != nil {
+			return nil, 0, err
+		}
+		changes, err := audit.Diff(before, after)
+		if err != nil {
+			return nil, 0, err
+		}
+		if len(changes) == 0 {
+			unchanged++
+			continue
+		}
+		action.Action = APPLY_UPDATE
+		action.Id = current.GuestIdentifier.String()
+		action.Changes = changes
+		virtualMachines = append(virtualMachines, action)
+	}
+	if prune {
+		for _, id := range state.managed.VirtualMachines {
+			manifest, ok := byId[id]
+			if !ok || (manifest.Name != "" && declared[KIND_VIRTUAL_MACHINE+"/"+manifest.Tenant.String()+"/"+manifest.Name]) {
+				continue
+			}
+			deleteVirtualMachines = append(deleteVirtualMachines, ApplyAction{
+				Action: APPLY_DELETE,
+				Kind:   KIND_VIRTUAL_MACHINE,
+				Tenant: manifest.Tenant.String(),
+				Name:   manifest.Name,
+				Id:     id,
+			})
+		}
+		for _, key := range state.managed.VpcNetworks {
+			if !networks[key] || declared[KIND_VPC_NETWORK+"/"+key] || used[key] {
+				continue
+			}
+			tenant, network, _ := strings.Cut(key, "/")
+			deleteNetworks = append(deleteNetworks, ApplyAction{
+				Action: APPLY_DELETE,
+				Kind:   KIND_VPC_NETWORK,
+				Tenant: tenant,
+				Name:   network,
+			})
+		}
+	}
+	var actions []ApplyAction = make([]ApplyAction, 0, len(createNetworks)+len(virtualMachines)+len(deleteVirtualMachines)+len(deleteNetworks))
+	actions = append(actions, createNetworks...)
+	actions = append(actions, virtualMachines...)
+	actions = append(actions, deleteVirtualMachines...)
+	actions = append(actions, deleteNetworks...)
+	return actions, unchanged, nil
+}
+
+func (hm *HypervisorMonitor) applyState(opts ApplyOptions) (applyState, error) {
+	var state applyState
+	hm.vmsMu.Lock()
+	for _, vm := range hm.virtualMachines {
+		manifest := vm.GetManifest()
+		if opts.Tenant == "" || manifest.Tenant.String() == opts.Tenant {
+			state.virtualMachines = append(state.virtualMachines, manifest)
+		}
+	}
+	hm.vmsMu.Unlock()
+	networks, err := hm.ListVpcNetworks(opts.Tenant)
+	if err != nil {
+		return applyState{}, err
+	}
+	state.vpcNetworks = networks
+	if opts.ApplySet != "" {
+		state.managed = hm.applySets.GetApplySet(opts.applySetKey())
+	}
+	return state, nil
+}
+
+// Apply brings the virtual machines and vpc networks of the host to the resources of a file.
+// A failed action does not stop the next ones, the plan reports the error of every action
+func (hm *HypervisorMonitor) Apply(resources []ApplyResource, opts ApplyOptions) (ApplyPlan, error) {
+	err := opts.Validate()
+	if err != nil {
+		return ApplyPlan{}, err
+	}
+	hm.applyMu.Lock()
+	defer hm.applyMu.Unlock()
+	state, err := hm.applyState(opts)
+	if err != nil {
+		return ApplyPlan{}, err
+	}
+	actions, unchanged, err := planApply(resources, state, opts.Prune)
+	if err != nil {
+		return ApplyPlan{}, err
+	}
+	plan := ApplyPlan{ApplySet: opts.ApplySet, DryRun: opts.DryRun, Actions: actions, Unchanged: unchanged}
+	if opts.DryRun {
+		return plan, nil
+	}
+	for i := range plan.Actions {
+		err = hm.applyAction(&plan.Actions[i])
+		if err != nil {
+			plan.Actions[i].Error = err.Error()
+		}
+	}
+	if opts.ApplySet != "" {
+		err = hm.applySets.SetApplySet(opts.applySetKey(), hm.applySetMembers(resources, state.managed))
+		if err != nil {
+			return plan, fmt.Errorf("unable to record apply set %s: %w", opts.ApplySet, err)
+		}
+	}
+	return plan, nil
+}
+
+func (hm *HypervisorMonitor) applyAction(action *ApplyAction) error {
+	switch {
+	case action.Kind == KIND_VPC_NETWORK && action.Action == APPLY_CREATE:
+		_, err := hm.CreateVpcNetwork(action.resource.Tenant, action.resource.Network)
+		return err
+	case action.Kind == KIND_VPC_NETWORK && action.Action == APPLY_DELETE:
+		network, err := ParseVpcNetwork(action.Name)
+		if err != nil {
+			return err
+		}
+		tenant, err := uuid.Parse(action.Tenant)
+		if err != nil {
+			return err
+		}
+		return hm.DeleteVpcNetwork(tenant, network)
+	case action.Action == APPLY_CREATE:
+		manifest := *action.resource.Manifest
+		manifest.Config.Vpc = slices.Clone(manifest.Config.Vpc)
+		err := hm.CreateVirtualMachine(&manifest)
+		if err != nil {
+			return err
+		}
+		action.Id = manifest.GuestIdentifier.String()
+		return nil
+	case action.Action == APPLY_UPDATE:
+		return hm.applyUpdate(action)
+	case action.Action == APPLY_DELETE:
+		return hm.DeleteVirtualMachine(action.Id)
+	}
+	return fmt.Errorf("unknown action %s of %s", action.Action, action.Kind)
+}
+
+// applyUpdate patches the metadata before the config, a running guest still gets its labels
+func (hm *HypervisorMonitor) applyUpdate(action *ApplyAction) error {
+	vm := hm.GetVirtualMachine(action.Id)
+	if vm == nil {
+		return &ErrVirtualMachineNotFound{}
+	}
+	current := vm.GetManifest()
+	desired := action.resource.Manifest
+	var metadata, config bool
+	for _, change := range action.Changes {
+		if strings.HasPrefix(change.Field, "hypervisor_config.") {
+			config = true
+		} else {
+			metadata = true
+		}
+	}
+	if metadata {
+		_, err := hm.UpdateVirtualMachineMetadata(action.Id, metadataPatch(current.Labels, desired.Labels), metadataPatch(current.Annotations, desired.Annotations))
+		if err != nil {
+			return err
+		}
+	}
+	if config {
+		var updated virtualmachine.Config = desired.Config
+		updated.Vpc = slices.Clone(updated.Vpc)
+		_, err := hm.UpdateVirtualMachine(action.Id, updated)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// metadataPatch turns current into desired, keys missing from desired are removed
+func metadataPatch(current map[string]string, desired map[string]string) map[string]*string {
+	var patch map[string]*string = make(map[string]*string)
+	for key := range current {
+		if _, ok := desired[key]; !ok {
+			patch[key] = nil
+		}
+	}
+	for key, value := range desired {
+		if previous, ok := current[key]; !ok || previous != value {
+			patch[key] = &value
+		}
+	}
+	return patch
+}
+
+// applySetMembers keeps the resources of the file and the previous members that still exist,
+// members dropped from the file stay in the set until they are pruned
+func (hm *HypervisorMonitor) applySetMembers(resources []ApplyResource, previous ApplySet) ApplySet {
+	var virtualMachines map[string]struct{} = make(map[string]struct{})
+	var networks map[string]struct{} = make(map[string]struct{})
+	for _, id := range previous.VirtualMachines {
+		if hm.GetVirtualMachine(id) != nil {
+			virtualMachines[id] = struct{}{}
+		}
+	}
+	exists := func(key string) bool {
+		tenant, cidr, _ := strings.Cut(key, "/")
+		id, err := uuid.Parse(tenant)
+		if err != nil {
+			return false
+		}
+		network, err := ParseVpcNetwork(cidr)
+		return err == nil && hm.vpcManager.HasNetwork(id, network)
+	}
+	for _, key := range previous.VpcNetworks {
+		if exists(key) {
+			networks[key] = struct{}{}
+		}
+	}
+	for i := range resources {
+		resource := &resources[i]
+		if resource.Kind == KIND_VPC_NETWORK {
+			if exists(resource.key()) {
+				networks[resource.key()] = struct{}{}
+			}
+			continue
+		}
+		if vm := hm.GetVirtualMachine(resource.key()); vm != nil {
+			virtualMachines[vm.GetManifest().GuestIdentifier.String()] = struct{}{}
+		}
+	}
+	return ApplySet{
+		VirtualMachines: slices.Sorted(maps.Keys(virtualMachines)),
+		VpcNetworks:     slices.Sorted(maps.Keys(networks)),
+	}
+}
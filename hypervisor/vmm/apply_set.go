@@ -0,0 +1,95 @@
+package vmm
+
+import (
+	"os"
+	"slices"
+	"sync"
+	"vmm/utils"
+)
+
+// ApplySet lists the resources created or adopted by the applies of a set, dropping one
+// from the file lets a pruning apply remove it
+type ApplySet struct {
+	VirtualMachines []string `json:"virtual_machines" yaml:"virtual_machines"`
+	// Networks are "<tenant>/<cidr>"
+	VpcNetworks []string `json:"vpc_networks" yaml:"vpc_networks"`
+}
+
+func (set ApplySet) Empty() bool {
+	return len(set.VirtualMachines) == 0 && len(set.VpcNetworks) == 0
+}
+
+type ApplySetStorage struct{}
+
+func (s *ApplySetStorage) ReadSnapshot(path string) (map[string]ApplySet, error) {
+	return utils.ReadGobFile[map[string]ApplySet](path)
+}
+
+func (s *ApplySetStorage) WriteSnapshot(path string, db map[string]ApplySet) error {
+	return utils.WriteGobFile(path, db)
+}
+
+type ApplySetStorageRepository interface {
+	ReadSnapshot(path string) (map[string]ApplySet, error)
+	WriteSnapshot(path string, db map[string]ApplySet) error
+}
+
+// ApplySetManager keeps the apply sets keyed by "<tenant>/<name>", the tenant is * for
+// applies spanning every tenant
+type ApplySetManager struct {
+	snapshotPath string
+	sets         map[string]ApplySet
+	mu           sync.Mutex
+	storage      ApplySetStorageRepository
+}
+
+func NewApplySetManager(snapshotPath string) (*ApplySetManager, error) {
+	return newApplySetManager(snapshotPath, new(ApplySetStorage))
+}
+
+func newApplySetManager(snapshotPath string, storage ApplySetStorageRepository) (*ApplySetManager, error) {
+	sets, err := storage.ReadSnapshot(snapshotPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if sets == nil {
+		sets = make(map[string]ApplySet)
+	}
+	return &ApplySetManager{
+		snapshotPath: snapshotPath,
+		sets:         sets,
+		storage:      storage,
+	}, nil
+}
+
+func (am *ApplySetManager) GetApplySet(key string) ApplySet {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	set := am.sets[key]
+	return ApplySet{
+		VirtualMachines: slices.Clone(set.VirtualMachines),
+		VpcNetworks:     slices.Clone(set.VpcNetworks),
+	}
+}
+
+// SetApplySet replaces the resources of a set, an empty set is removed
+func (am *ApplySetManager) SetApplySet(key string, set ApplySet) error {
+	am.mu.Lock()
+	defer am.mu.Unlock()
+	previous, existed := am.sets[key]
+	if set.Empty() {
+		delete(am.sets, key)
+	} else {
+		am.sets[key] = set
+	}
+	err := am.storage.WriteSnapshot(am.snapshotPath, am.sets)
+	if err != nil {
+		if existed {
+			am.sets[key] = previous
+		} else {
+			delete(am.sets, key)
+		}
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,141 @@
+package vmm
+
+import (
+	"errors"
+	"testing"
+	virtualmachine "vmm/virtual_machine"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+const applyTenant = "11111111-2222-3333-4444-555555555555"
+
+const applyFile = `
+kind: VpcNetwork
+network: 10.0.1.7/24
+---
+kind: VirtualMachine
+name: web
+labels:
+  tier: front
+hypervisor_config:
+  cpus: 2
+  memory: 536870912
+  vpc:
+    - addresses: [10.0.1.10]
+      mask: 255.255.255.0
+---
+`
+
+func Test_ParseApplyDocuments(t *testing.T) {
+	resources, err := ParseApplyDocuments([]byte(applyFile), applyTenant)
+	assert.Nil(t, err)
+	assert.Len(t, resources, 2, "Empty documents are skipped")
+	assert.Equal(t, KIND_VPC_NETWORK, resources[0].Kind)
+	assert.Equal(t, "10.0.1.0/24", resources[0].Name, "The network is masked")
+	assert.Equal(t, applyTenant, resources[1].Tenant.String(), "Documents without tenant belong to the tenant of the apply")
+	assert.Equal(t, 2, resources[1].Manifest.Config.Cpus)
+	assert.Equal(t, "front", resources[1].Manifest.Labels["tier"])
+
+	_, err = ParseApplyDocuments([]byte(applyFile), "")
+	var errInvalid *ErrInvalidApply
+	assert.True(t, errors.As(err, &errInvalid))
+	assert.Len(t, errInvalid.Problems, 2, "Every document without tenant is reported")
+
+	invalid := `
+kind: VirtualMachine
+name: Web
+hypervisor_config: {}
+---
+kind: VirtualMachine
+tenant: 99999999-2222-3333-4444-555555555555
+name: db
+hypervisor_config: {}
+---
+kind: VpcNetwork
+network: 10.0.1.0/24
+---
+kind: VpcNetwork
+network: 10.0.1.0/24
+---
+kind: Volume
+---
+kind: VirtualMachine
+name: cache
+hypervisor_config:
+  cpu: 2
+`
+	_, err = ParseApplyDocuments([]byte(invalid), applyTenant)
+	assert.True(t, errors.As(err, &errInvalid))
+	assert.Len(t, errInvalid.Problems, 5)
+	assert.Contains(t, errInvalid.Problems[0], "document 1: invalid name")
+	assert.Contains(t, errInvalid.Problems[1], "not the tenant of the apply")
+	assert.Contains(t, errInvalid.Problems[2], "already declared in document 3")
+	assert.Contains(t, errInvalid.Problems[3], "unknown kind")
+	assert.Contains(t, errInvalid.Problems[4], "document 6", "Unknown fields are rejected")
+}
+
+func Test_planApply(t *testing.T) {
+	tenant := uuid.MustParse(applyTenant)
+	web := &virtualmachine.Manifest{
+		GuestIdentifier: uuid.New(),
+		Tenant:          tenant,
+		Name:            "web",
+		Labels:          map[string]string{"tier": "front"},
+		Config: virtualmachine.Config{Cpus: 1, Memory: 536870912, Vpc: []virtualmachine.VpcNet{
+			{Addresses: []string{"10.0.1.10"}, Mask: "255.255.255.0", Bridge: "vpcbr0"},
+		}},
+	}
+	old := &virtualmachine.Manifest{GuestIdentifier: uuid.New(), Tenant: tenant, Name: "old"}
+	unmanaged := &virtualmachine.Manifest{GuestIdentifier: uuid.New(), Tenant: tenant, Name: "unmanaged"}
+	state := applyState{
+		virtualMachines: []*virtualmachine.Manifest{web, old, unmanaged},
+		vpcNetworks: []VpcNetwork{
+			{Tenant: applyTenant, Network: "10.0.1.0/24", Bridge: "vpcbr0"},
+			{Tenant: applyTenant, Network: "10.0.2.0/24", Bridge: "vpcbr1"},
+		},
+		managed: ApplySet{
+			VirtualMachines: []string{web.GuestIdentifier.String(), old.GuestIdentifier.String()},
+			VpcNetworks:     []string{applyTenant + "/10.0.1.0/24", applyTenant + "/10.0.2.0/24"},
+		},
+	}
+	resources, err := ParseApplyDocuments([]byte(applyFile+"kind: VpcNetwork\nnetwork: 10.0.3.0/24\n"), applyTenant)
+	assert.Nil(t, err)
+
+	actions, unchanged, err := planApply(resources, state, false)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, unchanged, "The existing network is unchanged")
+	assert.Len(t, actions, 2)
+	assert.Equal(t, APPLY_CREATE, actions[0].Action, "Networks are created first")
+	assert.Equal(t, "10.0.3.0/24", actions[0].Name)
+	assert.Equal(t, APPLY_UPDATE, actions[1].Action)
+	assert.Equal(t, web.GuestIdentifier.String(), actions[1].Id)
+	assert.Len(t, actions[1].Changes, 1, "The bridge assigned by the monitor is not a change")
+	assert.Equal(t, "hypervisor_config.cpus", actions[1].Changes[0].Field)
+
+	actions, _, err = planApply(resources, state, true)
+	assert.Nil(t, err)
+	assert.Len(t, actions, 4)
+	assert.Equal(t, APPLY_DELETE, actions[2].Action)
+	assert.Equal(t, old.GuestIdentifier.String(), actions[2].Id, "Only managed virtual machines are pruned")
+	assert.Equal(t, APPLY_DELETE, actions[3].Action)
+	assert.Equal(t, "10.0.2.0/24", actions[3].Name, "Networks are deleted last")
+
+	resources[1].Manifest.Config.Cpus = 1
+	resources[1].Manifest.Config.Vpc = nil
+	actions, unchanged, err = planApply(resources[1:2], state, true)
+	assert.Nil(t, err)
+	assert.Equal(t, 0, unchanged)
+	assert.Len(t, actions, 4, "A network dropped with its last user is pruned")
+	assert.Equal(t, KIND_VIRTUAL_MACHINE, actions[0].Kind)
+	assert.Equal(t, "hypervisor_config.vpc.0.addresses.0", actions[0].Changes[0].Field)
+}
+
+func Test_metadataPatch(t *testing.T) {
+	patch := metadataPatch(map[string]string{"keep": "a", "change": "b", "drop": "c"}, map[string]string{"keep": "a", "change": "d", "add": "e"})
+	assert.Len(t, patch, 3)
+	assert.Nil(t, patch["drop"])
+	assert.Equal(t, "d", *patch["change"])
+	assert.Equal(t, "e", *patch["add"])
+}
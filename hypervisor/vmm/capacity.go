@@ -0,0 +1,177 @@
+package vmm
+
+import (
+	"fmt"
+	"runtime"
+	virtualmachine "vmm/virtual_machine"
+
+	"golang.org/x/sys/unix"
+)
+
+// Cloud-hypervisor defaults used when the manifest leaves cpus or memory empty
+const (
+	defaultGuestCpus   int64 = 1
+	defaultGuestMemory int64 = 512 * 1024 * 1024
+)
+
+type Resources struct {
+	Cpus   int64 `json:"cpus" yaml:"cpus"`
+	Memory int64 `json:"memory" yaml:"memory"`
+}
+
+func (r Resources) Add(other Resources) Resources {
+	return Resources{Cpus: r.Cpus + other.Cpus, Memory: r.Memory + other.Memory}
+}
+
+func (r Resources) Sub(other Resources) Resources {
+	return Resources{Cpus: r.Cpus - other.Cpus, Memory: r.Memory - other.Memory}
+}
+
+func GuestResources(config virtualmachine.Config) Resources {
+	res := Resources{Cpus: int64(config.Cpus), Memory: config.Memory}
+	if res.Cpus <= 0 {
+		res.Cpus = defaultGuestCpus
+	}
+	if res.Memory <= 0 {
+		res.Memory = defaultGuestMemory
+	}
+	return res
+}
+
+func DiscoverHostResources() (Resources, error) {
+	var info unix.Sysinfo_t
+	err := unix.Sysinfo(&info)
+	if err != nil {
+		return Resources{}, err
+	}
+	return Resources{
+		Cpus:   int64(runtime.NumCPU()),
+		Memory: int64(info.Totalram) * int64(info.Unit),
+	}, nil
+}
+
+// Factors below 1 would make the host smaller than it is, they are treated as no overcommit
+func AllocatableResources(host Resources, cpuOvercommitFactor float32, memoryOvercommitFactor float32) Resources {
+	if cpuOvercommitFactor < 1 {
+		cpuOvercommitFactor = 1
+	}
+	if memoryOvercommitFactor < 1 {
+		memoryOvercommitFactor = 1
+	}
+	return Resources{
+		Cpus:   int64(float64(host.Cpus) * float64(cpuOvercommitFactor)),
+		Memory: int64(float64(host.Memory) * float64(memoryOvercommitFactor)),
+	}
+}
+
+type ErrInsufficientCapacity struct {
+	Resource  string
+	Requested int64
+	Available int64
+}
+
+func (err *ErrInsufficientCapacity) Error() string {
+	return fmt.Sprintf("insufficient host capacity: requested %d %s, available %d", err.Requested, err.Resource, err.Available)
+}
+
+func checkCapacity(available Resources, requested Resources) error {
+	if requested.Cpus > available.Cpus {
+		return &ErrInsufficientCapacity{Resource: "cpus", Requested: requested.Cpus, Available: available.Cpus}
+	}
+	if requested.Memory > available.Memory {
+		return &ErrInsufficientCapacity{Resource: "memory bytes", Requested: requested.Memory, Available: available.Memory}
+	}
+	return nil
+}
+
+type TenantUsage struct {
+	VirtualMachines int       `json:"virtual_machines" yaml:"virtual_machines"`
+	Allocated       Resources `json:"allocated" yaml:"allocated"`
+	Reserved        Resources `json:"reserved" yaml:"reserved"`
+}
+
+// Allocated counts guests holding host resources (starting, running, paused, stopping),
+// reserved counts every defined guest
+type CapacityReport struct {
+	Host        Resources               `json:"host" yaml:"host"`
+	Allocatable Resources               `json:"allocatable" yaml:"allocatable"`
+	Allocated   Resources               `json:"allocated" yaml:"allocated"`
+	Free        Resources               `json:"free" yaml:"free"`
+	Reserved    Resources               `json:"reserved" yaml:"reserved"`
+	Tenants     map[string]*TenantUsage `json:"tenants" yaml:"tenants"`
+}
+
+func (hm *HypervisorMonitor) GetCapacity() CapacityReport {
+	hm.admissionMu.Lock()
+	defer hm.admissionMu.Unlock()
+	return hm.capacityLocked()
+}
+
+// Caller must hold admissionMu
+func (hm *HypervisorMonitor) capacityLocked() CapacityReport {
+	hm.vmsMu.Lock()
+	var vms []*virtualmachine.VirtualMachine = make([]*virtualmachine.VirtualMachine, 0, len(hm.virtualMachines))
+	for _, vm := range hm.virtualMachines {
+		vms = append(vms, vm)
+	}
+	hm.vmsMu.Unlock()
+
+	report := CapacityReport{
+		Host:        hm.hostResources,
+		Allocatable: AllocatableResources(hm.hostResources, hm.getManifest().CpuOvercommitFactor, hm.getManifest().MemoryOvercommitFactor),
+		Tenants:     make(map[string]*TenantUsage),
+	}
+	for _, vm := range vms {
+		manifest := vm.GetManifest()
+		id := manifest.GuestIdentifier.String()
+		tenant := manifest.Tenant.String()
+		res := GuestResources(manifest.Config)
+		if _, ok := report.Tenants[tenant]; !ok {
+			report.Tenants[tenant] = &TenantUsage{}
+		}
+		usage := report.Tenants[tenant]
+		usage.VirtualMachines += 1
+		usage.Reserved = usage.Reserved.Add(res)
+		report.Reserved = report.Reserved.Add(res)
+		_, pending := hm.pendingBoots[id]
+		if vm.GetStatus().State.IsActive() || pending {
+			usage.Allocated = usage.Allocated.Add(res)
+			report.Allocated = report.Allocated.Add(res)
+		}
+	}
+	report.Free = report.Allocatable.Sub(report.Allocated)
+	return report
+}
+
+// BootVirtualMachine admits the guest against free capacity before booting it.
+// The guest counts as allocated from admission on, so concurrent boots cannot overbook the host
+func (hm *HypervisorMonitor) BootVirtualMachine(ref string) error {
+	vm := hm.GetVirtualMachine(ref)
+	if vm == nil {
+		return &ErrVirtualMachineNotFound{}
+	}
+	manifest := vm.GetManifest()
+	id := manifest.GuestIdentifier.String()
+
+	hm.admissionMu.Lock()
+	if _, ok := hm.pendingBoots[id]; ok {
+		hm.admissionMu.Unlock()
+		return &virtualmachine.ErrInvalidTransition{From: virtualmachine.STARTING, To: virtualmachine.STARTING}
+	}
+	if !vm.GetStatus().State.IsActive() {
+		err := checkCapacity(hm.capacityLocked().Free, GuestResources(manifest.Config))
+		if err != nil {
+			hm.admissionMu.Unlock()
+			return err
+		}
+	}
+	hm.pendingBoots[id] = struct{}{}
+	hm.admissionMu.Unlock()
+
+	defer func() {
+		hm.admissionMu.Lock()
+		delete(hm.pendingBoots, id)
+		hm.admissionMu.Unlock()
+	}()
+	return vm.RequestBoot(hm.GetLaunchOptions())
+}
@@ -0,0 +1,35 @@
+package vmm
+
+import (
+	"testing"
+	virtualmachine "vmm/virtual_machine"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_AllocatableResources(t *testing.T) {
+	host := Resources{Cpus: 8, Memory: 16 * 1024 * 1024 * 1024}
+	res := AllocatableResources(host, 4, 1.5)
+	assert.Equal(t, int64(32), res.Cpus, "Expect cpus multiplied by the overcommit factor")
+	assert.Equal(t, int64(24*1024*1024*1024), res.Memory, "Expect memory multiplied by the overcommit factor")
+	res = AllocatableResources(host, 0, 0.5)
+	assert.Equal(t, host, res, "Expect factors below 1 to be ignored")
+}
+
+func Test_GuestResources(t *testing.T) {
+	res := GuestResources(virtualmachine.Config{})
+	assert.Equal(t, defaultGuestCpus, res.Cpus, "Expect cloud-hypervisor default cpus")
+	assert.Equal(t, defaultGuestMemory, res.Memory, "Expect cloud-hypervisor default memory")
+	res = GuestResources(virtualmachine.Config{Cpus: 4, Memory: 1024})
+	assert.Equal(t, Resources{Cpus: 4, Memory: 1024}, res, "Expect configured resources")
+}
+
+func Test_CheckCapacity(t *testing.T) {
+	free := Resources{Cpus: 4, Memory: 2048}
+	assert.Nil(t, checkCapacity(free, Resources{Cpus: 4, Memory: 2048}), "Expect an exact fit to be admitted")
+	err := checkCapacity(free, Resources{Cpus: 5, Memory: 1024})
+	assert.IsType(t, &ErrInsufficientCapacity{}, err, "Expect too many cpus to be rejected")
+	assert.Equal(t, "cpus", err.(*ErrInsufficientCapacity).Resource, "Expect the failing resource in the error")
+	err = checkCapacity(free, Resources{Cpus: 1, Memory: 4096})
+	assert.IsType(t, &ErrInsufficientCapacity{}, err, "Expect too much memory to be rejected")
+}
@@ -0,0 +1,289 @@
+package vmm
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"vmm/auth"
+
+	"github.com/vishvananda/netlink"
+	"golang.org/x/sys/unix"
+	"gopkg.in/yaml.v3"
+)
+
+// Environment variables override manifest fields, the name is the prefix followed by the
+// path of the field in upper case, e.g. CHMON_SERVER_STORAGE_PATH or CHMON_CPU_OVERCOMMIT_FACTOR.
+// Lists of strings are comma separated, maps and lists of objects can only be set in the file
+const ENV_PREFIX = "CHMON_"
+
+// ErrInvalidManifest lists every problem found in the manifest
+type ErrInvalidManifest struct {
+	Problems []string
+}
+
+func (err *ErrInvalidManifest) Error() string {
+	return fmt.Sprintf("invalid host manifest: %s", strings.Join(err.Problems, "; "))
+}
+
+// LoadManifest reads a json or yaml manifest and applies the environment overrides.
+// The format follows the extension, files with another extension are json when they start with {
+func LoadManifest(path string) (*Manifest, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	manifest, err := decodeManifest(content, filepath.Ext(path))
+	if err != nil {
+		return nil, fmt.Errorf("unable to parse %s: %w", path, err)
+	}
+	problems := applyEnvironment(reflect.ValueOf(manifest).Elem(), ENV_PREFIX, os.LookupEnv)
+	if len(problems) > 0 {
+		return nil, &ErrInvalidManifest{Problems: problems}
+	}
+	manifest.applyDefaults()
+	return manifest, nil
+}
+
+func decodeManifest(content []byte, extension string) (*Manifest, error) {
+	manifest := &Manifest{}
+	var isJson bool
+	switch strings.ToLower(extension) {
+	case ".json":
+		isJson = true
+	case ".yaml", ".yml":
+		isJson = false
+	default:
+		isJson = bytes.HasPrefix(bytes.TrimSpace(content), []byte("{"))
+	}
+	var err error
+	if isJson {
+		err = json.Unmarshal(content, manifest)
+	} else {
+		err = yaml.Unmarshal(content, manifest)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return manifest, nil
+}
+
+func (manifest *Manifest) applyDefaults() {
+	if manifest.CpuOvercommitFactor == 0 {
+		manifest.CpuOvercommitFactor = 1
+	}
+	if manifest.MemoryOvercommitFactor == 0 {
+		manifest.MemoryOvercommitFactor = 1
+	}
+}
+
+// applyEnvironment sets the fields of value found in the environment, the name of a field is its yaml tag
+func applyEnvironment(value reflect.Value, prefix string, lookup func(string) (string, bool)) []string {
+	var problems []string = make([]string, 0)
+	var kind reflect.Type = value.Type()
+	for i := 0; i < kind.NumField(); i++ {
+		tag, _, _ := strings.Cut(kind.Field(i).Tag.Get("yaml"), ",")
+		if tag == "" || tag == "-" {
+			continue
+		}
+		var name string = prefix + strings.ToUpper(tag)
+		var field reflect.Value = value.Field(i)
+		if field.Kind() == reflect.Struct {
+			problems = append(problems, applyEnvironment(field, name+"_", lookup)...)
+			continue
+		}
+		raw, ok := lookup(name)
+		if !ok {
+			continue
+		}
+		err := setField(field, strings.TrimSpace(raw))
+		if err != nil {
+			problems = append(problems, fmt.Sprintf("%s: %s", name, err.Error()))
+		}
+	}
+	return problems
+}
+
+func setField(field reflect.Value, raw string) error {
+	switch field.Kind() {
+	case reflect.String:
+		field.SetString(raw)
+	case reflect.Bool:
+		parsed, err := strconv.ParseBool(raw)
+		if err != nil {
+			return errors.New("must be true or false")
+		}
+		field.SetBool(parsed)
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		parsed, err := strconv.ParseInt(raw, 10, field.Type().Bits())
+		if err != nil {
+			return errors.New("must be an integer")
+		}
+		field.SetInt(parsed)
+	case reflect.Float32, reflect.Float64:
+		parsed, err := strconv.ParseFloat(raw, field.Type().Bits())
+		if err != nil {
+			return errors.New("must be a number")
+		}
+		field.SetFloat(parsed)
+	case reflect.Slice:
+		if field.Type().Elem().Kind() != reflect.String {
+			return errors.New("can only be set in the manifest file")
+		}
+		var items []string = make([]string, 0)
+		for _, item := range strings.Split(raw, ",") {
+			if item = strings.TrimSpace(item); item != "" {
+				items = append(items, item)
+			}
+		}
+		field.Set(reflect.ValueOf(items))
+	default:
+		return errors.New("can only be set in the manifest file")
+	}
+	return nil
+}
+
+// Validate checks every field against the host, all problems are returned together
+func (manifest *Manifest) Validate() error {
+	var problems []string = make([]string, 0)
+	var report = func(format string, args ...any) {
+		problems = append(problems, fmt.Sprintf(format, args...))
+	}
+
+	if manifest.Bridge == "" {
+		report("bridge is required")
+	} else if link, err := netlink.LinkByName(manifest.Bridge); err != nil {
+		report("bridge %s does not exist", manifest.Bridge)
+	} else if link.Type() != "bridge" {
+		report("bridge %s is a %s interface, not a bridge", manifest.Bridge, link.Type())
+	}
+
+	if manifest.HypervisorPath == "" {
+		report("hypervisor_path is required")
+	} else if stat, err := os.Stat(manifest.HypervisorPath); err != nil {
+		report("hypervisor_path %s does not exist", manifest.HypervisorPath)
+	} else if !stat.Mode().IsRegular() || unix.Access(manifest.HypervisorPath, unix.X_OK) != nil {
+		report("hypervisor_path %s is not an executable file", manifest.HypervisorPath)
+	}
+
+	checkWritableFolder("server.storage_path", manifest.Server.StoragePath, report)
+	checkWritableFolder("config_folder_path", manifest.InternalConfigFolderPath, report)
+
+	if manifest.CpuOvercommitFactor < 1 {
+		report("cpu_overcommit_factor must be at least 1, found %g", manifest.CpuOvercommitFactor)
+	}
+	if manifest.MemoryOvercommitFactor < 1 {
+		report("memory_overcommit_factor must be at least 1, found %g", manifest.MemoryOvercommitFactor)
+	}
+
+	switch manifest.LogLevel {
+	case "", "debug", "info", "warn", "error":
+	default:
+		report("log_level must be debug, info, warn or error, found %s", manifest.LogLevel)
+	}
+	if manifest.Logs.MaxSize < 0 {
+		report("logs.max_size must not be negative")
+	}
+	if manifest.Logs.MaxFiles < 0 {
+		report("logs.max_files must not be negative")
+	}
+	if manifest.Events.JournalSize < 0 {
+		report("events.journal_size must not be negative")
+	}
+	for i, tier := range manifest.History.Tiers {
+		if tier.Step < 1 || tier.Retention <= tier.Step {
+			report("history.tiers.%d: step must be at least 1 and shorter than retention", i)
+		}
+	}
+
+	manifest.Server.Tls.validate(report)
+	manifest.Server.UnixSocket.validate(report)
+
+	if len(problems) > 0 {
+		return &ErrInvalidManifest{Problems: problems}
+	}
+	return nil
+}
+
+func checkWritableFolder(name string, path string, report func(format string, args ...any)) {
+	if path == "" {
+		report("%s is required", name)
+		return
+	}
+	stat, err := os.Stat(path)
+	if err != nil {
+		report("%s %s does not exist", name, path)
+		return
+	}
+	if !stat.IsDir() {
+		report("%s %s is not a folder", name, path)
+		return
+	}
+	if unix.Access(path, unix.W_OK|unix.X_OK) != nil {
+		report("%s %s is not writable", name, path)
+	}
+}
+
+func (config TlsConfig) validate(report func(format string, args ...any)) {
+	if config.Enabled() && (config.CertFile == "" || config.KeyFile == "") {
+		report("server.tls requires both cert_file and key_file")
+	}
+	files := []struct {
+		name string
+		path string
+	}{
+		{"server.tls.cert_file", config.CertFile},
+		{"server.tls.key_file", config.KeyFile},
+		{"server.tls.client_ca_file", config.ClientCaFile},
+	}
+	for _, file := range files {
+		if file.path != "" && unix.Access(file.path, unix.R_OK) != nil {
+			report("%s %s is not readable", file.name, file.path)
+		}
+	}
+	if config.ClientCaFile != "" && !config.Enabled() {
+		report("server.tls.client_ca_file requires cert_file and key_file")
+	}
+	if config.RequireClientCert && config.ClientCaFile == "" {
+		report("server.tls.require_client_cert requires client_ca_file")
+	}
+	if len(config.ClientCertScopes) > 0 {
+		if err := auth.ValidateScopes(config.ClientCertScopes); err != nil {
+			report("server.tls.client_cert_scopes: %s", err.Error())
+		}
+	}
+	for name, bindings := range config.ClientCertBindings {
+		if err := auth.ValidateBindings(bindings); err != nil {
+			report("server.tls.client_cert_bindings.%s: %s", name, err.Error())
+		}
+	}
+}
+
+func (config UnixSocketConfig) validate(report func(format string, args ...any)) {
+	if config.Path == "" {
+		if len(config.Peers) > 0 {
+			report("server.unix_socket.peers requires path")
+		}
+		return
+	}
+	checkWritableFolder("server.unix_socket.path folder", filepath.Dir(config.Path), report)
+	if _, err := config.FileMode(); err != nil {
+		report("server.unix_socket.%s", err.Error())
+	}
+	for i, rule := range config.Peers {
+		if rule.Uid == nil && rule.Gid == nil {
+			report("server.unix_socket.peers.%d: uid or gid is required", i)
+		}
+		if err := auth.ValidateScopes(rule.Scopes); err != nil {
+			report("server.unix_socket.peers.%d.scopes: %s", i, err.Error())
+		}
+		if err := auth.ValidateBindings(rule.Bindings); err != nil {
+			report("server.unix_socket.peers.%d.bindings: %s", i, err.Error())
+		}
+	}
+}
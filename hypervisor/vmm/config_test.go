@@ -0,0 +1,94 @@
+package vmm
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_LoadManifest(t *testing.T) {
+	var folder string = t.TempDir()
+	var jsonPath string = filepath.Join(folder, "manifest.json")
+	var yamlPath string = filepath.Join(folder, "manifest.yaml")
+	assert.Nil(t, os.WriteFile(jsonPath, []byte(`{"bridge":"br0","server":{"storage_path":"/var/lib/vmm"},"cpu_overcommit_factor":2}`), 0600))
+	assert.Nil(t, os.WriteFile(yamlPath, []byte("bridge: br0\nserver:\n  storage_path: /var/lib/vmm\ncpu_overcommit_factor: 2\n"), 0600))
+
+	for _, path := range []string{jsonPath, yamlPath} {
+		manifest, err := LoadManifest(path)
+		assert.Nil(t, err)
+		assert.Equal(t, "br0", manifest.Bridge)
+		assert.Equal(t, "/var/lib/vmm", manifest.Server.StoragePath)
+		assert.Equal(t, float32(2), manifest.CpuOvercommitFactor)
+		// Factors default to no overcommit
+		assert.Equal(t, float32(1), manifest.MemoryOvercommitFactor)
+	}
+
+	t.Setenv("CHMON_BRIDGE", "br1")
+	t.Setenv("CHMON_SERVER_STORAGE_PATH", "/srv/vmm")
+	t.Setenv("CHMON_MEMORY_OVERCOMMIT_FACTOR", "1.5")
+	t.Setenv("CHMON_SERVER_TLS_CLIENT_CERT_SCOPES", "vm:read, metrics")
+	manifest, err := LoadManifest(jsonPath)
+	assert.Nil(t, err)
+	assert.Equal(t, "br1", manifest.Bridge)
+	assert.Equal(t, "/srv/vmm", manifest.Server.StoragePath)
+	assert.Equal(t, float32(1.5), manifest.MemoryOvercommitFactor)
+	assert.Equal(t, []string{"vm:read", "metrics"}, manifest.Server.Tls.ClientCertScopes)
+
+	t.Setenv("CHMON_EVENTS_JOURNAL_SIZE", "many")
+	t.Setenv("CHMON_SERVER_TLS_REQUIRE_CLIENT_CERT", "maybe")
+	_, err = LoadManifest(jsonPath)
+	var errInvalid *ErrInvalidManifest
+	assert.True(t, errors.As(err, &errInvalid))
+	assert.Len(t, errInvalid.Problems, 2)
+}
+
+func Test_Manifest_Validate(t *testing.T) {
+	var folder string = t.TempDir()
+	var hypervisor string = filepath.Join(folder, "cloud-hypervisor")
+	assert.Nil(t, os.WriteFile(hypervisor, []byte("#!/bin/sh\n"), 0600))
+
+	var manifest *Manifest = &Manifest{
+		HypervisorPath:           hypervisor,
+		InternalConfigFolderPath: folder,
+		CpuOvercommitFactor:      0.5,
+		MemoryOvercommitFactor:   1,
+		History:                  HistoryConfig{Tiers: []HistoryTier{{Step: 60, Retention: 30}}},
+		Server: Server{
+			StoragePath: filepath.Join(folder, "missing"),
+			Tls:         TlsConfig{RequireClientCert: true, ClientCertScopes: []string{"root"}},
+			UnixSocket: UnixSocketConfig{
+				Path:  filepath.Join(folder, "chmon.sock"),
+				Mode:  "999",
+				Peers: []PeerRule{{Scopes: []string{"vm:read"}}},
+			},
+		},
+	}
+	err := manifest.Validate()
+	var errInvalid *ErrInvalidManifest
+	assert.True(t, errors.As(err, &errInvalid))
+	// Every problem is reported, not only the first one
+	assert.Equal(t, []string{
+		"bridge is required",
+		"hypervisor_path " + hypervisor + " is not an executable file",
+		"server.storage_path " + filepath.Join(folder, "missing") + " does not exist",
+		"cpu_overcommit_factor must be at least 1, found 0.5",
+		"history.tiers.0: step must be at least 1 and shorter than retention",
+		"server.tls.require_client_cert requires client_ca_file",
+		"server.tls.client_cert_scopes: unknown scope root, valid scopes are vm:read, vm:write, upload, events, webhooks, metrics, audit, admin",
+		"server.unix_socket.mode must be octal permissions, found 999",
+		"server.unix_socket.peers.0: uid or gid is required",
+	}, errInvalid.Problems)
+}
+
+func Test_PeerRule_Matches(t *testing.T) {
+	var uid uint32 = 1000
+	var gid uint32 = 0
+	assert.True(t, PeerRule{Uid: &uid}.Matches(1000, 1000))
+	assert.False(t, PeerRule{Uid: &uid}.Matches(1001, 1000))
+	assert.True(t, PeerRule{Gid: &gid}.Matches(1001, 0), "Gid 0 is matched like any other group")
+	assert.False(t, PeerRule{Gid: &gid}.Matches(1001, 1001))
+	assert.False(t, PeerRule{}.Matches(0, 0), "A rule without uid and gid matches nobody")
+}
@@ -0,0 +1,48 @@
+package vmm
+
+import (
+	virtualmachine "vmm/virtual_machine"
+)
+
+func (hm *HypervisorMonitor) ListDisks(ref string) ([]virtualmachine.DiskFile, error) {
+	vm := hm.GetVirtualMachine(ref)
+	if vm == nil {
+		return nil, &ErrVirtualMachineNotFound{}
+	}
+	return vm.ListDisks()
+}
+
+// ResizeDisk grows a disk of a stopped virtual machine, the growth is charged to the tenant quota
+func (hm *HypervisorMonitor) ResizeDisk(ref string, diskName string, size int64) (virtualmachine.DiskFile, error) {
+	vm := hm.GetVirtualMachine(ref)
+	if vm == nil {
+		return virtualmachine.DiskFile{}, &ErrVirtualMachineNotFound{}
+	}
+	disks, err := vm.ListDisks()
+	if err != nil {
+		return virtualmachine.DiskFile{}, err
+	}
+	var current *virtualmachine.DiskFile
+	for i := range disks {
+		if disks[i].Name == diskName {
+			current = &disks[i]
+		}
+	}
+	if current == nil {
+		return virtualmachine.DiskFile{}, &virtualmachine.ErrDiskNotFound{Name: diskName}
+	}
+	hm.admissionMu.Lock()
+	defer hm.admissionMu.Unlock()
+	if size > current.Size {
+		err = hm.checkQuotaLocked(vm.GetManifest().Tenant.String(), QuotaUsage{DiskBytes: size - current.Size})
+		if err != nil {
+			return virtualmachine.DiskFile{}, err
+		}
+	}
+	_, err = vm.ResizeDisk(diskName, size)
+	if err != nil {
+		return virtualmachine.DiskFile{}, err
+	}
+	current.Size = size
+	return *current, nil
+}
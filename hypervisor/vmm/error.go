@@ -0,0 +1,35 @@
+package vmm
+
+import "fmt"
+
+type ErrVirtualMachineNotFound struct{}
+
+func (err *ErrVirtualMachineNotFound) Error() string {
+	return "virtual machine is not found"
+}
+
+type ErrNameConflict struct {
+	Tenant string
+	Name   string
+}
+
+func (err *ErrNameConflict) Error() string {
+	return fmt.Sprintf("name %q is already used in tenant %s", err.Name, err.Tenant)
+}
+
+type ErrOrphanNotFound struct {
+	Pid int
+}
+
+func (err *ErrOrphanNotFound) Error() string {
+	return fmt.Sprintf("no orphan cloud-hypervisor process with pid %d", err.Pid)
+}
+
+// ErrOrphanGone is returned when the process exited or its pid was reused
+type ErrOrphanGone struct {
+	Pid int
+}
+
+func (err *ErrOrphanGone) Error() string {
+	return fmt.Sprintf("orphan cloud-hypervisor process %d is gone", err.Pid)
+}
@@ -0,0 +1,186 @@
+package vmm
+
+import (
+	"os"
+	"time"
+	"vmm/timeseries"
+	virtualmachine "vmm/virtual_machine"
+
+	"go.uber.org/zap"
+)
+
+// historyReading holds the cumulative counters of a guest at one point in time,
+// rates are computed from two consecutive readings of the same process
+type historyReading struct {
+	time       time.Time
+	pid        int
+	cpuSeconds float64
+	rssBytes   int64
+	diskRead   uint64
+	diskWrite  uint64
+	netRx      uint64
+	netTx      uint64
+}
+
+type historyEntry struct {
+	store   *timeseries.Store
+	last    historyReading
+	hasLast bool
+}
+
+// newHistoryReading sums the byte counters of every block and network device.
+// Returns false when the process usage or the counters could not be read
+func newHistoryReading(sample virtualMachineSample, now time.Time) (historyReading, bool) {
+	if sample.usage == nil || sample.counters == nil {
+		return historyReading{}, false
+	}
+	var reading historyReading = historyReading{
+		time:       now,
+		pid:        sample.pid,
+		cpuSeconds: sample.usage.CpuSeconds,
+		rssBytes:   sample.usage.RssBytes,
+	}
+	for _, counters := range sample.counters {
+		reading.diskRead += counters["read_bytes"]
+		reading.diskWrite += counters["write_bytes"]
+		reading.netRx += counters["rx_bytes"]
+		reading.netTx += counters["tx_bytes"]
+	}
+	return reading, true
+}
+
+// historySample returns false when no rate can be computed, i.e. the process was
+// restarted in between or a counter went back because a device was removed
+func historySample(previous historyReading, current historyReading) (timeseries.Sample, bool) {
+	var elapsed float64 = current.time.Sub(previous.time).Seconds()
+	if previous.pid != current.pid || elapsed <= 0 {
+		return timeseries.Sample{}, false
+	}
+	if current.cpuSeconds < previous.cpuSeconds || current.diskRead < previous.diskRead || current.diskWrite < previous.diskWrite ||
+		current.netRx < previous.netRx || current.netTx < previous.netTx {
+		return timeseries.Sample{}, false
+	}
+	return timeseries.Sample{
+		Time:                    current.time,
+		Cpus:                    (current.cpuSeconds - previous.cpuSeconds) / elapsed,
+		MemoryBytes:             float64(current.rssBytes),
+		DiskReadBytesPerSecond:  float64(current.diskRead-previous.diskRead) / elapsed,
+		DiskWriteBytesPerSecond: float64(current.diskWrite-previous.diskWrite) / elapsed,
+		NetRxBytesPerSecond:     float64(current.netRx-previous.netRx) / elapsed,
+		NetTxBytesPerSecond:     float64(current.netTx-previous.netTx) / elapsed,
+	}, true
+}
+
+func (hm *HypervisorMonitor) recordHistory(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-hm.done:
+			return
+		case now := <-ticker.C:
+			hm.sampleHistory(now)
+		}
+	}
+}
+
+// sampleHistory appends a sample for every running guest
+func (hm *HypervisorMonitor) sampleHistory(now time.Time) {
+	var vms []*virtualmachine.VirtualMachine = hm.listVirtualMachines()
+	var samples []virtualMachineSample = hm.sampleVirtualMachines(vms)
+	for i, sample := range samples {
+		id := sample.manifest.GuestIdentifier.String()
+		reading, ok := newHistoryReading(sample, now)
+		hm.historyMu.Lock()
+		if !ok {
+			if entry, found := hm.history[id]; found {
+				entry.hasLast = false
+			}
+			hm.historyMu.Unlock()
+			continue
+		}
+		entry, err := hm.historyEntryLocked(id, vms[i])
+		if err != nil {
+			hm.historyMu.Unlock()
+			hm.logger.Warn("Unable to open vm history", zap.String("vm_id", id), zap.String("error", err.Error()))
+			continue
+		}
+		previous, hasPrevious := entry.last, entry.hasLast
+		entry.last, entry.hasLast = reading, true
+		hm.historyMu.Unlock()
+		if !hasPrevious {
+			continue
+		}
+		point, ok := historySample(previous, reading)
+		if !ok {
+			continue
+		}
+		err = entry.store.Append(point)
+		if err != nil {
+			hm.logger.Warn("Unable to record vm history", zap.String("vm_id", id), zap.String("error", err.Error()))
+		}
+	}
+}
+
+// Caller must hold historyMu.
+// The store folder is created inside the vm folder only, a guest deleted in
+// the meantime is not brought back on disk
+func (hm *HypervisorMonitor) historyEntryLocked(id string, vm *virtualmachine.VirtualMachine) (*historyEntry, error) {
+	if entry, ok := hm.history[id]; ok {
+		return entry, nil
+	}
+	store, err := timeseries.OpenStore(vm.GetMetricsPath(), hm.getManifest().History.Retention())
+	if err != nil {
+		return nil, err
+	}
+	var entry *historyEntry = &historyEntry{store: store}
+	hm.history[id] = entry
+	return entry, nil
+}
+
+func (hm *HypervisorMonitor) closeHistory(id string) {
+	hm.historyMu.Lock()
+	entry, ok := hm.history[id]
+	delete(hm.history, id)
+	hm.historyMu.Unlock()
+	if ok {
+		entry.store.Close()
+	}
+}
+
+// closeAllHistory closes the ring files of every guest
+func (hm *HypervisorMonitor) closeAllHistory() {
+	hm.historyMu.Lock()
+	entries := hm.history
+	hm.history = make(map[string]*historyEntry)
+	hm.historyMu.Unlock()
+	for _, entry := range entries {
+		entry.store.Close()
+	}
+}
+
+// QueryHistory returns the resource usage of a virtual machine between from and to,
+// averaged over step. Guests never sampled have an empty history
+func (hm *HypervisorMonitor) QueryHistory(ref string, from time.Time, to time.Time, step time.Duration) (timeseries.Series, error) {
+	vm := hm.GetVirtualMachine(ref)
+	if vm == nil {
+		return timeseries.Series{}, &ErrVirtualMachineNotFound{}
+	}
+	id := vm.GetManifest().GuestIdentifier.String()
+	hm.historyMu.Lock()
+	entry, ok := hm.history[id]
+	if !ok {
+		if _, err := os.Stat(vm.GetMetricsPath()); os.IsNotExist(err) {
+			hm.historyMu.Unlock()
+			return timeseries.Series{Step: int64(step / time.Second), Points: make([]timeseries.Sample, 0)}, nil
+		}
+		var err error
+		entry, err = hm.historyEntryLocked(id, vm)
+		if err != nil {
+			hm.historyMu.Unlock()
+			return timeseries.Series{}, err
+		}
+	}
+	hm.historyMu.Unlock()
+	return entry.store.Query(from, to, step, time.Now())
+}
@@ -0,0 +1,59 @@
+package vmm
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_NewHistoryReading(t *testing.T) {
+	var now time.Time = time.Unix(1000, 0)
+	_, ok := newHistoryReading(virtualMachineSample{pid: 10}, now)
+	assert.False(t, ok)
+
+	reading, ok := newHistoryReading(virtualMachineSample{
+		pid:   10,
+		usage: &ProcessUsage{CpuSeconds: 4, RssBytes: 1024},
+		counters: map[string]map[string]uint64{
+			"_disk0": {"read_bytes": 100, "write_bytes": 200, "read_ops": 7},
+			"_disk1": {"read_bytes": 50, "write_bytes": 0},
+			"_net2":  {"rx_bytes": 300, "tx_bytes": 400, "rx_frames": 9},
+		},
+	}, now)
+	assert.True(t, ok)
+	assert.Equal(t, uint64(150), reading.diskRead)
+	assert.Equal(t, uint64(200), reading.diskWrite)
+	assert.Equal(t, uint64(300), reading.netRx)
+	assert.Equal(t, uint64(400), reading.netTx)
+	assert.Equal(t, int64(1024), reading.rssBytes)
+}
+
+func Test_HistorySample(t *testing.T) {
+	var previous historyReading = historyReading{time: time.Unix(1000, 0), pid: 10, cpuSeconds: 4, diskRead: 100, diskWrite: 100, netRx: 100, netTx: 100}
+	var current historyReading = historyReading{time: time.Unix(1010, 0), pid: 10, cpuSeconds: 9, rssBytes: 2048, diskRead: 1100, diskWrite: 200, netRx: 600, netTx: 100}
+
+	sample, ok := historySample(previous, current)
+	assert.True(t, ok)
+	assert.Equal(t, 0.5, sample.Cpus)
+	assert.Equal(t, float64(2048), sample.MemoryBytes)
+	assert.Equal(t, float64(100), sample.DiskReadBytesPerSecond)
+	assert.Equal(t, float64(10), sample.DiskWriteBytesPerSecond)
+	assert.Equal(t, float64(50), sample.NetRxBytesPerSecond)
+	assert.Equal(t, float64(0), sample.NetTxBytesPerSecond)
+
+	// A restarted process has new counters
+	restarted := current
+	restarted.pid = 11
+	_, ok = historySample(previous, restarted)
+	assert.False(t, ok)
+
+	// A removed device makes the sum go back
+	reset := current
+	reset.diskRead = 50
+	_, ok = historySample(previous, reset)
+	assert.False(t, ok)
+
+	_, ok = historySample(current, current)
+	assert.False(t, ok)
+}
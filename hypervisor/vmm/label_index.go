@@ -0,0 +1,91 @@
+package vmm
+
+import (
+	virtualmachine "vmm/virtual_machine"
+)
+
+// LabelIndex maps label key and value to the set of virtual machine ids carrying them.
+// It is not safe for concurrent use, the monitor guards it with vmsMu
+type LabelIndex struct {
+	index map[string]map[string]map[string]struct{}
+}
+
+func NewLabelIndex() *LabelIndex {
+	return &LabelIndex{
+		index: make(map[string]map[string]map[string]struct{}),
+	}
+}
+
+func (li *LabelIndex) Add(id string, labels map[string]string) {
+	for key, value := range labels {
+		if _, ok := li.index[key]; !ok {
+			li.index[key] = make(map[string]map[string]struct{})
+		}
+		if _, ok := li.index[key][value]; !ok {
+			li.index[key][value] = make(map[string]struct{})
+		}
+		li.index[key][value][id] = struct{}{}
+	}
+}
+
+func (li *LabelIndex) Remove(id string, labels map[string]string) {
+	for key, value := range labels {
+		values, ok := li.index[key]
+		if !ok {
+			continue
+		}
+		delete(values[value], id)
+		if len(values[value]) == 0 {
+			delete(values, value)
+		}
+		if len(values) == 0 {
+			delete(li.index, key)
+		}
+	}
+}
+
+func (li *LabelIndex) Update(id string, previous map[string]string, current map[string]string) {
+	li.Remove(id, previous)
+	li.Add(id, current)
+}
+
+// Candidates returns the ids that satisfy the equality and existence requirements of the selector.
+// The second value is false when the selector has no indexable requirement and every vm is a candidate.
+// Negative requirements are left to Selector.Matches
+func (li *LabelIndex) Candidates(selector *virtualmachine.Selector) (map[string]struct{}, bool) {
+	var res map[string]struct{} = nil
+	var indexed bool = false
+	for _, req := range selector.Requirements {
+		var ids map[string]struct{}
+		switch req.Operator {
+		case virtualmachine.SELECTOR_EQUALS:
+			ids = li.index[req.Key][req.Value]
+		case virtualmachine.SELECTOR_EXISTS:
+			ids = make(map[string]struct{})
+			for _, set := range li.index[req.Key] {
+				for id := range set {
+					ids[id] = struct{}{}
+				}
+			}
+		default:
+			continue
+		}
+		indexed = true
+		if res == nil {
+			res = make(map[string]struct{}, len(ids))
+			for id := range ids {
+				res[id] = struct{}{}
+			}
+			continue
+		}
+		for id := range res {
+			if _, ok := ids[id]; !ok {
+				delete(res, id)
+			}
+		}
+	}
+	if res == nil {
+		res = make(map[string]struct{})
+	}
+	return res, indexed
+}
@@ -0,0 +1,35 @@
+package vmm
+
+import (
+	"testing"
+	virtualmachine "vmm/virtual_machine"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_LabelIndex_Candidates(t *testing.T) {
+	li := NewLabelIndex()
+	li.Add("a", map[string]string{"env": "prod", "service": "api"})
+	li.Add("b", map[string]string{"env": "prod", "service": "db"})
+	li.Add("c", map[string]string{"env": "staging"})
+
+	selector, _ := virtualmachine.ParseSelector("env=prod,service")
+	candidates, indexed := li.Candidates(selector)
+	assert.True(t, indexed, "Expect equality requirements to use the index")
+	assert.Equal(t, map[string]struct{}{"a": {}, "b": {}}, candidates, "Expect vms with env=prod and a service")
+
+	li.Update("b", map[string]string{"env": "prod", "service": "db"}, map[string]string{"env": "staging"})
+	candidates, _ = li.Candidates(selector)
+	assert.Equal(t, map[string]struct{}{"a": {}}, candidates, "Expect updated labels to be reindexed")
+
+	selector, _ = virtualmachine.ParseSelector("!legacy")
+	_, indexed = li.Candidates(selector)
+	assert.False(t, indexed, "Expect negative requirements to scan every vm")
+}
+
+func Test_LabelIndex_Remove(t *testing.T) {
+	li := NewLabelIndex()
+	li.Add("a", map[string]string{"env": "prod"})
+	li.Remove("a", map[string]string{"env": "prod"})
+	assert.Equal(t, 0, len(li.index), "Expect empty index after removal")
+}
@@ -0,0 +1,243 @@
+package vmm
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+	virtualmachine "vmm/virtual_machine"
+)
+
+const (
+	DefaultListLimit = 50
+	MaxListLimit     = 500
+)
+
+const (
+	SORT_CREATED_AT = "created_at"
+	SORT_ID         = "id"
+	SORT_NAME       = "name"
+	SORT_TENANT     = "tenant"
+	SORT_STATE      = "state"
+	SORT_CPUS       = "cpus"
+	SORT_MEMORY     = "memory"
+)
+
+type NicSummary struct {
+	Type      string   `json:"type" yaml:"type"`
+	Addresses []string `json:"addresses" yaml:"addresses"`
+	Mac       string   `json:"mac" yaml:"mac"`
+	Bridge    string   `json:"bridge,omitempty" yaml:"bridge,omitempty"`
+}
+
+type VirtualMachineSummary struct {
+	Id        string                `json:"id" yaml:"id"`
+	Tenant    string                `json:"tenant" yaml:"tenant"`
+	Name      string                `json:"name,omitempty" yaml:"name,omitempty"`
+	Status    virtualmachine.Status `json:"status" yaml:"status"`
+	Cpus      int                   `json:"cpus" yaml:"cpus"`
+	Memory    int64                 `json:"memory" yaml:"memory"`
+	Disks     []string              `json:"disks" yaml:"disks"`
+	Nics      []NicSummary          `json:"nics" yaml:"nics"`
+	Labels    map[string]string     `json:"labels,omitempty" yaml:"labels,omitempty"`
+	CreatedAt time.Time             `json:"created_at" yaml:"created_at"`
+}
+
+type ListOptions struct {
+	Tenant     string
+	States     []virtualmachine.State
+	Selector   *virtualmachine.Selector
+	SortBy     string
+	Descending bool
+	Limit      int
+	Cursor     string
+}
+
+type ListPage struct {
+	Items      []VirtualMachineSummary `json:"items" yaml:"items"`
+	NextCursor string                  `json:"next_cursor,omitempty" yaml:"next_cursor,omitempty"`
+}
+
+// The cursor points to the last returned item, so pages stay stable
+// when virtual machines are created or deleted between two requests
+type listCursor struct {
+	Key string `json:"k"`
+	Id  string `json:"id"`
+}
+
+func NewVirtualMachineSummary(manifest *virtualmachine.Manifest, status virtualmachine.Status) VirtualMachineSummary {
+	summary := VirtualMachineSummary{
+		Id:        manifest.GuestIdentifier.String(),
+		Tenant:    manifest.Tenant.String(),
+		Name:      manifest.Name,
+		Status:    status,
+		Cpus:      manifest.Config.Cpus,
+		Memory:    manifest.Config.Memory,
+		Disks:     make([]string, 0, len(manifest.Config.Disks)),
+		Nics:      make([]NicSummary, 0, len(manifest.Config.Vpc)+1),
+		Labels:    manifest.Labels,
+		CreatedAt: manifest.CreatedAt,
+	}
+	for _, disk := range manifest.Config.Disks {
+		summary.Disks = append(summary.Disks, disk.Name)
+	}
+	if len(manifest.Config.Network.Addresses) > 0 {
+		summary.Nics = append(summary.Nics, NicSummary{
+			Type:      "public",
+			Addresses: manifest.Config.Network.Addresses,
+			Mac:       manifest.Config.Network.Mac,
+		})
+	}
+	for _, vpc := range manifest.Config.Vpc {
+		summary.Nics = append(summary.Nics, NicSummary{
+			Type:      "vpc",
+			Addresses: vpc.Addresses,
+			Mac:       vpc.Mac,
+			Bridge:    vpc.Bridge,
+		})
+	}
+	return summary
+}
+
+func (opts *ListOptions) Validate() error {
+	if opts.SortBy == "" {
+		opts.SortBy = SORT_CREATED_AT
+	}
+	switch opts.SortBy {
+	case SORT_CREATED_AT, SORT_ID, SORT_NAME, SORT_TENANT, SORT_STATE, SORT_CPUS, SORT_MEMORY:
+	default:
+		return fmt.Errorf("unknown sort field %q", opts.SortBy)
+	}
+	if opts.Limit <= 0 {
+		opts.Limit = DefaultListLimit
+	}
+	if opts.Limit > MaxListLimit {
+		opts.Limit = MaxListLimit
+	}
+	return nil
+}
+
+func (opts *ListOptions) matches(summary *VirtualMachineSummary) bool {
+	if opts.Tenant != "" && !strings.EqualFold(opts.Tenant, summary.Tenant) {
+		return false
+	}
+	if !opts.Selector.Matches(summary.Labels) {
+		return false
+	}
+	if len(opts.States) == 0 {
+		return true
+	}
+	for _, state := range opts.States {
+		if summary.Status.State == state {
+			return true
+		}
+	}
+	return false
+}
+
+// Sort keys are encoded as strings that compare in the same order as the original values
+func sortKey(summary *VirtualMachineSummary, sortBy string) string {
+	switch sortBy {
+	case SORT_ID:
+		return summary.Id
+	case SORT_NAME:
+		return summary.Name
+	case SORT_TENANT:
+		return summary.Tenant
+	case SORT_STATE:
+		return string(summary.Status.State)
+	case SORT_CPUS:
+		return fmt.Sprintf("%020d", summary.Cpus)
+	case SORT_MEMORY:
+		return fmt.Sprintf("%020d", summary.Memory)
+	default:
+		return summary.CreatedAt.UTC().Format("2006-01-02T15:04:05.000000000Z")
+	}
+}
+
+func encodeCursor(cursor listCursor) string {
+	content, _ := json.Marshal(cursor)
+	return base64.RawURLEncoding.EncodeToString(content)
+}
+
+func decodeCursor(encoded string) (*listCursor, error) {
+	content, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return nil, errors.New("malformed cursor")
+	}
+	var cursor *listCursor = &listCursor{}
+	err = json.Unmarshal(content, cursor)
+	if err != nil {
+		return nil, errors.New("malformed cursor")
+	}
+	return cursor, nil
+}
+
+// paginate filters, sorts and cuts a page out of the given summaries
+func paginate(summaries []VirtualMachineSummary, opts ListOptions) (ListPage, error) {
+	type entry struct {
+		key     string
+		summary VirtualMachineSummary
+	}
+	var err error
+	var after *listCursor = nil
+	if opts.Cursor != "" {
+		after, err = decodeCursor(opts.Cursor)
+		if err != nil {
+			return ListPage{}, err
+		}
+	}
+	var less = func(aKey string, aId string, bKey string, bId string) bool {
+		if aKey != bKey {
+			return (aKey < bKey) != opts.Descending
+		}
+		return (aId < bId) != opts.Descending
+	}
+	entries := make([]entry, 0, len(summaries))
+	for i := range summaries {
+		if !opts.matches(&summaries[i]) {
+			continue
+		}
+		key := sortKey(&summaries[i], opts.SortBy)
+		if after != nil && !less(after.Key, after.Id, key, summaries[i].Id) {
+			continue
+		}
+		entries = append(entries, entry{key: key, summary: summaries[i]})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return less(entries[i].key, entries[i].summary.Id, entries[j].key, entries[j].summary.Id)
+	})
+	page := ListPage{
+		Items: make([]VirtualMachineSummary, 0, opts.Limit),
+	}
+	for i := 0; i < len(entries) && i < opts.Limit; i++ {
+		page.Items = append(page.Items, entries[i].summary)
+	}
+	if len(entries) > opts.Limit {
+		last := entries[opts.Limit-1]
+		page.NextCursor = encodeCursor(listCursor{Key: last.key, Id: last.summary.Id})
+	}
+	return page, nil
+}
+
+// ListVirtualMachines returns a page of virtual machines.
+// Membership is read in a single critical section, so a page never
+// contains a half created or an already removed virtual machine
+func (hm *HypervisorMonitor) ListVirtualMachines(opts ListOptions) (ListPage, error) {
+	err := opts.Validate()
+	if err != nil {
+		return ListPage{}, err
+	}
+	hm.vmsMu.Lock()
+	var vms []*virtualmachine.VirtualMachine = hm.selectLocked(opts.Selector)
+	hm.vmsMu.Unlock()
+
+	summaries := make([]VirtualMachineSummary, 0, len(vms))
+	for _, vm := range vms {
+		summaries = append(summaries, NewVirtualMachineSummary(vm.GetManifest(), vm.GetStatus()))
+	}
+	return paginate(summaries, opts)
+}
@@ -0,0 +1,70 @@
+package vmm
+
+import (
+	"testing"
+	"time"
+	virtualmachine "vmm/virtual_machine"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func mockSummaries() []VirtualMachineSummary {
+	base := time.Date(2025, 1, 1, 0, 0, 0, 0, time.UTC)
+	return []VirtualMachineSummary{
+		{Id: "a", Tenant: "t1", Cpus: 4, Status: virtualmachine.Status{State: virtualmachine.RUNNING}, CreatedAt: base.Add(3 * time.Hour)},
+		{Id: "b", Tenant: "t2", Cpus: 2, Status: virtualmachine.Status{State: virtualmachine.STOPPED}, CreatedAt: base.Add(1 * time.Hour)},
+		{Id: "c", Tenant: "t1", Cpus: 16, Status: virtualmachine.Status{State: virtualmachine.RUNNING}, CreatedAt: base.Add(2 * time.Hour)},
+		{Id: "d", Tenant: "t1", Cpus: 2, Status: virtualmachine.Status{State: virtualmachine.CRASHED}, CreatedAt: base.Add(4 * time.Hour)},
+	}
+}
+
+func ids(page ListPage) []string {
+	res := []string{}
+	for _, item := range page.Items {
+		res = append(res, item.Id)
+	}
+	return res
+}
+
+func Test_Paginate_Filter(t *testing.T) {
+	opts := ListOptions{Tenant: "t1", States: []virtualmachine.State{virtualmachine.RUNNING}}
+	assert.Nil(t, opts.Validate(), "No errors expected with default options")
+	page, err := paginate(mockSummaries(), opts)
+	assert.Nil(t, err, "No errors expected in paginate")
+	assert.Equal(t, []string{"c", "a"}, ids(page), "Expect running vms of tenant t1 sorted by creation time")
+	assert.Equal(t, "", page.NextCursor, "Expect no cursor on last page")
+}
+
+func Test_Paginate_Sort(t *testing.T) {
+	opts := ListOptions{SortBy: SORT_CPUS, Descending: true}
+	assert.Nil(t, opts.Validate(), "No errors expected with a known sort field")
+	page, err := paginate(mockSummaries(), opts)
+	assert.Nil(t, err, "No errors expected in paginate")
+	assert.Equal(t, []string{"c", "a", "d", "b"}, ids(page), "Expect numeric sort with id as tie breaker")
+
+	opts = ListOptions{SortBy: "name_of_the_vm"}
+	assert.NotNil(t, opts.Validate(), "Expect unknown sort field to be rejected")
+}
+
+func Test_Paginate_Cursor(t *testing.T) {
+	summaries := mockSummaries()
+	opts := ListOptions{Limit: 2}
+	assert.Nil(t, opts.Validate(), "No errors expected with default options")
+	page, err := paginate(summaries, opts)
+	assert.Nil(t, err, "No errors expected in paginate")
+	assert.Equal(t, []string{"b", "c"}, ids(page), "Expect first page")
+	assert.NotEqual(t, "", page.NextCursor, "Expect a cursor for the next page")
+
+	// A vm created before the cursor and the removal of an already returned one must not shift the next page
+	created := VirtualMachineSummary{Id: "e", CreatedAt: summaries[1].CreatedAt.Add(-time.Hour)}
+	summaries = []VirtualMachineSummary{summaries[0], summaries[2], summaries[3], created}
+	opts.Cursor = page.NextCursor
+	page, err = paginate(summaries, opts)
+	assert.Nil(t, err, "No errors expected in paginate")
+	assert.Equal(t, []string{"a", "d"}, ids(page), "Expect second page")
+	assert.Equal(t, "", page.NextCursor, "Expect no cursor on last page")
+
+	opts.Cursor = "not a cursor"
+	_, err = paginate(summaries, opts)
+	assert.NotNil(t, err, "Expect malformed cursor to be rejected")
+}
@@ -1,34 +1,190 @@
 package vmm
 
 import (
-	"encoding/json"
+	"fmt"
 	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+	"vmm/auth"
+	cloudhypervisor "vmm/cloud_hypervisor"
+	"vmm/timeseries"
+
+	"go.uber.org/zap/zapcore"
 )
 
 type Manifest struct {
-	Bridge                   string `json:"bridge" yaml:"bridge"`
-	Server                   Server `json:"server" yaml:"server"`
-	HypervisorPath           string `json:"hypervisor_path" yaml:"hypervisor_path"`
-	HypervisorSocketUri      string `json:"socket_uri" yaml:"socket_uri"`
-	InternalConfigFolderPath string `json:"config_folder_path" yaml:"config_folder_path"`
-	CpuOvercommitFactor      float32
-	MemoryOvercommitFactor   float32
+	Bridge                   string  `json:"bridge" yaml:"bridge"`
+	Server                   Server  `json:"server" yaml:"server"`
+	HypervisorPath           string  `json:"hypervisor_path" yaml:"hypervisor_path"`
+	HypervisorSocketUri      string  `json:"socket_uri" yaml:"socket_uri"`
+	InternalConfigFolderPath string  `json:"config_folder_path" yaml:"config_folder_path"`
+	CpuOvercommitFactor      float32 `json:"cpu_overcommit_factor" yaml:"cpu_overcommit_factor"`
+	MemoryOvercommitFactor   float32 `json:"memory_overcommit_factor" yaml:"memory_overcommit_factor"`
+	// One of debug, info, warn or error, empty is info
+	LogLevel string        `json:"log_level" yaml:"log_level"`
+	Stop     StopConfig    `json:"stop" yaml:"stop"`
+	Logs     LogConfig     `json:"logs" yaml:"logs"`
+	Events   EventsConfig  `json:"events" yaml:"events"`
+	History  HistoryConfig `json:"history" yaml:"history"`
+}
+
+func (manifest *Manifest) Level() zapcore.Level {
+	level, err := zapcore.ParseLevel(manifest.LogLevel)
+	if err != nil {
+		return zapcore.InfoLevel
+	}
+	return level
+}
+
+// Sampling of the per vm resource usage history, in seconds.
+// Zero values use the defaults, a negative interval disables sampling
+type HistoryConfig struct {
+	Interval int           `json:"interval" yaml:"interval"`
+	Tiers    []HistoryTier `json:"tiers" yaml:"tiers"`
+}
+
+type HistoryTier struct {
+	Step      int `json:"step" yaml:"step"`
+	Retention int `json:"retention" yaml:"retention"`
+}
+
+func (config HistoryConfig) SampleInterval() time.Duration {
+	if config.Interval == 0 {
+		return 10 * time.Second
+	}
+	if config.Interval < 0 {
+		return 0
+	}
+	return time.Duration(config.Interval) * time.Second
+}
+
+func (config HistoryConfig) Retention() []timeseries.Tier {
+	if len(config.Tiers) == 0 {
+		return timeseries.DefaultTiers
+	}
+	var tiers []timeseries.Tier = make([]timeseries.Tier, 0, len(config.Tiers))
+	for _, tier := range config.Tiers {
+		tiers = append(tiers, timeseries.Tier{
+			Step:      time.Duration(tier.Step) * time.Second,
+			Retention: time.Duration(tier.Retention) * time.Second,
+		})
+	}
+	return tiers
+}
+
+// Size of the event journal segments, zero uses the default
+type EventsConfig struct {
+	JournalSize int `json:"journal_size" yaml:"journal_size"`
+}
+
+// Rotation of the per vm log files, zero values use the defaults
+type LogConfig struct {
+	MaxSize  int64 `json:"max_size" yaml:"max_size"`
+	MaxFiles int   `json:"max_files" yaml:"max_files"`
+}
+
+func (config LogConfig) Rotation() cloudhypervisor.LogRotation {
+	var rotation cloudhypervisor.LogRotation = cloudhypervisor.LogRotation{
+		MaxSize:  config.MaxSize,
+		MaxFiles: config.MaxFiles,
+	}
+	if rotation.MaxSize <= 0 {
+		rotation.MaxSize = 10 * 1024 * 1024
+	}
+	if rotation.MaxFiles <= 0 {
+		rotation.MaxFiles = 5
+	}
+	return rotation
+}
+
+// Timeouts of the graceful stop in seconds. Zero uses the default, a negative value skips the step
+type StopConfig struct {
+	PowerButtonTimeout int `json:"power_button_timeout" yaml:"power_button_timeout"`
+	ShutdownTimeout    int `json:"shutdown_timeout" yaml:"shutdown_timeout"`
+	TerminateTimeout   int `json:"terminate_timeout" yaml:"terminate_timeout"`
+	KillTimeout        int `json:"kill_timeout" yaml:"kill_timeout"`
+}
+
+func stopTimeout(seconds int, defaultTimeout time.Duration) time.Duration {
+	if seconds == 0 {
+		return defaultTimeout
+	}
+	if seconds < 0 {
+		return 0
+	}
+	return time.Duration(seconds) * time.Second
+}
+
+func (config StopConfig) Timeouts() cloudhypervisor.StopTimeouts {
+	return cloudhypervisor.StopTimeouts{
+		PowerButton: stopTimeout(config.PowerButtonTimeout, 60*time.Second),
+		Shutdown:    stopTimeout(config.ShutdownTimeout, 10*time.Second),
+		Terminate:   stopTimeout(config.TerminateTimeout, 10*time.Second),
+		Kill:        stopTimeout(config.KillTimeout, 5*time.Second),
+	}
 }
 
 type Server struct {
-	StoragePath string `json:"storage_path" yaml:"storage_path"`
+	StoragePath string           `json:"storage_path" yaml:"storage_path"`
+	Tls         TlsConfig        `json:"tls" yaml:"tls"`
+	UnixSocket  UnixSocketConfig `json:"unix_socket" yaml:"unix_socket"`
 }
 
-func LoadManifest(path string) (*Manifest, error) {
-	manifest := &Manifest{}
+// Api served on a local unix socket when Path is set, without tls. Callers without a token
+// are authenticated by the uid and gid of their process, every matching rule grants its roles
+type UnixSocketConfig struct {
+	Path string `json:"path" yaml:"path"`
+	// Octal permissions of the socket file, empty is 0660
+	Mode  string     `json:"mode" yaml:"mode"`
+	Peers []PeerRule `json:"peers" yaml:"peers"`
+}
 
-	fileByte, err := os.ReadFile(path)
-	if err != nil {
-		return nil, err
+// PeerRule matches processes running as Uid or with Gid as primary group
+type PeerRule struct {
+	Uid      *uint32        `json:"uid" yaml:"uid"`
+	Gid      *uint32        `json:"gid" yaml:"gid"`
+	Scopes   []string       `json:"scopes" yaml:"scopes"`
+	Bindings []auth.Binding `json:"bindings" yaml:"bindings"`
+}
+
+func (rule PeerRule) Matches(uid uint32, gid uint32) bool {
+	return (rule.Uid != nil && *rule.Uid == uid) || (rule.Gid != nil && *rule.Gid == gid)
+}
+
+func (config UnixSocketConfig) FileMode() (os.FileMode, error) {
+	if config.Mode == "" {
+		return 0660, nil
 	}
-	err = json.Unmarshal(fileByte, manifest)
-	if err != nil { 
-		return nil, err
+	mode, err := strconv.ParseUint(config.Mode, 8, 32)
+	if err != nil || mode > 0777 {
+		return 0, fmt.Errorf("mode must be octal permissions, found %s", config.Mode)
 	}
-	return manifest, nil
+	return os.FileMode(mode), nil
+}
+
+// Api is served over https when CertFile and KeyFile are set. Clients presenting a certificate
+// signed by ClientCaFile are authenticated with ClientCertScopes, without scopes they still need a token.
+// ClientCertBindings grants tenant roles to certificates by common name
+type TlsConfig struct {
+	CertFile           string                    `json:"cert_file" yaml:"cert_file"`
+	KeyFile            string                    `json:"key_file" yaml:"key_file"`
+	ClientCaFile       string                    `json:"client_ca_file" yaml:"client_ca_file"`
+	RequireClientCert  bool                      `json:"require_client_cert" yaml:"require_client_cert"`
+	ClientCertScopes   []string                  `json:"client_cert_scopes" yaml:"client_cert_scopes"`
+	ClientCertBindings map[string][]auth.Binding `json:"client_cert_bindings" yaml:"client_cert_bindings"`
+}
+
+func (config TlsConfig) Enabled() bool {
+	return config.CertFile != "" || config.KeyFile != ""
+}
+
+// TokensFilePath is the snapshot of the api tokens, shared by the server and the admin command
+func (manifest *Manifest) TokensFilePath() string {
+	return filepath.Join(manifest.InternalConfigFolderPath, "tokens.snapshot")
+}
+
+// AuditLogFilePath is the audit log of api requests, checked by the verify command
+func (manifest *Manifest) AuditLogFilePath() string {
+	return filepath.Join(manifest.InternalConfigFolderPath, "audit.log")
 }
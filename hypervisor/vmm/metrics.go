@@ -0,0 +1,202 @@
+package vmm
+
+import (
+	"os"
+	"runtime"
+	"sort"
+	"sync"
+	"vmm/metrics"
+	virtualmachine "vmm/virtual_machine"
+
+	"go.uber.org/zap"
+)
+
+const (
+	UPLOAD_KIND_DISK   = "disk"
+	UPLOAD_KIND_KERNEL = "kernel"
+)
+
+// Counters of cloud-hypervisor are read in parallel, each read is bounded by the socket client timeout
+const metricsScrapeWorkers = 8
+
+func (hm *HypervisorMonitor) GetMetrics() *metrics.Registry {
+	return hm.metrics
+}
+
+func (hm *HypervisorMonitor) registerMetrics() {
+	hm.metrics.Register(hm.uploadBytes)
+	hm.metrics.Register(metrics.CollectorFunc(hm.collectMonitorMetrics))
+	hm.metrics.Register(metrics.CollectorFunc(hm.collectVirtualMachineMetrics))
+}
+
+// RecordUploadBytes accounts bytes written by chunk uploads, exposed as a counter for throughput
+func (hm *HypervisorMonitor) RecordUploadBytes(kind string, written int64) {
+	hm.uploadBytes.Add(float64(written), kind)
+}
+
+func fileSize(path string) float64 {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return float64(stat.Size())
+}
+
+func (hm *HypervisorMonitor) collectMonitorMetrics() []metrics.Family {
+	hm.admissionMu.Lock()
+	var uploads int = len(hm.uploads)
+	hm.admissionMu.Unlock()
+	hm.orphansMu.Lock()
+	var orphans int = len(hm.orphans)
+	hm.orphansMu.Unlock()
+	tapSize, tapFree, bridgeSize, bridgeFree := hm.networkEnumerator.PoolUsage()
+	capacity := hm.GetCapacity()
+	self, err := readProcessUsage(procRoot, os.Getpid())
+	if err != nil {
+		hm.logger.Debug("Unable to read monitor process usage", zap.String("error", err.Error()))
+	}
+
+	pools := metrics.Family{Name: "chmon_network_pool_slots", Help: "Slots of the tap and bridge name pools", Type: metrics.GAUGE}
+	for _, pool := range []struct {
+		name string
+		size int
+		free int
+	}{{"tap", tapSize, tapFree}, {"bridge", bridgeSize, bridgeFree}} {
+		pools.Samples = append(pools.Samples,
+			metrics.Sample{Labels: []metrics.Label{{Name: "pool", Value: pool.name}, {Name: "state", Value: "free"}}, Value: float64(pool.free)},
+			metrics.Sample{Labels: []metrics.Label{{Name: "pool", Value: pool.name}, {Name: "state", Value: "used"}}, Value: float64(pool.size - pool.free)},
+		)
+	}
+	return []metrics.Family{
+		metrics.Gauge("chmon_upload_sessions", "Disk uploads begun and not committed", float64(uploads)),
+		metrics.Gauge("chmon_orphan_processes", "Running cloud-hypervisor processes not attached to a virtual machine", float64(orphans)),
+		metrics.Gauge("chmon_vpc_wal_bytes", "Size of the vpc changes log, it is emptied by snapshots", fileSize(hm.vpcManager.GetLogFilePath())),
+		metrics.Gauge("chmon_vpc_snapshot_bytes", "Size of the vpc snapshot", fileSize(hm.vpcManager.GetSnapshotFilePath())),
+		metrics.Gauge("chmon_host_allocatable_cpus", "Cpus allocatable to guests after overcommit", float64(capacity.Allocatable.Cpus)),
+		metrics.Gauge("chmon_host_allocatable_memory_bytes", "Memory allocatable to guests after overcommit", float64(capacity.Allocatable.Memory)),
+		metrics.Gauge("chmon_host_allocated_cpus", "Cpus allocated to active guests", float64(capacity.Allocated.Cpus)),
+		metrics.Gauge("chmon_host_allocated_memory_bytes", "Memory allocated to active guests", float64(capacity.Allocated.Memory)),
+		metrics.Gauge("chmon_goroutines", "Goroutines of the monitor", float64(runtime.NumGoroutine())),
+		{Name: "chmon_process_cpu_seconds_total", Help: "User and system cpu time of the monitor", Type: metrics.COUNTER, Samples: []metrics.Sample{{Value: self.CpuSeconds}}},
+		metrics.Gauge("chmon_process_resident_memory_bytes", "Resident memory of the monitor", float64(self.RssBytes)),
+		pools,
+	}
+}
+
+type virtualMachineSample struct {
+	manifest *virtualmachine.Manifest
+	status   virtualmachine.Status
+	pid      int
+	usage    *ProcessUsage
+	counters map[string]map[string]uint64
+}
+
+func (hm *HypervisorMonitor) sampleVirtualMachine(vm *virtualmachine.VirtualMachine) virtualMachineSample {
+	var sample virtualMachineSample = virtualMachineSample{
+		manifest: vm.GetManifest(),
+		status:   vm.GetStatus(),
+	}
+	instance := vm.GetInstance()
+	if instance == nil || sample.status.State != virtualmachine.RUNNING && sample.status.State != virtualmachine.PAUSED {
+		return sample
+	}
+	sample.pid = instance.GetPid()
+	if sample.pid > 0 {
+		usage, err := readProcessUsage(procRoot, sample.pid)
+		if err == nil {
+			sample.usage = &usage
+		}
+	}
+	counters, err := instance.GetCounters()
+	if err != nil {
+		hm.logger.Debug("Unable to read vm counters", zap.String("vm_id", sample.manifest.GuestIdentifier.String()), zap.String("error", err.Error()))
+		return sample
+	}
+	sample.counters = counters
+	return sample
+}
+
+// sampleVirtualMachines reads the usage of the given virtual machines in parallel
+func (hm *HypervisorMonitor) sampleVirtualMachines(vms []*virtualmachine.VirtualMachine) []virtualMachineSample {
+	var samples []virtualMachineSample = make([]virtualMachineSample, len(vms))
+	var indexes chan int = make(chan int)
+	var wg sync.WaitGroup
+	for range min(metricsScrapeWorkers, len(vms)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indexes {
+				samples[i] = hm.sampleVirtualMachine(vms[i])
+			}
+		}()
+	}
+	for i := range vms {
+		indexes <- i
+	}
+	close(indexes)
+	wg.Wait()
+	return samples
+}
+
+func (hm *HypervisorMonitor) listVirtualMachines() []*virtualmachine.VirtualMachine {
+	hm.vmsMu.Lock()
+	defer hm.vmsMu.Unlock()
+	var vms []*virtualmachine.VirtualMachine = make([]*virtualmachine.VirtualMachine, 0, len(hm.virtualMachines))
+	for _, vm := range hm.virtualMachines {
+		vms = append(vms, vm)
+	}
+	return vms
+}
+
+func (hm *HypervisorMonitor) collectVirtualMachineMetrics() []metrics.Family {
+	var vms []*virtualmachine.VirtualMachine = hm.listVirtualMachines()
+
+	var samples []virtualMachineSample = hm.sampleVirtualMachines(vms)
+	sort.Slice(samples, func(i, j int) bool {
+		return samples[i].manifest.GuestIdentifier.String() < samples[j].manifest.GuestIdentifier.String()
+	})
+
+	states := metrics.Family{Name: "chmon_vm_state", Help: "Current state of the virtual machine, the sample of the current state is 1", Type: metrics.GAUGE}
+	cpus := metrics.Family{Name: "chmon_vm_cpus", Help: "Configured boot cpus", Type: metrics.GAUGE}
+	memory := metrics.Family{Name: "chmon_vm_memory_bytes", Help: "Configured memory", Type: metrics.GAUGE}
+	cpuSeconds := metrics.Family{Name: "chmon_vm_process_cpu_seconds_total", Help: "User and system cpu time of the cloud-hypervisor process", Type: metrics.COUNTER}
+	rss := metrics.Family{Name: "chmon_vm_process_resident_memory_bytes", Help: "Resident memory of the cloud-hypervisor process", Type: metrics.GAUGE}
+	counters := metrics.Family{Name: "chmon_vm_device_counter", Help: "Device counters reported by cloud-hypervisor vm.counters, e.g. read_bytes or rx_bytes", Type: metrics.UNTYPED}
+	for _, sample := range samples {
+		var labels []metrics.Label = []metrics.Label{
+			{Name: "vm", Value: sample.manifest.GuestIdentifier.String()},
+			{Name: "tenant", Value: sample.manifest.Tenant.String()},
+			{Name: "name", Value: sample.manifest.Name},
+		}
+		with := func(extra ...metrics.Label) []metrics.Label {
+			return append(append([]metrics.Label(nil), labels...), extra...)
+		}
+		states.Samples = append(states.Samples, metrics.Sample{Labels: with(metrics.Label{Name: "state", Value: string(sample.status.State)}), Value: 1})
+		resources := GuestResources(sample.manifest.Config)
+		cpus.Samples = append(cpus.Samples, metrics.Sample{Labels: labels, Value: float64(resources.Cpus)})
+		memory.Samples = append(memory.Samples, metrics.Sample{Labels: labels, Value: float64(resources.Memory)})
+		if sample.usage != nil {
+			cpuSeconds.Samples = append(cpuSeconds.Samples, metrics.Sample{Labels: labels, Value: sample.usage.CpuSeconds})
+			rss.Samples = append(rss.Samples, metrics.Sample{Labels: labels, Value: float64(sample.usage.RssBytes)})
+		}
+		devices := make([]string, 0, len(sample.counters))
+		for device := range sample.counters {
+			devices = append(devices, device)
+		}
+		sort.Strings(devices)
+		for _, device := range devices {
+			names := make([]string, 0, len(sample.counters[device]))
+			for name := range sample.counters[device] {
+				names = append(names, name)
+			}
+			sort.Strings(names)
+			for _, name := range names {
+				counters.Samples = append(counters.Samples, metrics.Sample{
+					Labels: with(metrics.Label{Name: "device", Value: device}, metrics.Label{Name: "counter", Value: name}),
+					Value:  float64(sample.counters[device][name]),
+				})
+			}
+		}
+	}
+	return []metrics.Family{states, cpus, memory, cpuSeconds, rss, counters}
+}
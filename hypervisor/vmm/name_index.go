@@ -0,0 +1,81 @@
+package vmm
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// NameIndex maps tenant and name to a virtual machine id.
+// It is not safe for concurrent use, the monitor guards it with vmsMu
+type NameIndex struct {
+	index map[string]map[string]string
+}
+
+func NewNameIndex() *NameIndex {
+	return &NameIndex{
+		index: make(map[string]map[string]string),
+	}
+}
+
+func (ni *NameIndex) Get(tenant string, name string) (string, bool) {
+	id, ok := ni.index[tenant][name]
+	return id, ok
+}
+
+// Add fails when the name is already used by another virtual machine of the tenant
+func (ni *NameIndex) Add(tenant string, name string, id string) error {
+	if name == "" {
+		return nil
+	}
+	if current, ok := ni.index[tenant][name]; ok && current != id {
+		return &ErrNameConflict{Tenant: tenant, Name: name}
+	}
+	if _, ok := ni.index[tenant]; !ok {
+		ni.index[tenant] = make(map[string]string)
+	}
+	ni.index[tenant][name] = id
+	return nil
+}
+
+func (ni *NameIndex) Remove(tenant string, name string, id string) {
+	if current, ok := ni.index[tenant][name]; !ok || current != id {
+		return
+	}
+	delete(ni.index[tenant], name)
+	if len(ni.index[tenant]) == 0 {
+		delete(ni.index, tenant)
+	}
+}
+
+type Reference struct {
+	Id     string
+	Tenant string
+	Name   string
+}
+
+// ParseReference accepts a vm uuid or "<tenant uuid>/<name>", the slash can be url encoded
+func ParseReference(ref string) (*Reference, error) {
+	unescaped, err := url.PathUnescape(ref)
+	if err != nil {
+		return nil, err
+	}
+	parts := strings.Split(unescaped, "/")
+	if len(parts) == 1 {
+		id, err := uuid.Parse(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("invalid vm reference %q: expected uuid or tenant/name", ref)
+		}
+		return &Reference{Id: id.String()}, nil
+	}
+	if len(parts) != 2 || parts[1] == "" {
+		return nil, fmt.Errorf("invalid vm reference %q: expected uuid or tenant/name", ref)
+	}
+	tenant, err := uuid.Parse(parts[0])
+	if err != nil {
+		return nil, fmt.Errorf("invalid tenant in vm reference %q", ref)
+	}
+	return &Reference{Tenant: tenant.String(), Name: parts[1]}, nil
+}
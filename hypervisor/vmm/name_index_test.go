@@ -0,0 +1,39 @@
+package vmm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_NameIndex_Add(t *testing.T) {
+	ni := NewNameIndex()
+	assert.Nil(t, ni.Add("t1", "web", "a"), "No errors expected for a new name")
+	assert.Nil(t, ni.Add("t2", "web", "b"), "Expect the same name in another tenant to be accepted")
+	assert.IsType(t, &ErrNameConflict{}, ni.Add("t1", "web", "c"), "Expect duplicated name in a tenant to be rejected")
+	assert.Nil(t, ni.Add("t1", "", "c"), "Expect unnamed vms to be ignored")
+
+	ni.Remove("t1", "web", "c")
+	id, ok := ni.Get("t1", "web")
+	assert.True(t, ok, "Expect removal with the wrong id to be ignored")
+	assert.Equal(t, "a", id, "Expect the original owner of the name")
+	ni.Remove("t1", "web", "a")
+	_, ok = ni.Get("t1", "web")
+	assert.False(t, ok, "Expect the name to be released")
+}
+
+func Test_ParseReference(t *testing.T) {
+	ref, err := ParseReference("46c97539-797a-4cf6-b4b6-31f9909d9401")
+	assert.Nil(t, err, "No errors expected for a uuid")
+	assert.Equal(t, "46c97539-797a-4cf6-b4b6-31f9909d9401", ref.Id, "Expect the vm id")
+
+	ref, err = ParseReference("c8ddee26-bc2b-465a-9726-483f117cf618%2Fweb")
+	assert.Nil(t, err, "No errors expected for an encoded tenant/name")
+	assert.Equal(t, "c8ddee26-bc2b-465a-9726-483f117cf618", ref.Tenant, "Expect the tenant")
+	assert.Equal(t, "web", ref.Name, "Expect the name")
+
+	_, err = ParseReference("web")
+	assert.NotNil(t, err, "Expect a bare name to be rejected")
+	_, err = ParseReference("not-a-tenant/web")
+	assert.NotNil(t, err, "Expect an invalid tenant to be rejected")
+}
@@ -0,0 +1,125 @@
+package vmm
+
+import (
+	"time"
+	"vmm/audit"
+	"vmm/auth"
+	"vmm/events"
+	virtualmachine "vmm/virtual_machine"
+	"vmm/webhooks"
+
+	"go.uber.org/zap"
+)
+
+// vmObserver connects virtual machines to the event bus and to the boot admission of the monitor
+type vmObserver struct {
+	hm *HypervisorMonitor
+}
+
+func (o *vmObserver) Publish(event events.Event) events.Event {
+	return o.hm.bus.Publish(event)
+}
+
+// Restart goes through BootVirtualMachine so capacity is checked as for any boot.
+// Any change of status while waiting, e.g. a shutdown request, or the shutdown of the monitor cancels the restart
+func (o *vmObserver) Restart(vm *virtualmachine.VirtualMachine, reason string, delay time.Duration, from virtualmachine.Status) {
+	var id string = vm.GetManifest().GuestIdentifier.String()
+	time.AfterFunc(delay, func() {
+		o.hm.restartMu.RLock()
+		defer o.hm.restartMu.RUnlock()
+		select {
+		case <-o.hm.done:
+			o.hm.logger.Info("Restart cancelled, monitor stopped", zap.String("vm_id", id))
+			return
+		default:
+		}
+		current := vm.GetStatus()
+		if current.State != from.State || !current.UpdatedAt.Equal(from.UpdatedAt) {
+			o.hm.logger.Info("Restart cancelled, status changed", zap.String("vm_id", id), zap.String("state", string(current.State)))
+			return
+		}
+		err := o.hm.BootVirtualMachine(id)
+		if err != nil {
+			o.hm.logger.Error("Unable to restart virtual machine", zap.String("vm_id", id), zap.String("reason", reason), zap.String("error", err.Error()))
+			return
+		}
+		o.hm.logger.Info("Virtual machine restarted", zap.String("vm_id", id), zap.String("reason", reason))
+	})
+}
+
+func (hm *HypervisorMonitor) GetEventBus() *events.Bus {
+	return hm.bus
+}
+
+func (hm *HypervisorMonitor) GetWebhooks() *webhooks.Manager {
+	return hm.webhooks
+}
+
+func (hm *HypervisorMonitor) publishLifecycle(eventType string, manifest *virtualmachine.Manifest) {
+	hm.bus.Publish(events.Event{
+		Type:           eventType,
+		VirtualMachine: manifest.GuestIdentifier.String(),
+		Tenant:         manifest.Tenant.String(),
+		Data: map[string]any{
+			"name": manifest.Name,
+		},
+	})
+}
+
+// journalEvent runs as a bus hook, a failing journal must not stop the delivery of events
+func (hm *HypervisorMonitor) journalEvent(event events.Event) {
+	err := hm.journal.Append(event)
+	if err != nil {
+		hm.logger.Error("Unable to journal event", zap.Uint64("event_id", event.Id), zap.String("type", event.Type), zap.String("error", err.Error()))
+	}
+}
+
+// ReplayEvents returns the journaled events published after afterId.
+// The second value is false when part of them were discarded from the journal
+func (hm *HypervisorMonitor) ReplayEvents(afterId uint64, filter events.Filter) ([]events.Event, bool, error) {
+	return hm.journal.Since(afterId, filter)
+}
+
+func (hm *HypervisorMonitor) publishTenantEvent(eventType string, tenant string, data map[string]any) {
+	hm.bus.Publish(events.Event{
+		Type:   eventType,
+		Tenant: tenant,
+		Data:   data,
+	})
+}
+
+func (hm *HypervisorMonitor) publishVirtualMachineEvent(eventType string, manifest *virtualmachine.Manifest, data map[string]any) {
+	hm.bus.Publish(events.Event{
+		Type:           eventType,
+		VirtualMachine: manifest.GuestIdentifier.String(),
+		Tenant:         manifest.Tenant.String(),
+		Data:           data,
+	})
+}
+
+// RecordDenial publishes a request refused by authorization, the tenant is omitted for host routes
+func (hm *HypervisorMonitor) RecordDenial(principal *auth.Principal, tenant string, virtualMachine string, data map[string]any) {
+	data["principal"] = principal.Name
+	data["auth_method"] = principal.Method
+	if principal.TokenId != "" {
+		data["token_id"] = principal.TokenId
+	}
+	if tenant == auth.ALL_TENANTS {
+		tenant = ""
+	}
+	hm.logger.Warn("Request denied", zap.String("principal", principal.Name), zap.String("tenant", tenant), zap.Any("request", data))
+	hm.bus.Publish(events.Event{
+		Type:           events.AUTH_DENIED,
+		VirtualMachine: virtualMachine,
+		Tenant:         tenant,
+		Data:           data,
+	})
+}
+
+// RecordAudit appends a request to the audit log, the request already ran so a failure is only logged
+func (hm *HypervisorMonitor) RecordAudit(record *audit.Record) {
+	err := hm.audit.Append(record)
+	if err != nil {
+		hm.logger.Error("Unable to write audit record", zap.String("method", record.Method), zap.String("path", record.Path), zap.Error(err))
+	}
+}
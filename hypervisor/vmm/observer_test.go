@@ -0,0 +1,36 @@
+package vmm
+
+import (
+	"testing"
+	"time"
+	virtualmachine "vmm/virtual_machine"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func Test_vmObserver_Restart(t *testing.T) {
+	core, logs := observer.New(zap.InfoLevel)
+	hm := &HypervisorMonitor{
+		logger: zap.New(core),
+		done:   make(chan struct{}),
+	}
+	manifest := &virtualmachine.Manifest{GuestIdentifier: uuid.New(), Tenant: uuid.New()}
+	vm, err := virtualmachine.NewVirtualMachine(manifest, zap.NewNop(), t.TempDir(), "lo", nil, nil)
+	assert.Nil(t, err)
+
+	// A restart waiting in its backoff must not boot the guest once the monitor stopped
+	o := &vmObserver{hm: hm}
+	o.Restart(vm, "crashed", 10*time.Millisecond, vm.GetStatus())
+	close(hm.done)
+	hm.restartMu.Lock()
+	hm.restartMu.Unlock()
+
+	assert.Eventually(t, func() bool {
+		return logs.FilterMessage("Restart cancelled, monitor stopped").Len() == 1
+	}, time.Second, 5*time.Millisecond)
+	assert.Equal(t, 0, logs.FilterMessage("Unable to restart virtual machine").Len())
+	assert.Equal(t, 0, logs.FilterMessage("Virtual machine restarted").Len())
+}
@@ -0,0 +1,212 @@
+package vmm
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+	cloudhypervisor "vmm/cloud_hypervisor"
+	"vmm/events"
+	virtualmachine "vmm/virtual_machine"
+
+	"go.uber.org/zap"
+)
+
+const (
+	ORPHAN_NO_SOCKET      = "no_api_socket"
+	ORPHAN_UNREACHABLE    = "unreachable"
+	ORPHAN_UNKNOWN_VM     = "unknown_vm"
+	ORPHAN_DUPLICATE      = "duplicate"
+	ORPHAN_FOREIGN_BINARY = "foreign_binary"
+)
+
+// Orphan is a running cloud-hypervisor process not attached to any virtual machine
+type Orphan struct {
+	Pid            int       `json:"pid" yaml:"pid"`
+	Exe            string    `json:"exe" yaml:"exe"`
+	BinaryDeleted  bool      `json:"binary_deleted" yaml:"binary_deleted"`
+	SocketPath     string    `json:"socket_path,omitempty" yaml:"socket_path,omitempty"`
+	VirtualMachine string    `json:"virtual_machine,omitempty" yaml:"virtual_machine,omitempty"`
+	Reason         string    `json:"reason" yaml:"reason"`
+	Detail         string    `json:"detail,omitempty" yaml:"detail,omitempty"`
+	DetectedAt     time.Time `json:"detected_at" yaml:"detected_at"`
+	startTime      uint64
+}
+
+// MergeRunningInstances attaches running cloud-hypervisor processes to their virtual machine,
+// processes that cannot be attached are recorded as orphans
+func (hm *HypervisorMonitor) MergeRunningInstances(hypervisorBinaryPath string) error {
+	processes, err := LoadProcessData(procRoot, hypervisorBinaryPath)
+	if err != nil {
+		return err
+	}
+	var orphans map[int]*Orphan = make(map[int]*Orphan)
+	for _, process := range processes {
+		orphan := hm.adoptProcess(process)
+		if orphan == nil {
+			continue
+		}
+		hm.logger.Warn("Orphan cloud-hypervisor process", zap.Int("pid", orphan.Pid), zap.String("reason", orphan.Reason), zap.String("detail", orphan.Detail))
+		orphans[orphan.Pid] = orphan
+	}
+	hm.orphansMu.Lock()
+	previous := hm.orphans
+	hm.orphans = orphans
+	hm.orphansMu.Unlock()
+	// Only processes unknown to the previous scan are reported
+	for pid, orphan := range orphans {
+		if known, ok := previous[pid]; ok && known.startTime == orphan.startTime {
+			continue
+		}
+		hm.publishOrphanEvent(events.ORPHAN_DETECTED, orphan)
+	}
+	return nil
+}
+
+func (hm *HypervisorMonitor) publishOrphanEvent(eventType string, orphan *Orphan) {
+	hm.bus.Publish(events.Event{
+		Type:           eventType,
+		VirtualMachine: orphan.VirtualMachine,
+		Data: map[string]any{
+			"pid":    orphan.Pid,
+			"reason": orphan.Reason,
+		},
+	})
+}
+
+// adoptProcess returns the orphan record when the process cannot be attached
+func (hm *HypervisorMonitor) adoptProcess(process *HypervisorProcess) *Orphan {
+	var orphan *Orphan = &Orphan{
+		Pid:           process.Pid,
+		Exe:           process.Exe,
+		BinaryDeleted: process.BinaryDeleted,
+		SocketPath:    process.SocketPath,
+		DetectedAt:    time.Now().UTC(),
+		startTime:     process.StartTime,
+	}
+	if process.ForeignBinary {
+		orphan.Reason = ORPHAN_FOREIGN_BINARY
+		orphan.Detail = fmt.Sprintf("runs %s instead of the configured hypervisor binary", process.Exe)
+		if process.Problem != "" {
+			orphan.Detail += ", " + process.Problem
+		}
+		return orphan
+	}
+	if process.SocketPath == "" {
+		orphan.Reason = ORPHAN_NO_SOCKET
+		orphan.Detail = process.Problem
+		return orphan
+	}
+	instance := cloudhypervisor.LoadRunningInstance(process.Pid, process.SocketPath, hm.getManifest().HypervisorSocketUri, procStartedAt(procRoot, process.StartTime))
+	info, err := instance.GetInfo()
+	if err != nil {
+		orphan.Reason = ORPHAN_UNREACHABLE
+		orphan.Detail = err.Error()
+		return orphan
+	}
+	orphan.VirtualMachine = info.Config.Platform.Uuid
+	hm.vmsMu.Lock()
+	vm := hm.virtualMachines[info.Config.Platform.Uuid]
+	hm.vmsMu.Unlock()
+	if vm == nil {
+		orphan.Reason = ORPHAN_UNKNOWN_VM
+		return orphan
+	}
+	err = vm.AdoptInstance(instance)
+	if err != nil {
+		orphan.Reason = ORPHAN_DUPLICATE
+		orphan.Detail = err.Error()
+		return orphan
+	}
+	hm.logger.Info("Adopted running cloud-hypervisor process", zap.Int("pid", process.Pid), zap.String("vm_id", info.Config.Platform.Uuid), zap.Bool("binary_deleted", process.BinaryDeleted))
+	return nil
+}
+
+func (hm *HypervisorMonitor) ListOrphans() []Orphan {
+	hm.orphansMu.Lock()
+	defer hm.orphansMu.Unlock()
+	var res []Orphan = make([]Orphan, 0, len(hm.orphans))
+	for _, orphan := range hm.orphans {
+		res = append(res, *orphan)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Pid < res[j].Pid
+	})
+	return res
+}
+
+// Caller must hold orphansMu. A process that exited or whose pid was
+// reused by another process is dropped from the orphans
+func (hm *HypervisorMonitor) getOrphanLocked(pid int) (*Orphan, error) {
+	orphan, ok := hm.orphans[pid]
+	if !ok {
+		return nil, &ErrOrphanNotFound{Pid: pid}
+	}
+	startTime, err := readProcStartTime(procRoot, pid)
+	if err != nil || startTime != orphan.startTime {
+		delete(hm.orphans, pid)
+		return nil, &ErrOrphanGone{Pid: pid}
+	}
+	return orphan, nil
+}
+
+// AdoptOrphan attaches an orphan process to a virtual machine.
+// With an empty reference the uuid reported by the process is used
+func (hm *HypervisorMonitor) AdoptOrphan(pid int, ref string) (*virtualmachine.Manifest, error) {
+	hm.orphansMu.Lock()
+	defer hm.orphansMu.Unlock()
+	orphan, err := hm.getOrphanLocked(pid)
+	if err != nil {
+		return nil, err
+	}
+	if orphan.SocketPath == "" {
+		return nil, fmt.Errorf("orphan %d has no usable api socket and can only be killed", pid)
+	}
+	if ref == "" {
+		ref = orphan.VirtualMachine
+	}
+	if ref == "" {
+		return nil, errors.New("orphan does not report a vm uuid, a virtual machine must be given")
+	}
+	vm := hm.GetVirtualMachine(ref)
+	if vm == nil {
+		return nil, &ErrVirtualMachineNotFound{}
+	}
+	instance := cloudhypervisor.LoadRunningInstance(orphan.Pid, orphan.SocketPath, hm.getManifest().HypervisorSocketUri, procStartedAt(procRoot, orphan.startTime))
+	_, err = instance.GetInfo()
+	if err != nil {
+		return nil, fmt.Errorf("orphan %d does not answer on its api socket: %w", pid, err)
+	}
+	err = vm.AdoptInstance(instance)
+	if err != nil {
+		return nil, err
+	}
+	delete(hm.orphans, pid)
+	manifest := vm.GetManifest()
+	hm.publishVirtualMachineEvent(events.ORPHAN_ADOPTED, manifest, map[string]any{
+		"pid":         pid,
+		"reported_vm": orphan.VirtualMachine,
+	})
+	if orphan.VirtualMachine != manifest.GuestIdentifier.String() {
+		hm.logger.Warn("Adopted process reports a different vm uuid", zap.Int("pid", pid), zap.String("vm_id", manifest.GuestIdentifier.String()), zap.String("reported_vm_id", orphan.VirtualMachine))
+	}
+	return manifest, nil
+}
+
+func (hm *HypervisorMonitor) KillOrphan(pid int) error {
+	hm.orphansMu.Lock()
+	defer hm.orphansMu.Unlock()
+	orphan, err := hm.getOrphanLocked(pid)
+	if err != nil {
+		return err
+	}
+	instance := cloudhypervisor.LoadRunningInstance(orphan.Pid, orphan.SocketPath, hm.getManifest().HypervisorSocketUri, procStartedAt(procRoot, orphan.startTime))
+	err = instance.Kill()
+	if err != nil {
+		return err
+	}
+	delete(hm.orphans, pid)
+	hm.publishOrphanEvent(events.ORPHAN_KILLED, orphan)
+	hm.logger.Info("Killed orphan cloud-hypervisor process", zap.Int("pid", pid))
+	return nil
+}
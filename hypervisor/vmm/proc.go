@@ -1,130 +1,276 @@
 package vmm
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
-	"log"
 	"os"
 	"path/filepath"
 	"strconv"
 	"strings"
-	cloudhypervisor "vmm/cloud_hypervisor"
+	"sync"
+	"time"
 	"vmm/utils"
 )
 
-func parseProcFolder(cloudHypervisorPath string, pid int, procPath string, done chan<- *cloudhypervisor.CloudHypervisor) {
-	// Read content of exe and cwd files to get process info
-	// Step 1: check if the binary is related to Cloud-Hypervisor
-	// Step 2: push process info (unix socket) to pool of vms to provision
+const procRoot = "/proc"
 
-	var cmdPath = filepath.Join(procPath, strconv.Itoa(pid), "/cmdline")
-	var exePath = filepath.Join(procPath, strconv.Itoa(pid), "/exe")
-	var err error
-	fmt.Printf("Check %s, %s\n", exePath, cmdPath)
+// The kernel appends this to the exe link when the binary was replaced, e.g. on upgrade
+const deletedExeSuffix = " (deleted)"
 
-	contentCmd, err := os.ReadFile(cmdPath)
-	if err != nil {
-		done <- nil
-		return
-	}
-	contentExe, err := os.Readlink(exePath)
-	if err != nil {
-		done <- nil
-		return
-	}
+const procScanWorkers = 20
+
+// HypervisorProcess is a cloud-hypervisor process found in /proc.
+// SocketPath is empty when the api socket could not be resolved, Problem tells why.
+// ForeignBinary is set when the process runs a binary of the same name at another path
+type HypervisorProcess struct {
+	Pid           int
+	Exe           string
+	BinaryDeleted bool
+	ForeignBinary bool
+	StartTime     uint64
+	SocketPath    string
+	Problem       string
+}
 
-	if contentExe != cloudHypervisorPath {
-		done <- nil
-		return
+// matchesHypervisorBinary compares the exe link of a process with the configured binary.
+// The link is resolved by the kernel, so symlinks in the configured path are resolved too.
+// A binary replaced by an upgrade is only matched at the same path, marked as deleted
+func matchesHypervisorBinary(exe string, binaryPath string) bool {
+	exe = strings.TrimSuffix(exe, deletedExeSuffix)
+	if exe == binaryPath {
+		return true
 	}
+	resolved, err := filepath.EvalSymlinks(binaryPath)
+	return err == nil && exe == resolved
+}
 
-	var cmdLine = strings.Join(strings.Split(string(contentCmd), "\000"), " ")
+// sharesHypervisorBinaryName tells if the exe link of a process has the name of the configured
+// binary or of its symlink target, e.g. a process started from a previous target of the symlink
+func sharesHypervisorBinaryName(exe string, binaryPath string) bool {
+	var name string = filepath.Base(strings.TrimSuffix(exe, deletedExeSuffix))
+	if name == filepath.Base(binaryPath) {
+		return true
+	}
+	resolved, err := filepath.EvalSymlinks(binaryPath)
+	return err == nil && name == filepath.Base(resolved)
+}
 
-	cmdLineParsing, err := utils.ParseCmdLine(cmdLine)
+// readProcStat returns the fields of /proc/<pid>/stat after comm, the first one is the state
+func readProcStat(procPath string, pid int) ([]string, error) {
+	content, err := os.ReadFile(filepath.Join(procPath, strconv.Itoa(pid), "stat"))
 	if err != nil {
-		done <- nil
-		return
+		return nil, err
+	}
+	// Format is "pid (comm) state ...", comm can contain spaces
+	var stat string = string(content)
+	var index int = strings.LastIndex(stat, ")")
+	if index < 0 {
+		return nil, errors.New("malformed stat file")
 	}
-	if cmdLineParsing.Binary != cloudHypervisorPath {
-		done <- nil
-		return
+	var fields []string = strings.Fields(stat[index+1:])
+	if len(fields) < 22 {
+		return nil, errors.New("malformed stat file")
 	}
+	return fields, nil
+}
 
-	var cmdSocketParsing *utils.CmdSocketParsing = utils.NewCmdSocketParsing()
-	err = cmdSocketParsing.Parse(cmdLineParsing.Args["--api-socket"].(string))
+// readProcStartTime returns the start time of the process in clock ticks after boot,
+// together with the pid it tells apart a process from a later one reusing the pid
+func readProcStartTime(procPath string, pid int) (uint64, error) {
+	fields, err := readProcStat(procPath, pid)
 	if err != nil {
-		done <- nil
-		return
+		return 0, err
 	}
-
-	done <- cloudhypervisor.LoadRunningInstance(pid, cmdSocketParsing.Path)
+	// Fields after comm start from the third one, start time is the 22nd
+	return strconv.ParseUint(fields[19], 10, 64)
 }
 
-func LoadProcessData(hypervisorBinaryPath string) ([]*cloudhypervisor.CloudHypervisor, error) {
-	// List all processes in /proc
+// Kernel reports times in USER_HZ, which is 100 on every supported architecture
+const userHz = 100
 
-	var chanPool int = 20
-	var procs chan *cloudhypervisor.CloudHypervisor = make(chan *cloudhypervisor.CloudHypervisor, chanPool)
-	var index int
-	var poolIndex int
-	var procList []*cloudhypervisor.CloudHypervisor = make([]*cloudhypervisor.CloudHypervisor, 0)
-
-	files, err := os.ReadDir("/proc")
+// procStartedAt converts the start time of a process in clock ticks after boot to a time,
+// zero when the boot time cannot be read
+func procStartedAt(procPath string, startTime uint64) time.Time {
+	fd, err := os.Open(filepath.Join(procPath, "stat"))
 	if err != nil {
-		log.Fatalf("Unable to list folders in /proc; %s", err.Error())
+		return time.Time{}
 	}
-	index = 0
-	poolIndex = 0
-	var chInstance *cloudhypervisor.CloudHypervisor
-	var i int
-	for index < len(files) {
-
-		// We are looking for process folder, not files
-		if !files[index].IsDir() {
-			index += 1
-			continue
-		}
-
-		// This folder has no PID as its name, so we can skip it
-		if !utils.IsUnicodeDigit(files[index].Name()) {
-			index += 1
+	defer fd.Close()
+	var scanner *bufio.Scanner = bufio.NewScanner(fd)
+	for scanner.Scan() {
+		value, ok := strings.CutPrefix(scanner.Text(), "btime ")
+		if !ok {
 			continue
 		}
-
-		pid, err := strconv.Atoi(files[index].Name())
+		bootTime, err := strconv.ParseInt(strings.TrimSpace(value), 10, 64)
 		if err != nil {
-			index += 1
-			continue
+			return time.Time{}
 		}
+		var elapsed time.Duration = time.Duration(startTime) * time.Second / userHz
+		return time.Unix(bootTime, 0).Add(elapsed).UTC()
+	}
+	return time.Time{}
+}
 
-		if strconv.Itoa(pid) != files[index].Name() {
-			index += 1
-			continue
-		}
+type ProcessUsage struct {
+	CpuSeconds float64
+	RssBytes   int64
+}
+
+// readProcessUsage reads user plus system cpu time and resident memory of a process
+func readProcessUsage(procPath string, pid int) (ProcessUsage, error) {
+	fields, err := readProcStat(procPath, pid)
+	if err != nil {
+		return ProcessUsage{}, err
+	}
+	// utime and stime are the 14th and 15th fields, rss in pages the 24th
+	utime, err := strconv.ParseUint(fields[11], 10, 64)
+	if err != nil {
+		return ProcessUsage{}, err
+	}
+	stime, err := strconv.ParseUint(fields[12], 10, 64)
+	if err != nil {
+		return ProcessUsage{}, err
+	}
+	rss, err := strconv.ParseInt(fields[21], 10, 64)
+	if err != nil {
+		return ProcessUsage{}, err
+	}
+	return ProcessUsage{
+		CpuSeconds: float64(utime+stime) / userHz,
+		RssBytes:   rss * int64(os.Getpagesize()),
+	}, nil
+}
 
-		if poolIndex < 20 {
-			go parseProcFolder(hypervisorBinaryPath, pid, "/proc/", procs)
-			index += 1
-			poolIndex += 1
+// resolveSocketFd finds the path a listening unix socket inherited as a file descriptor is bound to.
+// Abstract sockets are returned with the leading @ understood by net.Dial
+func resolveSocketFd(procPath string, pid int, fd int) (string, error) {
+	link, err := os.Readlink(filepath.Join(procPath, strconv.Itoa(pid), "fd", strconv.Itoa(fd)))
+	if err != nil {
+		return "", err
+	}
+	var inode string
+	_, err = fmt.Sscanf(link, "socket:[%s", &inode)
+	if err != nil {
+		return "", fmt.Errorf("fd %d is not a socket", fd)
+	}
+	inode = strings.TrimSuffix(inode, "]")
+	file, err := os.Open(filepath.Join(procPath, strconv.Itoa(pid), "net", "unix"))
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// Num RefCount Protocol Flags Type St Inode Path
+		var fields []string = strings.Fields(scanner.Text())
+		if len(fields) < 7 || fields[6] != inode {
 			continue
 		}
-		// Process chan return
-		if poolIndex == 20 {
-			chInstance = <-procs
-			poolIndex -= 1
-			if chInstance == nil {
-				continue
-			}
-			procList = append(procList, chInstance)
+		if len(fields) < 8 {
+			return "", fmt.Errorf("socket of fd %d is not bound to a path", fd)
 		}
+		return fields[7], nil
+	}
+	if err := scanner.Err(); err != nil {
+		return "", err
+	}
+	return "", fmt.Errorf("socket of fd %d not found", fd)
+}
+
+// parseProcFolder returns nil when the process is not a cloud-hypervisor instance
+func parseProcFolder(cloudHypervisorPath string, pid int, procPath string) *HypervisorProcess {
+	contentExe, err := os.Readlink(filepath.Join(procPath, strconv.Itoa(pid), "exe"))
+	if err != nil {
+		return nil
+	}
+	var foreign bool = !matchesHypervisorBinary(contentExe, cloudHypervisorPath)
+	if foreign && !sharesHypervisorBinaryName(contentExe, cloudHypervisorPath) {
+		return nil
+	}
+	contentCmd, err := os.ReadFile(filepath.Join(procPath, strconv.Itoa(pid), "cmdline"))
+	if err != nil {
+		return nil
+	}
+	startTime, err := readProcStartTime(procPath, pid)
+	if err != nil {
+		return nil
+	}
+	var process *HypervisorProcess = &HypervisorProcess{
+		Pid:           pid,
+		Exe:           strings.TrimSuffix(contentExe, deletedExeSuffix),
+		BinaryDeleted: strings.HasSuffix(contentExe, deletedExeSuffix),
+		ForeignBinary: foreign,
+		StartTime:     startTime,
+	}
+
+	cmdLineParsing, err := utils.ParseCmdLineFile(contentCmd)
+	if err != nil {
+		process.Problem = fmt.Sprintf("unable to parse command line: %s", err.Error())
+		return process
+	}
+	apiSocket, ok := cmdLineParsing.Value("--api-socket")
+	if !ok {
+		process.Problem = "started without --api-socket"
+		return process
+	}
+	var cmdSocketParsing *utils.CmdSocketParsing = utils.NewCmdSocketParsing()
+	err = cmdSocketParsing.Parse(apiSocket)
+	if err != nil {
+		process.Problem = fmt.Sprintf("unable to parse --api-socket: %s", err.Error())
+		return process
+	}
+	if cmdSocketParsing.Path != "" {
+		process.SocketPath = cmdSocketParsing.Path
+		return process
+	}
+	socketPath, err := resolveSocketFd(procPath, pid, cmdSocketParsing.Fd)
+	if err != nil {
+		process.Problem = fmt.Sprintf("unable to resolve api socket: %s", err.Error())
+		return process
 	}
+	process.SocketPath = socketPath
+	return process
+}
 
-	for i = 0; i < poolIndex; i++ {
-		chInstance = <-procs
-		if chInstance == nil {
+// LoadProcessData lists the cloud-hypervisor processes running on the host
+func LoadProcessData(procPath string, hypervisorBinaryPath string) ([]*HypervisorProcess, error) {
+	files, err := os.ReadDir(procPath)
+	if err != nil {
+		return nil, fmt.Errorf("unable to list folders in %s: %w", procPath, err)
+	}
+	var pids chan int = make(chan int)
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var procList []*HypervisorProcess = make([]*HypervisorProcess, 0)
+	for range procScanWorkers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for pid := range pids {
+				process := parseProcFolder(hypervisorBinaryPath, pid, procPath)
+				if process == nil {
+					continue
+				}
+				mu.Lock()
+				procList = append(procList, process)
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, file := range files {
+		// This folder has no PID as its name, so we can skip it
+		if !file.IsDir() || !utils.IsUnicodeDigit(file.Name()) {
+			continue
+		}
+		pid, err := strconv.Atoi(file.Name())
+		if err != nil || strconv.Itoa(pid) != file.Name() {
 			continue
 		}
-		procList = append(procList, chInstance)
+		pids <- pid
 	}
-
+	close(pids)
+	wg.Wait()
 	return procList, nil
 }
@@ -0,0 +1,127 @@
+package vmm
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+// fakeProcess creates /proc/<pid> with the files read by LoadProcessData
+func fakeProcess(t *testing.T, procPath string, pid int, exe string, cmdline string) {
+	var folder string = filepath.Join(procPath, strconv.Itoa(pid))
+	assert.Nil(t, os.MkdirAll(filepath.Join(folder, "fd"), 0755))
+	assert.Nil(t, os.MkdirAll(filepath.Join(folder, "net"), 0755))
+	assert.Nil(t, os.Symlink(exe, filepath.Join(folder, "exe")))
+	assert.Nil(t, os.WriteFile(filepath.Join(folder, "cmdline"), []byte(cmdline), 0644))
+	var stat string = strconv.Itoa(pid) + " (cloud hyper) S 1 1 1 0 -1 4194560 0 0 0 0 0 0 0 0 20 0 4 0 " + strconv.Itoa(pid*100) + " 0 0"
+	assert.Nil(t, os.WriteFile(filepath.Join(folder, "stat"), []byte(stat), 0644))
+}
+
+func Test_MatchesHypervisorBinary(t *testing.T) {
+	assert.True(t, matchesHypervisorBinary("/usr/bin/cloud-hypervisor", "/usr/bin/cloud-hypervisor"))
+	assert.True(t, matchesHypervisorBinary("/usr/bin/cloud-hypervisor (deleted)", "/usr/bin/cloud-hypervisor"), "Upgraded binaries must be recognized")
+	assert.False(t, matchesHypervisorBinary("/opt/ch/v41/cloud-hypervisor", "/usr/bin/cloud-hypervisor"), "Binaries with the same name elsewhere are not adopted")
+	assert.False(t, matchesHypervisorBinary("/home/user/cloud-hypervisor (deleted)", "/usr/bin/cloud-hypervisor"))
+	assert.False(t, matchesHypervisorBinary("/usr/bin/bash", "/usr/bin/cloud-hypervisor"))
+
+	var folder string = t.TempDir()
+	var binary string = filepath.Join(folder, "cloud-hypervisor")
+	assert.Nil(t, os.WriteFile(binary, []byte{}, 0755))
+	assert.Nil(t, os.Symlink(binary, filepath.Join(folder, "current")))
+	assert.True(t, matchesHypervisorBinary(binary+" (deleted)", filepath.Join(folder, "current")), "Symlinks in the configured path are resolved")
+}
+
+func Test_SharesHypervisorBinaryName(t *testing.T) {
+	assert.True(t, sharesHypervisorBinaryName("/opt/ch/v40/cloud-hypervisor", "/usr/bin/cloud-hypervisor"))
+	assert.True(t, sharesHypervisorBinaryName("/opt/ch/v40/cloud-hypervisor (deleted)", "/usr/bin/cloud-hypervisor"))
+	assert.False(t, sharesHypervisorBinaryName("/usr/bin/bash", "/usr/bin/cloud-hypervisor"))
+
+	var folder string = t.TempDir()
+	var binary string = filepath.Join(folder, "cloud-hypervisor-v41")
+	assert.Nil(t, os.WriteFile(binary, []byte{}, 0755))
+	assert.Nil(t, os.Symlink(binary, filepath.Join(folder, "cloud-hypervisor")))
+	assert.True(t, sharesHypervisorBinaryName("/opt/old/cloud-hypervisor-v41", filepath.Join(folder, "cloud-hypervisor")), "Names of the symlink target are matched too")
+	assert.False(t, sharesHypervisorBinaryName("/opt/old/cloud-hypervisor-v40", filepath.Join(folder, "cloud-hypervisor")))
+}
+
+func Test_ReadProcStartTime(t *testing.T) {
+	var procPath string = t.TempDir()
+	fakeProcess(t, procPath, 42, "/usr/bin/cloud-hypervisor", "")
+	startTime, err := readProcStartTime(procPath, 42)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(4200), startTime, "Comm with spaces must not shift the fields")
+}
+
+func Test_procStartedAt(t *testing.T) {
+	var procPath string = t.TempDir()
+	assert.True(t, procStartedAt(procPath, 4200).IsZero(), "Boot time is unknown without /proc/stat")
+	assert.Nil(t, os.WriteFile(filepath.Join(procPath, "stat"), []byte("cpu  1 2 3 4\nbtime 1700000000\nprocesses 42\n"), 0644))
+	assert.Equal(t, time.Unix(1700000042, 0).UTC(), procStartedAt(procPath, 4200), "Start time is given in clock ticks after boot")
+}
+
+func Test_LoadProcessData(t *testing.T) {
+	var procPath string = t.TempDir()
+	var binary string = "/usr/bin/cloud-hypervisor"
+	fakeProcess(t, procPath, 10, binary, binary+"\000--api-socket\000path=/run/ch/a.sock\000")
+	fakeProcess(t, procPath, 11, binary+" (deleted)", binary+"\000--api-socket=path=/run/ch/b.sock\000--disk\000path=/a\000path=/b\000")
+	fakeProcess(t, procPath, 12, binary, binary+"\000--api-socket\000fd=3\000")
+	fakeProcess(t, procPath, 13, binary, binary+"\000--kernel\000/boot/vmlinux\000")
+	fakeProcess(t, procPath, 14, "/usr/bin/bash", "bash\000")
+	fakeProcess(t, procPath, 15, "/opt/ch/v40/cloud-hypervisor", "cloud-hypervisor\000--api-socket\000path=/run/ch/d.sock\000")
+	assert.Nil(t, os.Symlink("socket:[9876]", filepath.Join(procPath, "12", "fd", "3")))
+	var netUnix string = "Num       RefCount Protocol Flags    Type St Inode Path\n" +
+		"0000000000000000: 00000002 00000000 00010000 0001 01 1234 /run/other.sock\n" +
+		"0000000000000000: 00000002 00000000 00010000 0001 01 9876 /run/ch/c.sock\n"
+	assert.Nil(t, os.WriteFile(filepath.Join(procPath, "12", "net", "unix"), []byte(netUnix), 0644))
+	assert.Nil(t, os.MkdirAll(filepath.Join(procPath, "self"), 0755))
+
+	processes, err := LoadProcessData(procPath, binary)
+	assert.Nil(t, err)
+	var byPid map[int]*HypervisorProcess = make(map[int]*HypervisorProcess)
+	for _, process := range processes {
+		byPid[process.Pid] = process
+	}
+	assert.Len(t, byPid, 5)
+	assert.Equal(t, "/run/ch/a.sock", byPid[10].SocketPath)
+	assert.False(t, byPid[10].BinaryDeleted)
+	assert.Equal(t, "/run/ch/b.sock", byPid[11].SocketPath)
+	assert.True(t, byPid[11].BinaryDeleted)
+	assert.Equal(t, binary, byPid[11].Exe)
+	assert.Equal(t, "/run/ch/c.sock", byPid[12].SocketPath, "Inherited sockets must be resolved through /proc/net/unix")
+	assert.Equal(t, "", byPid[13].SocketPath)
+	assert.NotEmpty(t, byPid[13].Problem)
+	assert.Equal(t, uint64(1000), byPid[10].StartTime)
+	assert.False(t, byPid[10].ForeignBinary)
+	assert.True(t, byPid[15].ForeignBinary, "Processes of a previous symlink target are kept as foreign")
+	assert.Equal(t, "/run/ch/d.sock", byPid[15].SocketPath)
+}
+
+func Test_HypervisorMonitor_adoptProcess(t *testing.T) {
+	hm := &HypervisorMonitor{logger: zap.NewNop()}
+	orphan := hm.adoptProcess(&HypervisorProcess{Pid: 15, Exe: "/opt/ch/v40/cloud-hypervisor", ForeignBinary: true, SocketPath: "/run/ch/d.sock"})
+	if assert.NotNil(t, orphan) {
+		assert.Equal(t, ORPHAN_FOREIGN_BINARY, orphan.Reason, "A foreign binary is never adopted on its own")
+		assert.Contains(t, orphan.Detail, "/opt/ch/v40/cloud-hypervisor")
+		assert.Equal(t, "/run/ch/d.sock", orphan.SocketPath)
+	}
+	orphan = hm.adoptProcess(&HypervisorProcess{Pid: 13, Exe: "/usr/bin/cloud-hypervisor", Problem: "started without --api-socket"})
+	if assert.NotNil(t, orphan) {
+		assert.Equal(t, ORPHAN_NO_SOCKET, orphan.Reason)
+	}
+}
+
+func Test_ReadProcessUsage(t *testing.T) {
+	var procPath string = t.TempDir()
+	fakeProcess(t, procPath, 42, "/usr/bin/cloud-hypervisor", "")
+	var stat string = "42 (cloud hyper) S 1 1 1 0 -1 4194560 0 0 0 0 250 50 0 0 20 0 4 0 4200 1000 16 0"
+	assert.Nil(t, os.WriteFile(filepath.Join(procPath, "42", "stat"), []byte(stat), 0644))
+	usage, err := readProcessUsage(procPath, 42)
+	assert.Nil(t, err)
+	assert.Equal(t, 3.0, usage.CpuSeconds)
+	assert.Equal(t, int64(16*os.Getpagesize()), usage.RssBytes)
+}
@@ -0,0 +1,214 @@
+package vmm
+
+import (
+	"fmt"
+	"os"
+	"reflect"
+	"sync"
+	"vmm/utils"
+)
+
+// A nil limit means unlimited
+type Quota struct {
+	MaxVirtualMachines *int64 `json:"max_virtual_machines,omitempty" yaml:"max_virtual_machines,omitempty"`
+	MaxCpus            *int64 `json:"max_cpus,omitempty" yaml:"max_cpus,omitempty"`
+	MaxMemory          *int64 `json:"max_memory,omitempty" yaml:"max_memory,omitempty"`
+	MaxDiskBytes       *int64 `json:"max_disk_bytes,omitempty" yaml:"max_disk_bytes,omitempty"`
+	MaxVpcNetworks     *int64 `json:"max_vpc_networks,omitempty" yaml:"max_vpc_networks,omitempty"`
+	MaxPublicIps       *int64 `json:"max_public_ips,omitempty" yaml:"max_public_ips,omitempty"`
+}
+
+type QuotaUsage struct {
+	VirtualMachines int64 `json:"virtual_machines" yaml:"virtual_machines"`
+	Cpus            int64 `json:"cpus" yaml:"cpus"`
+	Memory          int64 `json:"memory" yaml:"memory"`
+	DiskBytes       int64 `json:"disk_bytes" yaml:"disk_bytes"`
+	VpcNetworks     int64 `json:"vpc_networks" yaml:"vpc_networks"`
+	PublicIps       int64 `json:"public_ips" yaml:"public_ips"`
+}
+
+func (u QuotaUsage) Add(other QuotaUsage) QuotaUsage {
+	return QuotaUsage{
+		VirtualMachines: u.VirtualMachines + other.VirtualMachines,
+		Cpus:            u.Cpus + other.Cpus,
+		Memory:          u.Memory + other.Memory,
+		DiskBytes:       u.DiskBytes + other.DiskBytes,
+		VpcNetworks:     u.VpcNetworks + other.VpcNetworks,
+		PublicIps:       u.PublicIps + other.PublicIps,
+	}
+}
+
+func (q *Quota) Validate() error {
+	limits := map[string]*int64{
+		"max_virtual_machines": q.MaxVirtualMachines,
+		"max_cpus":             q.MaxCpus,
+		"max_memory":           q.MaxMemory,
+		"max_disk_bytes":       q.MaxDiskBytes,
+		"max_vpc_networks":     q.MaxVpcNetworks,
+		"max_public_ips":       q.MaxPublicIps,
+	}
+	for name, limit := range limits {
+		if limit != nil && *limit < 0 {
+			return fmt.Errorf("%s must not be negative", name)
+		}
+	}
+	return nil
+}
+
+// Check verifies that usage fits the quota. Only resources actually requested are checked,
+// so a tenant already above a lowered limit can still shrink or do unrelated changes
+func (q *Quota) Check(tenant string, usage QuotaUsage, requested QuotaUsage) error {
+	checks := []struct {
+		resource  string
+		limit     *int64
+		usage     int64
+		requested int64
+	}{
+		{"virtual machines", q.MaxVirtualMachines, usage.VirtualMachines, requested.VirtualMachines},
+		{"cpus", q.MaxCpus, usage.Cpus, requested.Cpus},
+		{"memory bytes", q.MaxMemory, usage.Memory, requested.Memory},
+		{"disk bytes", q.MaxDiskBytes, usage.DiskBytes, requested.DiskBytes},
+		{"vpc networks", q.MaxVpcNetworks, usage.VpcNetworks, requested.VpcNetworks},
+		{"public ips", q.MaxPublicIps, usage.PublicIps, requested.PublicIps},
+	}
+	for _, check := range checks {
+		if check.limit == nil || check.requested <= 0 {
+			continue
+		}
+		if check.usage+check.requested > *check.limit {
+			return &ErrQuotaExceeded{
+				Tenant:    tenant,
+				Resource:  check.resource,
+				Limit:     *check.limit,
+				Usage:     check.usage,
+				Requested: check.requested,
+			}
+		}
+	}
+	return nil
+}
+
+type ErrQuotaExceeded struct {
+	Tenant    string
+	Resource  string
+	Limit     int64
+	Usage     int64
+	Requested int64
+}
+
+func (err *ErrQuotaExceeded) Error() string {
+	return fmt.Sprintf("quota exceeded for tenant %s: %s limit is %d, used %d, requested %d", err.Tenant, err.Resource, err.Limit, err.Usage, err.Requested)
+}
+
+type QuotaStorage struct{}
+
+func (s *QuotaStorage) ReadSnapshot(path string) (map[string]Quota, error) {
+	return utils.ReadGobFile[map[string]Quota](path)
+}
+
+func (s *QuotaStorage) WriteSnapshot(path string, db map[string]Quota) error {
+	return utils.WriteGobFile(path, db)
+}
+
+type QuotaStorageRepository interface {
+	ReadSnapshot(path string) (map[string]Quota, error)
+	WriteSnapshot(path string, db map[string]Quota) error
+}
+
+type QuotaManager struct {
+	snapshotPath string
+	quotas       map[string]Quota
+	mu           sync.Mutex
+	storage      QuotaStorageRepository
+}
+
+func NewQuotaManager(snapshotPath string) (*QuotaManager, error) {
+	return newQuotaManager(snapshotPath, new(QuotaStorage))
+}
+
+func newQuotaManager(snapshotPath string, storage QuotaStorageRepository) (*QuotaManager, error) {
+	quotas, err := storage.ReadSnapshot(snapshotPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if quotas == nil {
+		quotas = make(map[string]Quota)
+	}
+	return &QuotaManager{
+		snapshotPath: snapshotPath,
+		quotas:       quotas,
+		storage:      storage,
+	}, nil
+}
+
+// GetQuota returns the quota of a tenant, tenants without quota are unlimited
+func (qm *QuotaManager) GetQuota(tenant string) Quota {
+	qm.mu.Lock()
+	defer qm.mu.Unlock()
+	return qm.quotas[tenant]
+}
+
+func (qm *QuotaManager) ListQuotas() map[string]Quota {
+	qm.mu.Lock()
+	defer qm.mu.Unlock()
+	res := make(map[string]Quota, len(qm.quotas))
+	for tenant, quota := range qm.quotas {
+		res[tenant] = quota
+	}
+	return res
+}
+
+func (qm *QuotaManager) SetQuota(tenant string, quota Quota) error {
+	err := quota.Validate()
+	if err != nil {
+		return err
+	}
+	qm.mu.Lock()
+	defer qm.mu.Unlock()
+	previous, existed := qm.quotas[tenant]
+	qm.quotas[tenant] = quota
+	err = qm.storage.WriteSnapshot(qm.snapshotPath, qm.quotas)
+	if err != nil {
+		if existed {
+			qm.quotas[tenant] = previous
+		} else {
+			delete(qm.quotas, tenant)
+		}
+		return err
+	}
+	return nil
+}
+
+func (qm *QuotaManager) DeleteQuota(tenant string) error {
+	qm.mu.Lock()
+	defer qm.mu.Unlock()
+	previous, existed := qm.quotas[tenant]
+	if !existed {
+		return nil
+	}
+	delete(qm.quotas, tenant)
+	err := qm.storage.WriteSnapshot(qm.snapshotPath, qm.quotas)
+	if err != nil {
+		qm.quotas[tenant] = previous
+		return err
+	}
+	return nil
+}
+
+// Reload reads the snapshot again, returns true when the quotas changed
+func (qm *QuotaManager) Reload() (bool, error) {
+	quotas, err := qm.storage.ReadSnapshot(qm.snapshotPath)
+	if err != nil && !os.IsNotExist(err) {
+		return false, err
+	}
+	if quotas == nil {
+		quotas = make(map[string]Quota)
+	}
+	qm.mu.Lock()
+	defer qm.mu.Unlock()
+	if reflect.DeepEqual(qm.quotas, quotas) {
+		return false, nil
+	}
+	qm.quotas = quotas
+	return true, nil
+}
@@ -0,0 +1,120 @@
+package vmm
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type MockedStorageQuota struct {
+	snapshot map[string]Quota
+	writeErr error
+	writes   int
+}
+
+func (ms *MockedStorageQuota) ReadSnapshot(path string) (map[string]Quota, error) {
+	if ms.snapshot == nil {
+		return nil, os.ErrNotExist
+	}
+	return ms.snapshot, nil
+}
+
+func (ms *MockedStorageQuota) WriteSnapshot(path string, db map[string]Quota) error {
+	ms.writes++
+	return ms.writeErr
+}
+
+func quotaLimit(v int64) *int64 {
+	return &v
+}
+
+func Test_Quota_Check(t *testing.T) {
+	quota := Quota{
+		MaxCpus:   quotaLimit(8),
+		MaxMemory: quotaLimit(4096),
+	}
+	usage := QuotaUsage{Cpus: 6, Memory: 1024}
+
+	assert.Nil(t, quota.Check("t", usage, QuotaUsage{Cpus: 2}), "Exactly reaching the limit must be allowed")
+	assert.Nil(t, quota.Check("t", usage, QuotaUsage{DiskBytes: 1 << 40}), "Unlimited resources must not be checked")
+
+	err := quota.Check("t", usage, QuotaUsage{Cpus: 3})
+	var errQuota *ErrQuotaExceeded
+	assert.True(t, errors.As(err, &errQuota))
+	assert.Equal(t, "cpus", errQuota.Resource)
+	assert.Equal(t, int64(8), errQuota.Limit)
+	assert.Equal(t, int64(6), errQuota.Usage)
+	assert.Equal(t, int64(3), errQuota.Requested)
+
+	over := QuotaUsage{Cpus: 10, Memory: 1024}
+	assert.Nil(t, quota.Check("t", over, QuotaUsage{Cpus: -2}), "Shrinking above a lowered limit must be allowed")
+	assert.Nil(t, quota.Check("t", over, QuotaUsage{Memory: 1024}), "Unrelated resources must not be blocked")
+}
+
+func Test_Quota_Validate(t *testing.T) {
+	assert.Nil(t, (&Quota{}).Validate())
+	assert.Nil(t, (&Quota{MaxVirtualMachines: quotaLimit(0)}).Validate())
+	assert.NotNil(t, (&Quota{MaxPublicIps: quotaLimit(-1)}).Validate())
+}
+
+func Test_QuotaManager_SetQuota(t *testing.T) {
+	storage := &MockedStorageQuota{}
+	qm, err := newQuotaManager("quotas.snapshot", storage)
+	assert.Nil(t, err)
+	assert.Equal(t, Quota{}, qm.GetQuota("tenant"), "Tenants without quota are unlimited")
+
+	err = qm.SetQuota("tenant", Quota{MaxCpus: quotaLimit(4)})
+	assert.Nil(t, err)
+	assert.Equal(t, int64(4), *qm.GetQuota("tenant").MaxCpus)
+	assert.Equal(t, 1, storage.writes)
+
+	err = qm.SetQuota("tenant", Quota{MaxCpus: quotaLimit(-4)})
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, storage.writes, "Invalid quotas must not be stored")
+
+	storage.writeErr = errors.New("disk full")
+	err = qm.SetQuota("tenant", Quota{MaxCpus: quotaLimit(16)})
+	assert.NotNil(t, err)
+	assert.Equal(t, int64(4), *qm.GetQuota("tenant").MaxCpus, "A failed write must restore the previous quota")
+
+	err = qm.SetQuota("other", Quota{MaxCpus: quotaLimit(16)})
+	assert.NotNil(t, err)
+	_, ok := qm.ListQuotas()["other"]
+	assert.False(t, ok)
+}
+
+func Test_QuotaManager_DeleteQuota(t *testing.T) {
+	storage := &MockedStorageQuota{
+		snapshot: map[string]Quota{"tenant": {MaxVirtualMachines: quotaLimit(2)}},
+	}
+	qm, err := newQuotaManager("quotas.snapshot", storage)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(2), *qm.GetQuota("tenant").MaxVirtualMachines)
+
+	storage.writeErr = errors.New("disk full")
+	assert.NotNil(t, qm.DeleteQuota("tenant"))
+	assert.Len(t, qm.ListQuotas(), 1)
+
+	storage.writeErr = nil
+	assert.Nil(t, qm.DeleteQuota("tenant"))
+	assert.Len(t, qm.ListQuotas(), 0)
+	assert.Nil(t, qm.DeleteQuota("missing"))
+}
+
+func Test_QuotaManager_Reload(t *testing.T) {
+	storage := &MockedStorageQuota{}
+	qm, err := newQuotaManager("quotas.snapshot", storage)
+	assert.Nil(t, err)
+
+	changed, err := qm.Reload()
+	assert.Nil(t, err)
+	assert.False(t, changed)
+
+	storage.snapshot = map[string]Quota{"tenant": {MaxCpus: quotaLimit(8)}}
+	changed, err = qm.Reload()
+	assert.Nil(t, err)
+	assert.True(t, changed)
+	assert.Equal(t, int64(8), *qm.GetQuota("tenant").MaxCpus)
+}
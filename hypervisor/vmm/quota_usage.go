@@ -0,0 +1,173 @@
+package vmm
+
+import (
+	"errors"
+	"vmm/events"
+	virtualmachine "vmm/virtual_machine"
+	vmnetwork_utility "vmm/vm_networking"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+// guestQuotaUsage returns what a guest config consumes from its tenant quota.
+// Vpc networks are counted only when the tenant does not own them yet
+func (hm *HypervisorMonitor) guestQuotaUsage(tenant uuid.UUID, config virtualmachine.Config) (QuotaUsage, error) {
+	res := GuestResources(config)
+	usage := QuotaUsage{
+		Cpus:      res.Cpus,
+		Memory:    res.Memory,
+		PublicIps: int64(len(config.Network.Addresses)),
+	}
+	seen := make(map[string]struct{})
+	for _, vpc := range config.Vpc {
+		if len(vpc.Addresses) < 1 {
+			continue
+		}
+		_, ipNet, err := vmnetwork_utility.ParseCIDR4(vpc.Addresses[0], vpc.Mask)
+		if err != nil {
+			return QuotaUsage{}, err
+		}
+		if _, ok := seen[ipNet.String()]; ok {
+			continue
+		}
+		seen[ipNet.String()] = struct{}{}
+		if !hm.vpcManager.HasNetwork(tenant, *ipNet) {
+			usage.VpcNetworks += 1
+		}
+	}
+	return usage, nil
+}
+
+// Caller must hold admissionMu
+func (hm *HypervisorMonitor) tenantUsageLocked(tenant string) QuotaUsage {
+	hm.vmsMu.Lock()
+	var vms []*virtualmachine.VirtualMachine = make([]*virtualmachine.VirtualMachine, 0)
+	for _, vm := range hm.virtualMachines {
+		if vm.GetManifest().Tenant.String() == tenant {
+			vms = append(vms, vm)
+		}
+	}
+	hm.vmsMu.Unlock()
+
+	var usage QuotaUsage
+	for _, vm := range vms {
+		manifest := vm.GetManifest()
+		res := GuestResources(manifest.Config)
+		usage.VirtualMachines += 1
+		usage.Cpus += res.Cpus
+		usage.Memory += res.Memory
+		usage.PublicIps += int64(len(manifest.Config.Network.Addresses))
+		diskBytes, err := vm.GetDiskUsage()
+		if err != nil {
+			hm.logger.Warn("unable to compute disk usage", zap.String("vm_id", manifest.GuestIdentifier.String()), zap.String("error", err.Error()))
+		}
+		usage.DiskBytes += diskBytes
+	}
+	for _, upload := range hm.uploads {
+		if upload.Tenant == tenant {
+			usage.DiskBytes += upload.Size
+		}
+	}
+	if tenantId, err := uuid.Parse(tenant); err == nil {
+		usage.VpcNetworks = int64(hm.vpcManager.CountNetworks(tenantId))
+	}
+	return usage
+}
+
+// Caller must hold admissionMu. Violations are published, so they can be acted upon
+func (hm *HypervisorMonitor) checkQuotaLocked(tenant string, requested QuotaUsage) error {
+	quota := hm.quotaManager.GetQuota(tenant)
+	err := quota.Check(tenant, hm.tenantUsageLocked(tenant), requested)
+	var errQuota *ErrQuotaExceeded
+	if errors.As(err, &errQuota) {
+		hm.publishTenantEvent(events.QUOTA_EXCEEDED, tenant, map[string]any{
+			"resource":  errQuota.Resource,
+			"limit":     errQuota.Limit,
+			"usage":     errQuota.Usage,
+			"requested": errQuota.Requested,
+		})
+	}
+	return err
+}
+
+type TenantQuota struct {
+	Tenant string     `json:"tenant" yaml:"tenant"`
+	Quota  Quota      `json:"quota" yaml:"quota"`
+	Usage  QuotaUsage `json:"usage" yaml:"usage"`
+}
+
+func (hm *HypervisorMonitor) GetTenantQuota(tenant string) TenantQuota {
+	hm.admissionMu.Lock()
+	defer hm.admissionMu.Unlock()
+	return TenantQuota{
+		Tenant: tenant,
+		Quota:  hm.quotaManager.GetQuota(tenant),
+		Usage:  hm.tenantUsageLocked(tenant),
+	}
+}
+
+func (hm *HypervisorMonitor) ListTenantQuotas() []TenantQuota {
+	hm.admissionMu.Lock()
+	defer hm.admissionMu.Unlock()
+	quotas := hm.quotaManager.ListQuotas()
+	res := make([]TenantQuota, 0, len(quotas))
+	for tenant, quota := range quotas {
+		res = append(res, TenantQuota{
+			Tenant: tenant,
+			Quota:  quota,
+			Usage:  hm.tenantUsageLocked(tenant),
+		})
+	}
+	return res
+}
+
+func (hm *HypervisorMonitor) SetTenantQuota(tenant string, quota Quota) error {
+	return hm.quotaManager.SetQuota(tenant, quota)
+}
+
+func (hm *HypervisorMonitor) DeleteTenantQuota(tenant string) error {
+	return hm.quotaManager.DeleteQuota(tenant)
+}
+
+// ResizeVirtualMachine changes cpus and memory, zero values keep the current size.
+// Running guests can only give back cpus, they have no room to hotplug more
+func (hm *HypervisorMonitor) ResizeVirtualMachine(ref string, cpus int, memory int64) (*virtualmachine.Manifest, error) {
+	vm := hm.GetVirtualMachine(ref)
+	if vm == nil {
+		return nil, &ErrVirtualMachineNotFound{}
+	}
+	hm.admissionMu.Lock()
+	defer hm.admissionMu.Unlock()
+	manifest := vm.GetManifest()
+	config := manifest.Config
+	if cpus > 0 {
+		config.Cpus = cpus
+	}
+	if memory > 0 {
+		config.Memory = memory
+	}
+	current := GuestResources(manifest.Config)
+	desired := GuestResources(config)
+	delta := desired.Sub(current)
+	if vm.GetStatus().State.IsActive() {
+		err := checkCapacity(hm.capacityLocked().Free, delta)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		err := checkCapacity(hm.capacityLocked().Allocatable, desired)
+		if err != nil {
+			return nil, err
+		}
+	}
+	err := hm.checkQuotaLocked(manifest.Tenant.String(), QuotaUsage{Cpus: delta.Cpus, Memory: delta.Memory})
+	if err != nil {
+		return nil, err
+	}
+	err = vm.RequestResize(config.Cpus, config.Memory)
+	if err != nil {
+		return nil, err
+	}
+	return vm.GetManifest(), nil
+}
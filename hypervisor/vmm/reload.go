@@ -0,0 +1,125 @@
+package vmm
+
+import (
+	"fmt"
+	"reflect"
+	"strings"
+	"vmm/events"
+
+	"go.uber.org/zap"
+)
+
+// ReloadHook prepares a component for a reloaded manifest. The returned apply runs
+// once every hook accepted the manifest, an error refuses the reload
+type ReloadHook func(manifest *Manifest) (apply func(), err error)
+
+// ErrRestartRequired is returned when the reloaded manifest changes fields that only apply at startup
+type ErrRestartRequired struct {
+	Fields []string
+}
+
+func (err *ErrRestartRequired) Error() string {
+	return fmt.Sprintf("%s can only change with a restart of the monitor", strings.Join(err.Fields, ", "))
+}
+
+type ReloadResult struct {
+	Changed []string `json:"changed" yaml:"changed"`
+}
+
+type manifestField struct {
+	name    string
+	changed bool
+}
+
+func changedFields(fields []manifestField) []string {
+	var names []string = make([]string, 0)
+	for _, field := range fields {
+		if field.changed {
+			names = append(names, field.name)
+		}
+	}
+	return names
+}
+
+// restartFields lists the changes that running guests, open files or the listener depend on
+func restartFields(current *Manifest, next *Manifest) []string {
+	return changedFields([]manifestField{
+		{"bridge", current.Bridge != next.Bridge},
+		{"hypervisor_path", current.HypervisorPath != next.HypervisorPath},
+		{"socket_uri", current.HypervisorSocketUri != next.HypervisorSocketUri},
+		{"config_folder_path", current.InternalConfigFolderPath != next.InternalConfigFolderPath},
+		{"server.storage_path", current.Server.StoragePath != next.Server.StoragePath},
+		{"server.tls enabled", current.Server.Tls.Enabled() != next.Server.Tls.Enabled()},
+		{"server.unix_socket.path", current.Server.UnixSocket.Path != next.Server.UnixSocket.Path},
+		{"server.unix_socket.mode", current.Server.UnixSocket.Mode != next.Server.UnixSocket.Mode},
+		{"events", current.Events != next.Events},
+		{"history", !reflect.DeepEqual(current.History, next.History)},
+	})
+}
+
+// liveFields lists the changes applied by a reload, new settings apply to the next boot, stop or request
+func liveFields(current *Manifest, next *Manifest) []string {
+	return changedFields([]manifestField{
+		{"cpu_overcommit_factor", current.CpuOvercommitFactor != next.CpuOvercommitFactor},
+		{"memory_overcommit_factor", current.MemoryOvercommitFactor != next.MemoryOvercommitFactor},
+		{"log_level", current.Level() != next.Level()},
+		{"stop", current.Stop != next.Stop},
+		{"logs", current.Logs != next.Logs},
+		{"server.tls", !reflect.DeepEqual(current.Server.Tls, next.Server.Tls)},
+		{"server.unix_socket.peers", !reflect.DeepEqual(current.Server.UnixSocket.Peers, next.Server.UnixSocket.Peers)},
+	})
+}
+
+func (hm *HypervisorMonitor) AddReloadHook(hook ReloadHook) {
+	hm.reloadMu.Lock()
+	defer hm.reloadMu.Unlock()
+	hm.reloadHooks = append(hm.reloadHooks, hook)
+}
+
+// Reload reads the host manifest and the quotas again. Nothing is applied when the manifest
+// is not valid or changes a field requiring a restart, running guests are never touched
+func (hm *HypervisorMonitor) Reload() (ReloadResult, error) {
+	hm.reloadMu.Lock()
+	defer hm.reloadMu.Unlock()
+	var result ReloadResult = ReloadResult{Changed: make([]string, 0)}
+	manifest, err := LoadManifest(hm.manifestPath)
+	if err != nil {
+		return result, err
+	}
+	err = manifest.Validate()
+	if err != nil {
+		return result, err
+	}
+	var current *Manifest = hm.getManifest()
+	if fields := restartFields(current, manifest); len(fields) > 0 {
+		return result, &ErrRestartRequired{Fields: fields}
+	}
+	var applies []func() = make([]func(), 0, len(hm.reloadHooks))
+	for _, hook := range hm.reloadHooks {
+		apply, err := hook(manifest)
+		if err != nil {
+			return result, err
+		}
+		applies = append(applies, apply)
+	}
+	quotasChanged, err := hm.quotaManager.Reload()
+	if err != nil {
+		return result, fmt.Errorf("unable to read quotas: %w", err)
+	}
+
+	result.Changed = liveFields(current, manifest)
+	if quotasChanged {
+		result.Changed = append(result.Changed, "quotas")
+	}
+	hm.SetManifest(manifest)
+	hm.logLevel.SetLevel(manifest.Level())
+	for _, apply := range applies {
+		apply()
+	}
+	hm.logger.Info("Host manifest reloaded", zap.String("path", hm.manifestPath), zap.Strings("changed", result.Changed))
+	hm.bus.Publish(events.Event{
+		Type: events.MONITOR_RELOADED,
+		Data: map[string]any{"changed": result.Changed},
+	})
+	return result, nil
+}
@@ -0,0 +1,26 @@
+package vmm
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_RestartFields(t *testing.T) {
+	var current *Manifest = &Manifest{
+		Bridge:              "br0",
+		CpuOvercommitFactor: 1,
+		Server:              Server{StoragePath: "/var/lib/vmm"},
+	}
+	var next Manifest = *current
+	next.CpuOvercommitFactor = 2
+	next.LogLevel = "debug"
+	next.Server.Tls.ClientCertScopes = []string{"metrics"}
+	assert.Empty(t, restartFields(current, &next))
+	assert.Equal(t, []string{"cpu_overcommit_factor", "log_level", "server.tls"}, liveFields(current, &next))
+
+	next.Bridge = "br1"
+	next.Server.Tls.CertFile = "/etc/vmm/cert.pem"
+	next.History.Interval = 30
+	assert.Equal(t, []string{"bridge", "server.tls enabled", "history"}, restartFields(current, &next))
+}
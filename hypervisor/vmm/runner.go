@@ -1,73 +1,199 @@
 package vmm
 
 import (
-	"encoding/json"
 	"errors"
-	"io"
+	"fmt"
+	"net"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
+	"sync/atomic"
+	"time"
+	"vmm/audit"
+	"vmm/auth"
 	cloudhypervisor "vmm/cloud_hypervisor"
+	"vmm/events"
+	"vmm/metrics"
 	virtualmachine "vmm/virtual_machine"
 	vmnetwork_utility "vmm/vm_networking"
 	vmnetworking "vmm/vm_networking/interface_enumerator"
 	networkvpc "vmm/vm_networking/vpc"
+	"vmm/webhooks"
 
+	"github.com/google/uuid"
 	"go.uber.org/zap"
-	"gopkg.in/yaml.v3"
 )
 
+const stateRefreshInterval = 5 * time.Second
+
 type HypervisorMonitor struct {
 	virtualMachines   map[string]*virtualmachine.VirtualMachine
+	labelIndex        *LabelIndex
+	nameIndex         *NameIndex
 	vmsMu             sync.Mutex
 	logger            *zap.Logger
-	manifest          *Manifest
+	manifest          atomic.Pointer[Manifest]
+	manifestPath      string
+	logLevel          zap.AtomicLevel
 	networkEnumerator *vmnetworking.NetworkEnumerator
 	vpcManager        *networkvpc.VpcManager
+	hostResources     Resources
+	pendingBoots      map[string]struct{}
+	quotaManager      *QuotaManager
+	applySets         *ApplySetManager
+	uploads           map[string]*UploadSession
+	orphans           map[int]*Orphan
+	orphansMu         sync.Mutex
+	bus               *events.Bus
+	journal           *events.Journal
+	webhooks          *webhooks.Manager
+	tokens            *auth.TokenStore
+	audit             *audit.Log
+	metrics           *metrics.Registry
+	uploadBytes       *metrics.CounterVec
+	observer          *vmObserver
+	history           map[string]*historyEntry
+	historyMu         sync.Mutex
+	// Serializes capacity and quota checks with the change they admit
+	admissionMu sync.Mutex
+	reloadHooks []ReloadHook
+	// Serializes applies, so the resources of a set are recorded in order
+	applyMu sync.Mutex
+	// Serializes reloads of the host manifest
+	reloadMu sync.Mutex
+	// Closed by Shutdown, stops the background loops
+	done         chan struct{}
+	loops        sync.WaitGroup
+	shutdownOnce sync.Once
+	// Held for reading by restarts, Shutdown waits for the running ones
+	restartMu sync.RWMutex
 }
 
-func NewHypervisorMonitor(logger *zap.Logger, manifestPath string) (*HypervisorMonitor, error) {
-	fileBytes, err := os.ReadFile(manifestPath)
+// NewHypervisorMonitor reads the host manifest, the level of logger follows its log_level and reloads
+func NewHypervisorMonitor(logger *zap.Logger, logLevel zap.AtomicLevel, manifestPath string) (*HypervisorMonitor, error) {
+	manifest, err := LoadManifest(manifestPath)
 	if err != nil {
 		return nil, err
 	}
-	manifest := &Manifest{}
-	err = yaml.Unmarshal(fileBytes, manifest)
+	err = manifest.Validate()
 	if err != nil {
 		return nil, err
 	}
+	logLevel.SetLevel(manifest.Level())
 	enumeratorFilePath := filepath.Join(manifest.InternalConfigFolderPath, "enumerator_config.json")
 	vpcSnapshotFilePath := filepath.Join(manifest.InternalConfigFolderPath, "vpc_config.snapshot")
 	vpcChangesFilePath := filepath.Join(manifest.InternalConfigFolderPath, "vpc_changes.aof")
+	quotaSnapshotFilePath := filepath.Join(manifest.InternalConfigFolderPath, "quotas.snapshot")
+	eventsJournalFilePath := filepath.Join(manifest.InternalConfigFolderPath, "events.journal")
+	webhooksSnapshotFilePath := filepath.Join(manifest.InternalConfigFolderPath, "webhooks.snapshot")
+	applySetsSnapshotFilePath := filepath.Join(manifest.InternalConfigFolderPath, "apply_sets.snapshot")
 	networkEnumerator, err := vmnetworking.NewNetworkEnumerator(enumeratorFilePath)
 	if err != nil {
 		return nil, err
 	}
-	return &HypervisorMonitor{
+	quotaManager, err := NewQuotaManager(quotaSnapshotFilePath)
+	if err != nil {
+		return nil, err
+	}
+	applySets, err := NewApplySetManager(applySetsSnapshotFilePath)
+	if err != nil {
+		return nil, err
+	}
+	hostResources, err := DiscoverHostResources()
+	if err != nil {
+		return nil, err
+	}
+	journal, err := events.OpenJournal(eventsJournalFilePath, manifest.Events.JournalSize)
+	if err != nil {
+		return nil, err
+	}
+	webhookManager, err := webhooks.NewManager(webhooksSnapshotFilePath, logger)
+	if err != nil {
+		return nil, err
+	}
+	tokens, err := auth.OpenTokenStore(manifest.TokensFilePath())
+	if err != nil {
+		return nil, err
+	}
+	auditLog, err := audit.OpenLog(manifest.AuditLogFilePath())
+	if err != nil {
+		return nil, err
+	}
+	logger.Info("Host resources discovered", zap.Int64("cpus", hostResources.Cpus), zap.Int64("memory", hostResources.Memory))
+	hm := &HypervisorMonitor{
 		virtualMachines:   make(map[string]*virtualmachine.VirtualMachine),
+		labelIndex:        NewLabelIndex(),
+		nameIndex:         NewNameIndex(),
 		logger:            logger,
-		manifest:          manifest,
+		manifestPath:      manifestPath,
+		logLevel:          logLevel,
 		networkEnumerator: networkEnumerator,
 		vpcManager:        networkvpc.NewVpcManager(vpcSnapshotFilePath, vpcChangesFilePath),
-	}, nil
+		hostResources:     hostResources,
+		pendingBoots:      make(map[string]struct{}),
+		quotaManager:      quotaManager,
+		applySets:         applySets,
+		uploads:           make(map[string]*UploadSession),
+		orphans:           make(map[int]*Orphan),
+		bus:               events.NewBus(),
+		journal:           journal,
+		webhooks:          webhookManager,
+		tokens:            tokens,
+		audit:             auditLog,
+		metrics:           metrics.NewRegistry(),
+		uploadBytes:       metrics.NewCounterVec("chmon_upload_bytes_total", "Bytes written by chunk uploads", "kind"),
+		history:           make(map[string]*historyEntry),
+		done:              make(chan struct{}),
+	}
+	hm.manifest.Store(manifest)
+	hm.observer = &vmObserver{hm: hm}
+	hm.bus.SetLastId(journal.LastId())
+	hm.bus.AddHook(hm.journalEvent)
+	hm.bus.AddHook(webhookManager.Enqueue)
+	hm.registerMetrics()
+	return hm, nil
 }
 
 func (hm *HypervisorMonitor) MonitorSetup(manifestPath string, vmm *HypervisorMonitor) error {
 	hm.logger.Info("")
-	var hypervisorBinary cloudhypervisor.HypervisorRestServer = *cloudhypervisor.NewHypervisorRestServer(hm.manifest.HypervisorSocketUri)
-	err := vmm.LoadVirtualMachines(hm.manifest.Server.StoragePath)
+	err := hm.vpcManager.LoadFromStorage(hm.getManifest().InternalConfigFolderPath)
+	if err != nil {
+		return fmt.Errorf("unable to load vpc networks: %w", err)
+	}
+	hm.reserveVpcBridges()
+	err = vmm.LoadVirtualMachines(hm.getManifest().Server.StoragePath)
 	if err != nil {
 		return err
 	}
-	err = vmm.MergeRunningInstances(hm.manifest.HypervisorPath, &hypervisorBinary)
+	vmm.LoadDiskUploads()
+	err = vmm.MergeRunningInstances(hm.getManifest().HypervisorPath)
 	if err != nil {
 		return err
 	}
+	hm.RefreshVirtualMachines()
+	hm.webhooks.Start()
+	hm.loops.Add(1)
+	go func() {
+		defer hm.loops.Done()
+		hm.watchVirtualMachines(stateRefreshInterval)
+	}()
+	if interval := hm.getManifest().History.SampleInterval(); interval > 0 {
+		hm.loops.Add(1)
+		go func() {
+			defer hm.loops.Done()
+			hm.recordHistory(interval)
+		}()
+	}
 	return nil
 }
 
 func (hm *HypervisorMonitor) SetManifest(manifest *Manifest) {
-	hm.manifest = manifest
+	hm.manifest.Store(manifest)
+}
+
+func (hm *HypervisorMonitor) getManifest() *Manifest {
+	return hm.manifest.Load()
 }
 
 func (hm *HypervisorMonitor) LoadVirtualMachines(basePath string) error {
@@ -79,96 +205,433 @@ func (hm *HypervisorMonitor) LoadVirtualMachines(basePath string) error {
 	if err != nil {
 		return err
 	}
+	var loaded []*virtualmachine.VirtualMachine = make([]*virtualmachine.VirtualMachine, 0, len(entries))
 	for _, entry := range entries {
 		if !entry.IsDir() {
 			continue
 		}
-		vm, err := virtualmachine.LoadVirtualMachine(filepath.Join(basePath, entry.Name()), hm.logger, hm.manifest.Bridge, hm.networkEnumerator)
+		vm, err := virtualmachine.LoadVirtualMachine(filepath.Join(basePath, entry.Name()), hm.logger, hm.getManifest().Bridge, hm.networkEnumerator, hm.observer)
 		if err != nil {
 			hm.logger.Error("Unable to read manifest from file", zap.String("base_path", basePath), zap.String("vm_id", entry.Name()))
+			continue
+		}
+		loaded = append(loaded, vm)
+	}
+	// The oldest virtual machine keeps its name when manifests on disk collide
+	sort.Slice(loaded, func(i, j int) bool {
+		a, b := loaded[i].GetManifest(), loaded[j].GetManifest()
+		if !a.CreatedAt.Equal(b.CreatedAt) {
+			return a.CreatedAt.Before(b.CreatedAt)
+		}
+		return a.GuestIdentifier.String() < b.GuestIdentifier.String()
+	})
+	for _, vm := range loaded {
+		manifest := vm.GetManifest()
+		id := manifest.GuestIdentifier.String()
+		hm.virtualMachines[id] = vm
+		hm.labelIndex.Add(id, manifest.Labels)
+		err = hm.nameIndex.Add(manifest.Tenant.String(), manifest.Name, id)
+		if err != nil {
+			hm.logger.Error("Duplicated vm name, vm is reachable by id only", zap.String("vm_id", id), zap.String("error", err.Error()))
 		}
-		guestName := vm.GetManifest().GuestIdentifier
-		hm.virtualMachines[guestName.String()] = vm
 	}
 	return nil
 }
 
-func (hm *HypervisorMonitor) MergeRunningInstances(hypervisorBinaryPath string, hypervisorBinary *cloudhypervisor.HypervisorRestServer) error {
-	var err error
-	var instances []*cloudhypervisor.CloudHypervisor
-	instances, err = LoadProcessData(hypervisorBinaryPath)
+// RefreshVirtualMachines derives the state of every virtual machine from its running instance
+func (hm *HypervisorMonitor) RefreshVirtualMachines() {
+	hm.vmsMu.Lock()
+	var vms []*virtualmachine.VirtualMachine = make([]*virtualmachine.VirtualMachine, 0, len(hm.virtualMachines))
+	for _, vm := range hm.virtualMachines {
+		vms = append(vms, vm)
+	}
+	hm.vmsMu.Unlock()
+	for _, vm := range vms {
+		vm.RefreshState()
+	}
+}
+
+func (hm *HypervisorMonitor) watchVirtualMachines(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-hm.done:
+			return
+		case <-ticker.C:
+			hm.RefreshVirtualMachines()
+		}
+	}
+}
+
+// Creation only checks that the guest fits the host,
+// free capacity is checked when the guest is booted
+func (hm *HypervisorMonitor) CreateVirtualMachine(manifest *virtualmachine.Manifest) error {
+	err := manifest.Config.Validate()
+	if err != nil {
+		return err
+	}
+	hm.admissionMu.Lock()
+	defer hm.admissionMu.Unlock()
+	err = checkCapacity(hm.capacityLocked().Allocatable, GuestResources(manifest.Config))
 	if err != nil {
 		return err
 	}
-	for i := 0; i < len(instances); i++ {
-		var manifest cloudhypervisor.Manifest
-		var err error
-		uri, err := hypervisorBinary.GetUri(cloudhypervisor.VirtualMachineAction(cloudhypervisor.INFO))
+	requested, err := hm.guestQuotaUsage(manifest.Tenant, manifest.Config)
+	if err != nil {
+		return err
+	}
+	requested.VirtualMachines = 1
+	err = hm.checkQuotaLocked(manifest.Tenant.String(), requested)
+	if err != nil {
+		return err
+	}
+	hm.vmsMu.Lock()
+	defer hm.vmsMu.Unlock()
+	if manifest.GuestIdentifier == uuid.Nil {
+		manifest.GuestIdentifier = uuid.New()
+	}
+	manifest.CreatedAt = time.Now().UTC()
+	if _, ok := hm.virtualMachines[manifest.GuestIdentifier.String()]; ok {
+		return errors.New("a virtual machine with the same identifier already exists")
+	}
+	err = manifest.ValidateMetadata()
+	if err != nil {
+		return err
+	}
+	if manifest.Name != "" {
+		err = virtualmachine.ValidateName(manifest.Name)
 		if err != nil {
 			return err
 		}
-		res, err := instances[i].HttpClient.Get(uri)
-		if err != nil {
-			return err
+		if _, ok := hm.nameIndex.Get(manifest.Tenant.String(), manifest.Name); ok {
+			return &ErrNameConflict{Tenant: manifest.Tenant.String(), Name: manifest.Name}
 		}
-		if res.StatusCode < 200 || res.StatusCode > 299 {
-			return errors.New("error while retrieving vm info")
+	}
+	added, err := hm.allocateVpcNetworks(manifest.Tenant, manifest.Config.Vpc, nil)
+	if err != nil {
+		return err
+	}
+	vm, err := virtualmachine.NewVirtualMachine(manifest, hm.logger, hm.getManifest().Server.StoragePath, hm.getManifest().Bridge, hm.networkEnumerator, hm.observer)
+	if err != nil {
+		hm.releaseVpcNetworks(manifest.Tenant, added)
+		return err
+	}
+	err = vm.StoreManifest()
+	if err != nil {
+		hm.releaseVpcNetworks(manifest.Tenant, added)
+		return err
+	}
+	err = vm.StoreStatus()
+	if err != nil {
+		hm.releaseVpcNetworks(manifest.Tenant, added)
+		return err
+	}
+	hm.publishVpcNetworksAdded(manifest.Tenant, added)
+	hm.virtualMachines[manifest.GuestIdentifier.String()] = vm
+	hm.labelIndex.Add(manifest.GuestIdentifier.String(), manifest.Labels)
+	err = hm.nameIndex.Add(manifest.Tenant.String(), manifest.Name, manifest.GuestIdentifier.String())
+	if err != nil {
+		return err
+	}
+	hm.publishLifecycle(events.VM_CREATED, manifest)
+	return nil
+}
+
+// UpdateVirtualMachine replaces the hypervisor config of a guest that is not running
+func (hm *HypervisorMonitor) UpdateVirtualMachine(ref string, config virtualmachine.Config) (*virtualmachine.Manifest, error) {
+	vm := hm.GetVirtualMachine(ref)
+	if vm == nil {
+		return nil, &ErrVirtualMachineNotFound{}
+	}
+	err := config.Validate()
+	if err != nil {
+		return nil, err
+	}
+	hm.admissionMu.Lock()
+	defer hm.admissionMu.Unlock()
+	err = checkCapacity(hm.capacityLocked().Allocatable, GuestResources(config))
+	if err != nil {
+		return nil, err
+	}
+	if state := vm.GetStatus().State; state.IsActive() {
+		return nil, fmt.Errorf("virtual machine must be stopped to update its config, current state is %s", state)
+	}
+	manifest := vm.GetManifest()
+	current, err := hm.guestQuotaUsage(manifest.Tenant, manifest.Config)
+	if err != nil {
+		return nil, err
+	}
+	requested, err := hm.guestQuotaUsage(manifest.Tenant, config)
+	if err != nil {
+		return nil, err
+	}
+	requested.Cpus -= current.Cpus
+	requested.Memory -= current.Memory
+	requested.PublicIps -= current.PublicIps
+	err = hm.checkQuotaLocked(manifest.Tenant.String(), requested)
+	if err != nil {
+		return nil, err
+	}
+	added, err := hm.allocateVpcNetworks(manifest.Tenant, config.Vpc, manifest.Config.Vpc)
+	if err != nil {
+		return nil, err
+	}
+	err = vm.UpdateConfig(config)
+	if err != nil {
+		hm.releaseVpcNetworks(manifest.Tenant, added)
+		return nil, err
+	}
+	hm.publishVpcNetworksAdded(manifest.Tenant, added)
+	return vm.GetManifest(), nil
+}
+
+// addedVpcNetwork is a network created for an interface, it is released when the virtual machine is not stored
+type addedVpcNetwork struct {
+	network net.IPNet
+	bridge  string
+}
+
+// allocateVpcNetworks assigns a bridge to every vpc interface and returns the networks it added.
+// Interfaces on a network already present in current or owned by the tenant keep its bridge.
+// Added networks are announced by the caller once the virtual machine is stored
+func (hm *HypervisorMonitor) allocateVpcNetworks(tenant uuid.UUID, vpcs []virtualmachine.VpcNet, current []virtualmachine.VpcNet) ([]addedVpcNetwork, error) {
+	var added []addedVpcNetwork = make([]addedVpcNetwork, 0)
+	for i := 0; i < len(vpcs); i++ {
+		vpc := vpcs[i]
+		if len(vpc.Addresses) < 1 {
+			hm.releaseVpcNetworks(tenant, added)
+			return nil, errors.New("required at least one ip address for a given interface")
 		}
-		resBody, err := io.ReadAll(res.Body)
+		_, ipNet, err := vmnetwork_utility.ParseCIDR4(vpc.Addresses[0], vpc.Mask)
 		if err != nil {
-			return err
+			hm.releaseVpcNetworks(tenant, added)
+			return nil, err
+		}
+		var bridge string = ""
+		for _, existing := range current {
+			if len(existing.Addresses) < 1 || existing.Bridge == "" {
+				continue
+			}
+			_, existingNet, err := vmnetwork_utility.ParseCIDR4(existing.Addresses[0], existing.Mask)
+			if err == nil && existingNet.String() == ipNet.String() {
+				bridge = existing.Bridge
+				break
+			}
+		}
+		if bridge == "" {
+			bridge = hm.vpcManager.ListNetworks(tenant)[vmnetwork_utility.NetworkToCIDR4(*ipNet)]
 		}
-		err = json.Unmarshal(resBody, &manifest)
+		if bridge == "" {
+			bridge, err = hm.networkEnumerator.GenerateBridgeName()
+			if err != nil {
+				hm.releaseVpcNetworks(tenant, added)
+				return nil, err
+			}
+			err = hm.vpcManager.AddNetwork(tenant, *ipNet, bridge)
+			if err != nil {
+				hm.networkEnumerator.ReleaseBridgeName(bridge)
+				hm.releaseVpcNetworks(tenant, added)
+				return nil, err
+			}
+			added = append(added, addedVpcNetwork{network: *ipNet, bridge: bridge})
+		}
+		vpcs[i].Bridge = bridge
+	}
+	return added, nil
+}
+
+// releaseVpcNetworks removes the networks added for a virtual machine that was not stored
+func (hm *HypervisorMonitor) releaseVpcNetworks(tenant uuid.UUID, added []addedVpcNetwork) {
+	for _, vpc := range added {
+		err := hm.vpcManager.DeleteNetwork(tenant, vpc.network)
 		if err != nil {
-			return err
+			hm.logger.Warn("unable to release vpc network", zap.String("tenant", tenant.String()), zap.String("network", vpc.network.String()), zap.String("error", err.Error()))
+			continue
 		}
-		var vm *virtualmachine.VirtualMachine
-		hm.vmsMu.Lock()
-		vm = hm.virtualMachines[manifest.Platform.Uuid]
-		hm.vmsMu.Unlock()
-		vm.AttachInstance(instances[i])
+		hm.networkEnumerator.ReleaseBridgeName(vpc.bridge)
 	}
+}
+
+func (hm *HypervisorMonitor) publishVpcNetworksAdded(tenant uuid.UUID, added []addedVpcNetwork) {
+	for _, vpc := range added {
+		hm.publishTenantEvent(events.VPC_NETWORK_ADDED, tenant.String(), map[string]any{
+			"network": vpc.network.String(),
+			"bridge":  vpc.bridge,
+		})
+	}
+}
+
+func (hm *HypervisorMonitor) DeleteVirtualMachine(ref string) error {
+	vm := hm.GetVirtualMachine(ref)
+	if vm == nil {
+		return &ErrVirtualMachineNotFound{}
+	}
+	err := vm.RequestDelete()
+	if err != nil {
+		return err
+	}
+	hm.vmsMu.Lock()
+	defer hm.vmsMu.Unlock()
+	manifest := vm.GetManifest()
+	id := manifest.GuestIdentifier.String()
+	delete(hm.virtualMachines, id)
+	hm.labelIndex.Remove(id, manifest.Labels)
+	hm.nameIndex.Remove(manifest.Tenant.String(), manifest.Name, id)
+	hm.closeHistory(id)
+	hm.publishLifecycle(events.VM_DELETED, manifest)
 	return nil
 }
 
-func (hm *HypervisorMonitor) CreateVirtualMachine(manifest *virtualmachine.Manifest) error {
+// UpdateVirtualMachineMetadata patches labels and annotations, a nil value removes the key
+func (hm *HypervisorMonitor) UpdateVirtualMachineMetadata(ref string, labels map[string]*string, annotations map[string]*string) (*virtualmachine.Manifest, error) {
 	hm.vmsMu.Lock()
 	defer hm.vmsMu.Unlock()
-	for i := 0; i < len(manifest.Config.Vpc); i++ {
-		vpc := manifest.Config.Vpc[i]
-		if len(vpc.Addresses) < 1 {
-			return errors.New("required at least one ip address for a given interface")
+	vm := hm.resolveLocked(ref)
+	if vm == nil {
+		return nil, &ErrVirtualMachineNotFound{}
+	}
+	previous, current, err := vm.UpdateMetadata(labels, annotations)
+	if err != nil {
+		return nil, err
+	}
+	hm.labelIndex.Update(vm.GetManifest().GuestIdentifier.String(), previous, current)
+	return vm.GetManifest(), nil
+}
+
+// RenameVirtualMachine changes the name of a virtual machine, an empty name removes it
+func (hm *HypervisorMonitor) RenameVirtualMachine(ref string, name string) (*virtualmachine.Manifest, error) {
+	if name != "" {
+		err := virtualmachine.ValidateName(name)
+		if err != nil {
+			return nil, err
 		}
-		if len(vpc.Addresses) < 1 {
-			return errors.New("expected at least 1 ip address")
+	}
+	hm.vmsMu.Lock()
+	defer hm.vmsMu.Unlock()
+	vm := hm.resolveLocked(ref)
+	if vm == nil {
+		return nil, &ErrVirtualMachineNotFound{}
+	}
+	manifest := vm.GetManifest()
+	id := manifest.GuestIdentifier.String()
+	tenant := manifest.Tenant.String()
+	if current, ok := hm.nameIndex.Get(tenant, name); ok && current != id {
+		return nil, &ErrNameConflict{Tenant: tenant, Name: name}
+	}
+	err := vm.Rename(name)
+	if err != nil {
+		return nil, err
+	}
+	hm.nameIndex.Remove(tenant, manifest.Name, id)
+	err = hm.nameIndex.Add(tenant, name, id)
+	if err != nil {
+		return nil, err
+	}
+	return vm.GetManifest(), nil
+}
+
+// SelectVirtualMachines returns the virtual machines of a tenant matching the selector.
+// An empty tenant matches every tenant
+func (hm *HypervisorMonitor) SelectVirtualMachines(tenant string, selector *virtualmachine.Selector) []*virtualmachine.VirtualMachine {
+	hm.vmsMu.Lock()
+	defer hm.vmsMu.Unlock()
+	var res []*virtualmachine.VirtualMachine = make([]*virtualmachine.VirtualMachine, 0)
+	for _, vm := range hm.selectLocked(selector) {
+		manifest := vm.GetManifest()
+		if tenant != "" && manifest.Tenant.String() != tenant {
+			continue
 		}
-		_, ipNet, err := vmnetwork_utility.ParseCIDR4(vpc.Addresses[0], vpc.Mask)
-		if err != nil {
-			return err
+		if !selector.Matches(manifest.Labels) {
+			continue
 		}
-		bridge, err := hm.networkEnumerator.GenerateBridgeName()
-		if err != nil {
-			return err
+		res = append(res, vm)
+	}
+	return res
+}
+
+// Caller must hold vmsMu
+func (hm *HypervisorMonitor) selectLocked(selector *virtualmachine.Selector) []*virtualmachine.VirtualMachine {
+	var res []*virtualmachine.VirtualMachine
+	if selector.Empty() {
+		res = make([]*virtualmachine.VirtualMachine, 0, len(hm.virtualMachines))
+		for _, vm := range hm.virtualMachines {
+			res = append(res, vm)
 		}
-		err = hm.vpcManager.AddNetwork(manifest.Tenant, *ipNet, bridge)
-		if err != nil {
-			return err
+		return res
+	}
+	candidates, indexed := hm.labelIndex.Candidates(selector)
+	if !indexed {
+		res = make([]*virtualmachine.VirtualMachine, 0, len(hm.virtualMachines))
+		for _, vm := range hm.virtualMachines {
+			res = append(res, vm)
 		}
-		manifest.Config.Vpc[i].Bridge = bridge
+		return res
 	}
-	return nil
+	res = make([]*virtualmachine.VirtualMachine, 0, len(candidates))
+	for id := range candidates {
+		if vm, ok := hm.virtualMachines[id]; ok {
+			res = append(res, vm)
+		}
+	}
+	return res
 }
 
-func (hm *HypervisorMonitor) GetVirtualMachine(id string) *virtualmachine.VirtualMachine {
+// GetVirtualMachine accepts a vm uuid or "<tenant>/<name>"
+func (hm *HypervisorMonitor) GetVirtualMachine(ref string) *virtualmachine.VirtualMachine {
 	hm.vmsMu.Lock()
 	defer hm.vmsMu.Unlock()
+	return hm.resolveLocked(ref)
+}
+
+// Caller must hold vmsMu
+func (hm *HypervisorMonitor) resolveLocked(ref string) *virtualmachine.VirtualMachine {
+	reference, err := ParseReference(ref)
+	if err != nil {
+		return nil
+	}
+	if reference.Id != "" {
+		return hm.virtualMachines[reference.Id]
+	}
+	id, ok := hm.nameIndex.Get(reference.Tenant, reference.Name)
+	if !ok {
+		return nil
+	}
 	return hm.virtualMachines[id]
 }
 
 func (hm *HypervisorMonitor) GetBinaryPath() string {
-	return hm.manifest.HypervisorPath
+	return hm.getManifest().HypervisorPath
+}
+
+func (hm *HypervisorMonitor) GetLaunchOptions() cloudhypervisor.LaunchOptions {
+	return cloudhypervisor.LaunchOptions{
+		BinaryPath: hm.getManifest().HypervisorPath,
+		RemoteUri:  hm.getManifest().HypervisorSocketUri,
+		Rotation:   hm.getManifest().Logs.Rotation(),
+	}
+}
+
+func (hm *HypervisorMonitor) GetStopTimeouts() cloudhypervisor.StopTimeouts {
+	return hm.getManifest().Stop.Timeouts()
+}
+
+func (hm *HypervisorMonitor) GetTokens() *auth.TokenStore {
+	return hm.tokens
+}
+
+func (hm *HypervisorMonitor) GetAudit() *audit.Log {
+	return hm.audit
+}
+
+func (hm *HypervisorMonitor) GetTlsConfig() TlsConfig {
+	return hm.getManifest().Server.Tls
+}
+
+func (hm *HypervisorMonitor) GetUnixSocketConfig() UnixSocketConfig {
+	return hm.getManifest().Server.UnixSocket
 }
 
 func (hm *HypervisorMonitor) GetRestServerUri() string {
-	return hm.manifest.HypervisorSocketUri
+	return hm.getManifest().HypervisorSocketUri
 }
@@ -0,0 +1,68 @@
+package vmm
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	virtualmachine "vmm/virtual_machine"
+
+	"go.uber.org/zap"
+)
+
+// Shutdown stops the background work and persists the state kept in memory, the api must be
+// drained before. Guests keep running so the next start adopts them, unless stopGuests is set
+func (hm *HypervisorMonitor) Shutdown(stopGuests bool) error {
+	var err error
+	hm.shutdownOnce.Do(func() {
+		close(hm.done)
+		hm.loops.Wait()
+		// Restarts started before done was closed boot their guest, later ones see it closed
+		hm.restartMu.Lock()
+		hm.restartMu.Unlock()
+		if stopGuests {
+			hm.stopVirtualMachines()
+		}
+		hm.webhooks.Stop()
+		hm.closeAllHistory()
+
+		var errs []error = make([]error, 0)
+		if err := hm.vpcManager.MakeSnapshot(); err != nil {
+			errs = append(errs, fmt.Errorf("unable to snapshot vpc networks: %w", err))
+		}
+		if err := hm.networkEnumerator.MakeSnapshot(); err != nil {
+			errs = append(errs, fmt.Errorf("unable to snapshot network enumerator: %w", err))
+		}
+		if err := hm.journal.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("unable to close event journal: %w", err))
+		}
+		if err := hm.audit.Close(); err != nil {
+			errs = append(errs, fmt.Errorf("unable to close audit log: %w", err))
+		}
+		err = errors.Join(errs...)
+		hm.logger.Info("Monitor stopped", zap.Bool("guests_stopped", stopGuests))
+	})
+	return err
+}
+
+// stopVirtualMachines stops every running guest in parallel with the configured timeouts
+func (hm *HypervisorMonitor) stopVirtualMachines() {
+	var wg sync.WaitGroup
+	for _, vm := range hm.listVirtualMachines() {
+		if vm.GetInstance() == nil {
+			continue
+		}
+		wg.Add(1)
+		go func(vm *virtualmachine.VirtualMachine) {
+			defer wg.Done()
+			id := vm.GetManifest().GuestIdentifier.String()
+			err := vm.RequestShutdown(hm.GetStopTimeouts())
+			if err != nil {
+				hm.logger.Error("Unable to stop virtual machine", zap.String("vm_id", id), zap.String("error", err.Error()))
+				return
+			}
+			hm.logger.Info("Virtual machine stopped", zap.String("vm_id", id))
+		}(vm)
+	}
+	wg.Wait()
+}
@@ -0,0 +1,403 @@
+package vmm
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"time"
+	"vmm/events"
+	virtualmachine "vmm/virtual_machine"
+
+	"go.uber.org/zap"
+)
+
+// Progress events of an upload are published at most once per interval
+const uploadProgressInterval = time.Second
+
+type ErrUploadSessionNotFound struct {
+	TmpFileName string
+}
+
+func (err *ErrUploadSessionNotFound) Error() string {
+	return fmt.Sprintf("upload session %s is not found", err.TmpFileName)
+}
+
+// ErrUploadIncomplete is returned when committing an upload with missing bytes
+type ErrUploadIncomplete struct {
+	Received int64
+	Size     int64
+}
+
+func (err *ErrUploadIncomplete) Error() string {
+	return fmt.Sprintf("upload is incomplete, %d of %d bytes received", err.Received, err.Size)
+}
+
+type ErrUploadChecksum struct {
+	Expected string
+	Actual   string
+}
+
+func (err *ErrUploadChecksum) Error() string {
+	return fmt.Sprintf("sha256 of the upload is %s, expected %s", err.Actual, err.Expected)
+}
+
+// ByteRange is an inclusive range of bytes written to an upload
+type ByteRange struct {
+	Start int64 `json:"start" yaml:"start"`
+	End   int64 `json:"end" yaml:"end"`
+}
+
+// addByteRange inserts r in a sorted list of disjoint ranges, overlapping and adjacent ranges are merged
+func addByteRange(ranges []ByteRange, r ByteRange) []ByteRange {
+	var merged []ByteRange = make([]ByteRange, 0, len(ranges)+1)
+	var index int = 0
+	for ; index < len(ranges) && ranges[index].End+1 < r.Start; index++ {
+		merged = append(merged, ranges[index])
+	}
+	for ; index < len(ranges) && ranges[index].Start <= r.End+1; index++ {
+		r.Start = min(r.Start, ranges[index].Start)
+		r.End = max(r.End, ranges[index].End)
+	}
+	merged = append(merged, r)
+	return append(merged, ranges[index:]...)
+}
+
+// UploadSession tracks a disk upload between begin and commit.
+// The declared size is charged to the tenant quota until the disk is committed
+type UploadSession struct {
+	VirtualMachine string `json:"virtual_machine" yaml:"virtual_machine"`
+	Tenant         string `json:"tenant" yaml:"tenant"`
+	FileName       string `json:"file_name" yaml:"file_name"`
+	TmpFileName    string `json:"tmp_file_name" yaml:"tmp_file_name"`
+	Size           int64  `json:"size" yaml:"size"`
+	// Hex sha256 declared at begin, checked at commit when set
+	Sha256 string `json:"sha256,omitempty" yaml:"sha256,omitempty"`
+	// Bytes written so far, chunks written twice are counted once
+	Received int64 `json:"received" yaml:"received"`
+	// Written ranges, sorted and merged, a client resumes by sending what is missing
+	Ranges       []ByteRange `json:"ranges" yaml:"ranges"`
+	CreatedAt    time.Time   `json:"created_at" yaml:"created_at"`
+	lastProgress time.Time
+}
+
+// BeginDiskUpload checks the declared size against the tenant quota and creates the temporary disk
+func (hm *HypervisorMonitor) BeginDiskUpload(ref string, fileName string, size int64, sha256 string) (string, error) {
+	if size <= 0 {
+		return "", errors.New("a positive disk size must be declared")
+	}
+	sha256 = strings.ToLower(sha256)
+	if sha256 != "" && !isSha256(sha256) {
+		return "", fmt.Errorf("invalid sha256 %q", sha256)
+	}
+	vm := hm.GetVirtualMachine(ref)
+	if vm == nil {
+		return "", &ErrVirtualMachineNotFound{}
+	}
+	manifest := vm.GetManifest()
+	tenant := manifest.Tenant.String()
+
+	hm.admissionMu.Lock()
+	defer hm.admissionMu.Unlock()
+	err := hm.checkQuotaLocked(tenant, QuotaUsage{DiskBytes: size})
+	if err != nil {
+		return "", err
+	}
+	tmpFileName, err := vm.CreateDisk(fileName)
+	if err != nil {
+		return "", err
+	}
+	var session *UploadSession = &UploadSession{
+		VirtualMachine: manifest.GuestIdentifier.String(),
+		Tenant:         tenant,
+		FileName:       fileName,
+		TmpFileName:    tmpFileName,
+		Size:           size,
+		Sha256:         sha256,
+		Ranges:         make([]ByteRange, 0),
+		CreatedAt:      time.Now().UTC(),
+	}
+	err = storeUploadSession(vm, *session)
+	if err != nil {
+		if removeErr := vm.RemoveDiskUpload(tmpFileName); removeErr != nil {
+			hm.logger.Warn("unable to remove temporary disk", zap.String("vm_id", session.VirtualMachine), zap.String("tmp_file_name", tmpFileName), zap.String("error", removeErr.Error()))
+		}
+		return "", fmt.Errorf("unable to store upload session: %w", err)
+	}
+	hm.uploads[tmpFileName] = session
+	return tmpFileName, nil
+}
+
+func storeUploadSession(vm *virtualmachine.VirtualMachine, session UploadSession) error {
+	content, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	return vm.StoreUploadSession(session.TmpFileName, content)
+}
+
+// parseUploadSessions reads the stored sessions of a virtual machine.
+// The virtual machine and the temporary disk owning a session are not taken from its content
+func parseUploadSessions(manifest *virtualmachine.Manifest, stored map[string][]byte) ([]*UploadSession, []error) {
+	var sessions []*UploadSession = make([]*UploadSession, 0, len(stored))
+	var errs []error = make([]error, 0)
+	for tmpFileName, content := range stored {
+		var session *UploadSession
+		err := json.Unmarshal(content, &session)
+		if err == nil && (session == nil || session.Size <= 0) {
+			err = errors.New("no declared size")
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("upload session %s: %w", tmpFileName, err))
+			continue
+		}
+		session.VirtualMachine = manifest.GuestIdentifier.String()
+		session.Tenant = manifest.Tenant.String()
+		session.TmpFileName = tmpFileName
+		session.Received = 0
+		for _, r := range session.Ranges {
+			session.Received += r.End - r.Start + 1
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, errs
+}
+
+// LoadDiskUploads restores the upload sessions stored next to the temporary disks,
+// so uploads resume after a restart and their size is charged to the tenant quota again
+func (hm *HypervisorMonitor) LoadDiskUploads() {
+	hm.vmsMu.Lock()
+	var vms []*virtualmachine.VirtualMachine = make([]*virtualmachine.VirtualMachine, 0, len(hm.virtualMachines))
+	for _, vm := range hm.virtualMachines {
+		vms = append(vms, vm)
+	}
+	hm.vmsMu.Unlock()
+	var loaded []*UploadSession = make([]*UploadSession, 0)
+	for _, vm := range vms {
+		manifest := vm.GetManifest()
+		stored, err := vm.ReadUploadSessions()
+		if err != nil {
+			hm.logger.Warn("unable to read upload sessions", zap.String("vm_id", manifest.GuestIdentifier.String()), zap.String("error", err.Error()))
+			continue
+		}
+		sessions, errs := parseUploadSessions(manifest, stored)
+		for _, err := range errs {
+			hm.logger.Warn("unable to restore upload session", zap.String("vm_id", manifest.GuestIdentifier.String()), zap.String("error", err.Error()))
+		}
+		loaded = append(loaded, sessions...)
+	}
+	hm.admissionMu.Lock()
+	for _, session := range loaded {
+		hm.uploads[session.TmpFileName] = session
+	}
+	hm.admissionMu.Unlock()
+}
+
+func isSha256(value string) bool {
+	if len(value) != 64 {
+		return false
+	}
+	return strings.Trim(value, "0123456789abcdef") == ""
+}
+
+// ListDiskUploads returns the pending upload sessions of a virtual machine, oldest first
+func (hm *HypervisorMonitor) ListDiskUploads(ref string) ([]UploadSession, error) {
+	vm := hm.GetVirtualMachine(ref)
+	if vm == nil {
+		return nil, &ErrVirtualMachineNotFound{}
+	}
+	var id string = vm.GetManifest().GuestIdentifier.String()
+	var sessions []UploadSession = make([]UploadSession, 0)
+	hm.admissionMu.Lock()
+	for _, session := range hm.uploads {
+		if session.VirtualMachine == id {
+			var snapshot UploadSession = *session
+			snapshot.Ranges = slices.Clone(session.Ranges)
+			sessions = append(sessions, snapshot)
+		}
+	}
+	hm.admissionMu.Unlock()
+	slices.SortFunc(sessions, func(a UploadSession, b UploadSession) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+	return sessions, nil
+}
+
+// GetDiskUpload returns the upload session of a temporary disk
+func (hm *HypervisorMonitor) GetDiskUpload(ref string, tmpFileName string) (UploadSession, error) {
+	sessions, err := hm.ListDiskUploads(ref)
+	if err != nil {
+		return UploadSession{}, err
+	}
+	for _, session := range sessions {
+		if session.TmpFileName == tmpFileName {
+			return session, nil
+		}
+	}
+	return UploadSession{}, &ErrUploadSessionNotFound{TmpFileName: tmpFileName}
+}
+
+// CheckDiskUploadChunk rejects chunks outside of the declared size
+func (hm *HypervisorMonitor) CheckDiskUploadChunk(ref string, tmpFileName string, rangeStart int64, rangeEnd int64) error {
+	vm := hm.GetVirtualMachine(ref)
+	if vm == nil {
+		return &ErrVirtualMachineNotFound{}
+	}
+	hm.admissionMu.Lock()
+	defer hm.admissionMu.Unlock()
+	session, ok := hm.uploads[tmpFileName]
+	if !ok || session.VirtualMachine != vm.GetManifest().GuestIdentifier.String() {
+		return &ErrUploadSessionNotFound{TmpFileName: tmpFileName}
+	}
+	if rangeStart < 0 || rangeEnd < rangeStart || rangeEnd >= session.Size {
+		return fmt.Errorf("chunk %d-%d is outside of the declared size %d", rangeStart, rangeEnd, session.Size)
+	}
+	return nil
+}
+
+// RecordDiskUploadChunk accounts the bytes written at offset and publishes the upload progress
+func (hm *HypervisorMonitor) RecordDiskUploadChunk(tmpFileName string, offset int64, written int64) {
+	if written <= 0 {
+		return
+	}
+	hm.admissionMu.Lock()
+	session, ok := hm.uploads[tmpFileName]
+	if !ok {
+		hm.admissionMu.Unlock()
+		return
+	}
+	session.Ranges = addByteRange(session.Ranges, ByteRange{Start: offset, End: min(offset+written, session.Size) - 1})
+	session.Received = 0
+	for _, r := range session.Ranges {
+		session.Received += r.End - r.Start + 1
+	}
+	// Sessions stored out of order only lack ranges, which the client sends again
+	var stored UploadSession = *session
+	stored.Ranges = slices.Clone(session.Ranges)
+	defer hm.persistUploadSession(stored)
+	now := time.Now()
+	if session.Received < session.Size && now.Sub(session.lastProgress) < uploadProgressInterval {
+		hm.admissionMu.Unlock()
+		return
+	}
+	session.lastProgress = now
+	var snapshot UploadSession = *session
+	snapshot.Ranges = nil
+	hm.admissionMu.Unlock()
+	hm.publishUploadEvent(events.UPLOAD_PROGRESS, snapshot)
+}
+
+func (hm *HypervisorMonitor) persistUploadSession(session UploadSession) {
+	vm := hm.GetVirtualMachine(session.VirtualMachine)
+	if vm == nil {
+		return
+	}
+	err := storeUploadSession(vm, session)
+	if err != nil {
+		hm.logger.Warn("unable to store upload session", zap.String("vm_id", session.VirtualMachine), zap.String("tmp_file_name", session.TmpFileName), zap.String("error", err.Error()))
+	}
+}
+
+// CommitDiskUpload moves the uploaded disk in place and releases the quota reserved by the upload session.
+// A session must have received every byte, its sha256 is checked against the one given or declared at begin
+func (hm *HypervisorMonitor) CommitDiskUpload(ref string, tmpFileName string, fileName string, sha256 string) error {
+	vm := hm.GetVirtualMachine(ref)
+	if vm == nil {
+		return &ErrVirtualMachineNotFound{}
+	}
+	var id string = vm.GetManifest().GuestIdentifier.String()
+	hm.admissionMu.Lock()
+	pending, ok := hm.uploads[tmpFileName]
+	if !ok || pending.VirtualMachine != id {
+		hm.admissionMu.Unlock()
+		return &ErrUploadSessionNotFound{TmpFileName: tmpFileName}
+	}
+	if pending.Received < pending.Size {
+		hm.admissionMu.Unlock()
+		return &ErrUploadIncomplete{Received: pending.Received, Size: pending.Size}
+	}
+	if sha256 == "" {
+		sha256 = pending.Sha256
+	}
+	hm.admissionMu.Unlock()
+	err := verifyChecksum(sha256, func() (string, error) {
+		return vm.DiskChecksum(tmpFileName)
+	})
+	if err != nil {
+		return err
+	}
+	err = vm.CommitDisk(tmpFileName, fileName)
+	if err != nil {
+		return err
+	}
+	hm.admissionMu.Lock()
+	delete(hm.uploads, tmpFileName)
+	var committed UploadSession = *pending
+	hm.admissionMu.Unlock()
+	err = vm.RemoveDiskUpload(tmpFileName)
+	if err != nil {
+		hm.logger.Warn("unable to remove upload session", zap.String("vm_id", id), zap.String("tmp_file_name", tmpFileName), zap.String("error", err.Error()))
+	}
+	committed.FileName = fileName
+	committed.Ranges = nil
+	hm.publishUploadEvent(events.UPLOAD_COMMITTED, committed)
+	return nil
+}
+
+// verifyChecksum compares the sha256 computed by checksum with the expected one, nothing is checked without one
+func verifyChecksum(expected string, checksum func() (string, error)) error {
+	if expected == "" {
+		return nil
+	}
+	expected = strings.ToLower(expected)
+	if !isSha256(expected) {
+		return fmt.Errorf("invalid sha256 %q", expected)
+	}
+	actual, err := checksum()
+	if err != nil {
+		return err
+	}
+	if actual != expected {
+		return &ErrUploadChecksum{Expected: expected, Actual: actual}
+	}
+	return nil
+}
+
+// CommitKernelUpload moves the uploaded kernel in place, kernels are not charged to quotas
+func (hm *HypervisorMonitor) CommitKernelUpload(ref string, tmpFileName string, fileName string, sha256 string) error {
+	vm := hm.GetVirtualMachine(ref)
+	if vm == nil {
+		return &ErrVirtualMachineNotFound{}
+	}
+	err := verifyChecksum(sha256, func() (string, error) {
+		return vm.KernelChecksum(tmpFileName)
+	})
+	if err != nil {
+		return err
+	}
+	err = vm.CommitKernel(tmpFileName, fileName)
+	if err != nil {
+		return err
+	}
+	hm.publishVirtualMachineEvent(events.UPLOAD_COMMITTED, vm.GetManifest(), map[string]any{
+		"kind":      "kernel",
+		"file_name": fileName,
+	})
+	return nil
+}
+
+func (hm *HypervisorMonitor) publishUploadEvent(eventType string, session UploadSession) {
+	hm.bus.Publish(events.Event{
+		Type:           eventType,
+		VirtualMachine: session.VirtualMachine,
+		Tenant:         session.Tenant,
+		Data: map[string]any{
+			"kind":          "disk",
+			"file_name":     session.FileName,
+			"tmp_file_name": session.TmpFileName,
+			"size":          session.Size,
+			"received":      session.Received,
+		},
+	})
+}
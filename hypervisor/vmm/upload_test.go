@@ -0,0 +1,60 @@
+package vmm
+
+import (
+	"errors"
+	"testing"
+	virtualmachine "vmm/virtual_machine"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_addByteRange(t *testing.T) {
+	var ranges []ByteRange
+	ranges = addByteRange(ranges, ByteRange{Start: 100, End: 199})
+	ranges = addByteRange(ranges, ByteRange{Start: 0, End: 49})
+	assert.Equal(t, []ByteRange{{Start: 0, End: 49}, {Start: 100, End: 199}}, ranges, "Disjoint ranges are kept sorted")
+	ranges = addByteRange(ranges, ByteRange{Start: 50, End: 99})
+	assert.Equal(t, []ByteRange{{Start: 0, End: 199}}, ranges, "Adjacent ranges are merged")
+	ranges = addByteRange(ranges, ByteRange{Start: 150, End: 249})
+	assert.Equal(t, []ByteRange{{Start: 0, End: 249}}, ranges, "Overlapping ranges are merged")
+	ranges = addByteRange(ranges, ByteRange{Start: 400, End: 499})
+	ranges = addByteRange(ranges, ByteRange{Start: 300, End: 349})
+	ranges = addByteRange(ranges, ByteRange{Start: 240, End: 450})
+	assert.Equal(t, []ByteRange{{Start: 0, End: 499}}, ranges, "A range covering several ranges merges all of them")
+	ranges = addByteRange(ranges, ByteRange{Start: 10, End: 20})
+	assert.Equal(t, []ByteRange{{Start: 0, End: 499}}, ranges, "A range written twice is counted once")
+}
+
+func Test_verifyChecksum(t *testing.T) {
+	const empty = "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"
+	var calls int = 0
+	checksum := func() (string, error) {
+		calls++
+		return empty, nil
+	}
+	assert.Nil(t, verifyChecksum("", checksum))
+	assert.Equal(t, 0, calls, "Nothing is hashed without an expected sha256")
+	assert.Nil(t, verifyChecksum(empty, checksum))
+	assert.Nil(t, verifyChecksum("E3B0C44298FC1C149AFBF4C8996FB92427AE41E4649B934CA495991B7852B855", checksum), "The sha256 is not case sensitive")
+	err := verifyChecksum("0000000000000000000000000000000000000000000000000000000000000000", checksum)
+	var errChecksum *ErrUploadChecksum
+	assert.True(t, errors.As(err, &errChecksum))
+	assert.Equal(t, empty, errChecksum.Actual)
+	assert.NotNil(t, verifyChecksum("abc", checksum), "A malformed sha256 is rejected")
+}
+
+func Test_parseUploadSessions(t *testing.T) {
+	manifest := &virtualmachine.Manifest{GuestIdentifier: uuid.New(), Tenant: uuid.New()}
+	sessions, errs := parseUploadSessions(manifest, map[string][]byte{
+		"abc_root.raw.tmp":  []byte(`{"virtual_machine":"other","file_name":"root.raw","tmp_file_name":"other.tmp","size":1000,"received":1000,"ranges":[{"start":0,"end":99},{"start":500,"end":599}]}`),
+		"def_data.raw.tmp":  []byte(`{"file_name":"data.raw"}`),
+		"ghi_cache.raw.tmp": []byte(`not json`),
+	})
+	assert.Len(t, errs, 2, "Sessions without size and unreadable sessions are reported")
+	assert.Len(t, sessions, 1)
+	assert.Equal(t, manifest.GuestIdentifier.String(), sessions[0].VirtualMachine, "The session belongs to the virtual machine it is stored in")
+	assert.Equal(t, manifest.Tenant.String(), sessions[0].Tenant)
+	assert.Equal(t, "abc_root.raw.tmp", sessions[0].TmpFileName)
+	assert.Equal(t, int64(200), sessions[0].Received, "Received bytes are counted from the ranges")
+}
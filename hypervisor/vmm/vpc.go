@@ -0,0 +1,180 @@
+package vmm
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strings"
+	"vmm/events"
+	vmnetwork_utility "vmm/vm_networking"
+
+	"github.com/google/uuid"
+)
+
+// VpcNetwork is a private network of a tenant and the virtual machines attached to it
+type VpcNetwork struct {
+	Tenant          string   `json:"tenant" yaml:"tenant"`
+	Network         string   `json:"network" yaml:"network"`
+	Bridge          string   `json:"bridge" yaml:"bridge"`
+	VirtualMachines []string `json:"virtual_machines" yaml:"virtual_machines"`
+}
+
+type ErrVpcNetworkNotFound struct {
+	Network string
+}
+
+func (err *ErrVpcNetworkNotFound) Error() string {
+	return fmt.Sprintf("vpc network %s is not found", err.Network)
+}
+
+type ErrVpcNetworkExists struct {
+	Network string
+}
+
+func (err *ErrVpcNetworkExists) Error() string {
+	return fmt.Sprintf("vpc network %s already exists", err.Network)
+}
+
+// ErrVpcNetworkInUse is returned when deleting a network with virtual machines attached
+type ErrVpcNetworkInUse struct {
+	Network         string
+	VirtualMachines []string
+}
+
+func (err *ErrVpcNetworkInUse) Error() string {
+	return fmt.Sprintf("vpc network %s is used by %s", err.Network, strings.Join(err.VirtualMachines, ", "))
+}
+
+// ParseVpcNetwork accepts an ipv4 cidr, the address is masked to the network
+func ParseVpcNetwork(cidr string) (net.IPNet, error) {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil || network.IP.To4() == nil {
+		return net.IPNet{}, fmt.Errorf("network must be an ipv4 cidr, found %q", cidr)
+	}
+	return *network, nil
+}
+
+// vpcAttachments maps the networks of a tenant to the virtual machines using them
+func (hm *HypervisorMonitor) vpcAttachments(tenant string) map[string][]string {
+	var attachments map[string][]string = make(map[string][]string)
+	hm.vmsMu.Lock()
+	defer hm.vmsMu.Unlock()
+	for id, vm := range hm.virtualMachines {
+		manifest := vm.GetManifest()
+		if manifest.Tenant.String() != tenant {
+			continue
+		}
+		for _, vpc := range manifest.Config.Vpc {
+			if len(vpc.Addresses) < 1 {
+				continue
+			}
+			_, ipNet, err := vmnetwork_utility.ParseCIDR4(vpc.Addresses[0], vpc.Mask)
+			if err != nil {
+				continue
+			}
+			var network string = vmnetwork_utility.NetworkToCIDR4(*ipNet)
+			if !slices.Contains(attachments[network], id) {
+				attachments[network] = append(attachments[network], id)
+			}
+		}
+	}
+	for _, ids := range attachments {
+		slices.Sort(ids)
+	}
+	return attachments
+}
+
+// ListVpcNetworks returns the networks of a tenant, of every tenant when tenant is empty
+func (hm *HypervisorMonitor) ListVpcNetworks(tenant string) ([]VpcNetwork, error) {
+	var tenants []string = []string{tenant}
+	if tenant == "" {
+		tenants = hm.vpcManager.ListTenants()
+	}
+	var networks []VpcNetwork = make([]VpcNetwork, 0)
+	for _, owner := range tenants {
+		id, err := uuid.Parse(owner)
+		if err != nil {
+			return nil, fmt.Errorf("tenant must be a uuid, found %q", owner)
+		}
+		attachments := hm.vpcAttachments(id.String())
+		for network, bridge := range hm.vpcManager.ListNetworks(id) {
+			networks = append(networks, VpcNetwork{
+				Tenant:          id.String(),
+				Network:         network,
+				Bridge:          bridge,
+				VirtualMachines: append(make([]string, 0), attachments[network]...),
+			})
+		}
+	}
+	slices.SortFunc(networks, func(a VpcNetwork, b VpcNetwork) int {
+		return strings.Compare(a.Tenant+a.Network, b.Tenant+b.Network)
+	})
+	return networks, nil
+}
+
+// CreateVpcNetwork reserves a network and its bridge before any virtual machine uses it.
+// The network is charged to the tenant quota
+func (hm *HypervisorMonitor) CreateVpcNetwork(tenant uuid.UUID, network net.IPNet) (VpcNetwork, error) {
+	var cidr string = vmnetwork_utility.NetworkToCIDR4(network)
+	hm.admissionMu.Lock()
+	defer hm.admissionMu.Unlock()
+	if hm.vpcManager.HasNetwork(tenant, network) {
+		return VpcNetwork{}, &ErrVpcNetworkExists{Network: cidr}
+	}
+	err := hm.checkQuotaLocked(tenant.String(), QuotaUsage{VpcNetworks: 1})
+	if err != nil {
+		return VpcNetwork{}, err
+	}
+	bridge, err := hm.networkEnumerator.GenerateBridgeName()
+	if err != nil {
+		return VpcNetwork{}, err
+	}
+	err = hm.vpcManager.AddNetwork(tenant, network, bridge)
+	if err != nil {
+		return VpcNetwork{}, err
+	}
+	hm.publishTenantEvent(events.VPC_NETWORK_ADDED, tenant.String(), map[string]any{
+		"network": cidr,
+		"bridge":  bridge,
+	})
+	return VpcNetwork{Tenant: tenant.String(), Network: cidr, Bridge: bridge, VirtualMachines: make([]string, 0)}, nil
+}
+
+// reserveVpcBridges marks the bridges of the loaded vpc networks as taken, the vpc database
+// is authoritative over the enumerator snapshot
+func (hm *HypervisorMonitor) reserveVpcBridges() {
+	var bridges []string
+	for _, tenant := range hm.vpcManager.ListTenants() {
+		id, err := uuid.Parse(tenant)
+		if err != nil {
+			continue
+		}
+		for _, bridge := range hm.vpcManager.ListNetworks(id) {
+			bridges = append(bridges, bridge)
+		}
+	}
+	hm.networkEnumerator.ReserveBridgeNames(bridges)
+}
+
+// DeleteVpcNetwork releases a network no virtual machine is attached to
+func (hm *HypervisorMonitor) DeleteVpcNetwork(tenant uuid.UUID, network net.IPNet) error {
+	var cidr string = vmnetwork_utility.NetworkToCIDR4(network)
+	hm.admissionMu.Lock()
+	defer hm.admissionMu.Unlock()
+	if !hm.vpcManager.HasNetwork(tenant, network) {
+		return &ErrVpcNetworkNotFound{Network: cidr}
+	}
+	if users := hm.vpcAttachments(tenant.String())[cidr]; len(users) > 0 {
+		return &ErrVpcNetworkInUse{Network: cidr, VirtualMachines: users}
+	}
+	var bridge string = hm.vpcManager.ListNetworks(tenant)[cidr]
+	err := hm.vpcManager.DeleteNetwork(tenant, network)
+	if err != nil {
+		return err
+	}
+	hm.networkEnumerator.ReleaseBridgeName(bridge)
+	hm.publishTenantEvent(events.VPC_NETWORK_REMOVED, tenant.String(), map[string]any{
+		"network": cidr,
+	})
+	return nil
+}
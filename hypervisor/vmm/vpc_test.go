@@ -0,0 +1,56 @@
+package vmm
+
+import (
+	"path/filepath"
+	"testing"
+	virtualmachine "vmm/virtual_machine"
+	vmnetworking "vmm/vm_networking/interface_enumerator"
+	networkvpc "vmm/vm_networking/vpc"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+func Test_ParseVpcNetwork(t *testing.T) {
+	network, err := ParseVpcNetwork("10.0.1.7/24")
+	assert.Nil(t, err)
+	assert.Equal(t, "10.0.1.0/24", network.String(), "The address is masked to the network")
+	_, err = ParseVpcNetwork("fd00::/64")
+	assert.NotNil(t, err)
+	_, err = ParseVpcNetwork("10.0.1.0")
+	assert.NotNil(t, err)
+}
+
+func Test_HypervisorMonitor_allocateVpcNetworks(t *testing.T) {
+	dir := t.TempDir()
+	enumerator, err := vmnetworking.NewNetworkEnumerator(filepath.Join(dir, "enumerator.snapshot"))
+	assert.Nil(t, err)
+	hm := &HypervisorMonitor{
+		vpcManager:        networkvpc.NewVpcManager(filepath.Join(dir, "vpc.snapshot"), filepath.Join(dir, "vpc.changes")),
+		networkEnumerator: enumerator,
+		logger:            zap.NewNop(),
+	}
+	tenant := uuid.New()
+	vpcs := []virtualmachine.VpcNet{
+		{Addresses: []string{"10.0.1.10"}, Mask: "255.255.255.0"},
+		{Addresses: []string{"10.0.1.11"}, Mask: "255.255.255.0"},
+		{Addresses: []string{"10.0.2.10"}, Mask: "255.255.255.0"},
+	}
+	added, err := hm.allocateVpcNetworks(tenant, vpcs, nil)
+	assert.Nil(t, err)
+	assert.Len(t, added, 2, "Interfaces on the same network share it")
+	assert.Equal(t, vpcs[0].Bridge, vpcs[1].Bridge)
+	assert.Len(t, hm.vpcManager.ListNetworks(tenant), 2)
+
+	hm.releaseVpcNetworks(tenant, added)
+	assert.Empty(t, hm.vpcManager.ListNetworks(tenant), "Released networks are removed")
+
+	vpcs = []virtualmachine.VpcNet{
+		{Addresses: []string{"10.0.3.10"}, Mask: "255.255.255.0"},
+		{Addresses: []string{}},
+	}
+	_, err = hm.allocateVpcNetworks(tenant, vpcs, nil)
+	assert.NotNil(t, err)
+	assert.Empty(t, hm.vpcManager.ListNetworks(tenant), "Networks added before a failure are released")
+}
@@ -0,0 +1,466 @@
+package webhooks
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+	"vmm/events"
+	"vmm/utils"
+
+	"github.com/google/uuid"
+	"go.uber.org/zap"
+)
+
+const (
+	defaultMaxAttempts = 10
+	defaultWorkers     = 4
+	maxRetryBackoff    = time.Hour
+	// Completed deliveries kept for the delivery log
+	maxDeliveryLog  = 1000
+	deliveryTimeout = 10 * time.Second
+)
+
+// retryBackoff doubles from one second up to an hour
+func retryBackoff(attempt int) time.Duration {
+	if attempt > 12 {
+		return maxRetryBackoff
+	}
+	return min(time.Second<<max(attempt-1, 0), maxRetryBackoff)
+}
+
+type snapshot struct {
+	Webhooks map[string]Webhook
+	Queue    map[string]Delivery
+	// Only read from snapshots written before the log got its own file
+	Log []Delivery
+}
+
+// The snapshot holds the secrets of the webhooks
+const snapshotPerm = 0600
+
+type Storage struct{}
+
+func (s *Storage) ReadSnapshot(path string) (snapshot, error) {
+	return utils.ReadGobFile[snapshot](path)
+}
+
+func (s *Storage) WriteSnapshot(path string, db snapshot) error {
+	return utils.ReplaceGobFile(path, db, snapshotPerm)
+}
+
+func (s *Storage) ReadLog(path string) ([]Delivery, error) {
+	return utils.ReadGobFile[[]Delivery](path)
+}
+
+func (s *Storage) WriteLog(path string, log []Delivery) error {
+	return utils.ReplaceGobFile(path, log, snapshotPerm)
+}
+
+type StorageRepository interface {
+	ReadSnapshot(path string) (snapshot, error)
+	WriteSnapshot(path string, db snapshot) error
+	ReadLog(path string) ([]Delivery, error)
+	WriteLog(path string, log []Delivery) error
+}
+
+// The delivery log is stored apart from the queue, so enqueuing an event does not rewrite it
+func deliveryLogPath(snapshotPath string) string {
+	return snapshotPath + ".log"
+}
+
+// Manager delivers events to webhooks at least once. Deliveries are persisted
+// before the event is acknowledged by the bus and until the receiver answers with 2xx,
+// so a delivery interrupted by a restart is sent again
+type Manager struct {
+	snapshotPath string
+	storage      StorageRepository
+	client       *http.Client
+	logger       *zap.Logger
+	webhooks     map[string]Webhook
+	queue        map[string]*Delivery
+	log          []Delivery
+	inflight     map[string]struct{}
+	mu           sync.Mutex
+	wake         chan struct{}
+	stop         chan struct{}
+	done         chan struct{}
+	maxAttempts  int
+	workers      int
+	backoff      func(attempt int) time.Duration
+}
+
+func NewManager(snapshotPath string, logger *zap.Logger) (*Manager, error) {
+	return newManager(snapshotPath, new(Storage), &http.Client{Timeout: deliveryTimeout}, logger)
+}
+
+func newManager(snapshotPath string, storage StorageRepository, client *http.Client, logger *zap.Logger) (*Manager, error) {
+	db, err := storage.ReadSnapshot(snapshotPath)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	log, err := storage.ReadLog(deliveryLogPath(snapshotPath))
+	if os.IsNotExist(err) {
+		log, err = db.Log, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var manager *Manager = &Manager{
+		snapshotPath: snapshotPath,
+		storage:      storage,
+		client:       client,
+		logger:       logger,
+		webhooks:     make(map[string]Webhook),
+		queue:        make(map[string]*Delivery),
+		log:          log,
+		inflight:     make(map[string]struct{}),
+		wake:         make(chan struct{}, 1),
+		maxAttempts:  defaultMaxAttempts,
+		workers:      defaultWorkers,
+		backoff:      retryBackoff,
+	}
+	for id, webhook := range db.Webhooks {
+		manager.webhooks[id] = webhook
+	}
+	for id, delivery := range db.Queue {
+		manager.queue[id] = &delivery
+	}
+	return manager, nil
+}
+
+// Caller must hold mu. Stores the webhooks and the pending deliveries
+func (m *Manager) persistLocked() error {
+	var db snapshot = snapshot{
+		Webhooks: m.webhooks,
+		Queue:    make(map[string]Delivery, len(m.queue)),
+	}
+	for id, delivery := range m.queue {
+		db.Queue[id] = *delivery
+	}
+	return m.storage.WriteSnapshot(m.snapshotPath, db)
+}
+
+// Caller must hold mu
+func (m *Manager) persistLogLocked() error {
+	return m.storage.WriteLog(deliveryLogPath(m.snapshotPath), m.log)
+}
+
+func (m *Manager) notify() {
+	select {
+	case m.wake <- struct{}{}:
+	default:
+	}
+}
+
+// CreateWebhook stores a new webhook, a secret is generated when none is given
+func (m *Manager) CreateWebhook(webhook Webhook) (Webhook, error) {
+	err := webhook.Validate()
+	if err != nil {
+		return Webhook{}, err
+	}
+	if webhook.Secret == "" {
+		webhook.Secret, err = generateSecret()
+		if err != nil {
+			return Webhook{}, err
+		}
+	}
+	webhook.Id = uuid.New().String()
+	webhook.CreatedAt = time.Now().UTC()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.webhooks[webhook.Id] = webhook
+	err = m.persistLocked()
+	if err != nil {
+		delete(m.webhooks, webhook.Id)
+		return Webhook{}, err
+	}
+	return webhook, nil
+}
+
+func (m *Manager) GetWebhook(id string) (Webhook, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	webhook, ok := m.webhooks[id]
+	if !ok {
+		return Webhook{}, &ErrWebhookNotFound{Id: id}
+	}
+	return webhook, nil
+}
+
+func (m *Manager) ListWebhooks() []Webhook {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var res []Webhook = make([]Webhook, 0, len(m.webhooks))
+	for _, webhook := range m.webhooks {
+		res = append(res, webhook)
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].CreatedAt.Before(res[j].CreatedAt)
+	})
+	return res
+}
+
+// DeleteWebhook also drops its pending deliveries
+func (m *Manager) DeleteWebhook(id string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	webhook, ok := m.webhooks[id]
+	if !ok {
+		return &ErrWebhookNotFound{Id: id}
+	}
+	delete(m.webhooks, id)
+	var dropped map[string]*Delivery = make(map[string]*Delivery)
+	for deliveryId, delivery := range m.queue {
+		if delivery.Webhook == id {
+			dropped[deliveryId] = delivery
+			delete(m.queue, deliveryId)
+		}
+	}
+	err := m.persistLocked()
+	if err != nil {
+		m.webhooks[id] = webhook
+		for deliveryId, delivery := range dropped {
+			m.queue[deliveryId] = delivery
+		}
+		return err
+	}
+	return nil
+}
+
+// Deliveries returns the pending and completed deliveries of a webhook, newest first
+func (m *Manager) Deliveries(id string) ([]Delivery, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.webhooks[id]; !ok {
+		return nil, &ErrWebhookNotFound{Id: id}
+	}
+	var res []Delivery = make([]Delivery, 0)
+	for _, delivery := range m.queue {
+		if delivery.Webhook == id {
+			res = append(res, *delivery)
+		}
+	}
+	for _, delivery := range m.log {
+		if delivery.Webhook == id {
+			res = append(res, delivery)
+		}
+	}
+	sort.SliceStable(res, func(i, j int) bool {
+		if res[i].EventId != res[j].EventId {
+			return res[i].EventId > res[j].EventId
+		}
+		return res[i].CreatedAt.After(res[j].CreatedAt)
+	})
+	return res, nil
+}
+
+// Enqueue is meant to run as a bus hook, the deliveries are persisted before it returns
+func (m *Manager) Enqueue(event events.Event) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var payload []byte = nil
+	var added []string
+	for _, webhook := range m.webhooks {
+		filter := webhook.Filter()
+		if !filter.Matches(event) {
+			continue
+		}
+		if payload == nil {
+			var err error
+			payload, err = json.Marshal(event)
+			if err != nil {
+				m.logger.Error("Unable to encode webhook event", zap.Uint64("event_id", event.Id), zap.String("error", err.Error()))
+				return
+			}
+		}
+		now := time.Now().UTC()
+		var delivery *Delivery = &Delivery{
+			Id:            uuid.New().String(),
+			Webhook:       webhook.Id,
+			EventId:       event.Id,
+			EventType:     event.Type,
+			Payload:       payload,
+			State:         DELIVERY_PENDING,
+			NextAttemptAt: now,
+			CreatedAt:     now,
+		}
+		m.queue[delivery.Id] = delivery
+		added = append(added, delivery.Id)
+	}
+	if len(added) == 0 {
+		return
+	}
+	err := m.persistLocked()
+	if err != nil {
+		m.logger.Error("Unable to persist webhook deliveries", zap.Uint64("event_id", event.Id), zap.String("error", err.Error()))
+	}
+	m.notify()
+}
+
+func (m *Manager) Start() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.stop != nil {
+		return
+	}
+	m.stop = make(chan struct{})
+	m.done = make(chan struct{})
+	go m.run(m.stop, m.done)
+}
+
+// Stop waits for the attempts in progress, pending deliveries stay in the queue
+func (m *Manager) Stop() {
+	m.mu.Lock()
+	stop, done := m.stop, m.done
+	m.stop = nil
+	m.mu.Unlock()
+	if stop == nil {
+		return
+	}
+	close(stop)
+	<-done
+}
+
+func (m *Manager) run(stop chan struct{}, done chan struct{}) {
+	defer close(done)
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	var timer *time.Timer = time.NewTimer(0)
+	defer timer.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-m.wake:
+		case <-timer.C:
+		}
+		due, next := m.takeDue(time.Now())
+		for _, delivery := range due {
+			wg.Add(1)
+			go func(delivery Delivery) {
+				defer wg.Done()
+				m.attempt(delivery)
+				m.notify()
+			}(delivery)
+		}
+		timer.Stop()
+		select {
+		case <-timer.C:
+		default:
+		}
+		if !next.IsZero() {
+			timer.Reset(max(time.Until(next), 0))
+		}
+	}
+}
+
+// takeDue marks due deliveries in flight, up to the number of free workers.
+// It returns the time of the next delivery not taken
+func (m *Manager) takeDue(now time.Time) ([]Delivery, time.Time) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	var pending []*Delivery = make([]*Delivery, 0, len(m.queue))
+	for id, delivery := range m.queue {
+		if _, ok := m.inflight[id]; !ok {
+			pending = append(pending, delivery)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool {
+		return pending[i].NextAttemptAt.Before(pending[j].NextAttemptAt)
+	})
+	var due []Delivery
+	var next time.Time
+	for _, delivery := range pending {
+		if delivery.NextAttemptAt.After(now) || len(m.inflight) >= m.workers {
+			next = delivery.NextAttemptAt
+			break
+		}
+		m.inflight[delivery.Id] = struct{}{}
+		due = append(due, *delivery)
+	}
+	return due, next
+}
+
+func (m *Manager) attempt(delivery Delivery) {
+	m.mu.Lock()
+	webhook, ok := m.webhooks[delivery.Webhook]
+	if !ok {
+		delete(m.inflight, delivery.Id)
+		m.mu.Unlock()
+		return
+	}
+	m.mu.Unlock()
+	statusCode, err := m.send(webhook, delivery)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.inflight, delivery.Id)
+	current, queued := m.queue[delivery.Id]
+	if !queued {
+		return
+	}
+	now := time.Now().UTC()
+	current.Attempts++
+	current.LastStatusCode = statusCode
+	current.LastError = ""
+	if err != nil {
+		current.LastError = err.Error()
+	}
+	if err == nil {
+		current.State = DELIVERY_DELIVERED
+	} else if current.Attempts >= m.maxAttempts {
+		current.State = DELIVERY_FAILED
+		m.logger.Warn("Webhook delivery abandoned", zap.String("webhook", current.Webhook), zap.String("delivery", current.Id), zap.String("error", current.LastError))
+	} else {
+		current.NextAttemptAt = now.Add(m.backoff(current.Attempts))
+	}
+	if current.State != DELIVERY_PENDING {
+		current.CompletedAt = now
+		current.NextAttemptAt = time.Time{}
+		delete(m.queue, current.Id)
+		m.log = append(m.log, *current)
+		if len(m.log) > maxDeliveryLog {
+			m.log = m.log[len(m.log)-maxDeliveryLog:]
+		}
+		// The log is written first, a crash in between sends the delivery again rather than losing its record
+		err = m.persistLogLocked()
+		if err != nil {
+			m.logger.Error("Unable to persist webhook delivery log", zap.String("delivery", current.Id), zap.String("error", err.Error()))
+		}
+	}
+	err = m.persistLocked()
+	if err != nil {
+		m.logger.Error("Unable to persist webhook deliveries", zap.String("delivery", current.Id), zap.String("error", err.Error()))
+	}
+}
+
+// send returns an error unless the receiver answers with a 2xx status
+func (m *Manager) send(webhook Webhook, delivery Delivery) (int, error) {
+	var timestamp int64 = time.Now().Unix()
+	request, err := http.NewRequest(http.MethodPost, webhook.Url, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, err
+	}
+	request.Header.Set("Content-Type", "application/json")
+	request.Header.Set(HEADER_EVENT, delivery.EventType)
+	request.Header.Set(HEADER_DELIVERY, delivery.Id)
+	request.Header.Set(HEADER_TIMESTAMP, strconv.FormatInt(timestamp, 10))
+	request.Header.Set(HEADER_SIGNATURE, Sign(webhook.Secret, timestamp, delivery.Payload))
+	response, err := m.client.Do(request)
+	if err != nil {
+		return 0, err
+	}
+	defer response.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(response.Body, 64*1024))
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return response.StatusCode, fmt.Errorf("receiver answered %s", response.Status)
+	}
+	return response.StatusCode, nil
+}
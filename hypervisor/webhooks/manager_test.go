@@ -0,0 +1,239 @@
+package webhooks
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"vmm/events"
+
+	"github.com/google/uuid"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+type MockedStorage struct {
+	db  *snapshot
+	log []Delivery
+	// Number of writes of the delivery log
+	logWrites int
+	mu        sync.Mutex
+	err       error
+}
+
+func (s *MockedStorage) ReadSnapshot(path string) (snapshot, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.db == nil {
+		return snapshot{}, os.ErrNotExist
+	}
+	return *s.db, nil
+}
+
+func (s *MockedStorage) WriteSnapshot(path string, db snapshot) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	var copied snapshot = snapshot{
+		Webhooks: make(map[string]Webhook),
+		Queue:    make(map[string]Delivery),
+		Log:      append([]Delivery(nil), db.Log...),
+	}
+	for id, webhook := range db.Webhooks {
+		copied.Webhooks[id] = webhook
+	}
+	for id, delivery := range db.Queue {
+		copied.Queue[id] = delivery
+	}
+	s.db = &copied
+	return nil
+}
+
+func (s *MockedStorage) ReadLog(path string) ([]Delivery, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.log == nil {
+		return nil, os.ErrNotExist
+	}
+	return append([]Delivery(nil), s.log...), nil
+}
+
+func (s *MockedStorage) WriteLog(path string, log []Delivery) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return s.err
+	}
+	s.logWrites++
+	s.log = append(make([]Delivery, 0, len(log)), log...)
+	return nil
+}
+
+func testManager(t *testing.T, storage *MockedStorage) *Manager {
+	manager, err := newManager("webhooks.snapshot", storage, http.DefaultClient, zap.NewNop())
+	assert.Nil(t, err)
+	manager.backoff = func(attempt int) time.Duration {
+		return time.Millisecond
+	}
+	return manager
+}
+
+func waitDeliveries(t *testing.T, manager *Manager, id string, state string) []Delivery {
+	var deliveries []Delivery
+	assert.Eventually(t, func() bool {
+		var err error
+		deliveries, err = manager.Deliveries(id)
+		assert.Nil(t, err)
+		return len(deliveries) > 0 && deliveries[0].State == state
+	}, 2*time.Second, 5*time.Millisecond)
+	return deliveries
+}
+
+func Test_Sign(t *testing.T) {
+	assert.Equal(t, Sign("secret", 10, []byte("body")), Sign("secret", 10, []byte("body")))
+	assert.NotEqual(t, Sign("secret", 10, []byte("body")), Sign("other", 10, []byte("body")))
+	assert.NotEqual(t, Sign("secret", 10, []byte("body")), Sign("secret", 11, []byte("body")))
+}
+
+func Test_Webhook_Validate(t *testing.T) {
+	assert.Nil(t, (&Webhook{Url: "https://example.com/hook"}).Validate())
+	assert.NotNil(t, (&Webhook{Url: "ftp://example.com/hook"}).Validate())
+	assert.NotNil(t, (&Webhook{Url: "http:///hook"}).Validate())
+}
+
+func Test_RetryBackoff(t *testing.T) {
+	assert.Equal(t, time.Second, retryBackoff(1))
+	assert.Equal(t, 8*time.Second, retryBackoff(4))
+	assert.Equal(t, maxRetryBackoff, retryBackoff(40))
+}
+
+func Test_Manager_Delivery(t *testing.T) {
+	var calls atomic.Int32
+	var signatureValid atomic.Bool
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		timestamp, _ := strconv.ParseInt(r.Header.Get(HEADER_TIMESTAMP), 10, 64)
+		signatureValid.Store(r.Header.Get(HEADER_SIGNATURE) == Sign("secret", timestamp, body))
+		if calls.Add(1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer receiver.Close()
+
+	manager := testManager(t, &MockedStorage{})
+	webhook, err := manager.CreateWebhook(Webhook{Url: receiver.URL, Secret: "secret", Types: []string{events.VM_STATE}})
+	assert.Nil(t, err)
+	manager.Start()
+	defer manager.Stop()
+
+	manager.Enqueue(events.Event{Id: 1, Type: events.VM_CREATED})
+	manager.Enqueue(events.Event{Id: 2, Type: events.VM_STATE})
+	deliveries := waitDeliveries(t, manager, webhook.Id, DELIVERY_DELIVERED)
+	assert.Len(t, deliveries, 1, "Events outside of the filter must not be delivered")
+	assert.Equal(t, uint64(2), deliveries[0].EventId)
+	assert.Equal(t, 3, deliveries[0].Attempts, "Failed attempts must be retried")
+	assert.Equal(t, http.StatusNoContent, deliveries[0].LastStatusCode)
+	assert.True(t, signatureValid.Load())
+}
+
+func Test_Manager_MaxAttempts(t *testing.T) {
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer receiver.Close()
+
+	manager := testManager(t, &MockedStorage{})
+	manager.maxAttempts = 2
+	webhook, err := manager.CreateWebhook(Webhook{Url: receiver.URL})
+	assert.Nil(t, err)
+	assert.NotEmpty(t, webhook.Secret, "A secret must be generated when missing")
+	manager.Start()
+	defer manager.Stop()
+
+	manager.Enqueue(events.Event{Id: 1, Type: events.VM_STATE})
+	deliveries := waitDeliveries(t, manager, webhook.Id, DELIVERY_FAILED)
+	assert.Equal(t, 2, deliveries[0].Attempts)
+	assert.Equal(t, http.StatusInternalServerError, deliveries[0].LastStatusCode)
+}
+
+func Test_Manager_Restart(t *testing.T) {
+	var received atomic.Int32
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received.Add(1)
+	}))
+	defer receiver.Close()
+
+	var storage *MockedStorage = &MockedStorage{}
+	manager := testManager(t, storage)
+	webhook, err := manager.CreateWebhook(Webhook{Url: receiver.URL})
+	assert.Nil(t, err)
+	manager.Enqueue(events.Event{Id: 1, Type: events.VM_STATE})
+	assert.Equal(t, int32(0), received.Load(), "Nothing is sent before the manager starts")
+
+	restarted := testManager(t, storage)
+	restarted.Start()
+	defer restarted.Stop()
+	waitDeliveries(t, restarted, webhook.Id, DELIVERY_DELIVERED)
+	assert.Equal(t, int32(1), received.Load(), "The persisted queue must be delivered after a restart")
+	restarted.Stop()
+
+	storage.mu.Lock()
+	assert.Equal(t, 1, storage.logWrites)
+	storage.mu.Unlock()
+	restarted.Enqueue(events.Event{Id: 2, Type: events.VM_STATE})
+	storage.mu.Lock()
+	assert.Equal(t, 1, storage.logWrites, "Enqueuing an event does not rewrite the delivery log")
+	storage.mu.Unlock()
+	deliveries, err := testManager(t, storage).Deliveries(webhook.Id)
+	assert.Nil(t, err)
+	assert.Len(t, deliveries, 2, "The delivery log and the queue are both restored")
+}
+
+func Test_Manager_LogMigration(t *testing.T) {
+	webhook := Webhook{Id: uuid.New().String(), Url: "http://127.0.0.1:1"}
+	storage := &MockedStorage{db: &snapshot{
+		Webhooks: map[string]Webhook{webhook.Id: webhook},
+		Log:      []Delivery{{Id: uuid.New().String(), Webhook: webhook.Id, State: DELIVERY_DELIVERED}},
+	}}
+	deliveries, err := testManager(t, storage).Deliveries(webhook.Id)
+	assert.Nil(t, err)
+	assert.Len(t, deliveries, 1, "The log of a snapshot without log file is kept")
+}
+
+func Test_Storage_WriteSnapshot(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "webhooks.snapshot")
+	storage := new(Storage)
+	webhook := Webhook{Id: "hook", Url: "https://example.com/hook", Secret: "secret"}
+	assert.Nil(t, storage.WriteSnapshot(path, snapshot{Webhooks: map[string]Webhook{webhook.Id: webhook}}))
+	assert.Nil(t, storage.WriteSnapshot(path, snapshot{Webhooks: map[string]Webhook{webhook.Id: webhook}}), "The snapshot is replaced")
+	info, err := os.Stat(path)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm(), "Secrets are readable by the monitor only")
+	_, err = os.Stat(path + ".tmp")
+	assert.True(t, os.IsNotExist(err), "No temporary file is left")
+	db, err := storage.ReadSnapshot(path)
+	assert.Nil(t, err)
+	assert.Equal(t, "secret", db.Webhooks["hook"].Secret)
+}
+
+func Test_Manager_DeleteWebhook(t *testing.T) {
+	manager := testManager(t, &MockedStorage{})
+	webhook, err := manager.CreateWebhook(Webhook{Url: "http://127.0.0.1:1"})
+	assert.Nil(t, err)
+	manager.Enqueue(events.Event{Id: 1, Type: events.VM_STATE})
+	assert.Nil(t, manager.DeleteWebhook(webhook.Id))
+	assert.Len(t, manager.queue, 0, "Pending deliveries of a deleted webhook must be dropped")
+	_, err = manager.Deliveries(webhook.Id)
+	var errNotFound *ErrWebhookNotFound
+	assert.ErrorAs(t, err, &errNotFound)
+}
@@ -0,0 +1,111 @@
+package webhooks
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"time"
+	"vmm/events"
+)
+
+const (
+	HEADER_EVENT     = "X-CHMonitor-Event"
+	HEADER_DELIVERY  = "X-CHMonitor-Delivery"
+	HEADER_TIMESTAMP = "X-CHMonitor-Timestamp"
+	// Hex encoded HMAC-SHA256 of "<timestamp>.<body>", prefixed by "sha256="
+	HEADER_SIGNATURE = "X-CHMonitor-Signature"
+)
+
+const (
+	DELIVERY_PENDING   = "pending"
+	DELIVERY_DELIVERED = "delivered"
+	DELIVERY_FAILED    = "failed"
+)
+
+// Webhook receives the events matching its filter, an empty filter matches every event
+type Webhook struct {
+	Id             string    `json:"id" yaml:"id"`
+	Url            string    `json:"url" yaml:"url"`
+	Types          []string  `json:"types,omitempty" yaml:"types,omitempty"`
+	VirtualMachine string    `json:"virtual_machine,omitempty" yaml:"virtual_machine,omitempty"`
+	Tenant         string    `json:"tenant,omitempty" yaml:"tenant,omitempty"`
+	Secret         string    `json:"secret,omitempty" yaml:"secret,omitempty"`
+	CreatedAt      time.Time `json:"created_at" yaml:"created_at"`
+}
+
+func (w *Webhook) Filter() events.Filter {
+	return events.Filter{
+		Types:          w.Types,
+		VirtualMachine: w.VirtualMachine,
+		Tenant:         w.Tenant,
+	}
+}
+
+// Redacted returns the webhook without its secret, the secret is only shown at creation
+func (w Webhook) Redacted() Webhook {
+	w.Secret = ""
+	return w
+}
+
+func (w *Webhook) Validate() error {
+	target, err := url.Parse(w.Url)
+	if err != nil {
+		return fmt.Errorf("invalid webhook url: %w", err)
+	}
+	if target.Scheme != "http" && target.Scheme != "https" {
+		return errors.New("webhook url must use http or https")
+	}
+	if target.Host == "" {
+		return errors.New("webhook url must have a host")
+	}
+	return nil
+}
+
+func generateSecret() (string, error) {
+	var secret []byte = make([]byte, 32)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(secret), nil
+}
+
+// Sign computes the signature header value, receivers recompute it to authenticate a delivery
+func Sign(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+// Delivery is one event to send to one webhook. The payload is kept as json,
+// so the body of every attempt is identical and survives restarts unchanged
+type Delivery struct {
+	Id             string          `json:"id" yaml:"id"`
+	Webhook        string          `json:"webhook" yaml:"webhook"`
+	EventId        uint64          `json:"event_id" yaml:"event_id"`
+	EventType      string          `json:"event_type" yaml:"event_type"`
+	Payload        json.RawMessage `json:"payload" yaml:"payload"`
+	State          string          `json:"state" yaml:"state"`
+	Attempts       int             `json:"attempts" yaml:"attempts"`
+	NextAttemptAt  time.Time       `json:"next_attempt_at,omitempty" yaml:"next_attempt_at,omitempty"`
+	LastStatusCode int             `json:"last_status_code,omitempty" yaml:"last_status_code,omitempty"`
+	LastError      string          `json:"last_error,omitempty" yaml:"last_error,omitempty"`
+	CreatedAt      time.Time       `json:"created_at" yaml:"created_at"`
+	CompletedAt    time.Time       `json:"completed_at,omitempty" yaml:"completed_at,omitempty"`
+}
+
+type ErrWebhookNotFound struct {
+	Id string
+}
+
+func (err *ErrWebhookNotFound) Error() string {
+	return fmt.Sprintf("webhook %s is not found", err.Id)
+}
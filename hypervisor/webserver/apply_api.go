@@ -0,0 +1,78 @@
+package webserver
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"vmm/vmm"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+// Size of an apply file, documents are manifests without disks
+const maxApplyBody = 4 * 1024 * 1024
+
+type ApplyApi struct {
+	vmm *vmm.HypervisorMonitor
+}
+
+func NewApplyApi(vmm *vmm.HypervisorMonitor) *ApplyApi {
+	return &ApplyApi{
+		vmm: vmm,
+	}
+}
+
+// Apply reads a multi-document yaml of virtual machines and vpc networks and answers the plan.
+// The query gives ?tenant, ?apply_set, ?dry_run and ?prune. Failed actions are reported in the plan
+func (applyApi *ApplyApi) Apply() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		opts := vmm.ApplyOptions{ApplySet: c.QueryParam("apply_set")}
+		if c.QueryParam("tenant") != "" {
+			tenant, err := uuid.Parse(c.QueryParam("tenant"))
+			if err != nil {
+				return c.String(http.StatusBadRequest, "Tenant must be a uuid")
+			}
+			opts.Tenant = tenant.String()
+		}
+		var err error
+		if c.QueryParam("dry_run") != "" {
+			opts.DryRun, err = strconv.ParseBool(c.QueryParam("dry_run"))
+			if err != nil {
+				return c.String(http.StatusBadRequest, "Dry run must be a boolean")
+			}
+		}
+		if c.QueryParam("prune") != "" {
+			opts.Prune, err = strconv.ParseBool(c.QueryParam("prune"))
+			if err != nil {
+				return c.String(http.StatusBadRequest, "Prune must be a boolean")
+			}
+		}
+		body, err := io.ReadAll(io.LimitReader(c.Request().Body, maxApplyBody+1))
+		if err != nil {
+			return c.String(http.StatusBadRequest, fmt.Sprintf("There was an error reading the apply file\n%s", err.Error()))
+		}
+		if len(body) > maxApplyBody {
+			return c.String(http.StatusRequestEntityTooLarge, fmt.Sprintf("Apply file is larger than %d bytes", maxApplyBody))
+		}
+		resources, err := vmm.ParseApplyDocuments(body, opts.Tenant)
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		plan, err := applyApi.vmm.Apply(resources, opts)
+		if err != nil {
+			var errInvalid *vmm.ErrInvalidApply
+			if errors.As(err, &errInvalid) {
+				return c.String(http.StatusBadRequest, err.Error())
+			}
+			return c.String(http.StatusInternalServerError, fmt.Sprintf("There was an error applying the file\n%s", err.Error()))
+		}
+		return c.JSON(http.StatusOK, plan)
+	}
+}
+
+type ApplyApiService interface {
+	Apply() echo.HandlerFunc
+}
@@ -0,0 +1,291 @@
+package webserver
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"vmm/audit"
+	"vmm/auth"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	targetContextKey         = "target"
+	manifestBeforeContextKey = "manifest_before"
+)
+
+// Bytes of an error response kept in the audit record
+const maxAuditError = 1024
+
+const (
+	defaultAuditLimit = 100
+	maxAuditLimit     = 1000
+)
+
+// AuditMonitor is the part of the monitor used to record and query requests
+type AuditMonitor interface {
+	VirtualMachineReader
+	GetAudit() *audit.Log
+	RecordAudit(record *audit.Record)
+}
+
+type AuditApi struct {
+	vmm AuditMonitor
+}
+
+func NewAuditApi(vmm AuditMonitor) *AuditApi {
+	return &AuditApi{
+		vmm: vmm,
+	}
+}
+
+func mutating(method string) bool {
+	return method != http.MethodGet && method != http.MethodHead && method != http.MethodOptions
+}
+
+// rememberTarget keeps the target resolved by the authorization for the audit record,
+// with the manifest of the virtual machine before a change
+func rememberTarget(c echo.Context, hm VirtualMachineReader, target accessTarget) {
+	c.Set(targetContextKey, target)
+	if target.VirtualMachine == "" || !mutating(c.Request().Method) {
+		return
+	}
+	if manifest, ok := manifestDocument(hm, target.VirtualMachine); ok {
+		c.Set(manifestBeforeContextKey, manifest)
+	}
+}
+
+// manifestDocument returns false when the virtual machine does not exist
+func manifestDocument(hm VirtualMachineReader, ref string) ([]byte, bool) {
+	vm := hm.GetVirtualMachine(ref)
+	if vm == nil {
+		return nil, false
+	}
+	document, err := json.Marshal(vm.GetManifest())
+	if err != nil {
+		return nil, false
+	}
+	return document, true
+}
+
+// auditWriter keeps the beginning of error responses, streams are passed through
+type auditWriter struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (w *auditWriter) WriteHeader(status int) {
+	w.status = status
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *auditWriter) Write(b []byte) (int, error) {
+	if w.status >= http.StatusBadRequest && w.body.Len() < maxAuditError {
+		w.body.Write(b[:min(len(b), maxAuditError-w.body.Len())])
+	}
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *auditWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+func (w *auditWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hijacker, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response does not support hijacking")
+	}
+	return hijacker.Hijack()
+}
+
+func (w *auditWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// readBody returns the body of the request and puts it back for the handler,
+// nil when it is too large to be part of a record
+func readBody(c echo.Context) []byte {
+	var req *http.Request = c.Request()
+	if req.Body == nil {
+		return nil
+	}
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxPeekBody+1))
+	req.Body = io.NopCloser(io.MultiReader(bytes.NewReader(body), req.Body))
+	if err != nil || len(body) > maxPeekBody {
+		return nil
+	}
+	return body
+}
+
+func auditResult(status int) string {
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return audit.RESULT_DENIED
+	case status >= http.StatusBadRequest:
+		return audit.RESULT_FAILURE
+	default:
+		return audit.RESULT_SUCCESS
+	}
+}
+
+// Middleware records every request changing the state of the host and every denied request,
+// unauthenticated ones included.
+// Chunks of uploads are recorded by their begin and commit only
+func (auditApi *AuditApi) Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			var req *http.Request = c.Request()
+			var record bool = mutating(req.Method) && !strings.HasSuffix(c.Path(), "/chunk")
+			var body []byte
+			if record {
+				body = readBody(c)
+			}
+			writer := &auditWriter{ResponseWriter: c.Response().Writer, status: http.StatusOK}
+			c.Response().Writer = writer
+			start := time.Now()
+			err := next(c)
+			var latency time.Duration = time.Since(start)
+			c.Response().Writer = writer.ResponseWriter
+
+			var status int = c.Response().Status
+			var httpError *echo.HTTPError
+			if err != nil && !c.Response().Committed && errors.As(err, &httpError) {
+				status = httpError.Code
+			}
+			if !record && auditResult(status) != audit.RESULT_DENIED {
+				return err
+			}
+			auditApi.vmm.RecordAudit(auditApi.newRecord(c, start, latency, status, body, writer.body.String(), err))
+			return err
+		}
+	}
+}
+
+func (auditApi *AuditApi) newRecord(c echo.Context, start time.Time, latency time.Duration, status int, body []byte, response string, err error) *audit.Record {
+	var record *audit.Record = &audit.Record{
+		Time:      start.UTC(),
+		Method:    c.Request().Method,
+		Route:     c.Path(),
+		Path:      c.Request().URL.Path,
+		Status:    status,
+		Result:    auditResult(status),
+		LatencyMs: float64(latency.Microseconds()) / 1000,
+	}
+	if principal := principalOf(c); principal != nil {
+		record.Principal = principal.Name
+		record.AuthMethod = principal.Method
+		record.TokenId = principal.TokenId
+	}
+	if target, ok := c.Get(targetContextKey).(accessTarget); ok {
+		if target.Tenant != auth.ALL_TENANTS {
+			record.Tenant = target.Tenant
+		}
+		record.Target = target.VirtualMachine
+	}
+	if record.Result != audit.RESULT_SUCCESS {
+		record.Error = strings.TrimSpace(response)
+		if record.Error == "" && err != nil {
+			record.Error = err.Error()
+		}
+	}
+	if record.Result == audit.RESULT_DENIED {
+		return record
+	}
+
+	// A change of a virtual machine is the change of its manifest, other changes are their request body
+	var before, after []byte = nil, body
+	if document, ok := c.Get(manifestBeforeContextKey).([]byte); ok {
+		before = document
+		after, _ = manifestDocument(auditApi.vmm, record.Target)
+	}
+	if diff, err := audit.Diff(before, after); err == nil {
+		record.Diff = diff
+	}
+	return record
+}
+
+func parseAuditQuery(c echo.Context, hm VirtualMachineReader) (audit.Query, error) {
+	var query audit.Query = audit.Query{
+		Principal: c.QueryParam("principal"),
+		Result:    c.QueryParam("result"),
+		Limit:     defaultAuditLimit,
+	}
+	var err error
+	if value := c.QueryParam("from"); value != "" {
+		if query.From, err = parseHistoryTime(value); err != nil {
+			return query, errors.New("from must be a unix time or RFC3339")
+		}
+	}
+	if value := c.QueryParam("to"); value != "" {
+		if query.To, err = parseHistoryTime(value); err != nil {
+			return query, errors.New("to must be a unix time or RFC3339")
+		}
+	}
+	if value := c.QueryParam("tenant"); value != "" {
+		target, _, err := tenantTarget(value)
+		if err != nil {
+			return query, err
+		}
+		query.Tenant = target.Tenant
+	}
+	// Deleted virtual machines are only known by uuid
+	if ref := c.QueryParam("vm"); ref != "" {
+		if vm := hm.GetVirtualMachine(ref); vm != nil {
+			query.Target = vm.GetManifest().GuestIdentifier.String()
+		} else if id, err := uuid.Parse(ref); err == nil {
+			query.Target = id.String()
+		} else {
+			return query, errors.New("vm must be an existing virtual machine or a uuid")
+		}
+	}
+	switch query.Result {
+	case "", audit.RESULT_SUCCESS, audit.RESULT_DENIED, audit.RESULT_FAILURE:
+	default:
+		return query, errors.New("result must be success, denied or failure")
+	}
+	if value := c.QueryParam("after"); value != "" {
+		if query.After, err = strconv.ParseUint(value, 10, 64); err != nil {
+			return query, errors.New("after must be a record sequence")
+		}
+	}
+	if value := c.QueryParam("limit"); value != "" {
+		limit, err := strconv.Atoi(value)
+		if err != nil || limit <= 0 {
+			return query, errors.New("limit must be a positive integer")
+		}
+		query.Limit = min(limit, maxAuditLimit)
+	}
+	return query, nil
+}
+
+// Query lists audit records in log order, the next page starts after the sequence of the last record
+func (auditApi *AuditApi) Query() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		query, err := parseAuditQuery(c, auditApi.vmm)
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		records, err := auditApi.vmm.GetAudit().Query(query)
+		if err != nil {
+			return c.String(http.StatusInternalServerError, "There was an error reading the audit log\n"+err.Error())
+		}
+		return c.JSON(http.StatusOK, records)
+	}
+}
+
+type AuditApiService interface {
+	Middleware() echo.MiddlewareFunc
+	Query() echo.HandlerFunc
+}
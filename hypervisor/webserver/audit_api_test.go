@@ -0,0 +1,58 @@
+package webserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"vmm/audit"
+	"vmm/auth"
+
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+)
+
+func Test_AuditApi_Middleware(t *testing.T) {
+	monitor := newMockedMonitor(t)
+	authenticator := &Authenticator{vmm: monitor}
+	auditApi := NewAuditApi(monitor)
+	e := echo.New()
+	e.Use(auditApi.Middleware())
+	e.Use(authenticator.Middleware())
+	ok := func(c echo.Context) error {
+		return c.String(http.StatusOK, "ok")
+	}
+	vmRoute(e, http.MethodGet, "/info", ok, authenticator.Access(auth.SCOPE_VM_READ, auth.ROLE_VIEWER, authenticator.virtualMachineTarget))
+	e.GET("/api/audit", ok, authenticator.Access(auth.SCOPE_AUDIT, auth.ROLE_ADMIN, tenantQueryTarget))
+
+	vmA := monitor.addVirtualMachine(t, tenantA)
+	viewerA := monitor.token(t, []string{auth.SCOPE_VM_READ}, auth.Binding{Tenant: tenantA, Role: auth.ROLE_VIEWER})
+
+	do := func(path string, token string) int {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if token != "" {
+			req.Header.Set(echo.HeaderAuthorization, "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// Reads are not recorded unless they are denied
+	assert.Equal(t, http.StatusOK, do("/api/vm/"+vmA+"/info", viewerA))
+	assert.Empty(t, monitor.records)
+
+	assert.Equal(t, http.StatusUnauthorized, do("/api/vm/"+vmA+"/info", ""))
+	assert.Equal(t, http.StatusUnauthorized, do("/api/audit", "invalid"))
+	assert.Equal(t, http.StatusForbidden, do("/api/audit", viewerA))
+	if assert.Len(t, monitor.records, 3) {
+		for _, record := range monitor.records {
+			assert.Equal(t, audit.RESULT_DENIED, record.Result)
+		}
+		assert.Equal(t, http.StatusUnauthorized, monitor.records[0].Status)
+		assert.Equal(t, "/api/vm/"+vmA+"/info", monitor.records[0].Path)
+		assert.Equal(t, "", monitor.records[0].Principal)
+		assert.Equal(t, http.StatusUnauthorized, monitor.records[1].Status)
+		assert.Equal(t, http.StatusForbidden, monitor.records[2].Status)
+		assert.Equal(t, "test", monitor.records[2].Principal)
+	}
+}
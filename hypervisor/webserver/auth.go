@@ -0,0 +1,216 @@
+package webserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+	"vmm/auth"
+	virtualmachine "vmm/virtual_machine"
+	"vmm/vmm"
+	"vmm/webhooks"
+
+	"github.com/labstack/echo/v4"
+)
+
+const principalContextKey = "principal"
+
+// VirtualMachineReader finds a virtual machine by uuid or tenant/name
+type VirtualMachineReader interface {
+	GetVirtualMachine(ref string) *virtualmachine.VirtualMachine
+}
+
+// AuthenticatorMonitor is the part of the monitor read to authenticate and authorize requests
+type AuthenticatorMonitor interface {
+	VirtualMachineReader
+	GetTokens() *auth.TokenStore
+	GetTlsConfig() vmm.TlsConfig
+	GetUnixSocketConfig() vmm.UnixSocketConfig
+	GetWebhooks() *webhooks.Manager
+	RecordDenial(principal *auth.Principal, tenant string, virtualMachine string, data map[string]any)
+}
+
+type Authenticator struct {
+	vmm AuthenticatorMonitor
+	// Certificates of the last reload, used by new connections
+	tlsConfig atomic.Pointer[tls.Config]
+}
+
+func NewAuthenticator(vmm *vmm.HypervisorMonitor) *Authenticator {
+	return &Authenticator{
+		vmm: vmm,
+	}
+}
+
+// newTlsConfig returns nil when the api is served over plain http
+func newTlsConfig(config vmm.TlsConfig) (*tls.Config, error) {
+	if !config.Enabled() {
+		if config.ClientCaFile != "" {
+			return nil, errors.New("client_ca_file requires cert_file and key_file")
+		}
+		return nil, nil
+	}
+	certificate, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to load certificate: %w", err)
+	}
+	var tlsConfig *tls.Config = &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if config.ClientCaFile == "" {
+		if config.RequireClientCert {
+			return nil, errors.New("require_client_cert requires client_ca_file")
+		}
+		return tlsConfig, nil
+	}
+	content, err := os.ReadFile(config.ClientCaFile)
+	if err != nil {
+		return nil, fmt.Errorf("unable to read client ca: %w", err)
+	}
+	var pool *x509.CertPool = x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(content) {
+		return nil, fmt.Errorf("no certificate found in %s", config.ClientCaFile)
+	}
+	tlsConfig.ClientCAs = pool
+	// Without the requirement clients can still authenticate with a token only
+	tlsConfig.ClientAuth = tls.VerifyClientCertIfGiven
+	if config.RequireClientCert {
+		tlsConfig.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return tlsConfig, nil
+}
+
+// serverTlsConfig returns nil when the api is served over plain http. Every connection
+// uses the configuration of the last reload, so certificates change without a restart
+func (authenticator *Authenticator) serverTlsConfig() (*tls.Config, error) {
+	tlsConfig, err := newTlsConfig(authenticator.vmm.GetTlsConfig())
+	if err != nil || tlsConfig == nil {
+		return nil, err
+	}
+	authenticator.tlsConfig.Store(tlsConfig)
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return authenticator.tlsConfig.Load(), nil
+		},
+	}, nil
+}
+
+// reloadTls loads the certificates of a reloaded manifest, the reload is refused when they are not valid
+func (authenticator *Authenticator) reloadTls(manifest *vmm.Manifest) (func(), error) {
+	tlsConfig, err := newTlsConfig(manifest.Server.Tls)
+	if err != nil {
+		return nil, err
+	}
+	return func() {
+		if tlsConfig != nil {
+			authenticator.tlsConfig.Store(tlsConfig)
+		}
+	}, nil
+}
+
+func unauthorized(c echo.Context, message string) error {
+	c.Response().Header().Set(echo.HeaderWWWAuthenticate, "Bearer")
+	return c.String(http.StatusUnauthorized, message)
+}
+
+// certificatePrincipal returns nil when the client did not present a verified certificate
+// or certificates are not allowed to authenticate alone
+func (authenticator *Authenticator) certificatePrincipal(c echo.Context) *auth.Principal {
+	var state *tls.ConnectionState = c.Request().TLS
+	scopes := authenticator.vmm.GetTlsConfig().ClientCertScopes
+	if state == nil || len(state.VerifiedChains) == 0 || len(scopes) == 0 {
+		return nil
+	}
+	var name string = state.VerifiedChains[0][0].Subject.CommonName
+	return &auth.Principal{
+		Name:     name,
+		Method:   auth.METHOD_CERTIFICATE,
+		Scopes:   append([]string(nil), scopes...),
+		Bindings: append([]auth.Binding(nil), authenticator.vmm.GetTlsConfig().ClientCertBindings[name]...),
+	}
+}
+
+// peerPrincipal merges the rules matching the process connected to the unix socket,
+// nil for tcp connections and processes without any scope
+func (authenticator *Authenticator) peerPrincipal(c echo.Context) *auth.Principal {
+	credentials, ok := peerCredentials(c.Request().Context())
+	if !ok {
+		return nil
+	}
+	principal := &auth.Principal{
+		Name:   fmt.Sprintf("uid:%d", credentials.Uid),
+		Method: auth.METHOD_PEER,
+	}
+	for _, rule := range authenticator.vmm.GetUnixSocketConfig().Peers {
+		if !rule.Matches(credentials.Uid, credentials.Gid) {
+			continue
+		}
+		for _, scope := range rule.Scopes {
+			if !slices.Contains(principal.Scopes, scope) {
+				principal.Scopes = append(principal.Scopes, scope)
+			}
+		}
+		principal.Bindings = append(principal.Bindings, rule.Bindings...)
+	}
+	if len(principal.Scopes) == 0 {
+		return nil
+	}
+	return principal
+}
+
+// Middleware rejects every request without a valid bearer token, client certificate or
+// unix socket peer rule, except /ping
+func (authenticator *Authenticator) Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if c.Path() == "/ping" {
+				return next(c)
+			}
+			header := c.Request().Header.Get(echo.HeaderAuthorization)
+			if header == "" {
+				principal := authenticator.certificatePrincipal(c)
+				if principal == nil {
+					principal = authenticator.peerPrincipal(c)
+				}
+				if principal == nil {
+					return unauthorized(c, "Authentication is required")
+				}
+				c.Set(principalContextKey, principal)
+				return next(c)
+			}
+			raw, ok := strings.CutPrefix(header, "Bearer ")
+			if !ok {
+				return unauthorized(c, "Authorization must be a bearer token")
+			}
+			principal, err := authenticator.vmm.GetTokens().Authenticate(strings.TrimSpace(raw), time.Now())
+			if err != nil {
+				var errInvalid *auth.ErrInvalidToken
+				var errExpired *auth.ErrTokenExpired
+				if errors.As(err, &errInvalid) || errors.As(err, &errExpired) {
+					return unauthorized(c, err.Error())
+				}
+				return c.String(http.StatusInternalServerError, fmt.Sprintf("There was an error reading api tokens\n%s", err.Error()))
+			}
+			c.Set(principalContextKey, principal)
+			return next(c)
+		}
+	}
+}
+
+func principalOf(c echo.Context) *auth.Principal {
+	principal, _ := c.Get(principalContextKey).(*auth.Principal)
+	return principal
+}
+
+type AuthenticatorService interface {
+	Middleware() echo.MiddlewareFunc
+	Access(scope string, role string, resolve targetResolver) echo.MiddlewareFunc
+}
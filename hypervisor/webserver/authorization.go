@@ -0,0 +1,205 @@
+package webserver
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"vmm/auth"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+// Bodies read before the handler to find the target tenant, uploads of chunks are never read
+const maxPeekBody = 1024 * 1024
+
+// accessTarget is the tenant owning the resource of a request, auth.ALL_TENANTS for host resources
+type accessTarget struct {
+	Tenant         string
+	VirtualMachine string
+}
+
+// targetResolver returns false when the resource does not exist, the handler answers not found
+type targetResolver func(c echo.Context) (accessTarget, bool, error)
+
+// peekBody binds the body and puts it back for the handler
+func peekBody(c echo.Context, v any) error {
+	var req *http.Request = c.Request()
+	body, err := io.ReadAll(io.LimitReader(req.Body, maxPeekBody+1))
+	if err != nil {
+		return err
+	}
+	if len(body) > maxPeekBody {
+		return errors.New("request body is too large")
+	}
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	err = (&echo.DefaultBinder{}).BindBody(c, v)
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	return err
+}
+
+// Access checks the scope of the principal and its role on the tenant owning the target.
+// A nil resolver leaves the tenant check to the handler, e.g. lists filtered by tenant
+func (authenticator *Authenticator) Access(scope string, role string, resolve targetResolver) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			principal := principalOf(c)
+			if principal == nil {
+				return unauthorized(c, "Authentication is required")
+			}
+			if !principal.HasScope(scope) {
+				return authenticator.deny(c, principal, accessTarget{}, fmt.Sprintf("scope %s is required", scope))
+			}
+			if resolve == nil {
+				return next(c)
+			}
+			target, ok, err := resolve(c)
+			if err != nil {
+				return c.String(http.StatusBadRequest, err.Error())
+			}
+			if !ok {
+				return next(c)
+			}
+			rememberTarget(c, authenticator.vmm, target)
+			if !principal.Allows(target.Tenant, role) {
+				if target.Tenant == auth.ALL_TENANTS {
+					return authenticator.deny(c, principal, target, fmt.Sprintf("role %s on every tenant is required", role))
+				}
+				return authenticator.deny(c, principal, target, fmt.Sprintf("role %s on tenant %s is required", role, target.Tenant))
+			}
+			return next(c)
+		}
+	}
+}
+
+func (authenticator *Authenticator) deny(c echo.Context, principal *auth.Principal, target accessTarget, reason string) error {
+	authenticator.vmm.RecordDenial(principal, target.Tenant, target.VirtualMachine, map[string]any{
+		"method": c.Request().Method,
+		"route":  c.Path(),
+		"path":   c.Request().URL.Path,
+		"reason": reason,
+	})
+	return c.String(http.StatusForbidden, fmt.Sprintf("Access denied, %s", reason))
+}
+
+// hostTarget is used by routes not owned by a tenant
+func hostTarget(c echo.Context) (accessTarget, bool, error) {
+	return accessTarget{Tenant: auth.ALL_TENANTS}, true, nil
+}
+
+func tenantTarget(tenant string) (accessTarget, bool, error) {
+	if tenant == "" {
+		return accessTarget{Tenant: auth.ALL_TENANTS}, true, nil
+	}
+	id, err := uuid.Parse(tenant)
+	if err != nil {
+		return accessTarget{}, false, errors.New("tenant must be a uuid")
+	}
+	return accessTarget{Tenant: id.String()}, true, nil
+}
+
+func (authenticator *Authenticator) referenceTarget(ref string) (accessTarget, bool, error) {
+	vm := authenticator.vmm.GetVirtualMachine(ref)
+	if vm == nil {
+		return accessTarget{}, false, nil
+	}
+	manifest := vm.GetManifest()
+	return accessTarget{Tenant: manifest.Tenant.String(), VirtualMachine: manifest.GuestIdentifier.String()}, true, nil
+}
+
+func (authenticator *Authenticator) virtualMachineTarget(c echo.Context) (accessTarget, bool, error) {
+	return authenticator.referenceTarget(virtualMachineRef(c))
+}
+
+// tenantParamTarget reads the :tenant path parameter, e.g. /api/admin/quotas/:tenant
+func tenantParamTarget(c echo.Context) (accessTarget, bool, error) {
+	return tenantTarget(c.Param("tenant"))
+}
+
+// tenantQueryTarget requires a binding on every tenant when the list is not filtered by tenant
+func tenantQueryTarget(c echo.Context) (accessTarget, bool, error) {
+	return tenantTarget(c.QueryParam("tenant"))
+}
+
+// The virtual machine of an upload is checked, chunks are written in its folder only
+func (authenticator *Authenticator) uploadBodyTarget(c echo.Context) (accessTarget, bool, error) {
+	body := new(CommitBody)
+	if err := peekBody(c, body); err != nil {
+		return accessTarget{}, false, errors.New("Malformed request body")
+	}
+	return authenticator.referenceTarget(body.VirtualMachine)
+}
+
+func (authenticator *Authenticator) uploadHeaderTarget(c echo.Context) (accessTarget, bool, error) {
+	return authenticator.referenceTarget(c.Request().Header.Get("X-VirtualMachine"))
+}
+
+type manifestTargetBody struct {
+	GuestIdentifier string `json:"guest_identifier" xml:"guest_identifier"`
+	Tenant          string `json:"tenant" xml:"tenant"`
+}
+
+// createTarget is the tenant of a new virtual machine
+func createTarget(c echo.Context) (accessTarget, bool, error) {
+	body := new(manifestTargetBody)
+	if err := peekBody(c, body); err != nil {
+		return accessTarget{}, false, errors.New("Malformed request body")
+	}
+	if body.Tenant == "" {
+		return accessTarget{}, false, errors.New("tenant is required")
+	}
+	return tenantTarget(body.Tenant)
+}
+
+// updateTarget is the tenant of the virtual machine being updated, the tenant in the body is ignored
+func (authenticator *Authenticator) updateTarget(c echo.Context) (accessTarget, bool, error) {
+	body := new(manifestTargetBody)
+	if err := peekBody(c, body); err != nil {
+		return accessTarget{}, false, errors.New("Malformed request body")
+	}
+	return authenticator.referenceTarget(body.GuestIdentifier)
+}
+
+// Bulk actions without a tenant select virtual machines of every tenant
+func bulkTarget(c echo.Context) (accessTarget, bool, error) {
+	body := new(BulkActionBody)
+	if err := peekBody(c, body); err != nil {
+		return accessTarget{}, false, errors.New("Malformed request body")
+	}
+	return tenantTarget(body.Tenant)
+}
+
+// eventsTarget is the tenant the stream is filtered on, a deleted virtual machine is known by uuid only
+func (authenticator *Authenticator) eventsTarget(c echo.Context) (accessTarget, bool, error) {
+	if ref := c.QueryParam("vm"); ref != "" {
+		if target, ok, _ := authenticator.referenceTarget(ref); ok {
+			return target, true, nil
+		}
+		return accessTarget{Tenant: auth.ALL_TENANTS}, true, nil
+	}
+	return tenantQueryTarget(c)
+}
+
+// webhookBodyTarget is the tenant of a new webhook, a webhook on a virtual machine belongs to its tenant
+func (authenticator *Authenticator) webhookBodyTarget(c echo.Context) (accessTarget, bool, error) {
+	body := new(WebhookBody)
+	if err := peekBody(c, body); err != nil {
+		return accessTarget{}, false, errors.New("Malformed request body")
+	}
+	if body.Tenant == "" && body.VirtualMachine != "" {
+		if target, ok, _ := authenticator.referenceTarget(body.VirtualMachine); ok {
+			return target, true, nil
+		}
+	}
+	return tenantTarget(body.Tenant)
+}
+
+func (authenticator *Authenticator) webhookTarget(c echo.Context) (accessTarget, bool, error) {
+	webhook, err := authenticator.vmm.GetWebhooks().GetWebhook(c.Param("id"))
+	if err != nil {
+		return accessTarget{}, false, nil
+	}
+	return tenantTarget(webhook.Tenant)
+}
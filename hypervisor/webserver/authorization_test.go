@@ -0,0 +1,214 @@
+package webserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+	"vmm/audit"
+	"vmm/auth"
+	virtualmachine "vmm/virtual_machine"
+	"vmm/vmm"
+	"vmm/webhooks"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+	"github.com/stretchr/testify/assert"
+	"go.uber.org/zap"
+)
+
+const (
+	tenantA = "aaaaaaaa-0000-0000-0000-000000000000"
+	tenantB = "bbbbbbbb-0000-0000-0000-000000000000"
+)
+
+type MockedMonitor struct {
+	virtualMachines map[string]*virtualmachine.VirtualMachine
+	tokens          *auth.TokenStore
+	webhooks        *webhooks.Manager
+	unixSocket      vmm.UnixSocketConfig
+	denials         []string
+	records         []*audit.Record
+}
+
+func (m *MockedMonitor) GetVirtualMachine(ref string) *virtualmachine.VirtualMachine {
+	return m.virtualMachines[ref]
+}
+
+func (m *MockedMonitor) GetTokens() *auth.TokenStore {
+	return m.tokens
+}
+
+func (m *MockedMonitor) GetTlsConfig() vmm.TlsConfig {
+	return vmm.TlsConfig{}
+}
+
+func (m *MockedMonitor) GetUnixSocketConfig() vmm.UnixSocketConfig {
+	return m.unixSocket
+}
+
+func (m *MockedMonitor) GetWebhooks() *webhooks.Manager {
+	return m.webhooks
+}
+
+func (m *MockedMonitor) RecordDenial(principal *auth.Principal, tenant string, virtualMachine string, data map[string]any) {
+	m.denials = append(m.denials, tenant)
+}
+
+func (m *MockedMonitor) GetAudit() *audit.Log {
+	return nil
+}
+
+func (m *MockedMonitor) RecordAudit(record *audit.Record) {
+	m.records = append(m.records, record)
+}
+
+func newMockedMonitor(t *testing.T) *MockedMonitor {
+	dir := t.TempDir()
+	tokens, err := auth.OpenTokenStore(filepath.Join(dir, "tokens.snapshot"))
+	assert.Nil(t, err)
+	webhookManager, err := webhooks.NewManager(filepath.Join(dir, "webhooks.snapshot"), zap.NewNop())
+	assert.Nil(t, err)
+	return &MockedMonitor{
+		virtualMachines: make(map[string]*virtualmachine.VirtualMachine),
+		tokens:          tokens,
+		webhooks:        webhookManager,
+	}
+}
+
+// addVirtualMachine stores a virtual machine of tenant, the loopback stands for the bridge
+func (m *MockedMonitor) addVirtualMachine(t *testing.T, tenant string) string {
+	manifest := &virtualmachine.Manifest{GuestIdentifier: uuid.New(), Tenant: uuid.MustParse(tenant)}
+	vm, err := virtualmachine.NewVirtualMachine(manifest, zap.NewNop(), t.TempDir(), "lo", nil, nil)
+	assert.Nil(t, err)
+	m.virtualMachines[manifest.GuestIdentifier.String()] = vm
+	return manifest.GuestIdentifier.String()
+}
+
+func (m *MockedMonitor) token(t *testing.T, scopes []string, bindings ...auth.Binding) string {
+	_, raw, err := m.tokens.CreateToken("test", scopes, bindings, 0, time.Now())
+	assert.Nil(t, err)
+	return raw
+}
+
+// newAuthorizationServer registers the routes of the api with their resolvers, handlers answer 200
+func newAuthorizationServer(authenticator *Authenticator) *echo.Echo {
+	e := echo.New()
+	e.Use(authenticator.Middleware())
+	ok := func(c echo.Context) error {
+		return c.String(http.StatusOK, "ok")
+	}
+	e.POST("/api/disk/upload/:filename/begin", ok, authenticator.Access(auth.SCOPE_UPLOAD, auth.ROLE_OPERATOR, authenticator.uploadBodyTarget))
+	e.PUT("/api/disk/upload/:filename/chunk", ok, authenticator.Access(auth.SCOPE_UPLOAD, auth.ROLE_OPERATOR, authenticator.uploadHeaderTarget))
+	e.POST("/api/disk/upload/:filename/commit", ok, authenticator.Access(auth.SCOPE_UPLOAD, auth.ROLE_OPERATOR, authenticator.uploadBodyTarget))
+	e.GET("/api/vm", ok, authenticator.Access(auth.SCOPE_VM_READ, auth.ROLE_VIEWER, tenantQueryTarget))
+	e.PUT("/api/vm/bulk/:action", ok, authenticator.Access(auth.SCOPE_VM_WRITE, auth.ROLE_OPERATOR, bulkTarget))
+	vmRoute(e, http.MethodGet, "/info", ok, authenticator.Access(auth.SCOPE_VM_READ, auth.ROLE_VIEWER, authenticator.virtualMachineTarget))
+	vmRoute(e, http.MethodPut, "/boot", ok, authenticator.Access(auth.SCOPE_VM_WRITE, auth.ROLE_OPERATOR, authenticator.virtualMachineTarget))
+	e.PUT("/api/vmm/metadata", ok, authenticator.Access(auth.SCOPE_VM_WRITE, auth.ROLE_OPERATOR, authenticator.updateTarget))
+	e.POST("/api/vmm/metadata", ok, authenticator.Access(auth.SCOPE_VM_WRITE, auth.ROLE_OPERATOR, createTarget))
+	e.GET("/api/events", ok, authenticator.Access(auth.SCOPE_EVENTS, auth.ROLE_VIEWER, authenticator.eventsTarget))
+	e.POST("/api/webhooks", ok, authenticator.Access(auth.SCOPE_WEBHOOKS, auth.ROLE_ADMIN, authenticator.webhookBodyTarget))
+	e.GET("/api/webhooks/:id", ok, authenticator.Access(auth.SCOPE_WEBHOOKS, auth.ROLE_ADMIN, authenticator.webhookTarget))
+	e.DELETE("/api/webhooks/:id", ok, authenticator.Access(auth.SCOPE_WEBHOOKS, auth.ROLE_ADMIN, authenticator.webhookTarget))
+	return e
+}
+
+func Test_Authenticator_Access(t *testing.T) {
+	monitor := newMockedMonitor(t)
+	authenticator := &Authenticator{vmm: monitor}
+	e := newAuthorizationServer(authenticator)
+
+	vmA := monitor.addVirtualMachine(t, tenantA)
+	vmB := monitor.addVirtualMachine(t, tenantB)
+	webhookB, err := monitor.webhooks.CreateWebhook(webhooks.Webhook{Url: "https://example.com/hook", Tenant: tenantB})
+	assert.Nil(t, err)
+
+	every := []string{auth.SCOPE_VM_READ, auth.SCOPE_VM_WRITE, auth.SCOPE_UPLOAD, auth.SCOPE_EVENTS, auth.SCOPE_WEBHOOKS}
+	operatorA := monitor.token(t, every, auth.Binding{Tenant: tenantA, Role: auth.ROLE_OPERATOR})
+	adminA := monitor.token(t, every, auth.Binding{Tenant: tenantA, Role: auth.ROLE_ADMIN})
+	operatorAll := monitor.token(t, every, auth.Binding{Tenant: auth.ALL_TENANTS, Role: auth.ROLE_OPERATOR})
+	viewerA := monitor.token(t, every, auth.Binding{Tenant: tenantA, Role: auth.ROLE_VIEWER})
+	readOnly := monitor.token(t, []string{auth.SCOPE_VM_READ}, auth.Binding{Tenant: auth.ALL_TENANTS, Role: auth.ROLE_ADMIN})
+
+	tests := []struct {
+		name   string
+		token  string
+		method string
+		path   string
+		header map[string]string
+		body   string
+		status int
+	}{
+		{name: "no token", method: http.MethodGet, path: "/api/vm/" + vmA + "/info", status: http.StatusUnauthorized},
+		{name: "own virtual machine", token: operatorA, method: http.MethodGet, path: "/api/vm/" + vmA + "/info", status: http.StatusOK},
+		{name: "virtual machine of another tenant", token: operatorA, method: http.MethodGet, path: "/api/vm/" + vmB + "/info", status: http.StatusForbidden},
+		{name: "boot of another tenant", token: operatorA, method: http.MethodPut, path: "/api/vm/" + vmB + "/boot", status: http.StatusForbidden},
+		{name: "viewer cannot boot", token: viewerA, method: http.MethodPut, path: "/api/vm/" + vmA + "/boot", status: http.StatusForbidden},
+		{name: "scope is required", token: readOnly, method: http.MethodPut, path: "/api/vm/" + vmA + "/boot", status: http.StatusForbidden},
+		{name: "unknown virtual machine is left to the handler", token: operatorA, method: http.MethodGet, path: "/api/vm/" + uuid.NewString() + "/info", status: http.StatusOK},
+
+		{name: "upload begin of another tenant", token: operatorA, method: http.MethodPost, path: "/api/disk/upload/root.raw/begin", body: `{"virtual_machine":"` + vmB + `","size":512}`, status: http.StatusForbidden},
+		{name: "upload chunk of another tenant", token: operatorA, method: http.MethodPut, path: "/api/disk/upload/abc_root.raw.tmp/chunk", header: map[string]string{"X-VirtualMachine": vmB}, status: http.StatusForbidden},
+		{name: "upload commit of another tenant", token: operatorA, method: http.MethodPost, path: "/api/disk/upload/root.raw/commit", body: `{"virtual_machine":"` + vmB + `"}`, status: http.StatusForbidden},
+		{name: "upload of own virtual machine", token: operatorA, method: http.MethodPut, path: "/api/disk/upload/abc_root.raw.tmp/chunk", header: map[string]string{"X-VirtualMachine": vmA}, status: http.StatusOK},
+
+		{name: "list of own tenant", token: operatorA, method: http.MethodGet, path: "/api/vm?tenant=" + tenantA, status: http.StatusOK},
+		{name: "list of every tenant", token: operatorA, method: http.MethodGet, path: "/api/vm", status: http.StatusForbidden},
+		{name: "create in another tenant", token: operatorA, method: http.MethodPost, path: "/api/vmm/metadata", body: `{"tenant":"` + tenantB + `"}`, status: http.StatusForbidden},
+
+		{name: "bulk action without tenant", token: operatorA, method: http.MethodPut, path: "/api/vm/bulk/boot", body: `{"selector":"tier=front"}`, status: http.StatusForbidden},
+		{name: "bulk action on own tenant", token: operatorA, method: http.MethodPut, path: "/api/vm/bulk/boot", body: `{"tenant":"` + tenantA + `","selector":"tier=front"}`, status: http.StatusOK},
+		{name: "bulk action without tenant bound on every tenant", token: operatorAll, method: http.MethodPut, path: "/api/vm/bulk/boot", body: `{"selector":"tier=front"}`, status: http.StatusOK},
+
+		{name: "events without filter", token: operatorA, method: http.MethodGet, path: "/api/events", status: http.StatusForbidden},
+		{name: "events of own tenant", token: operatorA, method: http.MethodGet, path: "/api/events?tenant=" + tenantA, status: http.StatusOK},
+		{name: "events of a virtual machine of another tenant", token: operatorA, method: http.MethodGet, path: "/api/events?vm=" + vmB, status: http.StatusForbidden},
+		{name: "events of a deleted virtual machine", token: operatorA, method: http.MethodGet, path: "/api/events?vm=" + uuid.NewString(), status: http.StatusForbidden},
+		{name: "events without filter bound on every tenant", token: operatorAll, method: http.MethodGet, path: "/api/events", status: http.StatusOK},
+
+		{name: "webhook of another tenant", token: adminA, method: http.MethodGet, path: "/api/webhooks/" + webhookB.Id, status: http.StatusForbidden},
+		{name: "delete webhook of another tenant", token: adminA, method: http.MethodDelete, path: "/api/webhooks/" + webhookB.Id, status: http.StatusForbidden},
+		{name: "webhook on a virtual machine of another tenant", token: adminA, method: http.MethodPost, path: "/api/webhooks", body: `{"url":"https://example.com","virtual_machine":"` + vmB + `"}`, status: http.StatusForbidden},
+		{name: "webhook on own virtual machine", token: adminA, method: http.MethodPost, path: "/api/webhooks", body: `{"url":"https://example.com","virtual_machine":"` + vmA + `"}`, status: http.StatusOK},
+		{name: "webhook without tenant", token: adminA, method: http.MethodPost, path: "/api/webhooks", body: `{"url":"https://example.com"}`, status: http.StatusForbidden},
+	}
+	for _, test := range tests {
+		req := httptest.NewRequest(test.method, test.path, strings.NewReader(test.body))
+		req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+		if test.token != "" {
+			req.Header.Set(echo.HeaderAuthorization, "Bearer "+test.token)
+		}
+		for name, value := range test.header {
+			req.Header.Set(name, value)
+		}
+		rec := httptest.NewRecorder()
+		e.ServeHTTP(rec, req)
+		assert.Equal(t, test.status, rec.Code, test.name+": "+rec.Body.String())
+	}
+	assert.Contains(t, monitor.denials, tenantB, "Denials are recorded with the tenant of the target")
+}
+
+func Test_Authenticator_updateTarget(t *testing.T) {
+	monitor := newMockedMonitor(t)
+	authenticator := &Authenticator{vmm: monitor}
+	e := newAuthorizationServer(authenticator)
+	vmA := monitor.addVirtualMachine(t, tenantA)
+	operatorB := monitor.token(t, []string{auth.SCOPE_VM_WRITE}, auth.Binding{Tenant: tenantB, Role: auth.ROLE_OPERATOR})
+
+	req := httptest.NewRequest(http.MethodPut, "/api/vmm/metadata", strings.NewReader(`{"guest_identifier":"`+vmA+`","tenant":"`+tenantB+`"}`))
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set(echo.HeaderAuthorization, "Bearer "+operatorB)
+	rec := httptest.NewRecorder()
+	e.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusForbidden, rec.Code, "A virtual machine cannot be claimed by giving another tenant in the body")
+
+	c := e.NewContext(httptest.NewRequest(http.MethodPut, "/api/vmm/metadata", strings.NewReader(`{"guest_identifier":"`+vmA+`","tenant":"`+tenantB+`"}`)), httptest.NewRecorder())
+	c.Request().Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	target, ok, err := authenticator.updateTarget(c)
+	assert.Nil(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, accessTarget{Tenant: tenantA, VirtualMachine: vmA}, target, "The tenant of the stored virtual machine is checked")
+}
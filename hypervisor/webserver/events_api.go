@@ -0,0 +1,179 @@
+package webserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"vmm/events"
+	"vmm/vmm"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+// A comment line is sent on idle streams, so proxies do not close them
+const eventsKeepAliveInterval = 15 * time.Second
+
+type EventsApi struct {
+	vmm *vmm.HypervisorMonitor
+}
+
+func NewEventsApi(vmm *vmm.HypervisorMonitor) *EventsApi {
+	return &EventsApi{
+		vmm: vmm,
+	}
+}
+
+// eventsFilter reads type, vm and tenant query params. Types can be repeated or comma separated.
+// A vm is resolved by reference, a plain uuid is accepted for virtual machines already deleted
+func (eventsApi *EventsApi) eventsFilter(c echo.Context) (events.Filter, error) {
+	var filter events.Filter
+	for _, param := range c.QueryParams()["type"] {
+		for _, eventType := range strings.Split(param, ",") {
+			if eventType = strings.TrimSpace(eventType); eventType != "" {
+				filter.Types = append(filter.Types, eventType)
+			}
+		}
+	}
+	if ref := c.QueryParam("vm"); ref != "" {
+		if vm := eventsApi.vmm.GetVirtualMachine(ref); vm != nil {
+			filter.VirtualMachine = vm.GetManifest().GuestIdentifier.String()
+		} else if id, err := uuid.Parse(ref); err == nil {
+			filter.VirtualMachine = id.String()
+		} else {
+			return filter, fmt.Errorf("virtual machine %q is not found", ref)
+		}
+	}
+	if tenant := c.QueryParam("tenant"); tenant != "" {
+		id, err := uuid.Parse(tenant)
+		if err != nil {
+			return filter, fmt.Errorf("tenant must be a uuid")
+		}
+		filter.Tenant = id.String()
+	}
+	return filter, nil
+}
+
+// lastEventId reads the Last-Event-ID header sent by reconnecting clients,
+// the last_event_id query param is accepted for the first connection
+func lastEventId(c echo.Context) (uint64, bool, error) {
+	var value string = c.Request().Header.Get("Last-Event-ID")
+	if value == "" {
+		value = c.QueryParam("last_event_id")
+	}
+	if value == "" {
+		return 0, false, nil
+	}
+	id, err := strconv.ParseUint(value, 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("last event id must be a positive number")
+	}
+	return id, true, nil
+}
+
+func writeServerSentEvent(c echo.Context, event events.Event) error {
+	content, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+	var frame string
+	if event.Id != 0 {
+		frame = fmt.Sprintf("id: %d\nevent: %s\ndata: %s\n\n", event.Id, event.Type, content)
+	} else {
+		frame = fmt.Sprintf("event: %s\ndata: %s\n\n", event.Type, content)
+	}
+	_, err = c.Response().Write([]byte(frame))
+	return err
+}
+
+// StreamEvents streams monitor events as server-sent events.
+// Events after Last-Event-ID are replayed from the journal before live events,
+// a stream.gap event tells the client that part of them are lost.
+// A client too slow to keep up is disconnected and resumes from its last event
+func (eventsApi *EventsApi) StreamEvents() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		filter, err := eventsApi.eventsFilter(c)
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		afterId, resume, err := lastEventId(c)
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		// Subscribing before reading the journal leaves no hole between replayed and live events
+		subscription := eventsApi.vmm.GetEventBus().Subscribe(filter, events.DefaultSubscriptionBuffer)
+		defer subscription.Close()
+		var replay []events.Event = nil
+		var complete bool = true
+		if resume {
+			replay, complete, err = eventsApi.vmm.ReplayEvents(afterId, filter)
+			if err != nil {
+				return c.String(http.StatusInternalServerError, fmt.Sprintf("There was an error reading the event journal\n%s", err.Error()))
+			}
+		}
+
+		c.Response().Header().Set(echo.HeaderContentType, "text/event-stream")
+		c.Response().Header().Set(echo.HeaderCacheControl, "no-cache")
+		c.Response().Header().Set(echo.HeaderConnection, "keep-alive")
+		c.Response().WriteHeader(http.StatusOK)
+		if !complete {
+			err = writeServerSentEvent(c, events.Event{
+				Type: events.STREAM_GAP,
+				Time: time.Now().UTC(),
+				Data: map[string]any{"after_id": afterId},
+			})
+			if err != nil {
+				return err
+			}
+		}
+		var lastSent uint64 = afterId
+		for _, event := range replay {
+			err = writeServerSentEvent(c, event)
+			if err != nil {
+				return err
+			}
+			lastSent = event.Id
+		}
+		c.Response().Flush()
+
+		ctx, cancel := streamContext(c)
+		defer cancel()
+		var keepAlive *time.Ticker = time.NewTicker(eventsKeepAliveInterval)
+		defer keepAlive.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return nil
+			case <-keepAlive.C:
+				_, err = c.Response().Write([]byte(": keepalive\n\n"))
+				if err != nil {
+					return err
+				}
+				c.Response().Flush()
+			case event, ok := <-subscription.C:
+				if !ok {
+					return nil
+				}
+				if subscription.Dropped() > 0 {
+					return nil
+				}
+				if event.Id <= lastSent {
+					continue
+				}
+				err = writeServerSentEvent(c, event)
+				if err != nil {
+					return err
+				}
+				lastSent = event.Id
+				c.Response().Flush()
+			}
+		}
+	}
+}
+
+type EventsApiService interface {
+	StreamEvents() echo.HandlerFunc
+}
@@ -1,36 +1,202 @@
 package webserver
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"net"
 	"net/http"
+	"sync"
+	"time"
+	"vmm/auth"
 	"vmm/vmm"
 
 	"github.com/labstack/echo/v4"
 )
 
-func Run(vmmManager *vmm.HypervisorMonitor, socket string) {
+// Long lived responses read the context ending them when the server shuts down
+const streamsContextKey = "streams"
+
+// Run serves the api on address and the unix socket of the manifest until ctx is done,
+// then stops accepting connections and waits up to drainTimeout for the requests in flight
+func Run(ctx context.Context, vmmManager *vmm.HypervisorMonitor, address string, drainTimeout time.Duration) error {
 	var e *echo.Echo = echo.New()
 	var virtualMachineUpload *VirtualMachineUpload = NewVirtualMachineUpload(vmmManager)
 	var virtualMachineManagerApi *VirtualMachineManagerApi = NewVirtualMachineManagerApi(vmmManager)
+	var quotaApi *QuotaApi = NewQuotaApi(vmmManager)
+	var orphanApi *OrphanApi = NewOrphanApi(vmmManager)
+	var eventsApi *EventsApi = NewEventsApi(vmmManager)
+	var webhookApi *WebhookApi = NewWebhookApi(vmmManager)
+	var metricsApi *MetricsApi = NewMetricsApi(vmmManager)
+	var monitorApi *MonitorApi = NewMonitorApi(vmmManager)
+	var auditApi *AuditApi = NewAuditApi(vmmManager)
+	var vpcApi *VpcApi = NewVpcApi(vmmManager)
+	var applyApi *ApplyApi = NewApplyApi(vmmManager)
+
+	var authenticator *Authenticator = NewAuthenticator(vmmManager)
+
+	streams, endStreams := context.WithCancel(context.Background())
+	defer endStreams()
+	e.Use(func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			c.Set(streamsContextKey, streams)
+			return next(c)
+		}
+	})
+	e.Use(metricsApi.Middleware())
+	e.Use(auditApi.Middleware())
+	e.Use(authenticator.Middleware())
 
 	e.GET("/ping", func(c echo.Context) error {
 		return c.String(http.StatusAccepted, "pong")
 	})
+	e.GET("/metrics", metricsApi.Metrics(), authenticator.Access(auth.SCOPE_METRICS, auth.ROLE_VIEWER, hostTarget))
+
+	e.POST("/api/disk/upload/:filename/begin", virtualMachineUpload.UploadBegin(UploadType(DISK)), authenticator.Access(auth.SCOPE_UPLOAD, auth.ROLE_OPERATOR, authenticator.uploadBodyTarget))
+	e.PUT("/api/disk/upload/:filename/chunk", virtualMachineUpload.UploadChunk(UploadType(DISK)), authenticator.Access(auth.SCOPE_UPLOAD, auth.ROLE_OPERATOR, authenticator.uploadHeaderTarget))
+	e.POST("/api/disk/upload/:filename/commit", virtualMachineUpload.UploadCommit(UploadType(DISK)), authenticator.Access(auth.SCOPE_UPLOAD, auth.ROLE_OPERATOR, authenticator.uploadBodyTarget))
+	e.GET("/api/disk/upload", virtualMachineUpload.ListUploads(), authenticator.Access(auth.SCOPE_UPLOAD, auth.ROLE_OPERATOR, authenticator.uploadHeaderTarget))
+	e.GET("/api/disk/upload/:filename", virtualMachineUpload.GetUpload(), authenticator.Access(auth.SCOPE_UPLOAD, auth.ROLE_OPERATOR, authenticator.uploadHeaderTarget))
+
+	e.POST("/api/kernel/upload/:filename/begin", virtualMachineUpload.UploadBegin(UploadType(KERNEL)), authenticator.Access(auth.SCOPE_UPLOAD, auth.ROLE_OPERATOR, authenticator.uploadBodyTarget))
+	e.PUT("/api/kernel/upload/:filename/chunk", virtualMachineUpload.UploadChunk(UploadType(KERNEL)), authenticator.Access(auth.SCOPE_UPLOAD, auth.ROLE_OPERATOR, authenticator.uploadHeaderTarget))
+	e.POST("/api/kernel/upload/:filename/commit", virtualMachineUpload.UploadCommit(UploadType(KERNEL)), authenticator.Access(auth.SCOPE_UPLOAD, auth.ROLE_OPERATOR, authenticator.uploadBodyTarget))
+
+	e.GET("/api/vm", virtualMachineManagerApi.ListVirtualMachines(), authenticator.Access(auth.SCOPE_VM_READ, auth.ROLE_VIEWER, tenantQueryTarget))
+	e.PUT("/api/vm/bulk/:action", virtualMachineManagerApi.BulkAction(), authenticator.Access(auth.SCOPE_VM_WRITE, auth.ROLE_OPERATOR, bulkTarget))
+	vmRoute(e, http.MethodGet, "/info", virtualMachineManagerApi.InfoVirtualMachine(), authenticator.Access(auth.SCOPE_VM_READ, auth.ROLE_VIEWER, authenticator.virtualMachineTarget))
+	vmRoute(e, http.MethodPut, "/boot", virtualMachineManagerApi.BootVirtualMachine(), authenticator.Access(auth.SCOPE_VM_WRITE, auth.ROLE_OPERATOR, authenticator.virtualMachineTarget))
+	vmRoute(e, http.MethodPut, "/shutdown", virtualMachineManagerApi.ShutdownVirtualMachine(), authenticator.Access(auth.SCOPE_VM_WRITE, auth.ROLE_OPERATOR, authenticator.virtualMachineTarget))
+	vmRoute(e, http.MethodPut, "/pause", virtualMachineManagerApi.PauseVirtualMachine(), authenticator.Access(auth.SCOPE_VM_WRITE, auth.ROLE_OPERATOR, authenticator.virtualMachineTarget))
+	vmRoute(e, http.MethodPut, "/resume", virtualMachineManagerApi.ResumeVirtualMachine(), authenticator.Access(auth.SCOPE_VM_WRITE, auth.ROLE_OPERATOR, authenticator.virtualMachineTarget))
+	vmRoute(e, http.MethodPut, "/delete", virtualMachineManagerApi.DeleteVirtualMachine(), authenticator.Access(auth.SCOPE_VM_WRITE, auth.ROLE_OPERATOR, authenticator.virtualMachineTarget))
+	vmRoute(e, http.MethodPatch, "/metadata", virtualMachineManagerApi.UpdateMetadata(), authenticator.Access(auth.SCOPE_VM_WRITE, auth.ROLE_OPERATOR, authenticator.virtualMachineTarget))
+	vmRoute(e, http.MethodPut, "/rename", virtualMachineManagerApi.RenameVirtualMachine(), authenticator.Access(auth.SCOPE_VM_WRITE, auth.ROLE_OPERATOR, authenticator.virtualMachineTarget))
+	vmRoute(e, http.MethodPut, "/resize", virtualMachineManagerApi.ResizeVirtualMachine(), authenticator.Access(auth.SCOPE_VM_WRITE, auth.ROLE_OPERATOR, authenticator.virtualMachineTarget))
+	vmRoute(e, http.MethodGet, "/logs", virtualMachineManagerApi.VirtualMachineLogs(), authenticator.Access(auth.SCOPE_VM_READ, auth.ROLE_VIEWER, authenticator.virtualMachineTarget))
+	vmRoute(e, http.MethodGet, "/metrics", virtualMachineManagerApi.VirtualMachineHistory(), authenticator.Access(auth.SCOPE_VM_READ, auth.ROLE_VIEWER, authenticator.virtualMachineTarget))
+	vmRoute(e, http.MethodGet, "/disks", virtualMachineManagerApi.ListDisks(), authenticator.Access(auth.SCOPE_VM_READ, auth.ROLE_VIEWER, authenticator.virtualMachineTarget))
+	vmRoute(e, http.MethodPut, "/disks/:disk/resize", virtualMachineManagerApi.ResizeDisk(), authenticator.Access(auth.SCOPE_VM_WRITE, auth.ROLE_OPERATOR, authenticator.virtualMachineTarget))
+
+	e.PUT("/api/vmm/metadata", virtualMachineManagerApi.UpdateVirtualMachine(), authenticator.Access(auth.SCOPE_VM_WRITE, auth.ROLE_OPERATOR, authenticator.updateTarget))
+	e.POST("/api/vmm/metadata", virtualMachineManagerApi.CreateVirtualMachine(), authenticator.Access(auth.SCOPE_VM_WRITE, auth.ROLE_OPERATOR, createTarget))
+	e.GET("/api/vmm/capacity", virtualMachineManagerApi.GetCapacity(), authenticator.Access(auth.SCOPE_VM_READ, auth.ROLE_VIEWER, hostTarget))
+
+	e.POST("/api/vmm/reload", monitorApi.Reload(), authenticator.Access(auth.SCOPE_ADMIN, auth.ROLE_ADMIN, hostTarget))
 
-	e.POST("/api/disk/upload/:filename/begin", virtualMachineUpload.UploadBegin(UploadType(DISK)))
-	e.PUT("/api/disk/upload/:filename/chunk", virtualMachineUpload.UploadChunk(UploadType(DISK)))
-	e.POST("/api/disk/upload/:filename/commit", virtualMachineUpload.UploadCommit(UploadType(DISK)))
+	e.GET("/api/vmm/orphans", orphanApi.ListOrphans(), authenticator.Access(auth.SCOPE_ADMIN, auth.ROLE_ADMIN, hostTarget))
+	e.POST("/api/vmm/orphans/scan", orphanApi.ScanOrphans(), authenticator.Access(auth.SCOPE_ADMIN, auth.ROLE_ADMIN, hostTarget))
+	e.POST("/api/vmm/orphans/:pid/adopt", orphanApi.AdoptOrphan(), authenticator.Access(auth.SCOPE_ADMIN, auth.ROLE_ADMIN, hostTarget))
+	e.POST("/api/vmm/orphans/:pid/kill", orphanApi.KillOrphan(), authenticator.Access(auth.SCOPE_ADMIN, auth.ROLE_ADMIN, hostTarget))
 
-	e.POST("/api/kernel/upload/:filename/begin", virtualMachineUpload.UploadBegin(UploadType(KERNEL)))
-	e.PUT("/api/kernel/upload/:filename/chunk", virtualMachineUpload.UploadChunk(UploadType(KERNEL)))
-	e.POST("/api/kernel/upload/:filename/commit", virtualMachineUpload.UploadCommit(UploadType(KERNEL)))
+	e.GET("/api/vpc", vpcApi.ListNetworks(), authenticator.Access(auth.SCOPE_VM_READ, auth.ROLE_VIEWER, tenantQueryTarget))
+	e.POST("/api/vpc/:tenant", vpcApi.CreateNetwork(), authenticator.Access(auth.SCOPE_VM_WRITE, auth.ROLE_OPERATOR, tenantParamTarget))
+	e.DELETE("/api/vpc/:tenant", vpcApi.DeleteNetwork(), authenticator.Access(auth.SCOPE_VM_WRITE, auth.ROLE_OPERATOR, tenantParamTarget))
 
-	e.GET("/api/vm/:vm/info", nil)
-	e.PUT("/api/vm/:vm/boot", virtualMachineManagerApi.BootVirtualMachine())
-	e.PUT("/api/vm/:vm/shutdown", nil)
-	e.PUT("/api/vm/:vm/delete", nil)
+	e.POST("/api/apply", applyApi.Apply(), authenticator.Access(auth.SCOPE_VM_WRITE, auth.ROLE_OPERATOR, tenantQueryTarget))
 
-	e.PUT("/api/vmm/metadata", virtualMachineManagerApi.UpdateVirtualMachine())
-	e.POST("/api/vmm/metadata", virtualMachineManagerApi.CreateVirtualMachine())
+	e.GET("/api/events", eventsApi.StreamEvents(), authenticator.Access(auth.SCOPE_EVENTS, auth.ROLE_VIEWER, authenticator.eventsTarget))
+
+	e.GET("/api/webhooks", webhookApi.ListWebhooks(), authenticator.Access(auth.SCOPE_WEBHOOKS, auth.ROLE_ADMIN, nil))
+	e.POST("/api/webhooks", webhookApi.CreateWebhook(), authenticator.Access(auth.SCOPE_WEBHOOKS, auth.ROLE_ADMIN, authenticator.webhookBodyTarget))
+	e.GET("/api/webhooks/:id", webhookApi.GetWebhook(), authenticator.Access(auth.SCOPE_WEBHOOKS, auth.ROLE_ADMIN, authenticator.webhookTarget))
+	e.DELETE("/api/webhooks/:id", webhookApi.DeleteWebhook(), authenticator.Access(auth.SCOPE_WEBHOOKS, auth.ROLE_ADMIN, authenticator.webhookTarget))
+	e.GET("/api/webhooks/:id/deliveries", webhookApi.ListDeliveries(), authenticator.Access(auth.SCOPE_WEBHOOKS, auth.ROLE_ADMIN, authenticator.webhookTarget))
+
+	e.GET("/api/audit", auditApi.Query(), authenticator.Access(auth.SCOPE_AUDIT, auth.ROLE_ADMIN, tenantQueryTarget))
+
+	e.GET("/api/admin/quotas", quotaApi.ListQuotas(), authenticator.Access(auth.SCOPE_ADMIN, auth.ROLE_ADMIN, hostTarget))
+	e.GET("/api/admin/quotas/:tenant", quotaApi.GetQuota(), authenticator.Access(auth.SCOPE_VM_READ, auth.ROLE_VIEWER, tenantParamTarget))
+	e.PUT("/api/admin/quotas/:tenant", quotaApi.SetQuota(), authenticator.Access(auth.SCOPE_ADMIN, auth.ROLE_ADMIN, hostTarget))
+	e.DELETE("/api/admin/quotas/:tenant", quotaApi.DeleteQuota(), authenticator.Access(auth.SCOPE_ADMIN, auth.ROLE_ADMIN, hostTarget))
+
+	tlsConfig, err := authenticator.serverTlsConfig()
+	if err != nil {
+		return err
+	}
+	vmmManager.AddReloadHook(authenticator.reloadTls)
+	tcp, local, err := openListeners(address, vmmManager.GetUnixSocketConfig())
+	if err != nil {
+		return err
+	}
+	var servers []*http.Server = make([]*http.Server, 0, len(tcp)+len(local))
+	var listeners []net.Listener = make([]net.Listener, 0, len(tcp)+len(local))
+	for _, listener := range tcp {
+		if tlsConfig != nil {
+			listener = tls.NewListener(listener, tlsConfig)
+		} else {
+			e.Logger.Warnf("Tls is not configured, api tokens are sent in clear text on %s", listener.Addr().String())
+		}
+		servers = append(servers, &http.Server{Handler: e, ErrorLog: e.StdLogger})
+		listeners = append(listeners, listener)
+	}
+	// Local callers are identified by the credentials of the connection
+	for _, listener := range local {
+		servers = append(servers, &http.Server{Handler: e, ErrorLog: e.StdLogger, ConnContext: connContext})
+		listeners = append(listeners, listener)
+	}
+
+	served := make(chan error, len(servers))
+	for i, server := range servers {
+		server.RegisterOnShutdown(endStreams)
+		e.Logger.Infof("Api listening on %s %s", listeners[i].Addr().Network(), listeners[i].Addr().String())
+		go func(server *http.Server, listener net.Listener) {
+			served <- server.Serve(listener)
+		}(server, listeners[i])
+	}
+	// A listener failing stops the others
+	var serveErr error
+	select {
+	case serveErr = <-served:
+	case <-ctx.Done():
+	}
+
+	e.Logger.Info("Draining api requests")
+	drain, cancel := context.WithTimeout(context.Background(), drainTimeout)
+	defer cancel()
+	var wg sync.WaitGroup
+	var errs []error = make([]error, len(servers))
+	for i, server := range servers {
+		wg.Add(1)
+		go func(i int, server *http.Server) {
+			defer wg.Done()
+			errs[i] = server.Shutdown(drain)
+			if errors.Is(errs[i], context.DeadlineExceeded) {
+				e.Logger.Warn("Requests still in flight after the drain timeout are cut off")
+				errs[i] = server.Close()
+			}
+		}(i, server)
+	}
+	wg.Wait()
+	if serveErr == nil {
+		<-served
+	}
+	for range len(servers) - 1 {
+		<-served
+	}
+	if errors.Is(serveErr, http.ErrServerClosed) {
+		serveErr = nil
+	}
+	return errors.Join(append(errs, serveErr)...)
+}
+
+// streamContext ends with the request or when the server starts shutting down,
+// so event streams and followed logs do not hold the drain
+func streamContext(c echo.Context) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(c.Request().Context())
+	streams, ok := c.Get(streamsContextKey).(context.Context)
+	if !ok {
+		return ctx, cancel
+	}
+	stop := context.AfterFunc(streams, cancel)
+	return ctx, func() {
+		stop()
+		cancel()
+	}
+}
 
-	e.Logger.Fatal(e.Start(socket))
+// vmRoute registers a virtual machine route addressed either by uuid or by tenant and name
+func vmRoute(e *echo.Echo, method string, path string, handler echo.HandlerFunc, middleware ...echo.MiddlewareFunc) {
+	e.Add(method, "/api/vm/:vm"+path, handler, middleware...)
+	e.Add(method, "/api/vm/:tenant/:name"+path, handler, middleware...)
 }
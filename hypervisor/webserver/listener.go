@@ -0,0 +1,145 @@
+package webserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"vmm/vmm"
+
+	"golang.org/x/sys/unix"
+)
+
+// First file descriptor passed by systemd socket activation
+const systemdFirstFd = 3
+
+type peerCredentialsKey struct{}
+
+// connContext keeps the credentials of the process on the other end of a unix socket connection
+func connContext(ctx context.Context, conn net.Conn) context.Context {
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return ctx
+	}
+	raw, err := unixConn.SyscallConn()
+	if err != nil {
+		return ctx
+	}
+	var credentials *unix.Ucred
+	var credentialsErr error
+	err = raw.Control(func(fd uintptr) {
+		credentials, credentialsErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	})
+	if err != nil || credentialsErr != nil {
+		return ctx
+	}
+	return context.WithValue(ctx, peerCredentialsKey{}, credentials)
+}
+
+func peerCredentials(ctx context.Context) (*unix.Ucred, bool) {
+	credentials, ok := ctx.Value(peerCredentialsKey{}).(*unix.Ucred)
+	return credentials, ok
+}
+
+// systemdListeners returns the sockets passed by systemd, none when the monitor was not socket activated
+func systemdListeners() ([]net.Listener, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return nil, nil
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return nil, nil
+	}
+	// Guests and other children must not inherit the sockets
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	var listeners []net.Listener = make([]net.Listener, 0, count)
+	for fd := systemdFirstFd; fd < systemdFirstFd+count; fd++ {
+		unix.CloseOnExec(fd)
+		file := os.NewFile(uintptr(fd), fmt.Sprintf("systemd-socket-%d", fd))
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			for _, opened := range listeners {
+				opened.Close()
+			}
+			return nil, fmt.Errorf("socket %d passed by systemd is not a listening socket: %w", fd, err)
+		}
+		listeners = append(listeners, listener)
+	}
+	return listeners, nil
+}
+
+// listenUnix creates the socket file, a socket left by a previous run is replaced
+func listenUnix(config vmm.UnixSocketConfig) (net.Listener, error) {
+	mode, err := config.FileMode()
+	if err != nil {
+		return nil, err
+	}
+	stat, err := os.Lstat(config.Path)
+	if err == nil {
+		if stat.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", config.Path)
+		}
+		err = os.Remove(config.Path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	listener, err := net.Listen("unix", config.Path)
+	if err != nil {
+		return nil, err
+	}
+	err = os.Chmod(config.Path, mode)
+	if err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// openListeners returns the tcp and unix sockets of the api. Sockets passed by systemd
+// replace both address and the configured unix socket
+func openListeners(address string, config vmm.UnixSocketConfig) ([]net.Listener, []net.Listener, error) {
+	activated, err := systemdListeners()
+	if err != nil {
+		return nil, nil, err
+	}
+	var tcp []net.Listener = make([]net.Listener, 0)
+	var local []net.Listener = make([]net.Listener, 0)
+	if len(activated) > 0 {
+		for _, listener := range activated {
+			if listener.Addr().Network() == "unix" {
+				local = append(local, listener)
+			} else {
+				tcp = append(tcp, listener)
+			}
+		}
+		return tcp, local, nil
+	}
+	if address != "" {
+		listener, err := net.Listen("tcp", address)
+		if err != nil {
+			return nil, nil, err
+		}
+		tcp = append(tcp, listener)
+	}
+	if config.Path != "" {
+		listener, err := listenUnix(config)
+		if err != nil {
+			for _, opened := range tcp {
+				opened.Close()
+			}
+			return nil, nil, fmt.Errorf("unable to listen on %s: %w", config.Path, err)
+		}
+		local = append(local, listener)
+	}
+	if len(tcp) == 0 && len(local) == 0 {
+		return nil, nil, errors.New("no listener, set server_address or server.unix_socket.path")
+	}
+	return tcp, local, nil
+}
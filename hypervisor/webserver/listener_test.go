@@ -0,0 +1,134 @@
+package webserver
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"vmm/auth"
+	"vmm/vmm"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// servePeers serves the routes of the api on a temporary unix socket, like the monitor does
+func servePeers(t *testing.T, monitor *MockedMonitor) *http.Client {
+	path := filepath.Join(t.TempDir(), "chmon.sock")
+	listener, err := listenUnix(vmm.UnixSocketConfig{Path: path})
+	assert.Nil(t, err)
+	server := &http.Server{Handler: newAuthorizationServer(&Authenticator{vmm: monitor}), ConnContext: connContext}
+	go server.Serve(listener)
+	t.Cleanup(func() {
+		server.Close()
+	})
+	return &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, network string, address string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+}
+
+func peerStatus(t *testing.T, client *http.Client, method string, path string) int {
+	req, err := http.NewRequest(method, "http://localhost"+path, nil)
+	assert.Nil(t, err)
+	res, err := client.Do(req)
+	assert.Nil(t, err)
+	res.Body.Close()
+	return res.StatusCode
+}
+
+func Test_Authenticator_peerPrincipal(t *testing.T) {
+	monitor := newMockedMonitor(t)
+	vmA := monitor.addVirtualMachine(t, tenantA)
+	vmB := monitor.addVirtualMachine(t, tenantB)
+	client := servePeers(t, monitor)
+
+	var uid uint32 = uint32(os.Getuid())
+	var gid uint32 = uint32(os.Getgid())
+	var otherUid uint32 = uid + 1
+	scopes := []string{auth.SCOPE_VM_READ, auth.SCOPE_VM_WRITE}
+
+	monitor.unixSocket = vmm.UnixSocketConfig{Peers: []vmm.PeerRule{
+		{Uid: &uid, Scopes: scopes, Bindings: []auth.Binding{{Tenant: tenantA, Role: auth.ROLE_OPERATOR}}},
+		{Uid: &otherUid, Scopes: scopes, Bindings: []auth.Binding{{Tenant: tenantB, Role: auth.ROLE_OPERATOR}}},
+	}}
+	assert.Equal(t, http.StatusOK, peerStatus(t, client, http.MethodPut, "/api/vm/"+vmA+"/boot"), "The uid of the caller is mapped to its role")
+	assert.Equal(t, http.StatusForbidden, peerStatus(t, client, http.MethodPut, "/api/vm/"+vmB+"/boot"), "Rules of other uids are not granted")
+
+	monitor.unixSocket = vmm.UnixSocketConfig{Peers: []vmm.PeerRule{
+		{Uid: &uid, Scopes: []string{auth.SCOPE_VM_READ}, Bindings: []auth.Binding{{Tenant: tenantA, Role: auth.ROLE_VIEWER}}},
+		{Gid: &gid, Scopes: []string{auth.SCOPE_VM_WRITE}, Bindings: []auth.Binding{{Tenant: tenantA, Role: auth.ROLE_OPERATOR}}},
+	}}
+	assert.Equal(t, http.StatusOK, peerStatus(t, client, http.MethodPut, "/api/vm/"+vmA+"/boot"), "Every matching rule grants its scopes and roles")
+
+	monitor.unixSocket = vmm.UnixSocketConfig{Peers: []vmm.PeerRule{
+		{Uid: &otherUid, Scopes: scopes, Bindings: []auth.Binding{{Tenant: auth.ALL_TENANTS, Role: auth.ROLE_ADMIN}}},
+	}}
+	assert.Equal(t, http.StatusUnauthorized, peerStatus(t, client, http.MethodGet, "/api/vm/"+vmA+"/info"), "A peer matching no rule is rejected")
+}
+
+// Test_systemdListeners runs in a child process receiving the socket as fd 3, so the
+// descriptors of the test binary are left alone
+func Test_systemdListeners(t *testing.T) {
+	if os.Getenv("CHMON_TEST_SYSTEMD") != "" {
+		systemdListenersChild()
+		return
+	}
+	path := filepath.Join(t.TempDir(), "activated.sock")
+	listener, err := net.Listen("unix", path)
+	assert.Nil(t, err)
+	defer listener.Close()
+	file, err := listener.(*net.UnixListener).File()
+	assert.Nil(t, err)
+	defer file.Close()
+
+	cmd := exec.Command(os.Args[0], "-test.run=^Test_systemdListeners$")
+	cmd.Env = append(os.Environ(), "CHMON_TEST_SYSTEMD=1")
+	cmd.ExtraFiles = []*os.File{file}
+	output, err := cmd.CombinedOutput()
+	assert.Nil(t, err, string(output))
+
+	regular, err := os.Create(filepath.Join(t.TempDir(), "regular"))
+	assert.Nil(t, err)
+	defer regular.Close()
+	cmd = exec.Command(os.Args[0], "-test.run=^Test_systemdListeners$")
+	cmd.Env = append(os.Environ(), "CHMON_TEST_SYSTEMD=2")
+	cmd.ExtraFiles = []*os.File{regular}
+	output, err = cmd.CombinedOutput()
+	assert.Nil(t, err, string(output))
+}
+
+func systemdListenersChild() {
+	fail := func(message string) {
+		os.Stderr.WriteString(message + "\n")
+		os.Exit(1)
+	}
+	os.Setenv("LISTEN_FDS", "1")
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getppid()))
+	listeners, err := systemdListeners()
+	if err != nil || len(listeners) != 0 {
+		fail("sockets passed to another process must be ignored")
+	}
+	os.Setenv("LISTEN_PID", strconv.Itoa(os.Getpid()))
+	listeners, err = systemdListeners()
+	if os.Getenv("CHMON_TEST_SYSTEMD") == "2" {
+		if err == nil {
+			fail("a descriptor that is not a socket must be rejected")
+		}
+		os.Exit(0)
+	}
+	if err != nil || len(listeners) != 1 {
+		fail("expected the socket passed as fd 3")
+	}
+	if listeners[0].Addr().Network() != "unix" {
+		fail("expected a unix socket, found " + listeners[0].Addr().Network())
+	}
+	if os.Getenv("LISTEN_PID") != "" || os.Getenv("LISTEN_FDS") != "" {
+		fail("LISTEN_PID and LISTEN_FDS must not be inherited by children")
+	}
+	os.Exit(0)
+}
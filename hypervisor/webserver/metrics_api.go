@@ -0,0 +1,67 @@
+package webserver
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+	"vmm/metrics"
+	"vmm/vmm"
+
+	"github.com/labstack/echo/v4"
+)
+
+type MetricsApi struct {
+	vmm            *vmm.HypervisorMonitor
+	requestLatency *metrics.HistogramVec
+}
+
+func NewMetricsApi(vmm *vmm.HypervisorMonitor) *MetricsApi {
+	var requestLatency *metrics.HistogramVec = metrics.NewHistogramVec(
+		"chmon_api_request_duration_seconds",
+		"Latency of api requests by route template, streams are measured until they end",
+		metrics.DefaultBuckets,
+		"method", "route", "code",
+	)
+	vmm.GetMetrics().Register(requestLatency)
+	return &MetricsApi{
+		vmm:            vmm,
+		requestLatency: requestLatency,
+	}
+}
+
+// Middleware observes the latency of every request. Routes are labelled by their
+// template, so the cardinality does not grow with the number of virtual machines
+func (metricsApi *MetricsApi) Middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			start := time.Now()
+			err := next(c)
+			var code int = c.Response().Status
+			var httpError *echo.HTTPError
+			if err != nil && !c.Response().Committed && errors.As(err, &httpError) {
+				code = httpError.Code
+			}
+			var route string = c.Path()
+			if route == "" {
+				route = "unmatched"
+			}
+			metricsApi.requestLatency.Observe(time.Since(start).Seconds(), c.Request().Method, route, strconv.Itoa(code))
+			return err
+		}
+	}
+}
+
+// Metrics serves every metric in the Prometheus text exposition format
+func (metricsApi *MetricsApi) Metrics() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		c.Response().Header().Set(echo.HeaderContentType, metrics.ContentType)
+		c.Response().WriteHeader(http.StatusOK)
+		return metricsApi.vmm.GetMetrics().Write(c.Response())
+	}
+}
+
+type MetricsApiService interface {
+	Middleware() echo.MiddlewareFunc
+	Metrics() echo.HandlerFunc
+}
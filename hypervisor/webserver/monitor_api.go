@@ -0,0 +1,44 @@
+package webserver
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"vmm/vmm"
+
+	"github.com/labstack/echo/v4"
+)
+
+type MonitorApi struct {
+	vmm *vmm.HypervisorMonitor
+}
+
+func NewMonitorApi(vmm *vmm.HypervisorMonitor) *MonitorApi {
+	return &MonitorApi{
+		vmm: vmm,
+	}
+}
+
+// Reload applies the host manifest on disk, like SIGHUP
+func (monitorApi *MonitorApi) Reload() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		result, err := monitorApi.vmm.Reload()
+		if err != nil {
+			var errInvalid *vmm.ErrInvalidManifest
+			var errRestart *vmm.ErrRestartRequired
+			if errors.As(err, &errInvalid) {
+				return c.String(http.StatusUnprocessableEntity, fmt.Sprintf("Host manifest is not valid\n%s", strings.Join(errInvalid.Problems, "\n")))
+			}
+			if errors.As(err, &errRestart) {
+				return c.String(http.StatusConflict, fmt.Sprintf("Host manifest was not reloaded, %s", err.Error()))
+			}
+			return c.String(http.StatusInternalServerError, fmt.Sprintf("There was an error reloading the host manifest\n%s", err.Error()))
+		}
+		return c.JSON(http.StatusOK, result)
+	}
+}
+
+type MonitorApiService interface {
+	Reload() echo.HandlerFunc
+}
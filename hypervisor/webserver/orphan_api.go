@@ -0,0 +1,94 @@
+package webserver
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"vmm/vmm"
+
+	"github.com/labstack/echo/v4"
+)
+
+type OrphanApi struct {
+	vmm *vmm.HypervisorMonitor
+}
+
+func NewOrphanApi(vmm *vmm.HypervisorMonitor) *OrphanApi {
+	return &OrphanApi{
+		vmm: vmm,
+	}
+}
+
+func (orphanApi *OrphanApi) ListOrphans() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return c.JSON(http.StatusOK, orphanApi.vmm.ListOrphans())
+	}
+}
+
+// ScanOrphans looks for running cloud-hypervisor processes again
+func (orphanApi *OrphanApi) ScanOrphans() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		err := orphanApi.vmm.MergeRunningInstances(orphanApi.vmm.GetBinaryPath())
+		if err != nil {
+			return c.String(http.StatusInternalServerError, fmt.Sprintf("There was an error scanning processes\n%s", err.Error()))
+		}
+		return c.JSON(http.StatusOK, orphanApi.vmm.ListOrphans())
+	}
+}
+
+type AdoptBody struct {
+	// Optional, defaults to the vm uuid reported by the process
+	VirtualMachine string `json:"virtual_machine" xml:"virtual_machine"`
+}
+
+func (orphanApi *OrphanApi) AdoptOrphan() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		pid, err := strconv.Atoi(c.Param("pid"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Pid must be a number")
+		}
+		body := new(AdoptBody)
+		if err = c.Bind(body); err != nil {
+			return c.String(http.StatusBadRequest, "Malformed request body")
+		}
+		manifest, err := orphanApi.vmm.AdoptOrphan(pid, body.VirtualMachine)
+		if err != nil {
+			return c.String(orphanErrorStatus(err), fmt.Sprintf("There was an error adopting the process\n%s", err.Error()))
+		}
+		return c.JSON(http.StatusOK, manifest)
+	}
+}
+
+func (orphanApi *OrphanApi) KillOrphan() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		pid, err := strconv.Atoi(c.Param("pid"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Pid must be a number")
+		}
+		err = orphanApi.vmm.KillOrphan(pid)
+		if err != nil {
+			return c.String(orphanErrorStatus(err), fmt.Sprintf("There was an error killing the process\n%s", err.Error()))
+		}
+		return c.JSON(http.StatusOK, JsonResponse{Message: "OK"})
+	}
+}
+
+func orphanErrorStatus(err error) int {
+	var errNotFound *vmm.ErrOrphanNotFound
+	if errors.As(err, &errNotFound) {
+		return http.StatusNotFound
+	}
+	var errGone *vmm.ErrOrphanGone
+	if errors.As(err, &errGone) {
+		return http.StatusGone
+	}
+	return stateErrorStatus(err)
+}
+
+type OrphanApiService interface {
+	ListOrphans() echo.HandlerFunc
+	ScanOrphans() echo.HandlerFunc
+	AdoptOrphan() echo.HandlerFunc
+	KillOrphan() echo.HandlerFunc
+}
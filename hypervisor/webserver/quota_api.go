@@ -0,0 +1,75 @@
+package webserver
+
+import (
+	"fmt"
+	"net/http"
+	"vmm/vmm"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+type QuotaApi struct {
+	vmm *vmm.HypervisorMonitor
+}
+
+func NewQuotaApi(vmm *vmm.HypervisorMonitor) *QuotaApi {
+	return &QuotaApi{
+		vmm: vmm,
+	}
+}
+
+func (quotaApi *QuotaApi) ListQuotas() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return c.JSON(http.StatusOK, quotaApi.vmm.ListTenantQuotas())
+	}
+}
+
+func (quotaApi *QuotaApi) GetQuota() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		tenant, err := uuid.Parse(c.Param("tenant"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Tenant must be a uuid")
+		}
+		return c.JSON(http.StatusOK, quotaApi.vmm.GetTenantQuota(tenant.String()))
+	}
+}
+
+func (quotaApi *QuotaApi) SetQuota() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		tenant, err := uuid.Parse(c.Param("tenant"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Tenant must be a uuid")
+		}
+		quota := new(vmm.Quota)
+		if err = c.Bind(quota); err != nil {
+			return c.String(http.StatusBadRequest, "Malformed request body")
+		}
+		err = quotaApi.vmm.SetTenantQuota(tenant.String(), *quota)
+		if err != nil {
+			return c.String(http.StatusBadRequest, fmt.Sprintf("There was an error storing the quota\n%s", err.Error()))
+		}
+		return c.JSON(http.StatusOK, quotaApi.vmm.GetTenantQuota(tenant.String()))
+	}
+}
+
+func (quotaApi *QuotaApi) DeleteQuota() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		tenant, err := uuid.Parse(c.Param("tenant"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Tenant must be a uuid")
+		}
+		err = quotaApi.vmm.DeleteTenantQuota(tenant.String())
+		if err != nil {
+			return c.String(http.StatusInternalServerError, fmt.Sprintf("There was an error deleting the quota\n%s", err.Error()))
+		}
+		return c.JSON(http.StatusOK, JsonResponse{Message: "OK"})
+	}
+}
+
+type QuotaApiService interface {
+	ListQuotas() echo.HandlerFunc
+	GetQuota() echo.HandlerFunc
+	SetQuota() echo.HandlerFunc
+	DeleteQuota() echo.HandlerFunc
+}
@@ -1,7 +1,9 @@
 package webserver
 
 import (
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	virtualmachine "vmm/virtual_machine"
 	"vmm/vmm"
@@ -18,17 +20,35 @@ const (
 
 type BeginBody struct {
 	VirtualMachine string `json:"virtual_machine" xml:"virtual_machine"`
+	// Full size in bytes, required for disks to enforce tenant quotas
+	Size int64 `json:"size" xml:"size"`
+	// Optional hex sha256 of the disk, kept in the upload session so a client can find it to resume
+	Sha256 string `json:"sha256" xml:"sha256"`
 }
 
 type CommitBody struct {
 	VirtualMachine string `json:"virtual_machine" xml:"virtual_machine"`
 	TmpFileName    string `json:"tmp_file_name" xml:"tmp_file_name"`
+	// Optional hex sha256, the committed file must match it
+	Sha256 string `json:"sha256" xml:"sha256"`
 }
 
 type JsonResponse struct {
 	Message string `json:"message" xml:"message"`
 }
 
+// countingReader counts the bytes written by a chunk
+type countingReader struct {
+	reader io.Reader
+	count  int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.reader.Read(p)
+	r.count += int64(n)
+	return n, err
+}
+
 type VirtualMachineUpload struct {
 	vmm *vmm.HypervisorMonitor
 }
@@ -43,9 +63,31 @@ type VirtualMachineUploadService interface {
 	UploadBegin() echo.HandlerFunc
 	UploadCommit() echo.HandlerFunc
 	UploadChunk() echo.HandlerFunc
+	ListUploads() echo.HandlerFunc
+	GetUpload() echo.HandlerFunc
 	CreateVirtualMachine() echo.HandlerFunc
 }
 
+func uploadErrorStatus(err error) int {
+	var errSession *vmm.ErrUploadSessionNotFound
+	if errors.As(err, &errSession) {
+		return http.StatusNotFound
+	}
+	var errIncomplete *vmm.ErrUploadIncomplete
+	if errors.As(err, &errIncomplete) {
+		return http.StatusConflict
+	}
+	var errChecksum *vmm.ErrUploadChecksum
+	if errors.As(err, &errChecksum) {
+		return http.StatusUnprocessableEntity
+	}
+	var errNotFound *vmm.ErrVirtualMachineNotFound
+	if errors.As(err, &errNotFound) {
+		return http.StatusNotFound
+	}
+	return http.StatusBadRequest
+}
+
 func (vmStorage *VirtualMachineUpload) UploadBegin(uploadType UploadType) echo.HandlerFunc {
 	return func(c echo.Context) error {
 		fileMetadata := new(BeginBody)
@@ -61,9 +103,13 @@ func (vmStorage *VirtualMachineUpload) UploadBegin(uploadType UploadType) echo.H
 
 		var tmpFileName string
 		if uploadType == UploadType(DISK) {
-			tmpFileName, err = vm.CreateDisk(filename)
+			tmpFileName, err = vmStorage.vmm.BeginDiskUpload(fileMetadata.VirtualMachine, filename, fileMetadata.Size, fileMetadata.Sha256)
+			var errQuota *vmm.ErrQuotaExceeded
+			if errors.As(err, &errQuota) {
+				return c.String(http.StatusForbidden, err.Error())
+			}
 			if err != nil {
-				return c.String(http.StatusBadRequest, "There was an error creating disk")
+				return c.String(http.StatusBadRequest, fmt.Sprintf("There was an error creating disk\n%s", err.Error()))
 			}
 		} else if uploadType == UploadType(KERNEL) {
 			tmpFileName, err = vm.CreateKernel(filename)
@@ -92,14 +138,14 @@ func (vmStorage *VirtualMachineUpload) UploadCommit(uploadType UploadType) echo.
 		}
 
 		if uploadType == UploadType(DISK) {
-			err = vm.CommitDisk(fileMetadata.TmpFileName, filename)
+			err = vmStorage.vmm.CommitDiskUpload(fileMetadata.VirtualMachine, fileMetadata.TmpFileName, filename, fileMetadata.Sha256)
 			if err != nil {
-				return c.String(http.StatusBadRequest, "There was an error in disk commit")
+				return c.String(uploadErrorStatus(err), fmt.Sprintf("There was an error in disk commit\n%s", err.Error()))
 			}
 		} else if uploadType == UploadType(KERNEL) {
-			err = vm.CommitKernel(fileMetadata.TmpFileName, filename)
+			err = vmStorage.vmm.CommitKernelUpload(fileMetadata.VirtualMachine, fileMetadata.TmpFileName, filename, fileMetadata.Sha256)
 			if err != nil {
-				return c.String(http.StatusBadRequest, "There was an error in kernel commit")
+				return c.String(uploadErrorStatus(err), fmt.Sprintf("There was an error in kernel commit\n%s", err.Error()))
 			}
 		} else {
 			return c.String(http.StatusBadRequest, "Unknow file kind")
@@ -136,12 +182,22 @@ func (vmStorage *VirtualMachineUpload) UploadChunk(uploadType UploadType) echo.H
 		}
 
 		if uploadType == UploadType(DISK) {
-			err = vm.WriteChunkToDisk(filename, rangeStart, c.Request().Body)
+			err = vmStorage.vmm.CheckDiskUploadChunk(virtualMachine, filename, rangeStart, rangeEnd)
+			if err != nil {
+				return c.String(http.StatusRequestedRangeNotSatisfiable, err.Error())
+			}
+			var chunk *countingReader = &countingReader{reader: io.LimitReader(c.Request().Body, rangeEnd-rangeStart+1)}
+			err = vm.WriteChunkToDisk(filename, rangeStart, chunk)
+			vmStorage.vmm.RecordUploadBytes(vmm.UPLOAD_KIND_DISK, chunk.count)
 			if err != nil {
 				return c.String(http.StatusBadRequest, "There was an error writing chunk to disk file")
 			}
+			// A short body leaves the rest of the range missing, the client sends it again when resuming
+			vmStorage.vmm.RecordDiskUploadChunk(filename, rangeStart, chunk.count)
 		} else if uploadType == UploadType(KERNEL) {
-			err = vm.WriteChunkToKernel(filename, rangeStart, c.Request().Body)
+			var chunk *countingReader = &countingReader{reader: c.Request().Body}
+			err = vm.WriteChunkToKernel(filename, rangeStart, chunk)
+			vmStorage.vmm.RecordUploadBytes(vmm.UPLOAD_KIND_KERNEL, chunk.count)
 			if err != nil {
 				return c.String(http.StatusBadRequest, "There was an error writing chunk to kernel file")
 			}
@@ -152,3 +208,25 @@ func (vmStorage *VirtualMachineUpload) UploadChunk(uploadType UploadType) echo.H
 		return c.JSON(http.StatusOK, JsonResponse{Message: "OK"})
 	}
 }
+
+// ListUploads returns the pending disk uploads of the virtual machine in X-VirtualMachine
+func (vmStorage *VirtualMachineUpload) ListUploads() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		sessions, err := vmStorage.vmm.ListDiskUploads(c.Request().Header.Get("X-VirtualMachine"))
+		if err != nil {
+			return c.String(uploadErrorStatus(err), fmt.Sprintf("There was an error listing uploads\n%s", err.Error()))
+		}
+		return c.JSON(http.StatusOK, sessions)
+	}
+}
+
+// GetUpload returns a pending disk upload with the ranges received so far
+func (vmStorage *VirtualMachineUpload) GetUpload() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		session, err := vmStorage.vmm.GetDiskUpload(c.Request().Header.Get("X-VirtualMachine"), c.Param("filename"))
+		if err != nil {
+			return c.String(uploadErrorStatus(err), fmt.Sprintf("There was an error reading the upload\n%s", err.Error()))
+		}
+		return c.JSON(http.StatusOK, session)
+	}
+}
@@ -1,8 +1,15 @@
 package webserver
 
 import (
+	"errors"
 	"fmt"
 	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+	cloudhypervisor "vmm/cloud_hypervisor"
+	"vmm/utils"
 	virtualmachine "vmm/virtual_machine"
 	"vmm/vmm"
 
@@ -28,35 +35,495 @@ func (vmmApi *VirtualMachineManagerApi) CreateVirtualMachine() echo.HandlerFunc
 		}
 		err = vmmApi.vmm.CreateVirtualMachine(manifest)
 		if err != nil {
+			if status := stateErrorStatus(err); status != http.StatusInternalServerError {
+				return c.String(status, err.Error())
+			}
 			return c.String(http.StatusBadRequest, fmt.Sprintf("There was an error creating the vm\n%s", err.Error()))
 		}
-		return c.String(http.StatusAccepted, "Created")
+		return c.String(http.StatusCreated, manifest.GuestIdentifier.String())
+	}
+}
+
+type VirtualMachineInfo struct {
+	Manifest *virtualmachine.Manifest `json:"manifest" yaml:"manifest"`
+	Status   virtualmachine.Status    `json:"status" yaml:"status"`
+}
+
+func (vmmApi *VirtualMachineManagerApi) InfoVirtualMachine() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		virtualMachine := vmmApi.vmm.GetVirtualMachine(virtualMachineRef(c))
+		if virtualMachine == nil {
+			return c.String(http.StatusNotFound, "Virtual Machine is not found")
+		}
+		status := virtualMachine.RefreshState()
+		return c.JSON(http.StatusOK, VirtualMachineInfo{
+			Manifest: virtualMachine.GetManifest(),
+			Status:   status,
+		})
+	}
+}
+
+func (vmmApi *VirtualMachineManagerApi) ListVirtualMachines() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var err error
+		opts := vmm.ListOptions{
+			Tenant:     c.QueryParam("tenant"),
+			SortBy:     c.QueryParam("sort"),
+			Descending: c.QueryParam("order") == "desc",
+			Cursor:     c.QueryParam("cursor"),
+		}
+		if c.QueryParam("limit") != "" {
+			opts.Limit, err = strconv.Atoi(c.QueryParam("limit"))
+			if err != nil {
+				return c.String(http.StatusBadRequest, "limit must be a number")
+			}
+		}
+		if c.QueryParam("selector") != "" {
+			opts.Selector, err = virtualmachine.ParseSelector(c.QueryParam("selector"))
+			if err != nil {
+				return c.String(http.StatusBadRequest, err.Error())
+			}
+		}
+		if c.QueryParam("state") != "" {
+			for _, s := range strings.Split(c.QueryParam("state"), ",") {
+				state, err := virtualmachine.ParseState(s)
+				if err != nil {
+					return c.String(http.StatusBadRequest, err.Error())
+				}
+				opts.States = append(opts.States, state)
+			}
+		}
+		page, err := vmmApi.vmm.ListVirtualMachines(opts)
+		if err != nil {
+			return c.String(http.StatusBadRequest, fmt.Sprintf("There was an error listing vms\n%s", err.Error()))
+		}
+		return c.JSON(http.StatusOK, page)
 	}
 }
 
 func (vmmApi *VirtualMachineManagerApi) BootVirtualMachine() echo.HandlerFunc {
 	return func(c echo.Context) error {
-		vmId := c.Param("vm")
-		virtualMachine := vmmApi.vmm.GetVirtualMachine(vmId)
+		virtualMachine := vmmApi.vmm.GetVirtualMachine(virtualMachineRef(c))
 		if virtualMachine == nil {
 			return c.String(http.StatusNotFound, "Virtual Machine is not found")
 		}
-		err := virtualMachine.RequestBoot(vmmApi.vmm.GetBinaryPath(), vmmApi.vmm.GetRestServerUri())
+		err := vmmApi.vmm.BootVirtualMachine(virtualMachine.GetManifest().GuestIdentifier.String())
 		if err != nil {
-			return c.String(http.StatusInternalServerError, fmt.Sprintf("There was a problem booting the vm\n%s", err.Error()))
+			return c.String(stateErrorStatus(err), fmt.Sprintf("There was a problem booting the vm\n%s", err.Error()))
 		}
 		return c.String(http.StatusOK, "Booted")
 	}
 }
 
+func (vmmApi *VirtualMachineManagerApi) ShutdownVirtualMachine() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		virtualMachine := vmmApi.vmm.GetVirtualMachine(virtualMachineRef(c))
+		if virtualMachine == nil {
+			return c.String(http.StatusNotFound, "Virtual Machine is not found")
+		}
+		err := virtualMachine.RequestShutdown(vmmApi.vmm.GetStopTimeouts())
+		if err != nil {
+			return c.String(stateErrorStatus(err), fmt.Sprintf("There was a problem shutting down the vm\n%s", err.Error()))
+		}
+		return c.String(http.StatusOK, "Stopped")
+	}
+}
+
+func (vmmApi *VirtualMachineManagerApi) PauseVirtualMachine() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		virtualMachine := vmmApi.vmm.GetVirtualMachine(virtualMachineRef(c))
+		if virtualMachine == nil {
+			return c.String(http.StatusNotFound, "Virtual Machine is not found")
+		}
+		err := virtualMachine.RequestPause()
+		if err != nil {
+			return c.String(stateErrorStatus(err), fmt.Sprintf("There was a problem pausing the vm\n%s", err.Error()))
+		}
+		return c.String(http.StatusOK, "Paused")
+	}
+}
+
+func (vmmApi *VirtualMachineManagerApi) ResumeVirtualMachine() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		virtualMachine := vmmApi.vmm.GetVirtualMachine(virtualMachineRef(c))
+		if virtualMachine == nil {
+			return c.String(http.StatusNotFound, "Virtual Machine is not found")
+		}
+		err := virtualMachine.RequestResume()
+		if err != nil {
+			return c.String(stateErrorStatus(err), fmt.Sprintf("There was a problem resuming the vm\n%s", err.Error()))
+		}
+		return c.String(http.StatusOK, "Resumed")
+	}
+}
+
+func (vmmApi *VirtualMachineManagerApi) DeleteVirtualMachine() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		err := vmmApi.vmm.DeleteVirtualMachine(virtualMachineRef(c))
+		if err != nil {
+			return c.String(stateErrorStatus(err), fmt.Sprintf("There was a problem deleting the vm\n%s", err.Error()))
+		}
+		return c.String(http.StatusOK, "Deleted")
+	}
+}
+
+type MetadataBody struct {
+	Labels      map[string]*string `json:"labels" xml:"labels"`
+	Annotations map[string]*string `json:"annotations" xml:"annotations"`
+}
+
+// UpdateMetadata merges labels and annotations without touching the hypervisor config.
+// A null value removes the key
+func (vmmApi *VirtualMachineManagerApi) UpdateMetadata() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		body := new(MetadataBody)
+		if err := c.Bind(body); err != nil {
+			return c.String(http.StatusBadRequest, "Malformed request body")
+		}
+		manifest, err := vmmApi.vmm.UpdateVirtualMachineMetadata(virtualMachineRef(c), body.Labels, body.Annotations)
+		if err != nil {
+			var errNotFound *vmm.ErrVirtualMachineNotFound
+			if errors.As(err, &errNotFound) {
+				return c.String(http.StatusNotFound, "Virtual Machine is not found")
+			}
+			return c.String(http.StatusBadRequest, fmt.Sprintf("There was an error updating metadata\n%s", err.Error()))
+		}
+		return c.JSON(http.StatusOK, manifest)
+	}
+}
+
+const (
+	defaultLogTail = 200
+	maxLogTail     = 10000
+)
+
+// VirtualMachineLogs returns the last lines of a log source and keeps streaming with follow=true
+func (vmmApi *VirtualMachineManagerApi) VirtualMachineLogs() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		virtualMachine := vmmApi.vmm.GetVirtualMachine(virtualMachineRef(c))
+		if virtualMachine == nil {
+			return c.String(http.StatusNotFound, "Virtual Machine is not found")
+		}
+		var source string = c.QueryParam("source")
+		if source == "" {
+			source = cloudhypervisor.LOG_HYPERVISOR
+		}
+		path, err := virtualMachine.GetLogPath(source)
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		var tail int = defaultLogTail
+		if c.QueryParam("tail") != "" {
+			tail, err = strconv.Atoi(c.QueryParam("tail"))
+			if err != nil || tail < 0 {
+				return c.String(http.StatusBadRequest, "Tail must be a positive number")
+			}
+			tail = min(tail, maxLogTail)
+		}
+		var follow bool = false
+		if c.QueryParam("follow") != "" {
+			follow, err = strconv.ParseBool(c.QueryParam("follow"))
+			if err != nil {
+				return c.String(http.StatusBadRequest, "Follow must be a boolean")
+			}
+		}
+		content, offset, err := utils.TailFile(path, tail)
+		if err != nil && !os.IsNotExist(err) {
+			return c.String(http.StatusInternalServerError, fmt.Sprintf("There was an error reading logs\n%s", err.Error()))
+		}
+		c.Response().Header().Set(echo.HeaderContentType, echo.MIMETextPlainCharsetUTF8)
+		c.Response().WriteHeader(http.StatusOK)
+		_, err = c.Response().Write(content)
+		if err != nil || !follow {
+			return err
+		}
+		c.Response().Flush()
+		ctx, cancel := streamContext(c)
+		defer cancel()
+		return utils.FollowFile(ctx, path, offset, c.Response(), c.Response().Flush)
+	}
+}
+
+// Default range of the history when from is not given
+const defaultHistoryRange = time.Hour
+
+// parseHistoryTime accepts RFC3339 or unix seconds
+func parseHistoryTime(value string) (time.Time, error) {
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// parseHistoryStep accepts a duration, e.g. 5m, or seconds
+func parseHistoryStep(value string) (time.Duration, error) {
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Duration(seconds) * time.Second, nil
+	}
+	return time.ParseDuration(value)
+}
+
+func (vmmApi *VirtualMachineManagerApi) VirtualMachineHistory() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		var err error
+		var to time.Time = time.Now()
+		if c.QueryParam("to") != "" {
+			to, err = parseHistoryTime(c.QueryParam("to"))
+			if err != nil {
+				return c.String(http.StatusBadRequest, "To must be a RFC3339 time or unix seconds")
+			}
+		}
+		var from time.Time = to.Add(-defaultHistoryRange)
+		if c.QueryParam("from") != "" {
+			from, err = parseHistoryTime(c.QueryParam("from"))
+			if err != nil {
+				return c.String(http.StatusBadRequest, "From must be a RFC3339 time or unix seconds")
+			}
+		}
+		if !from.Before(to) {
+			return c.String(http.StatusBadRequest, "From must be before to")
+		}
+		var step time.Duration = 0
+		if c.QueryParam("step") != "" {
+			step, err = parseHistoryStep(c.QueryParam("step"))
+			if err != nil || step < 0 {
+				return c.String(http.StatusBadRequest, "Step must be a positive duration or seconds")
+			}
+		}
+		series, err := vmmApi.vmm.QueryHistory(virtualMachineRef(c), from, to, step)
+		if err != nil {
+			var errNotFound *vmm.ErrVirtualMachineNotFound
+			if errors.As(err, &errNotFound) {
+				return c.String(http.StatusNotFound, "Virtual Machine is not found")
+			}
+			return c.String(http.StatusInternalServerError, fmt.Sprintf("There was an error reading the vm history\n%s", err.Error()))
+		}
+		return c.JSON(http.StatusOK, series)
+	}
+}
+
+type ResizeBody struct {
+	Cpus   int   `json:"cpus" xml:"cpus"`
+	Memory int64 `json:"memory" xml:"memory"`
+}
+
+func (vmmApi *VirtualMachineManagerApi) ResizeVirtualMachine() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		body := new(ResizeBody)
+		if err := c.Bind(body); err != nil {
+			return c.String(http.StatusBadRequest, "Malformed request body")
+		}
+		manifest, err := vmmApi.vmm.ResizeVirtualMachine(virtualMachineRef(c), body.Cpus, body.Memory)
+		if err != nil {
+			return c.String(stateErrorStatus(err), fmt.Sprintf("There was a problem resizing the vm\n%s", err.Error()))
+		}
+		return c.JSON(http.StatusOK, manifest)
+	}
+}
+
+func (vmmApi *VirtualMachineManagerApi) ListDisks() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		disks, err := vmmApi.vmm.ListDisks(virtualMachineRef(c))
+		if err != nil {
+			if status := stateErrorStatus(err); status != http.StatusInternalServerError {
+				return c.String(status, err.Error())
+			}
+			return c.String(http.StatusInternalServerError, fmt.Sprintf("There was an error listing disks\n%s", err.Error()))
+		}
+		return c.JSON(http.StatusOK, disks)
+	}
+}
+
+type DiskResizeBody struct {
+	// New size in bytes, disks only grow
+	Size int64 `json:"size" xml:"size"`
+}
+
+func (vmmApi *VirtualMachineManagerApi) ResizeDisk() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		body := new(DiskResizeBody)
+		if err := c.Bind(body); err != nil {
+			return c.String(http.StatusBadRequest, "Malformed request body")
+		}
+		disk, err := vmmApi.vmm.ResizeDisk(virtualMachineRef(c), c.Param("disk"), body.Size)
+		if err != nil {
+			if status := stateErrorStatus(err); status != http.StatusInternalServerError {
+				return c.String(status, err.Error())
+			}
+			return c.String(http.StatusBadRequest, fmt.Sprintf("There was an error resizing the disk\n%s", err.Error()))
+		}
+		return c.JSON(http.StatusOK, disk)
+	}
+}
+
+type RenameBody struct {
+	Name string `json:"name" xml:"name"`
+}
+
+func (vmmApi *VirtualMachineManagerApi) RenameVirtualMachine() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		body := new(RenameBody)
+		if err := c.Bind(body); err != nil {
+			return c.String(http.StatusBadRequest, "Malformed request body")
+		}
+		manifest, err := vmmApi.vmm.RenameVirtualMachine(virtualMachineRef(c), body.Name)
+		if err != nil {
+			var errNotFound *vmm.ErrVirtualMachineNotFound
+			var errConflict *vmm.ErrNameConflict
+			if errors.As(err, &errNotFound) {
+				return c.String(http.StatusNotFound, "Virtual Machine is not found")
+			}
+			if errors.As(err, &errConflict) {
+				return c.String(http.StatusConflict, err.Error())
+			}
+			return c.String(http.StatusBadRequest, fmt.Sprintf("There was an error renaming the vm\n%s", err.Error()))
+		}
+		return c.JSON(http.StatusOK, manifest)
+	}
+}
+
+type BulkActionBody struct {
+	Tenant   string `json:"tenant" xml:"tenant"`
+	Selector string `json:"selector" xml:"selector"`
+}
+
+type BulkActionResult struct {
+	Id    string `json:"id" xml:"id"`
+	Error string `json:"error,omitempty" xml:"error,omitempty"`
+}
+
+// BulkAction runs boot, shutdown, pause, resume or delete on every vm matching a label selector
+func (vmmApi *VirtualMachineManagerApi) BulkAction() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		body := new(BulkActionBody)
+		if err := c.Bind(body); err != nil {
+			return c.String(http.StatusBadRequest, "Malformed request body")
+		}
+		selector, err := virtualmachine.ParseSelector(body.Selector)
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		if selector.Empty() {
+			return c.String(http.StatusBadRequest, "A non empty selector is required for bulk actions")
+		}
+		var action func(vm *virtualmachine.VirtualMachine) error
+		switch c.Param("action") {
+		case "boot":
+			action = func(vm *virtualmachine.VirtualMachine) error {
+				return vmmApi.vmm.BootVirtualMachine(vm.GetManifest().GuestIdentifier.String())
+			}
+		case "shutdown":
+			action = func(vm *virtualmachine.VirtualMachine) error { return vm.RequestShutdown(vmmApi.vmm.GetStopTimeouts()) }
+		case "pause":
+			action = func(vm *virtualmachine.VirtualMachine) error { return vm.RequestPause() }
+		case "resume":
+			action = func(vm *virtualmachine.VirtualMachine) error { return vm.RequestResume() }
+		case "delete":
+			action = func(vm *virtualmachine.VirtualMachine) error {
+				return vmmApi.vmm.DeleteVirtualMachine(vm.GetManifest().GuestIdentifier.String())
+			}
+		default:
+			return c.String(http.StatusBadRequest, "Unknown action")
+		}
+		vms := vmmApi.vmm.SelectVirtualMachines(body.Tenant, selector)
+		results := make([]BulkActionResult, len(vms))
+		for i, vm := range vms {
+			results[i].Id = vm.GetManifest().GuestIdentifier.String()
+			if err := action(vm); err != nil {
+				results[i].Error = err.Error()
+			}
+		}
+		return c.JSON(http.StatusOK, results)
+	}
+}
+
+// virtualMachineRef reads the vm uuid from /api/vm/:vm/... or the pair from /api/vm/:tenant/:name/...
+func virtualMachineRef(c echo.Context) string {
+	if c.Param("name") != "" {
+		return c.Param("tenant") + "/" + c.Param("name")
+	}
+	return c.Param("vm")
+}
+
+// Requests racing on the same virtual machine are reported as conflicts
+func stateErrorStatus(err error) int {
+	var errTransition *virtualmachine.ErrInvalidTransition
+	if errors.As(err, &errTransition) {
+		return http.StatusConflict
+	}
+	var errHotplug *virtualmachine.ErrHotplugUnsupported
+	if errors.As(err, &errHotplug) {
+		return http.StatusConflict
+	}
+	var errAttached *virtualmachine.ErrInstanceAttached
+	if errors.As(err, &errAttached) {
+		return http.StatusConflict
+	}
+	var errNotFound *vmm.ErrVirtualMachineNotFound
+	if errors.As(err, &errNotFound) {
+		return http.StatusNotFound
+	}
+	var errConflict *vmm.ErrNameConflict
+	if errors.As(err, &errConflict) {
+		return http.StatusConflict
+	}
+	var errDisk *virtualmachine.ErrDiskNotFound
+	if errors.As(err, &errDisk) {
+		return http.StatusNotFound
+	}
+	var errCapacity *vmm.ErrInsufficientCapacity
+	if errors.As(err, &errCapacity) {
+		return http.StatusConflict
+	}
+	var errQuota *vmm.ErrQuotaExceeded
+	if errors.As(err, &errQuota) {
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
+
+// UpdateVirtualMachine replaces the hypervisor config of the vm identified by guest_identifier
 func (vmmApi *VirtualMachineManagerApi) UpdateVirtualMachine() echo.HandlerFunc {
-	return func(e echo.Context) error {
-		return nil
+	return func(c echo.Context) error {
+		manifest := new(virtualmachine.Manifest)
+		if err := c.Bind(manifest); err != nil {
+			return c.String(http.StatusBadRequest, fmt.Sprintf("There was an error with request body\n%s", err.Error()))
+		}
+		updated, err := vmmApi.vmm.UpdateVirtualMachine(manifest.GuestIdentifier.String(), manifest.Config)
+		if err != nil {
+			status := stateErrorStatus(err)
+			if status == http.StatusInternalServerError {
+				status = http.StatusBadRequest
+			}
+			return c.String(status, fmt.Sprintf("There was an error updating the vm\n%s", err.Error()))
+		}
+		return c.JSON(http.StatusOK, updated)
+	}
+}
+
+func (vmmApi *VirtualMachineManagerApi) GetCapacity() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		return c.JSON(http.StatusOK, vmmApi.vmm.GetCapacity())
 	}
 }
 
 type VirtualMachineManagerApiService interface {
 	CreateVirtualMachine() echo.HandlerFunc
 	UpdateVirtualMachine() echo.HandlerFunc
+	GetCapacity() echo.HandlerFunc
+	InfoVirtualMachine() echo.HandlerFunc
+	ListVirtualMachines() echo.HandlerFunc
 	BootVirtualMachine() echo.HandlerFunc
+	ShutdownVirtualMachine() echo.HandlerFunc
+	PauseVirtualMachine() echo.HandlerFunc
+	ResumeVirtualMachine() echo.HandlerFunc
+	DeleteVirtualMachine() echo.HandlerFunc
+	UpdateMetadata() echo.HandlerFunc
+	RenameVirtualMachine() echo.HandlerFunc
+	ResizeVirtualMachine() echo.HandlerFunc
+	ListDisks() echo.HandlerFunc
+	ResizeDisk() echo.HandlerFunc
+	VirtualMachineLogs() echo.HandlerFunc
+	VirtualMachineHistory() echo.HandlerFunc
+	BulkAction() echo.HandlerFunc
 }
@@ -0,0 +1,102 @@
+package webserver
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"vmm/vmm"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+type VpcApi struct {
+	vmm *vmm.HypervisorMonitor
+}
+
+func NewVpcApi(vmm *vmm.HypervisorMonitor) *VpcApi {
+	return &VpcApi{
+		vmm: vmm,
+	}
+}
+
+type VpcNetworkBody struct {
+	Network string `json:"network" xml:"network"`
+}
+
+func vpcErrorStatus(err error) int {
+	var errNotFound *vmm.ErrVpcNetworkNotFound
+	if errors.As(err, &errNotFound) {
+		return http.StatusNotFound
+	}
+	var errExists *vmm.ErrVpcNetworkExists
+	var errInUse *vmm.ErrVpcNetworkInUse
+	if errors.As(err, &errExists) || errors.As(err, &errInUse) {
+		return http.StatusConflict
+	}
+	return stateErrorStatus(err)
+}
+
+// ListNetworks returns the vpc networks of ?tenant, of every tenant without it
+func (vpcApi *VpcApi) ListNetworks() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		networks, err := vpcApi.vmm.ListVpcNetworks(c.QueryParam("tenant"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		return c.JSON(http.StatusOK, networks)
+	}
+}
+
+func (vpcApi *VpcApi) CreateNetwork() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		tenant, err := uuid.Parse(c.Param("tenant"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Tenant must be a uuid")
+		}
+		body := new(VpcNetworkBody)
+		if err = c.Bind(body); err != nil {
+			return c.String(http.StatusBadRequest, "Malformed request body")
+		}
+		network, err := vmm.ParseVpcNetwork(body.Network)
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		created, err := vpcApi.vmm.CreateVpcNetwork(tenant, network)
+		if err != nil {
+			if status := vpcErrorStatus(err); status != http.StatusInternalServerError {
+				return c.String(status, err.Error())
+			}
+			return c.String(http.StatusInternalServerError, fmt.Sprintf("There was an error creating the network\n%s", err.Error()))
+		}
+		return c.JSON(http.StatusCreated, created)
+	}
+}
+
+// DeleteNetwork removes the network given by ?network, a cidr does not fit in a path segment
+func (vpcApi *VpcApi) DeleteNetwork() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		tenant, err := uuid.Parse(c.Param("tenant"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, "Tenant must be a uuid")
+		}
+		network, err := vmm.ParseVpcNetwork(c.QueryParam("network"))
+		if err != nil {
+			return c.String(http.StatusBadRequest, err.Error())
+		}
+		err = vpcApi.vmm.DeleteVpcNetwork(tenant, network)
+		if err != nil {
+			if status := vpcErrorStatus(err); status != http.StatusInternalServerError {
+				return c.String(status, err.Error())
+			}
+			return c.String(http.StatusInternalServerError, fmt.Sprintf("There was an error deleting the network\n%s", err.Error()))
+		}
+		return c.JSON(http.StatusOK, JsonResponse{Message: "OK"})
+	}
+}
+
+type VpcApiService interface {
+	ListNetworks() echo.HandlerFunc
+	CreateNetwork() echo.HandlerFunc
+	DeleteNetwork() echo.HandlerFunc
+}
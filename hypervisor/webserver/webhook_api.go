@@ -0,0 +1,132 @@
+package webserver
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"vmm/auth"
+	"vmm/vmm"
+	"vmm/webhooks"
+
+	"github.com/google/uuid"
+	"github.com/labstack/echo/v4"
+)
+
+type WebhookBody struct {
+	Url            string   `json:"url" xml:"url"`
+	Types          []string `json:"types" xml:"types"`
+	VirtualMachine string   `json:"virtual_machine" xml:"virtual_machine"`
+	Tenant         string   `json:"tenant" xml:"tenant"`
+	// Generated when empty, it is only returned by the creation
+	Secret string `json:"secret" xml:"secret"`
+}
+
+type WebhookApi struct {
+	vmm *vmm.HypervisorMonitor
+}
+
+func NewWebhookApi(vmm *vmm.HypervisorMonitor) *WebhookApi {
+	return &WebhookApi{
+		vmm: vmm,
+	}
+}
+
+func webhookErrorStatus(err error) int {
+	var errNotFound *webhooks.ErrWebhookNotFound
+	if errors.As(err, &errNotFound) {
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
+
+func (webhookApi *WebhookApi) ListWebhooks() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		// Principals see the webhooks of the tenants they administer
+		principal := principalOf(c)
+		list := make([]webhooks.Webhook, 0)
+		for _, webhook := range webhookApi.vmm.GetWebhooks().ListWebhooks() {
+			var tenant string = webhook.Tenant
+			if tenant == "" {
+				tenant = auth.ALL_TENANTS
+			}
+			if principal.Allows(tenant, auth.ROLE_ADMIN) {
+				list = append(list, webhook.Redacted())
+			}
+		}
+		return c.JSON(http.StatusOK, list)
+	}
+}
+
+func (webhookApi *WebhookApi) CreateWebhook() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		body := new(WebhookBody)
+		if err := c.Bind(body); err != nil {
+			return c.String(http.StatusBadRequest, "Malformed request body")
+		}
+		var webhook webhooks.Webhook = webhooks.Webhook{
+			Url:    body.Url,
+			Types:  body.Types,
+			Secret: body.Secret,
+		}
+		if body.VirtualMachine != "" {
+			vm := webhookApi.vmm.GetVirtualMachine(body.VirtualMachine)
+			if vm == nil {
+				return c.String(http.StatusNotFound, "Virtual Machine is not found")
+			}
+			webhook.VirtualMachine = vm.GetManifest().GuestIdentifier.String()
+			// The webhook belongs to the tenant of the virtual machine
+			webhook.Tenant = vm.GetManifest().Tenant.String()
+		}
+		if body.Tenant != "" {
+			tenant, err := uuid.Parse(body.Tenant)
+			if err != nil {
+				return c.String(http.StatusBadRequest, "Tenant must be a uuid")
+			}
+			webhook.Tenant = tenant.String()
+		}
+		webhook, err := webhookApi.vmm.GetWebhooks().CreateWebhook(webhook)
+		if err != nil {
+			return c.String(http.StatusBadRequest, fmt.Sprintf("There was an error creating the webhook\n%s", err.Error()))
+		}
+		return c.JSON(http.StatusCreated, webhook)
+	}
+}
+
+func (webhookApi *WebhookApi) GetWebhook() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		webhook, err := webhookApi.vmm.GetWebhooks().GetWebhook(c.Param("id"))
+		if err != nil {
+			return c.String(webhookErrorStatus(err), err.Error())
+		}
+		return c.JSON(http.StatusOK, webhook.Redacted())
+	}
+}
+
+func (webhookApi *WebhookApi) DeleteWebhook() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		err := webhookApi.vmm.GetWebhooks().DeleteWebhook(c.Param("id"))
+		if err != nil {
+			return c.String(webhookErrorStatus(err), fmt.Sprintf("There was an error deleting the webhook\n%s", err.Error()))
+		}
+		return c.JSON(http.StatusOK, JsonResponse{Message: "OK"})
+	}
+}
+
+// ListDeliveries returns the delivery log of a webhook, pending deliveries included
+func (webhookApi *WebhookApi) ListDeliveries() echo.HandlerFunc {
+	return func(c echo.Context) error {
+		deliveries, err := webhookApi.vmm.GetWebhooks().Deliveries(c.Param("id"))
+		if err != nil {
+			return c.String(webhookErrorStatus(err), err.Error())
+		}
+		return c.JSON(http.StatusOK, deliveries)
+	}
+}
+
+type WebhookApiService interface {
+	ListWebhooks() echo.HandlerFunc
+	CreateWebhook() echo.HandlerFunc
+	GetWebhook() echo.HandlerFunc
+	DeleteWebhook() echo.HandlerFunc
+	ListDeliveries() echo.HandlerFunc
+}